@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"sync"
@@ -14,23 +15,23 @@ import (
 
 // TorrentStatus represents the status of a torrent download
 type TorrentStatus struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Progress    float64 `json:"progress"`
-	DownSpeed   int64   `json:"downSpeed"`
-	Peers       int     `json:"peers"`
-	Seeds       int     `json:"seeds"`
-	Size        int64   `json:"size"`
-	Downloaded  int64   `json:"downloaded"`
-	Status      string  `json:"status"` // "downloading", "paused", "completed", "error"
-	Error       string  `json:"error,omitempty"`
-	
-	// Internal fields for pause/resume (not exposed to JSON)
-	torrentPath    string
-	magnetLink     string
-	outputPath     string
-	lastDownloaded int64     // for speed calculation
-	lastSpeedCheck time.Time // for speed calculation
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Progress   float64 `json:"progress"`
+	DownSpeed  int64   `json:"downSpeed"`
+	Peers      int     `json:"peers"`
+	Seeds      int     `json:"seeds"`
+	Size       int64   `json:"size"`
+	Downloaded int64   `json:"downloaded"`
+	Status     string  `json:"status"` // "starting", "downloading", "seeding", "paused", "completed", "error"
+	Error      string  `json:"error,omitempty"`
+}
+
+// speedSample is the amount downloaded by a torrent at some point, used for speed calculation
+type speedSample struct {
+	downloaded int64
+	at         time.Time
+	speed      int64
 }
 
 // DHTNodeInfo represents a DHT node for the frontend
@@ -50,21 +51,17 @@ type DHTStatus struct {
 
 // App struct
 type App struct {
-	ctx          context.Context
-	torrents     map[string]*TorrentStatus
-	cancelFuncs  map[string]context.CancelFunc
-	mu           sync.RWMutex
-	dht          *dht.DHT
-	dhtCtx       context.Context
-	dhtCancel    context.CancelFunc
-	rarestFirst  bool // Use rarest-first piece selection
+	ctx         context.Context
+	session     *torrent.Session
+	speeds      map[string]*speedSample
+	mu          sync.Mutex
+	rarestFirst bool // Use rarest-first piece selection
 }
 
 // NewApp creates a new App application struct
 func NewApp() *App {
 	return &App{
-		torrents:    make(map[string]*TorrentStatus),
-		cancelFuncs: make(map[string]context.CancelFunc),
+		speeds: make(map[string]*speedSample),
 	}
 }
 
@@ -73,77 +70,61 @@ func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 	log.Println("Go Torrent UI started")
 
-	// Start DHT at application startup
-	a.startDHT()
-}
-
-// shutdown is called when the app is closing
-func (a *App) shutdown(ctx context.Context) {
-	a.stopDHT()
-}
-
-// startDHT creates and starts the DHT node
-func (a *App) startDHT() {
-	d, err := dht.New()
+	// Start the session at application startup:
+	// it owns the DHT node and the listener shared by all the torrents
+	session, err := torrent.NewSession(nil)
 	if err != nil {
-		log.Printf("DHT: failed to create: %v", err)
+		log.Printf("Failed to start session: %v", err)
 		return
 	}
+	a.session = session
+}
 
-	a.dhtCtx, a.dhtCancel = context.WithCancel(context.Background())
-	if err := d.Start(a.dhtCtx); err != nil {
-		log.Printf("DHT: failed to start: %v", err)
-		a.dhtCancel()
-		return
+// shutdown is called when the app is closing
+func (a *App) shutdown(ctx context.Context) {
+	if a.session != nil {
+		a.session.Close()
+		log.Println("Session: stopped")
 	}
-
-	a.dht = d
-	log.Printf("DHT: started on port %d", d.Port())
-
-	// Bootstrap in background so the UI isn't blocked
-	go func() {
-		d.Bootstrap()
-		if d.RoutingTable().Size() == 0 {
-			log.Println("DHT: no bootstrap nodes reachable — UDP port 6881 may be blocked by firewall")
-		}
-	}()
 }
 
-// stopDHT gracefully stops the DHT node
-func (a *App) stopDHT() {
-	if a.dht != nil {
-		a.dhtCancel()
-		a.dht.Stop()
-		a.dht = nil
-		log.Println("DHT: stopped")
+// dht returns the DHT node of the session, nil if it is not running
+func (a *App) dht() *dht.DHT {
+	if a.session == nil {
+		return nil
 	}
+	return a.session.DHT()
 }
 
 // GetDHTStatus returns the current DHT status
 func (a *App) GetDHTStatus() DHTStatus {
-	if a.dht == nil {
+	d := a.dht()
+	if d == nil {
 		return DHTStatus{Running: false}
 	}
 	return DHTStatus{
 		Running:   true,
-		NodeID:    fmt.Sprintf("%x", a.dht.ID),
-		Port:      a.dht.Port(),
-		NodeCount: a.dht.RoutingTable().Size(),
+		NodeID:    fmt.Sprintf("%x", d.ID),
+		Port:      d.Port(),
+		NodeCount: d.RoutingTable().Size(),
 	}
 }
 
 // GetDHTNodes returns the list of known DHT nodes
 func (a *App) GetDHTNodes() []DHTNodeInfo {
-	if a.dht == nil {
+	d := a.dht()
+	if d == nil {
 		return nil
 	}
-	nodes := a.dht.RoutingTable().AllNodes()
+	nodes := append(d.RoutingTable().AllNodes(), d.RoutingTable6().AllNodes()...)
 	result := make([]DHTNodeInfo, len(nodes))
 	for i, n := range nodes {
 		result[i] = DHTNodeInfo{
-			ID:       fmt.Sprintf("%x", n.ID),
-			Address:  n.Addr.String(),
-			LastSeen: n.LastSeen.Format(time.RFC3339),
+			ID:      fmt.Sprintf("%x", n.ID),
+			Address: n.Addr.String(),
+		}
+		if !n.LastSeen.IsZero() { // learned from another node, never heard from
+			result[i].LastSeen = n.LastSeen.Format(time.RFC3339)
 		}
 	}
 	return result
@@ -151,297 +132,125 @@ func (a *App) GetDHTNodes() []DHTNodeInfo {
 
 // GetTorrents returns all torrents
 func (a *App) GetTorrents() []TorrentStatus {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-	
-	result := make([]TorrentStatus, 0, len(a.torrents))
-	for _, t := range a.torrents {
-		result = append(result, *t)
+	if a.session == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := a.session.List()
+	result := make([]TorrentStatus, 0, len(stats))
+	now := time.Now()
+	for _, ts := range stats {
+		id := fmt.Sprintf("%x", ts.InfoHash)
+		status := TorrentStatus{
+			ID:         id,
+			Name:       ts.Name,
+			Progress:   ts.Progress(),
+			Peers:      ts.Peers,
+			Seeds:      ts.Seeders,
+			Size:       ts.Size,
+			Downloaded: ts.Downloaded,
+			Status:     string(ts.Status),
+		}
+		if ts.Err != nil {
+			status.Error = ts.Err.Error()
+		}
+
+		// Calculate download speed
+		sample, ok := a.speeds[id]
+		if !ok || ts.Status != torrent.StatusDownloading {
+			sample = &speedSample{downloaded: ts.Downloaded, at: now}
+			a.speeds[id] = sample
+		}
+		if elapsed := now.Sub(sample.at).Seconds(); elapsed >= 1.0 {
+			sample.speed = int64(float64(ts.Downloaded-sample.downloaded) / elapsed)
+			sample.downloaded = ts.Downloaded
+			sample.at = now
+		}
+		status.DownSpeed = sample.speed
+		result = append(result, status)
 	}
 	return result
 }
 
+// options returns the download options of a new torrent
+func (a *App) options() *torrent.DownloadOptions {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return &torrent.DownloadOptions{
+		RarestFirst: a.rarestFirst,
+	}
+}
+
 // AddMagnet adds a magnet link for download
 func (a *App) AddMagnet(magnetLink string, outputPath string) (string, error) {
-	magnet, err := torrent.ParseMagnet(magnetLink)
-	if err != nil {
+	if a.session == nil {
+		return "", fmt.Errorf("session not started")
+	}
+	if _, err := torrent.ParseMagnet(magnetLink); err != nil {
 		return "", fmt.Errorf("invalid magnet link: %w", err)
 	}
-
-	id := magnet.InfoHashHex()
-	
-	// Create a cancellable context for this download
-	ctx, cancel := context.WithCancel(context.Background())
-	
-	a.mu.Lock()
-	a.torrents[id] = &TorrentStatus{
-		ID:         id,
-		Name:       magnet.DisplayName(),
-		Status:     "starting",
-		magnetLink: magnetLink,
-		outputPath: outputPath,
+	t, err := a.session.Add(magnetLink, outputPath, a.options())
+	if err != nil {
+		return "", err
 	}
-	a.cancelFuncs[id] = cancel
-	a.mu.Unlock()
-
-	// Start download in background
-	go func() {
-		// Progress callback updates the torrent status
-		onProgress := func(completedPieces, totalPieces int, downloadedBytes, totalBytes int64) {
-			a.mu.Lock()
-			if t, ok := a.torrents[id]; ok {
-				t.Progress = float64(completedPieces) / float64(totalPieces) * 100
-				t.Downloaded = downloadedBytes
-				t.Size = totalBytes
-				if t.Status == "starting" {
-					t.Status = "downloading"
-					t.lastSpeedCheck = time.Now()
-					t.lastDownloaded = downloadedBytes
-				}
-				// Calculate download speed
-				now := time.Now()
-				elapsed := now.Sub(t.lastSpeedCheck).Seconds()
-				if elapsed >= 1.0 {
-					deltaBytes := downloadedBytes - t.lastDownloaded
-					t.DownSpeed = int64(float64(deltaBytes) / elapsed)
-					t.lastSpeedCheck = now
-					t.lastDownloaded = downloadedBytes
-				}
-			}
-			a.mu.Unlock()
-		}
-		err := torrent.DownloadMagnetWithProgress(ctx, magnetLink, outputPath, a.dht, &torrent.DownloadOptions{
-			OnProgress:  onProgress,
-			RarestFirst: a.rarestFirst,
-		})
-		a.mu.Lock()
-		// Check if torrent still exists (might have been removed)
-		if t, ok := a.torrents[id]; ok {
-			t.DownSpeed = 0
-			if err != nil {
-				if err == context.Canceled {
-					t.Status = "paused"
-					t.Error = ""
-				} else {
-					t.Status = "error"
-					t.Error = err.Error()
-				}
-			} else {
-				t.Status = "completed"
-				t.Progress = 100
-			}
-		}
-		// Clean up cancel func
-		delete(a.cancelFuncs, id)
-		a.mu.Unlock()
-	}()
-
-	return id, nil
+	return fmt.Sprintf("%x", t.InfoHash()), nil
 }
 
 // AddTorrentFile adds a .torrent file for download
 func (a *App) AddTorrentFile(filePath string, outputPath string) (string, error) {
-	tf, err := torrent.OpenTorrent(filePath)
+	if a.session == nil {
+		return "", fmt.Errorf("session not started")
+	}
+	t, err := a.session.Add(filePath, outputPath, a.options())
 	if err != nil {
 		return "", fmt.Errorf("failed to open torrent: %w", err)
 	}
+	return fmt.Sprintf("%x", t.InfoHash()), nil
+}
 
-	id := fmt.Sprintf("%x", tf.Info.Hash)
-	
-	// Create a cancellable context for this download
-	ctx, cancel := context.WithCancel(context.Background())
-	
-	a.mu.Lock()
-	a.torrents[id] = &TorrentStatus{
-		ID:          id,
-		Name:        tf.Info.Name,
-		Size:        int64(tf.Info.Length),
-		Status:      "starting",
-		torrentPath: filePath,
-		outputPath:  outputPath,
+// infoHash parses the ID of a torrent of the frontend
+func infoHash(id string) ([20]byte, error) {
+	var hash [20]byte
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != len(hash) {
+		return hash, fmt.Errorf("torrent not found")
 	}
-	a.cancelFuncs[id] = cancel
-	a.mu.Unlock()
-
-	// Start download in background
-	go func() {
-		// Progress callback updates the torrent status
-		onProgress := func(completedPieces, totalPieces int, downloadedBytes, totalBytes int64) {
-			a.mu.Lock()
-			if t, ok := a.torrents[id]; ok {
-				t.Progress = float64(completedPieces) / float64(totalPieces) * 100
-				t.Downloaded = downloadedBytes
-				if t.Status == "starting" {
-					t.Status = "downloading"
-					t.lastSpeedCheck = time.Now()
-					t.lastDownloaded = downloadedBytes
-				}
-				// Calculate download speed
-				now := time.Now()
-				elapsed := now.Sub(t.lastSpeedCheck).Seconds()
-				if elapsed >= 1.0 {
-					deltaBytes := downloadedBytes - t.lastDownloaded
-					t.DownSpeed = int64(float64(deltaBytes) / elapsed)
-					t.lastSpeedCheck = now
-					t.lastDownloaded = downloadedBytes
-				}
-			}
-			a.mu.Unlock()
-		}
-		err := torrent.DownloadWithProgress(ctx, filePath, outputPath, &torrent.DownloadOptions{
-			OnProgress:  onProgress,
-			RarestFirst: a.rarestFirst,
-		})
-		a.mu.Lock()
-		// Check if torrent still exists (might have been removed)
-		if t, ok := a.torrents[id]; ok {
-			t.DownSpeed = 0
-			if err != nil {
-				if err == context.Canceled {
-					t.Status = "paused"
-					t.Error = ""
-				} else {
-					t.Status = "error"
-					t.Error = err.Error()
-				}
-			} else {
-				t.Status = "completed"
-				t.Progress = 100
-			}
-		}
-		// Clean up cancel func
-		delete(a.cancelFuncs, id)
-		a.mu.Unlock()
-	}()
-
-	return id, nil
+	copy(hash[:], b)
+	return hash, nil
 }
 
 // PauseTorrent pauses a downloading torrent
 func (a *App) PauseTorrent(id string) error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	
-	t, ok := a.torrents[id]
-	if !ok {
+	hash, err := infoHash(id)
+	if err != nil || a.session == nil {
 		return fmt.Errorf("torrent not found")
 	}
-	
-	if t.Status == "paused" || t.Status == "completed" {
-		return nil // Already paused or completed
-	}
-	
-	// Cancel the download (will be marked as paused)
-	if cancel, ok := a.cancelFuncs[id]; ok {
-		cancel()
-		delete(a.cancelFuncs, id)
-	}
-	
-	return nil
+	return a.session.Pause(hash)
 }
 
 // ResumeTorrent resumes a paused torrent
 func (a *App) ResumeTorrent(id string) error {
-	a.mu.Lock()
-	
-	t, ok := a.torrents[id]
-	if !ok {
-		a.mu.Unlock()
+	hash, err := infoHash(id)
+	if err != nil || a.session == nil {
 		return fmt.Errorf("torrent not found")
 	}
-	
-	if t.Status != "paused" && t.Status != "error" {
-		a.mu.Unlock()
-		return nil // Not paused or error, nothing to resume
-	}
-	
-	// Create new context for resumed download
-	ctx, cancel := context.WithCancel(context.Background())
-	a.cancelFuncs[id] = cancel
-	t.Status = "downloading"
-	t.Error = ""
-	t.lastSpeedCheck = time.Now()
-	t.lastDownloaded = t.Downloaded
-	
-	// Store values before unlocking
-	magnetLink := t.magnetLink
-	torrentPath := t.torrentPath
-	outputPath := t.outputPath
-	
-	a.mu.Unlock()
-	
-	// Start download in background
-	go func() {
-		var err error
-		// Progress callback updates the torrent status
-		onProgress := func(completedPieces, totalPieces int, downloadedBytes, totalBytes int64) {
-			a.mu.Lock()
-			if t, ok := a.torrents[id]; ok {
-				t.Progress = float64(completedPieces) / float64(totalPieces) * 100
-				t.Downloaded = downloadedBytes
-				t.Size = totalBytes
-				// Calculate download speed
-				now := time.Now()
-				elapsed := now.Sub(t.lastSpeedCheck).Seconds()
-				if elapsed >= 1.0 {
-					deltaBytes := downloadedBytes - t.lastDownloaded
-					t.DownSpeed = int64(float64(deltaBytes) / elapsed)
-					t.lastSpeedCheck = now
-					t.lastDownloaded = downloadedBytes
-				}
-			}
-			a.mu.Unlock()
-		}
-		opts := &torrent.DownloadOptions{
-			OnProgress:  onProgress,
-			RarestFirst: a.rarestFirst,
-		}
-		if magnetLink != "" {
-			err = torrent.DownloadMagnetWithProgress(ctx, magnetLink, outputPath, a.dht, opts)
-		} else if torrentPath != "" {
-			err = torrent.DownloadWithProgress(ctx, torrentPath, outputPath, opts)
-		} else {
-			err = fmt.Errorf("no source available for resume")
-		}
-		
-		a.mu.Lock()
-		if t, ok := a.torrents[id]; ok {
-			t.DownSpeed = 0
-			if err != nil {
-				if err == context.Canceled {
-					t.Status = "paused"
-					t.Error = ""
-				} else {
-					t.Status = "error"
-					t.Error = err.Error()
-				}
-			} else {
-				t.Status = "completed"
-				t.Progress = 100
-			}
-		}
-		delete(a.cancelFuncs, id)
-		a.mu.Unlock()
-	}()
-	
-	return nil
+	return a.session.Resume(hash)
 }
 
 // RemoveTorrent removes a torrent from the list and cancels any ongoing download
 func (a *App) RemoveTorrent(id string) {
-	a.mu.Lock()
-	// Cancel the download if it's still running
-	if cancel, ok := a.cancelFuncs[id]; ok {
-		cancel()
-		delete(a.cancelFuncs, id)
+	hash, err := infoHash(id)
+	if err != nil || a.session == nil {
+		return
 	}
-	delete(a.torrents, id)
-	a.mu.Unlock()
-	
-	// Delete the state file (outside lock to avoid blocking)
-	if err := torrent.DeleteStateByHex(id); err != nil {
+	if err := a.session.Remove(hash); err != nil {
 		log.Printf("Failed to delete state file: %v", err)
 	}
+	a.mu.Lock()
+	delete(a.speeds, id)
+	a.mu.Unlock()
 }
 
 // SelectTorrentFile opens a file dialog to select a .torrent file
@@ -474,8 +283,8 @@ func (a *App) SelectOutputFolder() (string, error) {
 
 // GetRarestFirst returns whether rarest-first piece selection is enabled
 func (a *App) GetRarestFirst() bool {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	return a.rarestFirst
 }
 
@@ -5,13 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
+	"github.com/matei-oltean/go-torrent/dht"
 	"github.com/matei-oltean/go-torrent/torrent"
 )
 
 func usage() {
 	fmt.Printf(`%s [options] <torrent-file|magnet-link>
+%s tracker [options]
 
     torrent-file       Path of the torrent file
     magnet-link        Magnet link (starting with magnet:)
@@ -20,17 +24,39 @@ func usage() {
                        If not set, the file will be downloaded in the current
                        directory (for magnets) or torrent file folder (for .torrent)
     -r, --rarest-first Use rarest-first piece selection (better for swarm health)
-`, os.Args[0])
+    -s, --seed         Keep seeding once the download is complete (until interrupted)
+    -p port            Optional: TCP port to accept incoming peers on.
+                       If not set, the first free port in 6881-6889 is used
+    --dht-port port    Optional: UDP port of the DHT node (magnet links only).
+                       If not set, the first free port in 6881-6889 is used
+    --dht-ro           Run the DHT node read-only: query other nodes without
+                       answering their queries (BEP 43)
+
+    tracker            Run a tracker instead, see %s tracker -h
+`, os.Args[0], os.Args[0], os.Args[0])
 	os.Exit(2)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tracker" {
+		runTracker(os.Args[2:])
+		return
+	}
+
 	var outPath string
 	var rarestFirst bool
+	var seed bool
+	var port int
+	var dhtConfig dht.Config
 	flag.Usage = usage
 	flag.StringVar(&outPath, "o", "", "")
 	flag.BoolVar(&rarestFirst, "r", false, "")
 	flag.BoolVar(&rarestFirst, "rarest-first", false, "")
+	flag.BoolVar(&seed, "s", false, "")
+	flag.BoolVar(&seed, "seed", false, "")
+	flag.IntVar(&port, "p", 0, "")
+	flag.IntVar(&dhtConfig.Port, "dht-port", 0, "")
+	flag.BoolVar(&dhtConfig.ReadOnly, "dht-ro", false, "")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -40,16 +66,32 @@ func main() {
 
 	opts := &torrent.DownloadOptions{
 		RarestFirst: rarestFirst,
+		Seed:        seed,
+	}
+
+	isMagnet := strings.HasPrefix(input, "magnet:")
+	if isMagnet && outPath == "" {
+		outPath, _ = os.Getwd()
+	}
+
+	// Only magnet links need the DHT to find peers
+	session, err := torrent.NewSession(&torrent.SessionConfig{
+		ListenPort: port,
+		DisableDHT: !isMagnet,
+		DHTConfig:  &dhtConfig,
+	})
+	if err != nil {
+		println(err.Error())
+		os.Exit(2)
 	}
+	defer session.Close()
 
-	var err error
-	if strings.HasPrefix(input, "magnet:") {
-		if outPath == "" {
-			outPath, _ = os.Getwd()
-		}
-		err = torrent.DownloadMagnetWithProgress(context.Background(), input, outPath, nil, opts)
-	} else {
-		err = torrent.DownloadWithProgress(context.Background(), input, outPath, opts)
+	// Stop the download on Ctrl-C or SIGTERM, so that the trackers are told we left
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	t, err := session.AddWithContext(ctx, input, outPath, opts)
+	if err == nil {
+		err = t.Wait()
 	}
 
 	if err != nil {
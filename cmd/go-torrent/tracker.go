@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matei-oltean/go-torrent/tracker"
+)
+
+func trackerUsage() {
+	fmt.Printf(`%s tracker [options]
+
+    -http address      Optional: address to serve HTTP announces and scrapes on,
+                       empty to disable (default :6969)
+    -udp address       Optional: address to serve UDP announces and scrapes on,
+                       empty to disable (default :6969)
+    -a allowlist-file  Optional: file of hex info hashes, one per line.
+                       If set, only these torrents are tracked
+    -i interval        Optional: announce interval given to the peers (default 30m)
+`, os.Args[0])
+	os.Exit(2)
+}
+
+// runTracker runs a tracker until the process is killed
+func runTracker(args []string) {
+	var httpAddr, udpAddr, allowlistPath string
+	var interval time.Duration
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	flags.Usage = trackerUsage
+	flags.StringVar(&httpAddr, "http", ":6969", "")
+	flags.StringVar(&udpAddr, "udp", ":6969", "")
+	flags.StringVar(&allowlistPath, "a", "", "")
+	flags.DurationVar(&interval, "i", tracker.DefaultInterval, "")
+	flags.Parse(args)
+	if flags.NArg() != 0 || (httpAddr == "" && udpAddr == "") {
+		trackerUsage()
+	}
+
+	cfg := &tracker.Config{Interval: interval}
+	if allowlistPath != "" {
+		allowlist, err := readAllowlist(allowlistPath)
+		if err != nil {
+			println(err.Error())
+			os.Exit(2)
+		}
+		cfg.Allowlist = allowlist
+	}
+	srv := tracker.NewServer(cfg)
+
+	errs := make(chan error, 2)
+	if udpAddr != "" {
+		conn, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			println(err.Error())
+			os.Exit(2)
+		}
+		log.Printf("Serving UDP tracker on %s", conn.LocalAddr())
+		go func() { errs <- srv.ServeUDP(conn) }()
+	}
+	if httpAddr != "" {
+		ln, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			println(err.Error())
+			os.Exit(2)
+		}
+		log.Printf("Serving HTTP tracker on %s", ln.Addr())
+		go func() { errs <- http.Serve(ln, srv) }()
+	}
+	println((<-errs).Error())
+	os.Exit(2)
+}
+
+// readAllowlist reads the info hashes of a file, one hex hash per line
+// empty lines and lines starting with # are skipped
+func readAllowlist(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hashes [][20]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, err := hex.DecodeString(line)
+		if err != nil || len(hash) != 20 {
+			return nil, fmt.Errorf("invalid info hash %q in %s", line, path)
+		}
+		hashes = append(hashes, [20]byte(hash))
+	}
+	return hashes, scanner.Err()
+}
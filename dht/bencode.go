@@ -0,0 +1,238 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// maxDepth is the deepest nesting of lists and dictionaries we decode
+const maxDepth = 32
+
+// Kind is the type of a bencoded value
+type Kind int
+
+// Bencoded value types
+const (
+	KindString Kind = iota + 1
+	KindInt
+	KindList
+	KindDict
+)
+
+// Value is a bencoded value of a KRPC message: a string, an integer, a list or a dictionary
+type Value struct {
+	Kind Kind
+	Str  string
+	Int  int
+	List []Value
+	Dict Dict
+}
+
+// Dict is a bencoded dictionary
+type Dict map[string]Value
+
+// NewString returns a string value
+func NewString(s string) Value {
+	return Value{Kind: KindString, Str: s}
+}
+
+// NewInt returns an integer value
+func NewInt(i int) Value {
+	return Value{Kind: KindInt, Int: i}
+}
+
+// NewList returns a list value
+func NewList(items ...Value) Value {
+	return Value{Kind: KindList, List: items}
+}
+
+// NewStringList returns a list of strings
+func NewStringList(items []string) Value {
+	list := make([]Value, len(items))
+	for i, s := range items {
+		list[i] = NewString(s)
+	}
+	return NewList(list...)
+}
+
+// NewDict returns a dictionary value
+func NewDict(d Dict) Value {
+	return Value{Kind: KindDict, Dict: d}
+}
+
+// Str returns the string at key, empty if it is missing or not a string
+func (d Dict) Str(key string) string {
+	if v, ok := d[key]; ok && v.Kind == KindString {
+		return v.Str
+	}
+	return ""
+}
+
+// Int returns the integer at key, false if it is missing or not an integer
+func (d Dict) Int(key string) (int, bool) {
+	if v, ok := d[key]; ok && v.Kind == KindInt {
+		return v.Int, true
+	}
+	return 0, false
+}
+
+// List returns the list at key, nil if it is missing or not a list
+func (d Dict) List(key string) []Value {
+	if v, ok := d[key]; ok && v.Kind == KindList {
+		return v.List
+	}
+	return nil
+}
+
+// Dict returns the dictionary at key, nil if it is missing or not a dictionary
+func (d Dict) Dict(key string) Dict {
+	if v, ok := d[key]; ok && v.Kind == KindDict {
+		return v.Dict
+	}
+	return nil
+}
+
+// Strings returns the strings of a list, skipping the other values
+func Strings(list []Value) []string {
+	var strs []string
+	for _, v := range list {
+		if v.Kind == KindString {
+			strs = append(strs, v.Str)
+		}
+	}
+	return strs
+}
+
+// Encode returns the bencoded form of the value
+func (v Value) Encode() []byte {
+	var buf bytes.Buffer
+	v.encodeTo(&buf)
+	return buf.Bytes()
+}
+
+// encodeTo writes the bencoded form of the value to a buffer
+func (v Value) encodeTo(buf *bytes.Buffer) {
+	switch v.Kind {
+	case KindString:
+		writeString(buf, v.Str)
+	case KindInt:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.Itoa(v.Int))
+		buf.WriteByte('e')
+	case KindList:
+		buf.WriteByte('l')
+		for _, item := range v.List {
+			item.encodeTo(buf)
+		}
+		buf.WriteByte('e')
+	case KindDict:
+		v.Dict.encodeTo(buf)
+	}
+}
+
+// encodeTo writes the bencoded form of the dictionary to a buffer, keys sorted
+func (d Dict) encodeTo(buf *bytes.Buffer) {
+	buf.WriteByte('d')
+	for _, k := range slices.Sorted(maps.Keys(d)) {
+		writeString(buf, k)
+		d[k].encodeTo(buf)
+	}
+	buf.WriteByte('e')
+}
+
+// writeString writes a bencoded string to a buffer
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+// DecodeValue parses a bencoded value, ignoring any trailing data
+func DecodeValue(data []byte) (Value, error) {
+	v, _, err := decodeValue(data, 0)
+	return v, err
+}
+
+// decodeValue parses the bencoded value at the start of data and returns the rest of data
+func decodeValue(data []byte, depth int) (Value, []byte, error) {
+	if len(data) == 0 {
+		return Value{}, nil, errors.New("unexpected end of data")
+	}
+	switch data[0] {
+	case 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return Value{}, nil, errors.New("unterminated integer")
+		}
+		i, err := strconv.Atoi(string(data[1:end]))
+		if err != nil {
+			return Value{}, nil, fmt.Errorf("invalid integer %q", data[1:end])
+		}
+		return NewInt(i), data[end+1:], nil
+	case 'l':
+		if depth >= maxDepth {
+			return Value{}, nil, errors.New("nesting too deep")
+		}
+		list := []Value{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			var item Value
+			var err error
+			if item, data, err = decodeValue(data, depth+1); err != nil {
+				return Value{}, nil, err
+			}
+			list = append(list, item)
+		}
+		if len(data) == 0 {
+			return Value{}, nil, errors.New("unterminated list")
+		}
+		return NewList(list...), data[1:], nil
+	case 'd':
+		if depth >= maxDepth {
+			return Value{}, nil, errors.New("nesting too deep")
+		}
+		dict := make(Dict)
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			key, rest, err := decodeString(data)
+			if err != nil {
+				return Value{}, nil, fmt.Errorf("invalid dictionary key: %w", err)
+			}
+			var item Value
+			if item, data, err = decodeValue(rest, depth+1); err != nil {
+				return Value{}, nil, err
+			}
+			dict[key] = item
+		}
+		if len(data) == 0 {
+			return Value{}, nil, errors.New("unterminated dictionary")
+		}
+		return NewDict(dict), data[1:], nil
+	}
+	s, rest, err := decodeString(data)
+	if err != nil {
+		return Value{}, nil, err
+	}
+	return NewString(s), rest, nil
+}
+
+// decodeString parses the bencoded string at the start of data and returns the rest of data
+func decodeString(data []byte) (string, []byte, error) {
+	colon := bytes.IndexByte(data, ':')
+	if colon <= 0 {
+		return "", nil, errors.New("invalid string")
+	}
+	length, err := strconv.Atoi(string(data[:colon]))
+	if err != nil || length < 0 {
+		return "", nil, fmt.Errorf("invalid string length %q", data[:colon])
+	}
+	data = data[colon+1:]
+	if length > len(data) {
+		return "", nil, fmt.Errorf("string length %d past the end of data", length)
+	}
+	return string(data[:length]), data[length:], nil
+}
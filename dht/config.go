@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Defaults of the Config fields
+const (
+	DefaultQueryRate      = 1000 // incoming queries answered per second
+	DefaultQueryRatePerIP = 20   // incoming queries answered per second from one IP
+	DefaultWorkers        = 16   // goroutines handling incoming messages
+)
+
+// DefaultNodesFile is the default filename for persisted nodes
+const DefaultNodesFile = ".dht_nodes.json"
+
+// Config configures a DHT node; the zero value of each field selects its default
+type Config struct {
+	ListenAddr     string   // IPv4 address to listen on, every interface if empty
+	ListenAddr6    string   // IPv6 address to listen on, every interface if empty
+	DisableIPv6    bool     // only run the DHT over IPv4
+	Port           int      // UDP port of both addresses, the first free one in DefaultPort-MaxPort if 0
+	BootstrapNodes []string // nodes to bootstrap from, BootstrapNodes if nil
+	NodesFile      string   // file the routing tables are persisted to, DefaultNodesPath() if empty
+
+	// ReadOnly makes the node query others without answering their queries,
+	// and asks them not to add it to their routing tables (BEP 43)
+	ReadOnly bool
+
+	QueryRate         int // incoming queries answered per second, DefaultQueryRate if 0, unlimited if negative
+	QueryRatePerIP    int // incoming queries answered per second from one IP, DefaultQueryRatePerIP if 0, unlimited if negative
+	Workers           int // goroutines handling incoming messages, DefaultWorkers if 0
+	MaxPendingQueries int // outgoing queries waiting for a response at once, DefaultMaxPendingQueries if 0
+}
+
+// DefaultNodesPath returns the default path of the file the routing tables are persisted to,
+// in the cache directory of the user
+func DefaultNodesPath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "go-torrent", "dht_nodes.json")
+}
+
+// withDefaults returns a copy of the config with the defaults of the fields left empty
+func (c Config) withDefaults() Config {
+	if c.BootstrapNodes == nil {
+		c.BootstrapNodes = BootstrapNodes
+	}
+	if c.NodesFile == "" {
+		c.NodesFile = DefaultNodesPath()
+	}
+	if c.QueryRate == 0 {
+		c.QueryRate = DefaultQueryRate
+	}
+	if c.QueryRatePerIP == 0 {
+		c.QueryRatePerIP = DefaultQueryRatePerIP
+	}
+	if c.Workers <= 0 {
+		c.Workers = DefaultWorkers
+	}
+	if c.MaxPendingQueries <= 0 {
+		c.MaxPendingQueries = DefaultMaxPendingQueries
+	}
+	return c
+}
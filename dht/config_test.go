@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// answered sends a raw ping query to d and returns true if it answers within a short delay
+func answered(t *testing.T, d *DHT) bool {
+	t.Helper()
+	conn, err := net.DialUDP("udp4", nil, d.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(EncodePing("aa", NodeID{1}, false)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, MaxPacketSize)
+	_, err = conn.Read(buf)
+	return err == nil
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{}.withDefaults()
+	if !slices.Equal(c.BootstrapNodes, BootstrapNodes) {
+		t.Errorf("Expected the default bootstrap nodes, got %v", c.BootstrapNodes)
+	}
+	if c.NodesFile != DefaultNodesPath() || filepath.Base(c.NodesFile) != "dht_nodes.json" {
+		t.Errorf("Unexpected nodes file %s", c.NodesFile)
+	}
+	if c.QueryRate != DefaultQueryRate {
+		t.Errorf("Expected a query rate of %d, got %d", DefaultQueryRate, c.QueryRate)
+	}
+
+	// An empty bootstrap list is kept, for nodes that must not reach the public DHT
+	if c := (Config{BootstrapNodes: []string{}}).withDefaults(); len(c.BootstrapNodes) != 0 {
+		t.Errorf("Expected no bootstrap nodes, got %v", c.BootstrapNodes)
+	}
+}
+
+func TestDHTStartWithConfig(t *testing.T) {
+	// Find a free port
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	d, err := NewWithConfig(&Config{
+		ListenAddr:  "127.0.0.1",
+		Port:        port,
+		DisableIPv6: true,
+		NodesFile:   filepath.Join(t.TempDir(), "nodes.json"),
+	})
+	if err != nil {
+		t.Fatalf("NewWithConfig failed: %v", err)
+	}
+	if err := d.Start(t.Context()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer d.Stop()
+	if d.Port() != port || d.conn6 != nil {
+		t.Errorf("Expected port %d over IPv4 only, got port %d", port, d.Port())
+	}
+	if !d.conn.LocalAddr().(*net.UDPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected to listen on 127.0.0.1, got %s", d.conn.LocalAddr())
+	}
+
+	// The port is taken now
+	other, _ := NewWithConfig(&Config{ListenAddr: "127.0.0.1", Port: port, NodesFile: filepath.Join(t.TempDir(), "nodes.json")})
+	if err := other.Start(t.Context()); err == nil {
+		other.Stop()
+		t.Error("Expected an error binding a port in use")
+	}
+}
+
+func TestDHTReadOnly(t *testing.T) {
+	ro := newTestDHTWithConfig(t, &Config{ReadOnly: true})
+	b := newTestDHT(t)
+
+	// Our queries are answered, but we are not added to the routing table of b
+	if _, err := ro.Ping(b.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if b.routingTable.FindNode(ro.ID) != nil {
+		t.Error("Read-only node added to the routing table")
+	}
+	if ro.routingTable.FindNode(b.ID) == nil {
+		t.Error("Expected b in our routing table")
+	}
+
+	// We do not answer queries
+	if answered(t, ro) {
+		t.Error("Read-only node answered a query")
+	}
+	if !answered(t, b) {
+		t.Error("Expected b to answer")
+	}
+}
+
+func TestDHTQueryRate(t *testing.T) {
+	d := newTestDHTWithConfig(t, &Config{QueryRate: 2})
+	if !answered(t, d) || !answered(t, d) {
+		t.Fatal("Expected a burst of 2 queries answered")
+	}
+	if answered(t, d) {
+		t.Error("Expected the third query to be dropped")
+	}
+	if got := d.Stats().RateLimited; got != 1 {
+		t.Errorf("Expected 1 rate limited query, got %d", got)
+	}
+}
+
+func TestDHTQueryRatePerIP(t *testing.T) {
+	d := newTestDHTWithConfig(t, &Config{QueryRatePerIP: 1})
+	if !answered(t, d) {
+		t.Fatal("Expected the first query answered")
+	}
+	if answered(t, d) {
+		t.Error("Expected the second query from the same IP to be dropped")
+	}
+	// other IPs have buckets of their own
+	if !d.ipLimit.allow(net.IPv4(192, 0, 2, 1), time.Now()) {
+		t.Error("Expected another IP to be allowed")
+	}
+}
+
+func TestDHTDropsPacketsWhenBusy(t *testing.T) {
+	d, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.conn = conn
+	d.wg.Go(func() { d.readLoop(t.Context(), conn) })
+	t.Cleanup(func() {
+		close(d.shutdown)
+		conn.Close()
+		d.wg.Wait()
+	})
+
+	// without workers, the queue fills up
+	for range maxQueuedPackets {
+		d.packets <- packet{}
+	}
+	answered(t, d)
+	if got := d.Stats().DroppedPackets; got != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", got)
+	}
+}
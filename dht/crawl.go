@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Crawl parameters
+const (
+	crawlParallelism  = 8                // sample_infohashes queries in flight during a crawl
+	crawlRetry        = 30 * time.Second // wait before walking the routing tables again when no node may be queried
+	maxCrawlNodes     = 100000           // nodes remembered by a crawl
+	maxCrawlSeen      = 100000           // info hashes remembered by a crawl to report each of them once
+	maxSampleInterval = 6 * time.Hour    // longest interval a node may ask for between two queries (BEP 51)
+)
+
+// Samples is the answer of a node to a sample_infohashes query (BEP 51)
+type Samples struct {
+	InfoHashes [][20]byte    // info hashes sampled from the ones the node stores
+	Num        int           // number of info hashes the node stores
+	Interval   time.Duration // how long to wait before querying the node again
+	Nodes      []*NodeInfo   // closest nodes to the target, of the address family of the node
+}
+
+// handleSampleInfohashes answers a sample_infohashes query with a sample of the info hashes
+// announced to us and the closest nodes to the target (BEP 51)
+func (d *DHT) handleSampleInfohashes(msg *Message, addr *net.UDPAddr) []byte {
+	target := msg.Args.Str("target")
+	if len(target) != 20 {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "invalid target")
+	}
+	nodes, nodes6 := d.wantedNodes(msg, addr, NodeID([]byte(target)))
+	samples, num := d.peers.sample(maxSamples)
+	return EncodeSampleInfohashesResponse(msg.TransactionID, d.NodeID(), int(SampleInterval/time.Second), num, samples, nodes, nodes6, addr)
+}
+
+// SampleInfohashes sends a sample_infohashes query to addr (BEP 51)
+func (d *DHT) SampleInfohashes(addr *net.UDPAddr, target NodeID) (*Samples, error) {
+	txID := d.transactions.NewTransactionID()
+	query := EncodeSampleInfohashes(txID, d.NodeID(), target, d.config.ReadOnly)
+
+	pq, err := d.transactions.AddPending(txID, MethodSampleInfohashes, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.send(query, addr); err != nil {
+		d.transactions.GetPending(txID)
+		return nil, err
+	}
+
+	select {
+	case resp := <-pq.ResponseChan:
+		if resp == nil {
+			return nil, fmt.Errorf("nil response")
+		}
+		if resp.Type == ErrorType {
+			return nil, resp.Error
+		}
+		compact := resp.Response.Str("samples")
+		if len(compact)%20 != 0 {
+			return nil, fmt.Errorf("samples of %d bytes, not a multiple of 20", len(compact))
+		}
+		samples := &Samples{InfoHashes: make([][20]byte, 0, len(compact)/20)}
+		for i := 0; i < len(compact); i += 20 {
+			samples.InfoHashes = append(samples.InfoHashes, [20]byte([]byte(compact[i:i+20])))
+		}
+		samples.Num, _ = resp.Response.Int("num")
+		interval, _ := resp.Response.Int("interval")
+		// a negative interval or one longer than allowed is clamped
+		samples.Interval = time.Duration(min(max(interval, 0), int(maxSampleInterval/time.Second))) * time.Second
+		samples.Nodes, _ = resp.ExtractNodes(addr.IP.To4() == nil)
+		return samples, nil
+
+	case <-time.After(QueryTimeout):
+		d.transactions.GetPending(txID) // Remove pending
+		d.tableFor(addr).Failed(addr)
+		return nil, fmt.Errorf("sample_infohashes %w", ErrQueryTimeout)
+	}
+}
+
+// Crawl walks the key space with sample_infohashes queries (BEP 51) until ctx is done or the node stops,
+// and calls found for every info hash sampled, from the goroutine of the crawl
+// an info hash is reported again only once maxCrawlSeen others were sampled since
+// each node is queried with a random target and the nodes it returns are queried in turn;
+// a node is not queried again before the interval it asked for
+func (d *DHT) Crawl(ctx context.Context, found func(infoHash [20]byte)) error {
+	if d.size() == 0 {
+		return fmt.Errorf("no nodes in routing table")
+	}
+
+	seen := make(map[[20]byte]bool)
+	var seenOrder [][20]byte           // the keys of seen, oldest first
+	next := make(map[string]time.Time) // node address -> when it may be queried again
+	queued := make(map[string]bool)
+	var queue []*NodeInfo
+	enqueue := func(nodes []*NodeInfo) {
+		now := time.Now()
+		for _, n := range nodes {
+			key := n.Addr.String()
+			t, known := next[key]
+			if queued[key] || now.Before(t) || !known && len(next) >= maxCrawlNodes {
+				continue
+			}
+			next[key] = t
+			queued[key] = true
+			queue = append(queue, n)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.shutdown:
+			return errors.New("DHT stopped")
+		default:
+		}
+
+		// start over from the routing tables once every node we know of was queried
+		if len(queue) == 0 {
+			for _, rt := range d.tables() {
+				enqueue(rt.AllNodes())
+			}
+		}
+		if len(queue) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-d.shutdown:
+				return errors.New("DHT stopped")
+			case <-time.After(crawlRetry):
+			}
+			continue
+		}
+
+		batch := queue[:min(len(queue), crawlParallelism)]
+		queue = queue[len(batch):]
+		replies := make([]*Samples, len(batch))
+		var wg sync.WaitGroup
+		for i, n := range batch {
+			wg.Go(func() {
+				target, err := GenerateNodeID()
+				if err != nil {
+					return
+				}
+				replies[i], _ = d.SampleInfohashes(n.Addr, target)
+			})
+		}
+		wg.Wait()
+
+		for i, n := range batch {
+			key := n.Addr.String()
+			delete(queued, key)
+			reply := replies[i]
+			if reply == nil {
+				// the node failed or does not support BEP 51: leave it alone for a while
+				next[key] = time.Now().Add(SampleInterval)
+				continue
+			}
+			next[key] = time.Now().Add(reply.Interval)
+			for _, infoHash := range reply.InfoHashes {
+				if seen[infoHash] {
+					continue
+				}
+				if len(seenOrder) >= maxCrawlSeen {
+					delete(seen, seenOrder[0])
+					seenOrder = seenOrder[1:]
+				}
+				seen[infoHash] = true
+				seenOrder = append(seenOrder, infoHash)
+				found(infoHash)
+			}
+			enqueue(reply.Nodes)
+		}
+	}
+}
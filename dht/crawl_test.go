@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerStoreSample(t *testing.T) {
+	ps := newPeerStore()
+	if samples, num := ps.sample(maxSamples); len(samples) != 0 || num != 0 {
+		t.Fatalf("Expected no samples, got %d of %d", len(samples), num)
+	}
+	for i := range 30 {
+		ps.add([20]byte{byte(i)}, "peer")
+	}
+	samples, num := ps.sample(maxSamples)
+	if len(samples) != maxSamples || num != 30 {
+		t.Fatalf("Expected %d samples of 30, got %d of %d", maxSamples, len(samples), num)
+	}
+
+	// The same sample is given out until the interval is over
+	ps.sampled = time.Now().Add(-sampleRefresh)
+	again, num := ps.sample(maxSamples)
+	if !slices.Equal(again, samples) || num != 30 {
+		t.Error("Expected the same sample")
+	}
+	ps.sampled = time.Now().Add(-SampleInterval)
+	if again, _ := ps.sample(maxSamples); slices.Equal(again, samples) {
+		t.Error("Expected a new sample")
+	}
+
+	// or until the stored info hashes change, once sampleRefresh is over
+	ps.add([20]byte{0xFF}, "peer")
+	if _, num := ps.sample(maxSamples); num != 30 {
+		t.Errorf("Expected the same sample of 30, got one of %d", num)
+	}
+	ps.sampled = time.Now().Add(-sampleRefresh)
+	if _, num := ps.sample(maxSamples); num != 31 {
+		t.Errorf("Expected a new sample of 31, got one of %d", num)
+	}
+}
+
+func TestDHTSampleInfohashes(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	c := newTestDHT(t)
+	b.routingTable.AddNode(&NodeInfo{ID: c.ID, Addr: c.conn.LocalAddr().(*net.UDPAddr)})
+	b.peers.add([20]byte{0xAB}, "peer")
+
+	samples, err := a.SampleInfohashes(b.conn.LocalAddr().(*net.UDPAddr), c.ID)
+	if err != nil {
+		t.Fatalf("SampleInfohashes failed: %v", err)
+	}
+	if !slices.Equal(samples.InfoHashes, [][20]byte{{0xAB}}) || samples.Num != 1 {
+		t.Errorf("Unexpected samples %x of %d", samples.InfoHashes, samples.Num)
+	}
+	if samples.Interval != SampleInterval {
+		t.Errorf("Expected an interval of %s, got %s", SampleInterval, samples.Interval)
+	}
+	// b knows of c, and of a since it queried it
+	if !slices.ContainsFunc(samples.Nodes, func(n *NodeInfo) bool { return n.ID == c.ID }) {
+		t.Errorf("Expected c among the closest nodes, got %v", samples.Nodes)
+	}
+}
+
+func TestDHTSampleInfohashesInterval(t *testing.T) {
+	a := newTestDHT(t)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a node answering with the interval it is given
+	tests := []struct {
+		interval int
+		want     time.Duration
+	}{
+		{60, time.Minute},
+		{-1, 0},
+		{1 << 40, maxSampleInterval},
+	}
+	for _, tt := range tests {
+		go func() {
+			buf := make([]byte, MaxPacketSize)
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := DecodeMessage(buf[:n])
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(EncodeSampleInfohashesResponse(query.TransactionID, NodeID{1}, tt.interval, 0, nil, nil, nil, nil), addr)
+		}()
+		samples, err := a.SampleInfohashes(conn.LocalAddr().(*net.UDPAddr), NodeID{2})
+		if err != nil {
+			t.Fatalf("SampleInfohashes failed: %v", err)
+		}
+		if samples.Interval != tt.want {
+			t.Errorf("Interval %d: expected %s, got %s", tt.interval, tt.want, samples.Interval)
+		}
+	}
+}
+
+func TestDHTCrawl(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	c := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+	b.routingTable.AddNode(&NodeInfo{ID: c.ID, Addr: c.conn.LocalAddr().(*net.UDPAddr)})
+	b.peers.add([20]byte{0x0B}, "peer")
+	c.peers.add([20]byte{0x0C}, "peer")
+	c.peers.add([20]byte{0x0B}, "peer")
+
+	// The crawl learns about c from b and samples both
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var found [][20]byte
+	err := a.Crawl(ctx, func(infoHash [20]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		found = append(found, infoHash)
+		if len(found) == 2 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected the crawl to be canceled, got %v", err)
+	}
+	slices.SortFunc(found, func(x, y [20]byte) int { return int(x[0]) - int(y[0]) })
+	if !slices.Equal(found, [][20]byte{{0x0B}, {0x0C}}) {
+		t.Errorf("Expected each info hash once, got %x", found)
+	}
+}
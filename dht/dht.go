@@ -1,12 +1,17 @@
 package dht
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +22,8 @@ const (
 	MaxPacketSize     = 1500
 	BootstrapInterval = 5 * time.Minute
 	SaveInterval      = 2 * time.Minute
+	CleanupInterval   = 1 * time.Minute // expired pending queries, announce targets and idle rate limits are dropped this often
+	maxQueuedPackets  = 1024            // packets waiting for a worker, the ones past it are dropped
 )
 
 // Bootstrap nodes - well-known DHT entry points
@@ -31,65 +38,149 @@ var BootstrapNodes = []string{
 
 // DHT represents a DHT node
 type DHT struct {
-	ID           NodeID
-	conn         *net.UDPConn
-	port         int
-	routingTable *RoutingTable
-	transactions *TransactionManager
-	peerStore    map[[20]byte][]string // info_hash -> peer addresses
-	peerStoreMu  sync.RWMutex
-	nodesFile    string // path to persist routing table
+	ID            NodeID // changes when we learn our external IP (BEP 42), use NodeID once started
+	idMu          sync.RWMutex
+	external      externalIP // our external IP as reported by the nodes we query
+	conn          *net.UDPConn
+	conn6         *net.UDPConn // IPv6 socket (BEP 32), nil if IPv6 is not available
+	port          int
+	routingTable  *RoutingTable
+	routingTable6 *RoutingTable // IPv6 nodes
+	transactions  *TransactionManager
+	peers         *peerStore    // peers announced to us
+	items         *itemStore    // items put to us (BEP 44)
+	tokens        *tokenManager // tokens given to the nodes that may announce to us
+	config        Config
+	queryLimit    *tokenBucket // incoming queries we answer, nil for no limit
+	ipLimit       *ipLimiter   // incoming queries we answer per IP, nil for no limit
+	packets       chan packet  // received packets waiting for a worker
+
+	droppedPackets atomic.Uint64 // packets dropped because the workers were busy
+	rateLimited    atomic.Uint64 // queries dropped by the rate limits
+
+	announceTargets announceTargets // nodes to announce our torrents to, with their tokens
+	nodesFile       string          // path to persist routing table
 
 	// Channels for communication
 	shutdown chan struct{}
 	wg       sync.WaitGroup
 }
 
-// New creates a new DHT node
+// packet is a received UDP packet
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// Stats counts what a node dropped to protect itself, for monitoring
+type Stats struct {
+	DroppedPackets  uint64 // packets dropped because every worker was busy
+	RateLimited     uint64 // incoming queries dropped by the rate limits
+	RejectedQueries uint64 // outgoing queries not sent because too many were pending
+	ExpiredQueries  uint64 // outgoing queries dropped by the periodic cleanup while still pending
+	PendingQueries  int    // outgoing queries waiting for a response
+}
+
+// New creates a new DHT node with the default configuration
 func New() (*DHT, error) {
+	return NewWithConfig(nil)
+}
+
+// NewWithConfig creates a new DHT node
+// cfg can be nil to use the defaults
+func NewWithConfig(cfg *Config) (*DHT, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
 	nodeID, err := GenerateNodeID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate node ID: %w", err)
 	}
 
-	return &DHT{
-		ID:           nodeID,
-		routingTable: NewRoutingTable(nodeID),
-		transactions: NewTransactionManager(),
-		peerStore:    make(map[[20]byte][]string),
-		nodesFile:    DefaultNodesFile,
-		shutdown:     make(chan struct{}),
-	}, nil
+	config := cfg.withDefaults()
+	d := &DHT{
+		ID:            nodeID,
+		config:        config,
+		routingTable:  NewRoutingTable(nodeID),
+		routingTable6: NewRoutingTable(nodeID),
+		transactions:  newTransactionManager(config.MaxPendingQueries),
+		peers:         newPeerStore(),
+		items:         newItemStore(),
+		tokens:        newTokenManager(),
+		nodesFile:     config.NodesFile,
+		packets:       make(chan packet, maxQueuedPackets),
+		shutdown:      make(chan struct{}),
+	}
+	if config.QueryRate > 0 {
+		d.queryLimit = newTokenBucket(config.QueryRate, config.QueryRate)
+	}
+	if config.QueryRatePerIP > 0 {
+		d.ipLimit = newIPLimiter(config.QueryRatePerIP, config.QueryRatePerIP)
+	}
+	return d, nil
 }
 
 // Start starts the DHT node
 func (d *DHT) Start(ctx context.Context) error {
 	// Load persisted nodes
-	if loaded, err := d.routingTable.LoadNodes(d.nodesFile); err != nil {
+	if loaded, err := LoadNodes(d.nodesFile, d.routingTable, d.routingTable6); err != nil {
 		log.Printf("DHT: failed to load nodes: %v", err)
 	} else if loaded > 0 {
 		log.Printf("DHT: loaded %d nodes from %s", loaded, d.nodesFile)
 	}
 
-	// Try to bind to a port in the standard range
+	ip := net.IPv4zero
+	if d.config.ListenAddr != "" {
+		if ip = net.ParseIP(d.config.ListenAddr).To4(); ip == nil {
+			return fmt.Errorf("invalid IPv4 listen address %q", d.config.ListenAddr)
+		}
+	}
+	ip6 := net.IPv6unspecified
+	if d.config.ListenAddr6 != "" {
+		if ip6 = net.ParseIP(d.config.ListenAddr6); ip6 == nil || ip6.To4() != nil {
+			return fmt.Errorf("invalid IPv6 listen address %q", d.config.ListenAddr6)
+		}
+	}
+
+	// Bind to the configured port, or try the ports of the standard range
 	var conn *net.UDPConn
 	var err error
-	for port := DefaultPort; port <= MaxPort; port++ {
-		addr := &net.UDPAddr{IP: net.IPv4zero, Port: port}
-		conn, err = net.ListenUDP("udp4", addr)
-		if err == nil {
-			d.port = port
-			break
+	if d.config.Port != 0 {
+		if conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: d.config.Port}); err != nil {
+			return fmt.Errorf("failed to bind to port %d: %w", d.config.Port, err)
+		}
+		d.port = d.config.Port
+	} else {
+		for port := DefaultPort; port <= MaxPort; port++ {
+			addr := &net.UDPAddr{IP: ip, Port: port}
+			conn, err = net.ListenUDP("udp4", addr)
+			if err == nil {
+				d.port = port
+				break
+			}
+		}
+		if conn == nil {
+			return fmt.Errorf("failed to bind to any port in range %d-%d: %w", DefaultPort, MaxPort, err)
 		}
-	}
-	if conn == nil {
-		return fmt.Errorf("failed to bind to any port in range %d-%d: %w", DefaultPort, MaxPort, err)
 	}
 	d.conn = conn
 	log.Printf("DHT listening on port %d", d.port)
 
+	// IPv6 is optional: listen on the same port if we can (BEP 32)
+	if !d.config.DisableIPv6 {
+		if conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ip6, Port: d.port}); err != nil {
+			log.Printf("DHT: IPv6 unavailable: %v", err)
+		} else {
+			d.conn6 = conn6
+		}
+	}
+
 	// Start background goroutines
-	d.wg.Go(func() { d.readLoop(ctx) })
+	d.startWorkers(ctx)
+	d.wg.Go(func() { d.readLoop(ctx, d.conn) })
+	if d.conn6 != nil {
+		d.wg.Go(func() { d.readLoop(ctx, d.conn6) })
+	}
 	d.wg.Go(func() { d.bootstrapLoop(ctx) })
 
 	return nil
@@ -101,12 +192,15 @@ func (d *DHT) Stop() {
 	if d.conn != nil {
 		d.conn.Close()
 	}
+	if d.conn6 != nil {
+		d.conn6.Close()
+	}
 	d.wg.Wait()
 
-	// Save routing table
-	if err := d.routingTable.SaveNodes(d.nodesFile); err != nil {
+	// Save routing tables
+	if err := SaveNodes(d.nodesFile, d.routingTable, d.routingTable6); err != nil {
 		log.Printf("DHT: failed to save nodes: %v", err)
-	} else if size := d.routingTable.Size(); size > 0 {
+	} else if size := d.size(); size > 0 {
 		log.Printf("DHT: saved %d nodes to %s", size, d.nodesFile)
 	}
 }
@@ -121,13 +215,100 @@ func (d *DHT) Port() int {
 	return d.port
 }
 
-// RoutingTable returns the routing table
+// NodeID returns our node ID
+func (d *DHT) NodeID() NodeID {
+	d.idMu.RLock()
+	defer d.idMu.RUnlock()
+	return d.ID
+}
+
+// ExternalIP returns our external IPv4 address as reported by other nodes, nil if unknown yet
+func (d *DHT) ExternalIP() net.IP {
+	return d.external.get()
+}
+
+// setExternalIP derives a new node ID from our external IP if ours was not (BEP 42)
+// the nodes of the routing tables are sorted into the buckets of the new ID
+func (d *DHT) setExternalIP(ip net.IP) {
+	log.Printf("DHT: external IP is %s", ip)
+	if ValidNodeID(d.NodeID(), ip) {
+		return
+	}
+	id, err := GenerateSecureNodeID(ip)
+	if err != nil {
+		log.Printf("DHT: failed to generate node ID: %v", err)
+		return
+	}
+	d.idMu.Lock()
+	d.ID = id
+	d.idMu.Unlock()
+	d.routingTable.SetSelf(id)
+	d.routingTable6.SetSelf(id)
+	log.Printf("DHT: new node ID %x", id)
+}
+
+// Stats returns the counters of what the node dropped
+func (d *DHT) Stats() Stats {
+	return Stats{
+		DroppedPackets:  d.droppedPackets.Load(),
+		RateLimited:     d.rateLimited.Load(),
+		RejectedQueries: d.transactions.rejected.Load(),
+		ExpiredQueries:  d.transactions.expired.Load(),
+		PendingQueries:  d.transactions.PendingCount(),
+	}
+}
+
+// ReadOnly returns true if the node does not answer queries (BEP 43)
+func (d *DHT) ReadOnly() bool {
+	return d.config.ReadOnly
+}
+
+// RoutingTable returns the routing table of the IPv4 nodes
 func (d *DHT) RoutingTable() *RoutingTable {
 	return d.routingTable
 }
 
-// readLoop reads incoming UDP packets
-func (d *DHT) readLoop(ctx context.Context) {
+// RoutingTable6 returns the routing table of the IPv6 nodes
+func (d *DHT) RoutingTable6() *RoutingTable {
+	return d.routingTable6
+}
+
+// tables returns the routing tables of the address families we can reach
+func (d *DHT) tables() []*RoutingTable {
+	if d.conn6 == nil {
+		return []*RoutingTable{d.routingTable}
+	}
+	return []*RoutingTable{d.routingTable, d.routingTable6}
+}
+
+// tableFor returns the routing table of the address family of addr
+func (d *DHT) tableFor(addr *net.UDPAddr) *RoutingTable {
+	if addr.IP.To4() == nil {
+		return d.routingTable6
+	}
+	return d.routingTable
+}
+
+// size returns the number of nodes in both routing tables
+func (d *DHT) size() int {
+	return d.routingTable.Size() + d.routingTable6.Size()
+}
+
+// send writes a packet to addr through the socket of its address family
+func (d *DHT) send(data []byte, addr *net.UDPAddr) error {
+	conn := d.conn
+	if addr.IP.To4() == nil {
+		conn = d.conn6
+	}
+	if conn == nil {
+		return fmt.Errorf("no socket to reach %s", addr)
+	}
+	_, err := conn.WriteToUDP(data, addr)
+	return err
+}
+
+// readLoop reads incoming UDP packets from conn
+func (d *DHT) readLoop(ctx context.Context, conn *net.UDPConn) {
 	buf := make([]byte, MaxPacketSize)
 
 	for {
@@ -139,8 +320,8 @@ func (d *DHT) readLoop(ctx context.Context) {
 		default:
 		}
 
-		d.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, addr, err := d.conn.ReadFromUDP(buf)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
@@ -155,10 +336,35 @@ func (d *DHT) readLoop(ctx context.Context) {
 			}
 		}
 
-		// Handle the message in a goroutine
+		// Hand the message to a worker, or drop it if they are all busy
 		data := make([]byte, n)
 		copy(data, buf[:n])
-		go d.handleMessage(data, addr)
+		select {
+		case d.packets <- packet{data: data, addr: addr}:
+		default:
+			d.droppedPackets.Add(1)
+		}
+	}
+}
+
+// startWorkers starts the workers that handle the received packets
+func (d *DHT) startWorkers(ctx context.Context) {
+	for range d.config.Workers {
+		d.wg.Go(func() { d.worker(ctx) })
+	}
+}
+
+// worker handles received packets until the node stops
+func (d *DHT) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.shutdown:
+			return
+		case p := <-d.packets:
+			d.handleMessage(p.data, p.addr)
+		}
 	}
 }
 
@@ -170,38 +376,95 @@ func (d *DHT) bootstrapLoop(ctx context.Context) {
 	saveTicker := time.NewTicker(SaveInterval)
 	defer saveTicker.Stop()
 
+	cleanupTicker := time.NewTicker(CleanupInterval)
+	defer cleanupTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-d.shutdown:
 			return
+		case <-cleanupTicker.C:
+			// queries remove themselves once they time out, this catches the ones that did not
+			d.transactions.CleanupExpired(2 * QueryTimeout)
+			d.ipLimit.cleanup(time.Now())
+			d.announceTargets.cleanup()
 		case <-saveTicker.C:
-			// Periodically save routing table
-			if size := d.routingTable.Size(); size > 0 {
-				if err := d.routingTable.SaveNodes(d.nodesFile); err != nil {
+			d.peers.cleanup()
+			d.items.cleanup()
+			// Periodically save routing tables
+			if size := d.size(); size > 0 {
+				if err := SaveNodes(d.nodesFile, d.routingTable, d.routingTable6); err != nil {
 					log.Printf("DHT: periodic save failed: %v", err)
 				} else {
 					log.Printf("DHT: saved %d nodes", size)
 				}
 			}
 			// Re-bootstrap if we have very few nodes
-			if d.routingTable.Size() < K {
-				log.Printf("DHT: low node count (%d), re-bootstrapping...", d.routingTable.Size())
+			if d.size() < K {
+				log.Printf("DHT: low node count (%d), re-bootstrapping...", d.size())
 				d.Bootstrap()
 			}
 		case <-refreshTicker.C:
 			// Refresh stale buckets
-			stale := d.routingTable.StaleBuckets()
-			for _, idx := range stale {
-				// Generate a random ID in this bucket and search for it
-				target := d.randomIDInBucket(idx)
-				d.FindNode(target)
+			for _, rt := range d.tables() {
+				for _, idx := range rt.StaleBuckets() {
+					// Generate a random ID in this bucket and search for it
+					target := d.randomIDInBucket(idx)
+					d.lookup(rt, target, d.findNodeLookupQuery(target))
+				}
 			}
 		}
 	}
 }
 
+// addNode adds a node we heard from to the routing table
+// if its bucket is full, the node waits in the replacement cache while the questionable nodes of the bucket are pinged,
+// by one goroutine per bucket at most
+func (d *DHT) addNode(node *NodeInfo) {
+	rt := d.tableFor(node.Addr)
+	if rt.AddNode(node) {
+		return
+	}
+	if bucket := rt.startProbe(node.ID); bucket != nil {
+		go func() {
+			defer rt.endProbe(bucket)
+			d.evictQuestionable(rt, node.ID)
+		}()
+	}
+}
+
+// evictQuestionable pings the questionable nodes of the bucket of id in rt, least recently seen first,
+// and evicts the first one that does not respond so a node of the replacement cache takes its place
+// it stops at the first ping that fails on our side, such as when too many queries are pending
+func (d *DHT) evictQuestionable(rt *RoutingTable, id NodeID) {
+	var pinged []NodeID
+	defer func() {
+		for _, p := range pinged {
+			rt.Pinged(p)
+		}
+	}()
+	for {
+		n := rt.Questionable(id)
+		if n == nil {
+			return
+		}
+		pinged = append(pinged, n.ID)
+		_, err := d.Ping(n.Addr)
+		var krpcErr *Error
+		switch {
+		case err == nil, errors.As(err, &krpcErr):
+			// the node responded
+		case errors.Is(err, ErrQueryTimeout):
+			rt.Evict(n.ID)
+			return
+		default:
+			return
+		}
+	}
+}
+
 // handleMessage processes an incoming KRPC message
 func (d *DHT) handleMessage(data []byte, addr *net.UDPAddr) {
 	msg, err := DecodeMessage(data)
@@ -217,40 +480,58 @@ func (d *DHT) handleMessage(data []byte, addr *net.UDPAddr) {
 		d.handleResponse(msg, addr)
 	case ErrorType:
 		log.Printf("DHT: received error from %s: %v", addr, msg.Error)
+		// hand the error to the query waiting for it
+		if pq := d.transactions.GetPending(msg.TransactionID); pq != nil {
+			select {
+			case pq.ResponseChan <- msg:
+			default:
+			}
+		}
 	}
 }
 
 // handleQuery handles incoming queries
 func (d *DHT) handleQuery(msg *Message, addr *net.UDPAddr) {
-	// Extract sender's node ID and add to routing table
+	// a noisy IP is limited before it eats into the limit of everyone
+	now := time.Now()
+	if !d.ipLimit.allow(addr.IP, now) || !d.queryLimit.allow(now) {
+		d.rateLimited.Add(1)
+		return
+	}
+
+	// Extract sender's node ID and add to routing table, unless it is read-only (BEP 43)
 	senderID, err := msg.ExtractNodeID()
-	if err == nil {
-		d.routingTable.AddNode(&NodeInfo{
+	if err == nil && !msg.ReadOnly {
+		d.addNode(&NodeInfo{
 			ID:       senderID,
 			Addr:     addr,
 			LastSeen: time.Now(),
 		})
 	}
 
+	// a read-only node does not answer queries (BEP 43)
+	if d.config.ReadOnly {
+		return
+	}
+
 	var response []byte
 	switch msg.Query {
 	case MethodPing:
-		response = EncodePingResponse(msg.TransactionID, d.ID)
+		response = EncodePingResponse(msg.TransactionID, d.NodeID(), addr)
 
 	case MethodFindNode:
-		target := msg.Args["target"]
+		target := msg.Args.Str("target")
 		if len(target) != 20 {
 			response = EncodeError(msg.TransactionID, ErrorProtocol, "invalid target")
 			break
 		}
 		var targetID NodeID
 		copy(targetID[:], target)
-		closest := d.routingTable.ClosestNodes(targetID, K)
-		nodes := d.encodeNodes(closest, false)
-		response = EncodeFindNodeResponse(msg.TransactionID, d.ID, nodes)
+		nodes, nodes6 := d.wantedNodes(msg, addr, targetID)
+		response = EncodeFindNodeResponse(msg.TransactionID, d.NodeID(), nodes, nodes6, addr)
 
 	case MethodGetPeers:
-		infoHashStr := msg.Args["info_hash"]
+		infoHashStr := msg.Args.Str("info_hash")
 		if len(infoHashStr) != 20 {
 			response = EncodeError(msg.TransactionID, ErrorProtocol, "invalid info_hash")
 			break
@@ -258,29 +539,85 @@ func (d *DHT) handleQuery(msg *Message, addr *net.UDPAddr) {
 		var infoHash [20]byte
 		copy(infoHash[:], infoHashStr)
 
-		token := d.generateToken()
-
-		// Check if we have peers for this info_hash
-		d.peerStoreMu.RLock()
-		peers := d.peerStore[infoHash]
-		d.peerStoreMu.RUnlock()
+		token := d.tokens.generate(addr.IP)
 
-		if len(peers) > 0 {
-			response = EncodeGetPeersResponsePeers(msg.TransactionID, d.ID, token, peers)
+		// Check if we have peers of the address family of the sender for this info_hash
+		if peers := d.peers.get(infoHash, addr.IP.To4() == nil, maxReturnPeers); len(peers) > 0 {
+			response = EncodeGetPeersResponsePeers(msg.TransactionID, d.NodeID(), token, peers, addr)
 		} else {
 			// Return closest nodes
-			closest := d.routingTable.ClosestNodes(NodeID(infoHash), K)
-			nodes := d.encodeNodes(closest, false)
-			response = EncodeGetPeersResponseNodes(msg.TransactionID, d.ID, token, nodes)
+			nodes, nodes6 := d.wantedNodes(msg, addr, NodeID(infoHash))
+			response = EncodeGetPeersResponseNodes(msg.TransactionID, d.NodeID(), token, nodes, nodes6, addr)
 		}
 
+	case MethodAnnounce:
+		response = d.handleAnnouncePeer(msg, addr)
+
+	case MethodGet:
+		response = d.handleGet(msg, addr)
+
+	case MethodPut:
+		response = d.handlePut(msg, addr)
+
+	case MethodSampleInfohashes:
+		response = d.handleSampleInfohashes(msg, addr)
+
 	default:
 		response = EncodeError(msg.TransactionID, ErrorMethodUnknown, "unknown method")
 	}
 
 	if response != nil {
-		d.conn.WriteToUDP(response, addr)
+		d.send(response, addr)
+	}
+}
+
+// wantedNodes returns the compact nodes closest to target of the address families the sender wants (BEP 32):
+// "n4" and "n6" in the want argument of the query, the address family of the sender if there is none
+func (d *DHT) wantedNodes(msg *Message, addr *net.UDPAddr, target NodeID) (nodes, nodes6 []byte) {
+	want := Strings(msg.Args.List("want"))
+	if len(want) == 0 {
+		if addr.IP.To4() == nil {
+			want = []string{"n6"}
+		} else {
+			want = []string{"n4"}
+		}
+	}
+	if slices.Contains(want, "n4") {
+		nodes = d.encodeNodes(d.routingTable.ClosestNodes(target, K), false)
+	}
+	if slices.Contains(want, "n6") {
+		nodes6 = d.encodeNodes(d.routingTable6.ClosestNodes(target, K), true)
+	}
+	return nodes, nodes6
+}
+
+// handleAnnouncePeer stores the peer of an announce_peer query and returns the response
+// the token must be one we gave to the IP of the sender in a get_peers response
+func (d *DHT) handleAnnouncePeer(msg *Message, addr *net.UDPAddr) []byte {
+	infoHashStr := msg.Args.Str("info_hash")
+	if len(infoHashStr) != 20 {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "invalid info_hash")
+	}
+	if !d.tokens.validate(msg.Args.Str("token"), addr.IP) {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "bad token")
+	}
+	// with implied_port, the peer accepts connections on the port it sent the query from
+	port := addr.Port
+	if implied, _ := msg.Args.Int("implied_port"); implied == 0 {
+		var ok bool
+		port, ok = msg.Args.Int("port")
+		if !ok || port <= 0 || port > 65535 {
+			return EncodeError(msg.TransactionID, ErrorProtocol, "invalid port")
+		}
+	}
+	peer, err := compactPeer(addr.IP, port)
+	if err != nil {
+		return EncodeError(msg.TransactionID, ErrorProtocol, err.Error())
 	}
+	if !d.peers.add([20]byte([]byte(infoHashStr)), peer) {
+		return EncodeError(msg.TransactionID, ErrorServer, "peer store full")
+	}
+	return EncodeAnnouncePeerResponse(msg.TransactionID, d.NodeID(), addr)
 }
 
 // handleResponse handles incoming responses
@@ -291,13 +628,20 @@ func (d *DHT) handleResponse(msg *Message, addr *net.UDPAddr) {
 		return // Unknown transaction, ignore
 	}
 
+	// Learn our external IP from the address the node sees us at
+	if ip, ok := d.external.vote(compactIP(msg.IP), addr.IP); ok {
+		d.setExternalIP(ip)
+	}
+
 	// Extract sender's node ID and add to routing table
 	senderID, err := msg.ExtractNodeID()
 	if err == nil {
-		d.routingTable.AddNode(&NodeInfo{
-			ID:       senderID,
-			Addr:     addr,
-			LastSeen: time.Now(),
+		now := time.Now()
+		d.addNode(&NodeInfo{
+			ID:           senderID,
+			Addr:         addr,
+			LastSeen:     now,
+			LastResponse: now,
 		})
 	}
 
@@ -311,69 +655,73 @@ func (d *DHT) handleResponse(msg *Message, addr *net.UDPAddr) {
 // Ping sends a ping query to the given address
 func (d *DHT) Ping(addr *net.UDPAddr) (*Message, error) {
 	txID := d.transactions.NewTransactionID()
-	query := EncodePing(txID, d.ID)
+	query := EncodePing(txID, d.NodeID(), d.config.ReadOnly)
 
-	pq := d.transactions.AddPending(txID, MethodPing, addr)
-	n, err := d.conn.WriteToUDP(query, addr)
+	pq, err := d.transactions.AddPending(txID, MethodPing, addr)
 	if err != nil {
+		return nil, err
+	}
+	if err = d.send(query, addr); err != nil {
 		d.transactions.GetPending(txID) // Remove pending
 		log.Printf("DHT: ping send error to %s: %v", addr, err)
 		return nil, err
 	}
-	log.Printf("DHT: sent ping (%d bytes) to %s", n, addr)
+	log.Printf("DHT: sent ping to %s", addr)
 
 	select {
 	case resp := <-pq.ResponseChan:
+		if resp == nil {
+			return nil, fmt.Errorf("nil response")
+		}
+		if resp.Type == ErrorType {
+			return nil, resp.Error
+		}
 		log.Printf("DHT: got ping response from %s", addr)
 		return resp, nil
 	case <-time.After(QueryTimeout):
 		d.transactions.GetPending(txID) // Remove pending
+		d.tableFor(addr).Failed(addr)
 		log.Printf("DHT: ping timeout for %s", addr)
-		return nil, fmt.Errorf("ping timeout")
+		return nil, fmt.Errorf("ping %w", ErrQueryTimeout)
 	}
 }
 
-// FindNode sends a find_node query
+// FindNode runs an iterative find_node lookup of target
+// and returns the closest nodes that responded, at most K
+// with IPv6, the lookup runs over both address families and the closest nodes of each are returned
 func (d *DHT) FindNode(target NodeID) ([]*NodeInfo, error) {
-	// Get closest known nodes to target
-	closest := d.routingTable.ClosestNodes(target, K)
-	if len(closest) == 0 {
+	if d.size() == 0 {
 		return nil, fmt.Errorf("no nodes in routing table")
 	}
-
-	var allNodes []*NodeInfo
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	for _, node := range closest {
-		wg.Go(func() {
-			nodes, err := d.findNodeQuery(node.Addr, target)
-			if err != nil {
-				return
-			}
-			mu.Lock()
-			allNodes = append(allNodes, nodes...)
-			mu.Unlock()
-		})
+	result := d.lookupAll(target, d.findNodeLookupQuery(target))
+	closest := make([]*NodeInfo, len(result.closest))
+	for i, e := range result.closest {
+		closest[i] = e.node
 	}
-	wg.Wait()
+	return closest, nil
+}
 
-	// Add discovered nodes to routing table
-	for _, node := range allNodes {
-		d.routingTable.AddNode(node)
+// findNodeLookupQuery returns the query of a find_node lookup of target
+func (d *DHT) findNodeLookupQuery(target NodeID) lookupQuery {
+	return func(node *NodeInfo) (*lookupReply, error) {
+		nodes, err := d.findNodeQuery(node.Addr, target)
+		if err != nil {
+			return nil, err
+		}
+		return &lookupReply{nodes: nodes}, nil
 	}
-
-	return allNodes, nil
 }
 
 // findNodeQuery sends a single find_node query
 func (d *DHT) findNodeQuery(addr *net.UDPAddr, target NodeID) ([]*NodeInfo, error) {
 	txID := d.transactions.NewTransactionID()
-	query := EncodeFindNode(txID, d.ID, target)
+	query := EncodeFindNode(txID, d.NodeID(), target, d.config.ReadOnly)
 
-	pq := d.transactions.AddPending(txID, MethodFindNode, addr)
-	_, err := d.conn.WriteToUDP(query, addr)
+	pq, err := d.transactions.AddPending(txID, MethodFindNode, addr)
 	if err != nil {
+		return nil, err
+	}
+	if err = d.send(query, addr); err != nil {
 		d.transactions.GetPending(txID)
 		return nil, err
 	}
@@ -383,126 +731,196 @@ func (d *DHT) findNodeQuery(addr *net.UDPAddr, target NodeID) ([]*NodeInfo, erro
 		if resp == nil {
 			return nil, fmt.Errorf("nil response")
 		}
-		return resp.ExtractNodes(false)
+		return resp.ExtractNodes(addr.IP.To4() == nil)
 	case <-time.After(QueryTimeout):
 		d.transactions.GetPending(txID) // Remove pending
-		return nil, fmt.Errorf("find_node timeout")
+		d.tableFor(addr).Failed(addr)
+		return nil, fmt.Errorf("find_node %w", ErrQueryTimeout)
 	}
 }
 
-// GetPeers searches for peers with the given info hash
+// GetPeers runs an iterative get_peers lookup of infoHash and returns the peers found
+// the tokens of the closest nodes are kept for a subsequent AnnouncePeer
 func (d *DHT) GetPeers(infoHash [20]byte) ([]string, error) {
-	var allPeers []string
-	var mu sync.Mutex
-	seen := make(map[string]bool)
-
-	// Get closest nodes to info_hash
-	closest := d.routingTable.ClosestNodes(NodeID(infoHash), K)
-	if len(closest) == 0 {
+	if d.size() == 0 {
 		return nil, fmt.Errorf("no nodes in routing table")
 	}
+	result := d.getPeersLookup(infoHash)
+	return result.peers, nil
+}
 
-	var wg sync.WaitGroup
-	for _, node := range closest {
-		wg.Go(func() {
-			peers, nodes, err := d.getPeersQuery(node.Addr, infoHash)
-			if err != nil {
-				return
-			}
+// getPeersLookup runs an iterative get_peers lookup of infoHash
+// and records the closest nodes that gave us a token as the targets of our announces
+func (d *DHT) getPeersLookup(infoHash [20]byte) *lookupResult {
+	result := d.lookupAll(NodeID(infoHash), func(node *NodeInfo) (*lookupReply, error) {
+		peers, nodes, token, err := d.getPeersQuery(node.Addr, infoHash)
+		if err != nil {
+			return nil, err
+		}
+		return &lookupReply{nodes: nodes, peers: peers, token: token}, nil
+	})
+	var targets []announceTarget
+	for _, e := range result.closest {
+		if e.token != "" {
+			targets = append(targets, announceTarget{node: e.node, token: e.token})
+		}
+	}
+	d.announceTargets.set(infoHash, targets)
+	return result
+}
 
-			mu.Lock()
-			for _, p := range peers {
-				if !seen[p] {
-					seen[p] = true
-					allPeers = append(allPeers, p)
-				}
-			}
-			mu.Unlock()
+// getPeersQuery sends a single get_peers query
+// returns the peers and the closer nodes of the address family of addr, and the token to announce to the node
+func (d *DHT) getPeersQuery(addr *net.UDPAddr, infoHash [20]byte) ([]string, []*NodeInfo, string, error) {
+	txID := d.transactions.NewTransactionID()
+	query := EncodeGetPeers(txID, d.NodeID(), infoHash, d.config.ReadOnly)
+
+	pq, err := d.transactions.AddPending(txID, MethodGetPeers, addr)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err = d.send(query, addr); err != nil {
+		d.transactions.GetPending(txID)
+		return nil, nil, "", err
+	}
+
+	select {
+	case resp := <-pq.ResponseChan:
+		if resp == nil {
+			return nil, nil, "", fmt.Errorf("nil response")
+		}
+		if resp.Type == ErrorType {
+			return nil, nil, "", resp.Error
+		}
+		token := resp.Response.Str("token")
+
+		// Peers (values) and closer nodes may both be present
+		var peers []string
+		for _, value := range Strings(resp.Response.List("values")) {
+			peers = append(peers, parsePeerList(value)...)
+		}
+		nodes, _ := resp.ExtractNodes(addr.IP.To4() == nil)
+		return peers, nodes, token, nil
 
-			// Add discovered nodes to routing table
-			for _, n := range nodes {
-				d.routingTable.AddNode(n)
+	case <-time.After(QueryTimeout):
+		d.transactions.GetPending(txID) // Remove pending
+		d.tableFor(addr).Failed(addr)
+		return nil, nil, "", fmt.Errorf("get_peers %w", ErrQueryTimeout)
+	}
+}
+
+// AnnouncePeer tells the nodes closest to infoHash that we accept peers for the torrent on port,
+// so that other nodes find us with get_peers; if port is 0, the nodes use the source port
+// of our DHT packets instead (implied_port)
+// the nodes and tokens of a recent GetPeers are reused, otherwise a get_peers lookup finds them
+func (d *DHT) AnnouncePeer(infoHash [20]byte, port int) error {
+	targets := d.announceTargets.get(infoHash)
+	if targets == nil {
+		if d.size() == 0 {
+			return fmt.Errorf("no nodes in routing table")
+		}
+		d.getPeersLookup(infoHash)
+		targets = d.announceTargets.get(infoHash)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no node to announce to")
+	}
+
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Go(func() {
+			if err := d.announcePeerQuery(target.node.Addr, infoHash, port, target.token); err == nil {
+				accepted.Add(1)
 			}
 		})
 	}
 	wg.Wait()
 
-	return allPeers, nil
+	if accepted.Load() == 0 {
+		return fmt.Errorf("no node accepted the announce")
+	}
+	return nil
 }
 
-// getPeersQuery sends a single get_peers query
-func (d *DHT) getPeersQuery(addr *net.UDPAddr, infoHash [20]byte) ([]string, []*NodeInfo, error) {
+// announcePeerQuery sends a single announce_peer query
+func (d *DHT) announcePeerQuery(addr *net.UDPAddr, infoHash [20]byte, port int, token string) error {
 	txID := d.transactions.NewTransactionID()
-	query := EncodeGetPeers(txID, d.ID, infoHash)
+	query := EncodeAnnouncePeer(txID, d.NodeID(), infoHash, port, token, port == 0, d.config.ReadOnly)
 
-	pq := d.transactions.AddPending(txID, MethodGetPeers, addr)
-	_, err := d.conn.WriteToUDP(query, addr)
+	pq, err := d.transactions.AddPending(txID, MethodAnnounce, addr)
 	if err != nil {
+		return err
+	}
+	if err = d.send(query, addr); err != nil {
 		d.transactions.GetPending(txID)
-		return nil, nil, err
+		return err
 	}
 
 	select {
 	case resp := <-pq.ResponseChan:
 		if resp == nil {
-			return nil, nil, fmt.Errorf("nil response")
+			return fmt.Errorf("nil response")
 		}
-
-		// Check for peers (values)
-		if values, ok := resp.Response["values"]; ok {
-			// Parse compact peer list
-			peers := parsePeerList(values)
-			return peers, nil, nil
+		if resp.Type == ErrorType {
+			return resp.Error
 		}
-
-		// No peers, extract nodes
-		nodes, _ := resp.ExtractNodes(false)
-		return nil, nodes, nil
-
+		return nil
 	case <-time.After(QueryTimeout):
 		d.transactions.GetPending(txID) // Remove pending
-		return nil, nil, fmt.Errorf("get_peers timeout")
+		d.tableFor(addr).Failed(addr)
+		return fmt.Errorf("announce_peer %w", ErrQueryTimeout)
 	}
 }
 
 // Bootstrap connects to well-known DHT nodes and waits for initial population
 func (d *DHT) Bootstrap() {
-	log.Printf("DHT: bootstrapping with %d nodes", len(BootstrapNodes))
+	log.Printf("DHT: bootstrapping with %d nodes", len(d.config.BootstrapNodes))
 
+	networks := []string{"udp4"}
+	if d.conn6 != nil {
+		networks = append(networks, "udp6")
+	}
 	var wg sync.WaitGroup
-	for _, addrStr := range BootstrapNodes {
-		addr, err := net.ResolveUDPAddr("udp", addrStr)
-		if err != nil {
-			continue
-		}
-
-		wg.Add(1)
-		go func(a *net.UDPAddr) {
-			defer wg.Done()
-
-			// Ping the bootstrap node
-			resp, err := d.Ping(a)
+	for _, addrStr := range d.config.BootstrapNodes {
+		for _, network := range networks {
+			addr, err := net.ResolveUDPAddr(network, addrStr)
 			if err != nil {
-				return
+				continue
 			}
 
-			// Extract node ID and add to routing table
-			nodeID, err := resp.ExtractNodeID()
-			if err != nil {
-				return
-			}
-			d.routingTable.AddNode(&NodeInfo{
-				ID:       nodeID,
-				Addr:     a,
-				LastSeen: time.Now(),
-			})
+			wg.Add(1)
+			go func(a *net.UDPAddr) {
+				defer wg.Done()
+
+				// Ping the bootstrap node
+				resp, err := d.Ping(a)
+				if err != nil {
+					return
+				}
 
-			// Find nodes close to ourselves
-			d.FindNode(d.ID)
-		}(addr)
+				// Extract node ID and add to routing table
+				nodeID, err := resp.ExtractNodeID()
+				if err != nil {
+					return
+				}
+				now := time.Now()
+				d.tableFor(a).AddNode(&NodeInfo{
+					ID:           nodeID,
+					Addr:         a,
+					LastSeen:     now,
+					LastResponse: now,
+				})
+			}(addr)
+		}
 	}
 	wg.Wait()
-	log.Printf("DHT: bootstrap complete, %d nodes in routing table", d.routingTable.Size())
+
+	// Find nodes close to ourselves, starting from the bootstrap nodes
+	if d.size() > 0 {
+		d.FindNode(d.NodeID())
+	}
+	log.Printf("DHT: bootstrap complete, %d nodes in routing tables", d.size())
 }
 
 // encodeNodes encodes a slice of nodes to compact format
@@ -523,18 +941,10 @@ func (d *DHT) encodeNodes(nodes []*NodeInfo, ipv6 bool) []byte {
 	return buf
 }
 
-// generateToken generates a token for get_peers responses.
-// We don't store tokens since we don't implement announce_peer (read-only DHT).
-func (d *DHT) generateToken() string {
-	token, _ := GenerateToken()
-	return token
-}
-
 // randomIDInBucket generates a random node ID that would fall in the given bucket
 func (d *DHT) randomIDInBucket(bucketIdx int) NodeID {
-	var target NodeID
 	// XOR with self to get desired distance
-	copy(target[:], d.ID[:])
+	target := d.NodeID()
 
 	// Set the bit at position bucketIdx
 	byteIdx := bucketIdx / 8
@@ -544,18 +954,34 @@ func (d *DHT) randomIDInBucket(bucketIdx int) NodeID {
 	return target
 }
 
-// parsePeerList parses compact peer format (6 bytes per peer: 4 IP + 2 port)
+// compactPeer returns the compact form of a peer address: 4 bytes of IP, or 16 for IPv6, and 2 of port
+func compactPeer(ip net.IP, port int) (string, error) {
+	compact := ip.To4()
+	if compact == nil {
+		if compact = ip.To16(); compact == nil {
+			return "", fmt.Errorf("invalid IP address: %s", ip)
+		}
+	}
+	return string(binary.BigEndian.AppendUint16(bytes.Clone(compact), uint16(port))), nil
+}
+
+// parsePeerList parses a compact peer of a values list:
+// 18 bytes for an IPv6 peer (BEP 32), otherwise 6 bytes per IPv4 peer: 4 IP + 2 port
 func parsePeerList(data string) []string {
 	bytes := []byte(data)
-	if len(bytes)%6 != 0 {
+	size := 6
+	if len(bytes) == 18 {
+		size = 18
+	}
+	if len(bytes)%size != 0 {
 		return nil
 	}
 
 	var peers []string
-	for i := 0; i < len(bytes); i += 6 {
-		ip := net.IP(bytes[i : i+4])
-		port := int(bytes[i+4])<<8 | int(bytes[i+5])
-		peers = append(peers, fmt.Sprintf("%s:%d", ip, port))
+	for i := 0; i < len(bytes); i += size {
+		ip := net.IP(bytes[i : i+size-2])
+		port := int(bytes[i+size-2])<<8 | int(bytes[i+size-1])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
 	}
 	return peers
 }
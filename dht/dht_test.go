@@ -2,8 +2,12 @@ package dht
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestGenerateNodeID(t *testing.T) {
@@ -266,6 +270,184 @@ func TestRoutingTableBucketFull(t *testing.T) {
 	}
 }
 
+// fullBucket returns a routing table whose bucket 0 holds K questionable nodes
+func fullBucket(t *testing.T) (*RoutingTable, []*NodeInfo) {
+	t.Helper()
+	self, _ := GenerateNodeID()
+	rt := NewRoutingTable(self)
+	var nodes []*NodeInfo
+	for i := range K {
+		var nodeID NodeID
+		nodeID[0] = self[0] ^ 0x80
+		nodeID[19] = byte(i)
+		node := &NodeInfo{
+			ID:   nodeID,
+			Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i+1)), Port: 6881},
+		}
+		rt.AddNode(node)
+		nodes = append(nodes, node)
+	}
+	return rt, nodes
+}
+
+func TestNodeState(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		node NodeInfo
+		want NodeState
+	}{
+		{"never heard from", NodeInfo{}, NodeQuestionable},
+		{"queried us", NodeInfo{LastSeen: now}, NodeQuestionable},
+		{"responded", NodeInfo{LastSeen: now, LastResponse: now}, NodeGood},
+		{"silent", NodeInfo{LastSeen: now.Add(-GoodNodeTimeout), LastResponse: now.Add(-GoodNodeTimeout)}, NodeQuestionable},
+		{"one failure", NodeInfo{LastSeen: now, LastResponse: now, Failures: 1}, NodeGood},
+		{"failed", NodeInfo{LastSeen: now, LastResponse: now, Failures: MaxNodeFailures}, NodeBad},
+	}
+	for _, tt := range tests {
+		if got := tt.node.State(); got != tt.want {
+			t.Errorf("%s: expected state %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRoutingTableReplacementCache(t *testing.T) {
+	rt, nodes := fullBucket(t)
+
+	var replacementID NodeID
+	replacementID[0] = rt.Self[0] ^ 0x80
+	replacementID[19] = 0xFF
+	replacement := &NodeInfo{ID: replacementID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}
+	if rt.AddNode(replacement) {
+		t.Fatal("Should not have added a node to a full bucket")
+	}
+	if len(rt.Buckets[0].Replacements) != 1 {
+		t.Fatalf("Expected the node in the replacement cache, got %d replacements", len(rt.Buckets[0].Replacements))
+	}
+
+	// One timeout is not enough to replace a node
+	rt.Failed(nodes[3].Addr)
+	if rt.FindNode(nodes[3].ID) == nil {
+		t.Fatal("Node replaced after a single failure")
+	}
+	rt.Failed(nodes[3].Addr)
+	if rt.FindNode(nodes[3].ID) != nil {
+		t.Error("Bad node still in the routing table")
+	}
+	if rt.FindNode(replacementID) == nil {
+		t.Error("Replacement not promoted")
+	}
+	if rt.Size() != K || len(rt.Buckets[0].Replacements) != 0 {
+		t.Errorf("Expected %d nodes and no replacement, got %d and %d", K, rt.Size(), len(rt.Buckets[0].Replacements))
+	}
+
+	// A response resets the failures
+	rt.Failed(nodes[4].Addr)
+	now := time.Now()
+	rt.AddNode(&NodeInfo{ID: nodes[4].ID, Addr: nodes[4].Addr, LastSeen: now, LastResponse: now})
+	if n := rt.FindNode(nodes[4].ID); n.Failures != 0 || n.State() != NodeGood {
+		t.Errorf("Expected a good node, got %d failures", n.Failures)
+	}
+}
+
+func TestRoutingTableBadNodeReplaced(t *testing.T) {
+	rt, nodes := fullBucket(t)
+	rt.Failed(nodes[0].Addr)
+	rt.Failed(nodes[0].Addr) // bad, but nothing to replace it with yet
+
+	var newID NodeID
+	newID[0] = rt.Self[0] ^ 0x80
+	newID[19] = 0xFF
+	if !rt.AddNode(&NodeInfo{ID: newID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}) {
+		t.Fatal("Should have replaced the bad node")
+	}
+	if rt.FindNode(nodes[0].ID) != nil {
+		t.Error("Bad node still in the routing table")
+	}
+	if closest := rt.ClosestNodes(rt.Self, 2*K); len(closest) != K {
+		t.Errorf("Expected %d nodes, got %d", K, len(closest))
+	}
+}
+
+func TestRoutingTableQuestionableEviction(t *testing.T) {
+	rt, nodes := fullBucket(t)
+	if rt.Questionable(nodes[0].ID) != nil {
+		t.Fatal("Nothing to ping without a replacement")
+	}
+
+	var replacementID NodeID
+	replacementID[0] = rt.Self[0] ^ 0x80
+	replacementID[19] = 0xFF
+	rt.AddNode(&NodeInfo{ID: replacementID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+
+	// nodes[0] responded, so nodes[1] is the least recently seen questionable node
+	now := time.Now()
+	rt.AddNode(&NodeInfo{ID: nodes[0].ID, LastSeen: now, LastResponse: now})
+	n := rt.Questionable(replacementID)
+	if n == nil || n.ID != nodes[1].ID {
+		t.Fatalf("Expected node 1 to be pinged, got %v", n)
+	}
+	if next := rt.Questionable(replacementID); next == nil || next.ID != nodes[2].ID {
+		t.Fatalf("Expected node 2 while node 1 is being pinged, got %v", next)
+	}
+	rt.Pinged(nodes[2].ID)
+
+	rt.Evict(n.ID)
+	if rt.FindNode(n.ID) != nil || rt.FindNode(replacementID) == nil {
+		t.Error("Expected the replacement to take the place of the evicted node")
+	}
+}
+
+func TestRoutingTableProbe(t *testing.T) {
+	rt, nodes := fullBucket(t)
+	bucket := rt.startProbe(nodes[0].ID)
+	if bucket == nil {
+		t.Fatal("Expected to start probing the bucket")
+	}
+	if rt.startProbe(nodes[1].ID) != nil {
+		t.Error("Started a second probe of the same bucket")
+	}
+	rt.endProbe(bucket)
+	if rt.startProbe(nodes[1].ID) == nil {
+		t.Error("Expected to probe the bucket again once the first probe ended")
+	}
+}
+
+func TestRoutingTableSplit(t *testing.T) {
+	self, _ := GenerateNodeID()
+	rt := NewRoutingTable(self)
+
+	// K far nodes and K nodes sharing the first bit of self: the bucket holding self splits
+	for i := range 2 * K {
+		var nodeID NodeID
+		nodeID[0] = self[0] ^ 0x80
+		if i >= K {
+			nodeID[0] = self[0] ^ 0x40
+		}
+		nodeID[19] = byte(i)
+		if !rt.AddNode(&NodeInfo{ID: nodeID, Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i+1)), Port: 6881}}) {
+			t.Errorf("Should have added node %d", i)
+		}
+	}
+	if rt.Size() != 2*K {
+		t.Errorf("Expected %d nodes, got %d", 2*K, rt.Size())
+	}
+	if len(rt.Buckets) != 2 || len(rt.Buckets[0].Nodes) != K || len(rt.Buckets[1].Nodes) != K {
+		t.Errorf("Expected 2 full buckets, got %d", len(rt.Buckets))
+	}
+
+	// The far bucket does not split
+	var farID NodeID
+	farID[0] = self[0] ^ 0x80
+	farID[19] = 0xFF
+	if rt.AddNode(&NodeInfo{ID: farID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}) {
+		t.Error("Should not have split a bucket that does not hold our ID")
+	}
+	if len(rt.Buckets) != 2 {
+		t.Errorf("Expected 2 buckets, got %d", len(rt.Buckets))
+	}
+}
+
 func TestNodeInfoString(t *testing.T) {
 	node := &NodeInfo{
 		ID:   NodeID{0xDE, 0xAD, 0xBE, 0xEF, 0xCA, 0xFE, 0xBA, 0xBE},
@@ -301,14 +483,46 @@ func TestDHTGenerateToken(t *testing.T) {
 		t.Fatalf("New() failed: %v", err)
 	}
 
-	token1 := dht.generateToken()
-	token2 := dht.generateToken()
+	ip1 := net.IPv4(192, 168, 1, 1)
+	ip2 := net.IPv4(192, 168, 1, 2)
+	token1 := dht.tokens.generate(ip1)
+	token2 := dht.tokens.generate(ip2)
 
 	if len(token1) == 0 {
 		t.Error("Token should not be empty")
 	}
 	if token1 == token2 {
-		t.Error("Tokens should be unique")
+		t.Error("Tokens of different IPs should differ")
+	}
+	if token1 != dht.tokens.generate(ip1) {
+		t.Error("Tokens of the same IP should be stable")
+	}
+	if !dht.tokens.validate(token1, ip1) {
+		t.Error("Token should be valid for its IP")
+	}
+	if dht.tokens.validate(token1, ip2) {
+		t.Error("Token should not be valid for another IP")
+	}
+}
+
+func TestDHTTokenRotation(t *testing.T) {
+	tm := newTokenManager()
+	ip := net.IPv4(10, 0, 0, 1)
+	token := tm.generate(ip)
+
+	// One rotation: the token of the previous secret is still valid
+	tm.rotated = time.Now().Add(-TokenRotateInterval)
+	if !tm.validate(token, ip) {
+		t.Error("Token should survive one rotation")
+	}
+	if tm.generate(ip) == token {
+		t.Error("Token should change after a rotation")
+	}
+
+	// Two rotations: the token expired
+	tm.rotated = time.Now().Add(-TokenRotateInterval)
+	if tm.validate(token, ip) {
+		t.Error("Token should expire after two rotations")
 	}
 }
 
@@ -354,24 +568,161 @@ func TestDHTPeerStore(t *testing.T) {
 	infoHash := [20]byte{0xDE, 0xAD, 0xBE, 0xEF}
 
 	// Initially empty
-	dht.peerStoreMu.RLock()
-	peers := dht.peerStore[infoHash]
-	dht.peerStoreMu.RUnlock()
-	if len(peers) != 0 {
+	if peers := dht.peers.get(infoHash, false, maxReturnPeers); len(peers) != 0 {
 		t.Error("Peer store should be empty initially")
 	}
 
-	// Add a peer
-	dht.peerStoreMu.Lock()
-	dht.peerStore[infoHash] = []string{"192.168.1.1:6881"}
-	dht.peerStoreMu.Unlock()
-
-	dht.peerStoreMu.RLock()
-	peers = dht.peerStore[infoHash]
-	dht.peerStoreMu.RUnlock()
-	if len(peers) != 1 {
+	// Add a peer, twice
+	peer, _ := compactPeer(net.IPv4(192, 168, 1, 1), 6881)
+	dht.peers.add(infoHash, peer)
+	dht.peers.add(infoHash, peer)
+	if peers := dht.peers.get(infoHash, false, maxReturnPeers); len(peers) != 1 {
 		t.Error("Should have 1 peer")
 	}
+
+	// Expired peers are not returned, and dropped on cleanup
+	dht.peers.peers[infoHash][peer] = time.Now().Add(-PeerExpiry)
+	if peers := dht.peers.get(infoHash, false, maxReturnPeers); len(peers) != 0 {
+		t.Error("Expired peer should not be returned")
+	}
+	dht.peers.cleanup()
+	if len(dht.peers.peers) != 0 {
+		t.Error("Cleanup should drop the info hash without peers")
+	}
+}
+
+// newTestDHT returns a DHT node listening on a random local port
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+	id, err := GenerateNodeID()
+	if err != nil {
+		t.Fatalf("GenerateNodeID failed: %v", err)
+	}
+	return newTestDHTWithID(t, id)
+}
+
+// newTestDHTWithID returns a DHT node with the given ID listening on a random local port
+func newTestDHTWithID(t *testing.T, id NodeID) *DHT {
+	t.Helper()
+	return startTestDHT(t, id, nil)
+}
+
+// newTestDHTWithConfig returns a DHT node configured with cfg listening on a random local port
+func newTestDHTWithConfig(t *testing.T, cfg *Config) *DHT {
+	t.Helper()
+	id, err := GenerateNodeID()
+	if err != nil {
+		t.Fatalf("GenerateNodeID failed: %v", err)
+	}
+	return startTestDHT(t, id, cfg)
+}
+
+// startTestDHT returns a DHT node with the given ID and config listening on a random local port
+func startTestDHT(t *testing.T, id NodeID, cfg *Config) *DHT {
+	t.Helper()
+	d, err := NewWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewWithConfig failed: %v", err)
+	}
+	d.ID = id
+	d.routingTable = NewRoutingTable(id)
+	d.routingTable6 = NewRoutingTable(id)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.conn = conn
+	d.port = conn.LocalAddr().(*net.UDPAddr).Port
+	ctx, cancel := context.WithCancel(context.Background())
+	d.startWorkers(ctx)
+	d.wg.Go(func() { d.readLoop(ctx, conn) })
+	t.Cleanup(func() {
+		cancel()
+		close(d.shutdown)
+		conn.Close()
+		d.wg.Wait()
+	})
+	return d
+}
+
+// newTestDHT6 returns a DHT node listening on random local IPv4 and IPv6 ports
+func newTestDHT6(t *testing.T) *DHT {
+	t.Helper()
+	d := newTestDHT(t)
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %v", err)
+	}
+	d.conn6 = conn6
+	ctx, cancel := context.WithCancel(context.Background())
+	d.wg.Go(func() { d.readLoop(ctx, conn6) })
+	t.Cleanup(func() {
+		cancel()
+		conn6.Close()
+	})
+	return d
+}
+
+func TestDHTAnnouncePeer(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+	infoHash := [20]byte{0xAB}
+
+	if err := a.AnnouncePeer(infoHash, 51413); err != nil {
+		t.Fatalf("AnnouncePeer failed: %v", err)
+	}
+	expected, _ := compactPeer(net.IPv4(127, 0, 0, 1), 51413)
+	if peers := b.peers.get(infoHash, false, maxReturnPeers); len(peers) != 1 || peers[0] != expected {
+		t.Errorf("Expected the announced peer, got %q", peers)
+	}
+
+	// implied_port: the source port of the query is stored
+	if err := a.AnnouncePeer(infoHash, 0); err != nil {
+		t.Fatalf("AnnouncePeer with implied port failed: %v", err)
+	}
+	implied, _ := compactPeer(net.IPv4(127, 0, 0, 1), a.port)
+	if peers := b.peers.get(infoHash, false, maxReturnPeers); !slices.Contains(peers, implied) {
+		t.Errorf("Expected the implied port peer, got %q", peers)
+	}
+}
+
+func TestDHTPingExpired(t *testing.T) {
+	a := newTestDHT(t)
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Ping(silent.LocalAddr().(*net.UDPAddr))
+		errs <- err
+	}()
+	for a.transactions.PendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the cleanup closes the response channel of the query before it times out
+	a.transactions.CleanupExpired(0)
+	if err := <-errs; err == nil {
+		t.Error("Expected an error for an expired ping")
+	}
+}
+
+func TestDHTAnnouncePeerBadToken(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	infoHash := [20]byte{0xAB}
+
+	err := a.announcePeerQuery(b.conn.LocalAddr().(*net.UDPAddr), infoHash, 6881, "forged")
+	if err == nil {
+		t.Error("Expected an error for a forged token")
+	}
+	if peers := b.peers.get(infoHash, false, maxReturnPeers); len(peers) != 0 {
+		t.Errorf("Peer with a forged token should not be stored, got %q", peers)
+	}
 }
 
 func TestParsePeerList(t *testing.T) {
@@ -386,6 +737,21 @@ func TestParsePeerList(t *testing.T) {
 	}
 }
 
+func TestParsePeerListIPv6(t *testing.T) {
+	// [2001:db8::1]:6881, BEP 32
+	peer, err := compactPeer(net.ParseIP("2001:db8::1"), 6881)
+	if err != nil {
+		t.Fatalf("compactPeer failed: %v", err)
+	}
+	if len(peer) != 18 {
+		t.Fatalf("Expected an 18-byte compact peer, got %d bytes", len(peer))
+	}
+	peers := parsePeerList(peer)
+	if len(peers) != 1 || peers[0] != "[2001:db8::1]:6881" {
+		t.Errorf("Expected [2001:db8::1]:6881, got %v", peers)
+	}
+}
+
 func TestParsePeerListMultiple(t *testing.T) {
 	// Create compact peer data: 2 peers
 	data := string([]byte{
@@ -420,3 +786,261 @@ func TestRandomIDInBucket(t *testing.T) {
 		}
 	}
 }
+
+// newTestChain returns DHT nodes that each only know the next one,
+// with IDs closer and closer to 0xFF...
+func newTestChain(t *testing.T, length int) []*DHT {
+	nodes := make([]*DHT, length)
+	for i := range nodes {
+		var id NodeID
+		id[0] = ^byte(0xFF >> i) // 0x00, 0x80, 0xC0...
+		id[19] = 1
+		nodes[i] = newTestDHTWithID(t, id)
+	}
+	for i := range length - 1 {
+		nodes[i].routingTable.AddNode(&NodeInfo{ID: nodes[i+1].ID, Addr: nodes[i+1].conn.LocalAddr().(*net.UDPAddr)})
+	}
+	return nodes
+}
+
+func TestDHTIterativeFindNode(t *testing.T) {
+	chain := newTestChain(t, 4)
+	var target NodeID
+	for i := range target {
+		target[i] = 0xFF
+	}
+
+	closest, err := chain[0].FindNode(target)
+	if err != nil {
+		t.Fatalf("FindNode failed: %v", err)
+	}
+	// the lookup walks the chain up to its last node, the closest to the target
+	if len(closest) != 3 || closest[0].ID != chain[3].ID {
+		t.Errorf("Expected the 3 other nodes, closest first, got %v", closest)
+	}
+	if chain[0].routingTable.FindNode(chain[3].ID) == nil {
+		t.Error("Nodes found by the lookup should be added to the routing table")
+	}
+}
+
+func TestAnnounceTargetsCleanup(t *testing.T) {
+	var at announceTargets
+	at.set([20]byte{1}, []announceTarget{{token: "old"}})
+	at.set([20]byte{2}, []announceTarget{{token: "new"}})
+	at.found[[20]byte{1}] = time.Now().Add(-TokenRotateInterval)
+
+	// the targets whose tokens may have expired are dropped even if never asked for again
+	at.cleanup()
+	if len(at.targets) != 1 || len(at.found) != 1 || at.get([20]byte{2}) == nil {
+		t.Errorf("Expected only the recent targets to be kept, got %d", len(at.targets))
+	}
+}
+
+func TestDHTLookupTokens(t *testing.T) {
+	chain := newTestChain(t, 4)
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xFF
+	}
+
+	if _, err := chain[0].GetPeers(infoHash); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if targets := chain[0].announceTargets.get(infoHash); len(targets) != 3 {
+		t.Fatalf("Expected a token from each of the 3 other nodes, got %d", len(targets))
+	}
+
+	// the announce reaches the node beyond our routing table with the tokens of the lookup
+	if err := chain[0].AnnouncePeer(infoHash, 6881); err != nil {
+		t.Fatalf("AnnouncePeer failed: %v", err)
+	}
+	if peers := chain[3].peers.get(infoHash, false, maxReturnPeers); len(peers) != 1 {
+		t.Errorf("Expected the announce to reach the last node, got %q", peers)
+	}
+
+	// and the announced peer is found by the next lookups, in the values of the responses
+	peers, err := chain[1].GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if !slices.Contains(peers, "127.0.0.1:6881") {
+		t.Errorf("Expected the announced peer, got %v", peers)
+	}
+}
+
+func TestDHTEvictQuestionableResponds(t *testing.T) {
+	a := newTestDHT(t)
+	var id NodeID
+	id[0] = a.ID[0] ^ 0x80
+	b := newTestDHTWithID(t, id)
+
+	// fill the bucket of b with good nodes and b, which never responded to a
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+	now := time.Now()
+	for i := range K - 1 {
+		otherID := id
+		otherID[19] = byte(i + 1)
+		a.routingTable.AddNode(&NodeInfo{ID: otherID, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, LastSeen: now, LastResponse: now})
+	}
+	replacementID := id
+	replacementID[19] = 0xFF
+	a.routingTable.AddNode(&NodeInfo{ID: replacementID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+
+	// b answers the ping and stays
+	a.evictQuestionable(a.routingTable, replacementID)
+	if node := a.routingTable.FindNode(b.ID); node == nil || node.State() != NodeGood {
+		t.Error("Expected b to be a good node after answering")
+	}
+	if a.routingTable.FindNode(replacementID) != nil {
+		t.Error("Replacement promoted while the bucket is good")
+	}
+}
+
+func TestDHTLookupKeepsLearnedNodesOutOfTable(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+
+	learned := &NodeInfo{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+	a.lookup(a.routingTable, b.ID, func(node *NodeInfo) (*lookupReply, error) {
+		if node.ID == b.ID {
+			return &lookupReply{nodes: []*NodeInfo{learned}}, nil
+		}
+		return nil, errors.New("timeout")
+	})
+	if a.routingTable.FindNode(learned.ID) != nil {
+		t.Error("Node added to the routing table before responding")
+	}
+}
+
+func TestDHTEvictQuestionableTooManyPending(t *testing.T) {
+	a := newTestDHTWithConfig(t, &Config{MaxPendingQueries: 1})
+	if _, err := a.transactions.AddPending(a.transactions.NewTransactionID(), MethodPing, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	rt, nodes := fullBucket(t)
+	var replacementID NodeID
+	replacementID[0] = rt.Self[0] ^ 0x80
+	replacementID[19] = 0xFF
+	rt.AddNode(&NodeInfo{ID: replacementID, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+
+	// the ping is never sent, so no node is evicted
+	a.evictQuestionable(rt, replacementID)
+	for _, node := range nodes {
+		if rt.FindNode(node.ID) == nil {
+			t.Errorf("Node %v evicted without a ping timeout", node.ID)
+		}
+	}
+	if rt.Questionable(replacementID) == nil {
+		t.Error("Expected the node to be pingable again")
+	}
+}
+
+func TestDHTLookupSkipsFailedNodes(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	// a node that never answers
+	a.routingTable.AddNode(&NodeInfo{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}})
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+
+	result := a.lookup(a.routingTable, b.ID, func(node *NodeInfo) (*lookupReply, error) {
+		if node.ID == b.ID {
+			return &lookupReply{}, nil
+		}
+		return nil, errors.New("timeout")
+	})
+	if len(result.closest) != 1 || result.closest[0].node.ID != b.ID {
+		t.Errorf("Expected only the responding node, got %v", result.closest)
+	}
+}
+
+func TestDHTWantNodes(t *testing.T) {
+	a := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+	a.routingTable6.AddNode(&NodeInfo{ID: NodeID{2}, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}})
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	findNode := func(want ...string) *Message {
+		t.Helper()
+		args := Dict{
+			"id":     NewString(string(make([]byte, 20))),
+			"target": NewString(string(make([]byte, 20))),
+		}
+		if len(want) > 0 {
+			args["want"] = NewStringList(want)
+		}
+		if _, err := conn.WriteToUDP(encodeQuery("aa", MethodFindNode, args, false), a.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, MaxPacketSize)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("No response: %v", err)
+		}
+		msg, err := DecodeMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		return msg
+	}
+
+	// Without want, the nodes of the address family of the sender: the IPv4 node and the sender itself
+	msg := findNode()
+	if nodes, _ := msg.ExtractNodes(false); len(nodes) != 2 {
+		t.Errorf("Expected 2 IPv4 nodes, got %d", len(nodes))
+	}
+	if _, ok := msg.Response["nodes6"]; ok {
+		t.Error("Unexpected nodes6 without want")
+	}
+
+	msg = findNode("n4", "n6")
+	if nodes, _ := msg.ExtractNodes(false); len(nodes) != 2 {
+		t.Errorf("Expected 2 IPv4 nodes, got %d", len(nodes))
+	}
+	nodes6, err := msg.ExtractNodes(true)
+	if err != nil || len(nodes6) != 1 || nodes6[0].ID != (NodeID{2}) {
+		t.Errorf("Expected the IPv6 node, got %v (%v)", nodes6, err)
+	}
+
+	msg = findNode("n6")
+	if _, ok := msg.Response["nodes"]; ok {
+		t.Error("Unexpected nodes with want n6")
+	}
+}
+
+func TestDHTIPv6(t *testing.T) {
+	a := newTestDHT6(t)
+	b := newTestDHT6(t)
+	a.routingTable6.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn6.LocalAddr().(*net.UDPAddr)})
+	infoHash := [20]byte{0xAB}
+
+	if err := a.AnnouncePeer(infoHash, 51413); err != nil {
+		t.Fatalf("AnnouncePeer failed: %v", err)
+	}
+	if peers := b.peers.get(infoHash, false, maxReturnPeers); len(peers) != 0 {
+		t.Errorf("Expected no IPv4 peer, got %q", peers)
+	}
+	expected, _ := compactPeer(net.IPv6loopback, 51413)
+	if peers := b.peers.get(infoHash, true, maxReturnPeers); len(peers) != 1 || peers[0] != expected {
+		t.Fatalf("Expected the announced IPv6 peer, got %q", peers)
+	}
+
+	// the lookup over IPv6 finds b and the peer
+	c := newTestDHT6(t)
+	c.routingTable6.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn6.LocalAddr().(*net.UDPAddr)})
+	peers, err := c.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if !slices.Contains(peers, "[::1]:51413") {
+		t.Errorf("Expected [::1]:51413, got %v", peers)
+	}
+	if c.routingTable6.FindNode(b.ID) == nil || c.routingTable.Size() != 0 {
+		t.Error("Expected b in the IPv6 routing table only")
+	}
+}
@@ -0,0 +1,320 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Item limits (BEP 44)
+const (
+	MaxItemSize = 1000 // bencoded size of the value of an item
+	MaxSaltSize = 64
+)
+
+// Item is a value stored in the DHT (BEP 44):
+// an immutable item is stored under the SHA-1 of its value,
+// a mutable item under the SHA-1 of its public key and salt, signed with the private key
+type Item struct {
+	Value Value
+	Key   ed25519.PublicKey // nil for an immutable item
+	Salt  string
+	Seq   int
+	Sig   []byte
+}
+
+// ImmutableTarget returns the target of the immutable item holding v
+func ImmutableTarget(v Value) [20]byte {
+	return sha1.Sum(v.Encode())
+}
+
+// MutableTarget returns the target of the mutable items of the public key and salt
+func MutableTarget(key ed25519.PublicKey, salt string) [20]byte {
+	return sha1.Sum(append(bytes.Clone(key), salt...))
+}
+
+// NewMutableItem returns the mutable item holding v with sequence number seq, signed with key
+func NewMutableItem(key ed25519.PrivateKey, salt string, seq int, v Value) *Item {
+	item := &Item{
+		Value: v,
+		Key:   key.Public().(ed25519.PublicKey),
+		Salt:  salt,
+		Seq:   seq,
+	}
+	item.Sig = ed25519.Sign(key, item.signedData())
+	return item
+}
+
+// Target returns the target the item is stored under
+func (it *Item) Target() [20]byte {
+	if it.Key == nil {
+		return ImmutableTarget(it.Value)
+	}
+	return MutableTarget(it.Key, it.Salt)
+}
+
+// signedData returns the data signed by a mutable item: the bencoded salt, seq and v of the put query
+func (it *Item) signedData() []byte {
+	var buf bytes.Buffer
+	if it.Salt != "" {
+		buf.WriteString("4:salt")
+		writeString(&buf, it.Salt)
+	}
+	buf.WriteString("3:seqi")
+	buf.WriteString(strconv.Itoa(it.Seq))
+	buf.WriteString("e1:v")
+	it.Value.encodeTo(&buf)
+	return buf.Bytes()
+}
+
+// Verify returns true if the signature of a mutable item is valid, always true for an immutable item
+func (it *Item) Verify() bool {
+	if it.Key == nil {
+		return true
+	}
+	return len(it.Key) == ed25519.PublicKeySize && ed25519.Verify(it.Key, it.signedData(), it.Sig)
+}
+
+// handleGet answers a get query with the item stored under the target, if any, and the closest nodes
+func (d *DHT) handleGet(msg *Message, addr *net.UDPAddr) []byte {
+	target := msg.Args.Str("target")
+	if len(target) != 20 {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "invalid target")
+	}
+	token := d.tokens.generate(addr.IP)
+	nodes, nodes6 := d.wantedNodes(msg, addr, NodeID([]byte(target)))
+	item := d.items.get([20]byte([]byte(target)))
+	// the querier only wants a mutable item newer than the one it has
+	if seq, ok := msg.Args.Int("seq"); ok && item != nil && item.Key != nil && item.Seq <= seq {
+		item = nil
+	}
+	return EncodeGetResponse(msg.TransactionID, d.NodeID(), token, nodes, nodes6, item, addr)
+}
+
+// handlePut stores the item of a put query and returns the response
+// the token must be one we gave to the IP of the sender in a get response
+func (d *DHT) handlePut(msg *Message, addr *net.UDPAddr) []byte {
+	if !d.tokens.validate(msg.Args.Str("token"), addr.IP) {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "bad token")
+	}
+	v, ok := msg.Args["v"]
+	if !ok {
+		return EncodeError(msg.TransactionID, ErrorProtocol, "missing v")
+	}
+	if len(v.Encode()) > MaxItemSize {
+		return EncodeError(msg.TransactionID, ErrorMessageTooBig, "message (v field) too big")
+	}
+	item := &Item{Value: v}
+	if k := msg.Args.Str("k"); k != "" {
+		if len(k) != ed25519.PublicKeySize {
+			return EncodeError(msg.TransactionID, ErrorProtocol, "invalid k")
+		}
+		item.Key = ed25519.PublicKey(k)
+		if item.Salt = msg.Args.Str("salt"); len(item.Salt) > MaxSaltSize {
+			return EncodeError(msg.TransactionID, ErrorSaltTooBig, "salt (salt field) too big")
+		}
+		if item.Seq, ok = msg.Args.Int("seq"); !ok {
+			return EncodeError(msg.TransactionID, ErrorProtocol, "missing seq")
+		}
+		item.Sig = []byte(msg.Args.Str("sig"))
+		if !item.Verify() {
+			return EncodeError(msg.TransactionID, ErrorInvalidSignature, "invalid signature")
+		}
+	}
+	var cas *int
+	if c, ok := msg.Args.Int("cas"); ok {
+		cas = &c
+	}
+	if err := d.items.put(item, cas); err != nil {
+		return EncodeError(msg.TransactionID, err.Code, err.Message)
+	}
+	return EncodePutResponse(msg.TransactionID, d.NodeID(), addr)
+}
+
+// Get runs an iterative get lookup of target and returns the item stored under it:
+// the immutable item whose value hashes to target, or the mutable item with the highest
+// sequence number and a valid signature; salt is the salt of a mutable item
+func (d *DHT) Get(target [20]byte, salt string) (*Item, error) {
+	if d.size() == 0 {
+		return nil, fmt.Errorf("no nodes in routing table")
+	}
+	_, item := d.getLookup(target, salt)
+	if item == nil {
+		return nil, fmt.Errorf("item not found")
+	}
+	return item, nil
+}
+
+// PutImmutable stores v in the DHT and returns its target
+func (d *DHT) PutImmutable(v Value) ([20]byte, error) {
+	item := &Item{Value: v}
+	target := item.Target()
+	if len(v.Encode()) > MaxItemSize {
+		return target, fmt.Errorf("item of %d bytes, the limit is %d", len(v.Encode()), MaxItemSize)
+	}
+	if d.size() == 0 {
+		return target, fmt.Errorf("no nodes in routing table")
+	}
+	result, _ := d.getLookup(target, "")
+	return target, d.put(result, item, nil)
+}
+
+// PutMutable stores v in the DHT as the mutable item of key and salt and returns the stored item
+// its sequence number follows the one of the item found in the DHT, which the nodes must still hold (CAS)
+func (d *DHT) PutMutable(key ed25519.PrivateKey, salt string, v Value) (*Item, error) {
+	if len(v.Encode()) > MaxItemSize {
+		return nil, fmt.Errorf("item of %d bytes, the limit is %d", len(v.Encode()), MaxItemSize)
+	}
+	if len(salt) > MaxSaltSize {
+		return nil, fmt.Errorf("salt of %d bytes, the limit is %d", len(salt), MaxSaltSize)
+	}
+	if d.size() == 0 {
+		return nil, fmt.Errorf("no nodes in routing table")
+	}
+	target := MutableTarget(key.Public().(ed25519.PublicKey), salt)
+	result, current := d.getLookup(target, salt)
+	seq := 0
+	var cas *int
+	if current != nil {
+		seq = current.Seq + 1
+		cas = &current.Seq
+	}
+	item := NewMutableItem(key, salt, seq, v)
+	return item, d.put(result, item, cas)
+}
+
+// getLookup runs an iterative get lookup of target
+// and returns the lookup result, whose closest nodes hold our tokens, and the item found
+func (d *DHT) getLookup(target [20]byte, salt string) (*lookupResult, *Item) {
+	var mu sync.Mutex
+	var found *Item
+	result := d.lookupAll(NodeID(target), func(node *NodeInfo) (*lookupReply, error) {
+		item, nodes, token, err := d.getQuery(node.Addr, target)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil && item.Key != nil {
+			item.Salt = salt // signed, but not sent back
+		}
+		if item != nil && item.Target() == target && item.Verify() {
+			mu.Lock()
+			if found == nil || item.Seq > found.Seq {
+				found = item
+			}
+			mu.Unlock()
+		}
+		return &lookupReply{nodes: nodes, token: token}, nil
+	})
+	return result, found
+}
+
+// put sends the item to the closest nodes of a get lookup
+func (d *DHT) put(result *lookupResult, item *Item, cas *int) error {
+	var accepted atomic.Int32
+	var mu sync.Mutex
+	var lastErr error
+	var wg sync.WaitGroup
+	for _, e := range result.closest {
+		if e.token == "" {
+			continue
+		}
+		wg.Go(func() {
+			if err := d.putQuery(e.node.Addr, e.token, item, cas); err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			accepted.Add(1)
+		})
+	}
+	wg.Wait()
+
+	if accepted.Load() == 0 {
+		if lastErr != nil {
+			return fmt.Errorf("no node accepted the item: %w", lastErr)
+		}
+		return errors.New("no node to put the item to")
+	}
+	return nil
+}
+
+// getQuery sends a single get query
+// returns the item of the response, unverified, the closer nodes of the address family of addr,
+// and the token to put to the node
+func (d *DHT) getQuery(addr *net.UDPAddr, target [20]byte) (*Item, []*NodeInfo, string, error) {
+	txID := d.transactions.NewTransactionID()
+	query := EncodeGet(txID, d.NodeID(), target, d.config.ReadOnly)
+
+	pq, err := d.transactions.AddPending(txID, MethodGet, addr)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err = d.send(query, addr); err != nil {
+		d.transactions.GetPending(txID)
+		return nil, nil, "", err
+	}
+
+	select {
+	case resp := <-pq.ResponseChan:
+		if resp == nil {
+			return nil, nil, "", fmt.Errorf("nil response")
+		}
+		if resp.Type == ErrorType {
+			return nil, nil, "", resp.Error
+		}
+		var item *Item
+		if v, ok := resp.Response["v"]; ok {
+			item = &Item{Value: v}
+			if k := resp.Response.Str("k"); k != "" {
+				item.Key = ed25519.PublicKey(k)
+				item.Seq, _ = resp.Response.Int("seq")
+				item.Sig = []byte(resp.Response.Str("sig"))
+			}
+		}
+		nodes, _ := resp.ExtractNodes(addr.IP.To4() == nil)
+		return item, nodes, resp.Response.Str("token"), nil
+
+	case <-time.After(QueryTimeout):
+		d.transactions.GetPending(txID) // Remove pending
+		d.tableFor(addr).Failed(addr)
+		return nil, nil, "", fmt.Errorf("get %w", ErrQueryTimeout)
+	}
+}
+
+// putQuery sends a single put query
+func (d *DHT) putQuery(addr *net.UDPAddr, token string, item *Item, cas *int) error {
+	txID := d.transactions.NewTransactionID()
+	query := EncodePut(txID, d.NodeID(), token, item, cas, d.config.ReadOnly)
+
+	pq, err := d.transactions.AddPending(txID, MethodPut, addr)
+	if err != nil {
+		return err
+	}
+	if err = d.send(query, addr); err != nil {
+		d.transactions.GetPending(txID)
+		return err
+	}
+
+	select {
+	case resp := <-pq.ResponseChan:
+		if resp == nil {
+			return fmt.Errorf("nil response")
+		}
+		if resp.Type == ErrorType {
+			return resp.Error
+		}
+		return nil
+	case <-time.After(QueryTimeout):
+		d.transactions.GetPending(txID) // Remove pending
+		d.tableFor(addr).Failed(addr)
+		return fmt.Errorf("put %w", ErrQueryTimeout)
+	}
+}
@@ -0,0 +1,150 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestImmutableTarget(t *testing.T) {
+	// BEP 44 test vector
+	target := ImmutableTarget(NewString("Hello World!"))
+	if got := fmt.Sprintf("%x", target); got != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("Unexpected target %s", got)
+	}
+}
+
+func TestMutableItemSignature(t *testing.T) {
+	// BEP 44: the signature covers the bencoded salt, seq and v
+	item := &Item{Value: NewString("Hello World!"), Key: make(ed25519.PublicKey, ed25519.PublicKeySize), Seq: 1}
+	if got := string(item.signedData()); got != "3:seqi1e1:v12:Hello World!" {
+		t.Errorf("Unexpected signed data %q", got)
+	}
+	item.Salt = "foobar"
+	if got := string(item.signedData()); got != "4:salt6:foobar3:seqi1e1:v12:Hello World!" {
+		t.Errorf("Unexpected signed data with salt %q", got)
+	}
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	item = NewMutableItem(key, "foobar", 1, NewString("Hello World!"))
+	if !item.Verify() {
+		t.Fatal("Expected a valid signature")
+	}
+	if item.Target() != MutableTarget(key.Public().(ed25519.PublicKey), "foobar") {
+		t.Error("Unexpected target")
+	}
+	item.Seq = 2
+	if item.Verify() {
+		t.Error("Expected an invalid signature once seq changed")
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	store := newItemStore()
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	immutable := &Item{Value: NewString("data")}
+	if err := store.put(immutable, nil); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if got := store.get(immutable.Target()); got != immutable {
+		t.Error("Expected the immutable item")
+	}
+
+	first := NewMutableItem(key, "", 1, NewString("first"))
+	if err := store.put(first, nil); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	tests := []struct {
+		name string
+		item *Item
+		cas  *int
+		code int
+	}{
+		{"lower seq", NewMutableItem(key, "", 0, NewString("older")), nil, ErrorSequenceNumberLow},
+		{"same seq, other value", NewMutableItem(key, "", 1, NewString("other")), nil, ErrorSequenceNumberLow},
+		{"cas mismatch", NewMutableItem(key, "", 2, NewString("second")), new(int), ErrorCASMismatch},
+		{"same seq, same value", NewMutableItem(key, "", 1, NewString("first")), nil, 0},
+	}
+	for _, tt := range tests {
+		err := store.put(tt.item, tt.cas)
+		if tt.code == 0 && err != nil || tt.code != 0 && (err == nil || err.Code != tt.code) {
+			t.Errorf("%s: expected error code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+
+	cas := 1
+	second := NewMutableItem(key, "", 2, NewString("second"))
+	if err := store.put(second, &cas); err != nil {
+		t.Fatalf("put with the right cas failed: %v", err)
+	}
+	if got := store.get(first.Target()); got != second {
+		t.Error("Expected the second item")
+	}
+}
+
+func TestDHTPutGet(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	c := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+	c.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+
+	// Immutable item
+	target, err := a.PutImmutable(NewString("Hello World!"))
+	if err != nil {
+		t.Fatalf("PutImmutable failed: %v", err)
+	}
+	item, err := c.Get(target, "")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if item.Value.Str != "Hello World!" {
+		t.Errorf("Expected Hello World!, got %q", item.Value.Str)
+	}
+
+	// Mutable item: the second put follows the sequence number of the first
+	_, key, _ := ed25519.GenerateKey(nil)
+	if item, err = a.PutMutable(key, "nightly", NewString("v1")); err != nil || item.Seq != 0 {
+		t.Fatalf("PutMutable failed: %v", err)
+	}
+	if item, err = a.PutMutable(key, "nightly", NewString("v2")); err != nil || item.Seq != 1 {
+		t.Fatalf("Second PutMutable failed: %v (seq %d)", err, item.Seq)
+	}
+	item, err = c.Get(MutableTarget(key.Public().(ed25519.PublicKey), "nightly"), "nightly")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if item.Value.Str != "v2" || item.Seq != 1 {
+		t.Errorf("Expected v2 with seq 1, got %q with seq %d", item.Value.Str, item.Seq)
+	}
+
+	// Without the salt the item does not verify
+	if _, err := c.Get(MutableTarget(key.Public().(ed25519.PublicKey), "nightly"), ""); err == nil {
+		t.Error("Expected no item without the salt")
+	}
+}
+
+func TestDHTPutInvalidSignature(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	addr := b.conn.LocalAddr().(*net.UDPAddr)
+	_, key, _ := ed25519.GenerateKey(nil)
+	item := NewMutableItem(key, "", 0, NewString("data"))
+
+	_, _, token, err := a.getQuery(addr, item.Target())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	item.Value = NewString("forged")
+	err = a.putQuery(addr, token, item, nil)
+	var krpcErr *Error
+	if !errors.As(err, &krpcErr) || krpcErr.Code != ErrorInvalidSignature {
+		t.Errorf("Expected an invalid signature error, got %v", err)
+	}
+	if b.items.get(item.Target()) != nil {
+		t.Error("Item with an invalid signature should not be stored")
+	}
+}
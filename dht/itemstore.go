@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Item store limits
+const (
+	ItemExpiry     = 2 * time.Hour // items that are not put again for this long are dropped
+	maxStoredItems = 10000         // items stored
+)
+
+// storedItem is an item put to us and the time of its last put
+type storedItem struct {
+	item   *Item
+	stored time.Time
+}
+
+// itemStore holds the items put to us with put (BEP 44), by target
+type itemStore struct {
+	mu    sync.Mutex
+	items map[[20]byte]storedItem
+}
+
+// newItemStore creates an empty item store
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[[20]byte]storedItem)}
+}
+
+// get returns the unexpired item stored under target, nil if there is none
+func (is *itemStore) get(target [20]byte) *Item {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	stored, ok := is.items[target]
+	if !ok || time.Since(stored.stored) >= ItemExpiry {
+		return nil
+	}
+	return stored.item
+}
+
+// put stores an item under its target, the item must have been verified
+// a mutable item only replaces an older one: its sequence number must be higher,
+// or the same with the same value, and match cas if it is not nil
+// returns the KRPC error to answer with if the item is refused
+func (is *itemStore) put(item *Item, cas *int) *Error {
+	target := item.Target()
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	stored, ok := is.items[target]
+	if ok && time.Since(stored.stored) >= ItemExpiry {
+		ok = false
+	}
+	if !ok && len(is.items) >= maxStoredItems {
+		return &Error{Code: ErrorServer, Message: "item store full"}
+	}
+	if ok && item.Key != nil {
+		current := stored.item
+		if cas != nil && *cas != current.Seq {
+			return &Error{Code: ErrorCASMismatch, Message: "CAS mismatch, re-read value and try again"}
+		}
+		if item.Seq < current.Seq || item.Seq == current.Seq && !bytes.Equal(item.Value.Encode(), current.Value.Encode()) {
+			return &Error{Code: ErrorSequenceNumberLow, Message: "sequence number less than current"}
+		}
+	}
+	is.items[target] = storedItem{item: item, stored: time.Now()}
+	return nil
+}
+
+// cleanup drops the expired items
+func (is *itemStore) cleanup() {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for target, stored := range is.items {
+		if time.Since(stored.stored) >= ItemExpiry {
+			delete(is.items, target)
+		}
+	}
+}
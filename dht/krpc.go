@@ -1,13 +1,13 @@
 package dht
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +24,10 @@ const (
 	MethodFindNode = "find_node"
 	MethodGetPeers = "get_peers"
 	MethodAnnounce = "announce_peer"
+	MethodGet      = "get" // BEP 44
+	MethodPut      = "put" // BEP 44
+
+	MethodSampleInfohashes = "sample_infohashes" // BEP 51
 )
 
 // KRPC error codes
@@ -32,6 +36,13 @@ const (
 	ErrorServer        = 202
 	ErrorProtocol      = 203
 	ErrorMethodUnknown = 204
+
+	// BEP 44
+	ErrorMessageTooBig     = 205
+	ErrorInvalidSignature  = 206
+	ErrorSaltTooBig        = 207
+	ErrorCASMismatch       = 301
+	ErrorSequenceNumberLow = 302
 )
 
 // QueryTimeout is the default timeout for KRPC queries
@@ -39,12 +50,24 @@ const QueryTimeout = 15 * time.Second
 
 // Message represents a KRPC message (query, response, or error)
 type Message struct {
-	TransactionID string            // "t" - transaction ID
-	Type          string            // "y" - message type: q, r, or e
-	Query         string            // "q" - query method name (for queries)
-	Args          map[string]string // "a" - query arguments
-	Response      map[string]string // "r" - response values
-	Error         []any             // "e" - error [code, message]
+	TransactionID string // "t" - transaction ID
+	Type          string // "y" - message type: q, r, or e
+	Query         string // "q" - query method name (for queries)
+	Args          Dict   // "a" - query arguments
+	Response      Dict   // "r" - response values
+	Error         *Error // "e" - error [code, message]
+	IP            string // "ip" - compact address of the receiver as seen by the sender (BEP 42)
+	ReadOnly      bool   // "ro" - the sender of the query is a read-only node (BEP 43)
+}
+
+// Error is the error of a KRPC error message
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
 }
 
 // PendingQuery tracks an outgoing query waiting for response
@@ -56,17 +79,37 @@ type PendingQuery struct {
 	ResponseChan  chan *Message
 }
 
+// DefaultMaxPendingQueries is how many queries may wait for a response at once by default
+const DefaultMaxPendingQueries = 1000
+
+// ErrTooManyPending is returned for a query that cannot be sent because too many are waiting for a response
+var ErrTooManyPending = errors.New("too many pending queries")
+
+// ErrQueryTimeout is returned for a query the node did not respond to in time
+var ErrQueryTimeout = errors.New("timeout")
+
 // TransactionManager manages KRPC transaction IDs and pending queries
 type TransactionManager struct {
-	pending map[string]*PendingQuery
-	mu      sync.RWMutex
-	counter uint16
+	pending    map[string]*PendingQuery
+	mu         sync.RWMutex
+	counter    uint16
+	maxPending int
+
+	rejected atomic.Uint64 // queries refused by AddPending
+	expired  atomic.Uint64 // queries dropped by CleanupExpired
 }
 
 // NewTransactionManager creates a new transaction manager
+// that allows DefaultMaxPendingQueries pending queries
 func NewTransactionManager() *TransactionManager {
+	return newTransactionManager(DefaultMaxPendingQueries)
+}
+
+// newTransactionManager creates a new transaction manager that allows maxPending pending queries
+func newTransactionManager(maxPending int) *TransactionManager {
 	return &TransactionManager{
-		pending: make(map[string]*PendingQuery),
+		pending:    make(map[string]*PendingQuery),
+		maxPending: maxPending,
 	}
 }
 
@@ -79,9 +122,14 @@ func (tm *TransactionManager) NewTransactionID() string {
 }
 
 // AddPending registers a pending query
-func (tm *TransactionManager) AddPending(txID, method string, target *net.UDPAddr) *PendingQuery {
+// returns ErrTooManyPending if the maximum number of pending queries is reached
+func (tm *TransactionManager) AddPending(txID, method string, target *net.UDPAddr) (*PendingQuery, error) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	if len(tm.pending) >= tm.maxPending {
+		tm.rejected.Add(1)
+		return nil, ErrTooManyPending
+	}
 	pq := &PendingQuery{
 		TransactionID: txID,
 		Method:        method,
@@ -90,7 +138,7 @@ func (tm *TransactionManager) AddPending(txID, method string, target *net.UDPAdd
 		ResponseChan:  make(chan *Message, 1),
 	}
 	tm.pending[txID] = pq
-	return pq
+	return pq, nil
 }
 
 // GetPending retrieves and removes a pending query
@@ -115,6 +163,7 @@ func (tm *TransactionManager) CleanupExpired(timeout time.Duration) []*PendingQu
 			close(pq.ResponseChan)
 		}
 	}
+	tm.expired.Add(uint64(len(expired)))
 	return expired
 }
 
@@ -126,301 +175,282 @@ func (tm *TransactionManager) PendingCount() int {
 }
 
 // EncodePing creates a ping query message
-func EncodePing(txID string, nodeID NodeID) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": QueryType,
-		"q": MethodPing,
-		"a": map[string]any{
-			"id": string(nodeID[:]),
-		},
-	}
-	return encodeMessage(msg)
+// the query encoders mark the query as coming from a read-only node if readOnly is set (BEP 43)
+func EncodePing(txID string, nodeID NodeID, readOnly bool) []byte {
+	return encodeQuery(txID, MethodPing, Dict{
+		"id": NewString(string(nodeID[:])),
+	}, readOnly)
 }
 
 // EncodePingResponse creates a ping response message
-func EncodePingResponse(txID string, nodeID NodeID) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": ResponseType,
-		"r": map[string]any{
-			"id": string(nodeID[:]),
-		},
-	}
-	return encodeMessage(msg)
+// the response encoders tell the requester at to where we see it, unless to is nil (BEP 42)
+func EncodePingResponse(txID string, nodeID NodeID, to *net.UDPAddr) []byte {
+	return encodeResponse(txID, Dict{
+		"id": NewString(string(nodeID[:])),
+	}, to)
 }
 
 // EncodeFindNode creates a find_node query message
-func EncodeFindNode(txID string, nodeID, target NodeID) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": QueryType,
-		"q": MethodFindNode,
-		"a": map[string]any{
-			"id":     string(nodeID[:]),
-			"target": string(target[:]),
-		},
-	}
-	return encodeMessage(msg)
+func EncodeFindNode(txID string, nodeID, target NodeID, readOnly bool) []byte {
+	return encodeQuery(txID, MethodFindNode, Dict{
+		"id":     NewString(string(nodeID[:])),
+		"target": NewString(string(target[:])),
+	}, readOnly)
 }
 
 // EncodeFindNodeResponse creates a find_node response message
-func EncodeFindNodeResponse(txID string, nodeID NodeID, nodes []byte) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": ResponseType,
-		"r": map[string]any{
-			"id":    string(nodeID[:]),
-			"nodes": string(nodes),
-		},
+// with the IPv4 nodes, the IPv6 nodes (BEP 32) or both; nodes is sent, even empty, if there are no IPv6 nodes
+func EncodeFindNodeResponse(txID string, nodeID NodeID, nodes, nodes6 []byte, to *net.UDPAddr) []byte {
+	response := Dict{"id": NewString(string(nodeID[:]))}
+	addNodes(response, nodes, nodes6)
+	return encodeResponse(txID, response, to)
+}
+
+// addNodes sets the nodes and nodes6 values of a response
+func addNodes(response Dict, nodes, nodes6 []byte) {
+	if len(nodes) > 0 || len(nodes6) == 0 {
+		response["nodes"] = NewString(string(nodes))
+	}
+	if len(nodes6) > 0 {
+		response["nodes6"] = NewString(string(nodes6))
 	}
-	return encodeMessage(msg)
 }
 
 // EncodeGetPeers creates a get_peers query message
-func EncodeGetPeers(txID string, nodeID NodeID, infoHash [20]byte) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": QueryType,
-		"q": MethodGetPeers,
-		"a": map[string]any{
-			"id":        string(nodeID[:]),
-			"info_hash": string(infoHash[:]),
-		},
-	}
-	return encodeMessage(msg)
+func EncodeGetPeers(txID string, nodeID NodeID, infoHash [20]byte, readOnly bool) []byte {
+	return encodeQuery(txID, MethodGetPeers, Dict{
+		"id":        NewString(string(nodeID[:])),
+		"info_hash": NewString(string(infoHash[:])),
+	}, readOnly)
 }
 
 // EncodeGetPeersResponseNodes creates a get_peers response with nodes (no peers found)
-func EncodeGetPeersResponseNodes(txID string, nodeID NodeID, token string, nodes []byte) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": ResponseType,
-		"r": map[string]any{
-			"id":    string(nodeID[:]),
-			"token": token,
-			"nodes": string(nodes),
-		},
+func EncodeGetPeersResponseNodes(txID string, nodeID NodeID, token string, nodes, nodes6 []byte, to *net.UDPAddr) []byte {
+	response := Dict{
+		"id":    NewString(string(nodeID[:])),
+		"token": NewString(token),
 	}
-	return encodeMessage(msg)
+	addNodes(response, nodes, nodes6)
+	return encodeResponse(txID, response, to)
 }
 
-// EncodeGetPeersResponsePeers creates a get_peers response with peers
-func EncodeGetPeersResponsePeers(txID string, nodeID NodeID, token string, peers []string) []byte {
-	peerList := make([]any, len(peers))
-	for i, p := range peers {
-		peerList[i] = p
-	}
-	msg := map[string]any{
-		"t": txID,
-		"y": ResponseType,
-		"r": map[string]any{
-			"id":     string(nodeID[:]),
-			"token":  token,
-			"values": peerList,
-		},
-	}
-	return encodeMessage(msg)
+// EncodeGetPeersResponsePeers creates a get_peers response with peers in compact form
+func EncodeGetPeersResponsePeers(txID string, nodeID NodeID, token string, peers []string, to *net.UDPAddr) []byte {
+	return encodeResponse(txID, Dict{
+		"id":     NewString(string(nodeID[:])),
+		"token":  NewString(token),
+		"values": NewStringList(peers),
+	}, to)
 }
 
-// EncodeError creates an error response message
-func EncodeError(txID string, code int, message string) []byte {
-	msg := map[string]any{
-		"t": txID,
-		"y": ErrorType,
-		"e": []any{code, message},
+// EncodeAnnouncePeer creates an announce_peer query message
+// if impliedPort is set, the receiver uses the source port of the packet instead of port
+func EncodeAnnouncePeer(txID string, nodeID NodeID, infoHash [20]byte, port int, token string, impliedPort, readOnly bool) []byte {
+	args := Dict{
+		"id":        NewString(string(nodeID[:])),
+		"info_hash": NewString(string(infoHash[:])),
+		"port":      NewInt(port),
+		"token":     NewString(token),
+	}
+	if impliedPort {
+		args["implied_port"] = NewInt(1)
 	}
-	return encodeMessage(msg)
+	return encodeQuery(txID, MethodAnnounce, args, readOnly)
 }
 
-// encodeMessage converts a message map to bencoded bytes
-func encodeMessage(msg map[string]any) []byte {
-	return encodeBencode(msg)
+// EncodeAnnouncePeerResponse creates an announce_peer response message
+func EncodeAnnouncePeerResponse(txID string, nodeID NodeID, to *net.UDPAddr) []byte {
+	return EncodePingResponse(txID, nodeID, to)
 }
 
-// encodeBencode encodes a Go value to bencode format
-func encodeBencode(v any) []byte {
-	var buf bytes.Buffer
-	encodeBencodeTo(&buf, v)
-	return buf.Bytes()
+// EncodeGet creates a get query message (BEP 44)
+func EncodeGet(txID string, nodeID NodeID, target [20]byte, readOnly bool) []byte {
+	return encodeQuery(txID, MethodGet, Dict{
+		"id":     NewString(string(nodeID[:])),
+		"target": NewString(string(target[:])),
+	}, readOnly)
 }
 
-func encodeBencodeTo(buf *bytes.Buffer, v any) {
-	switch val := v.(type) {
-	case string:
-		buf.WriteString(fmt.Sprintf("%d:%s", len(val), val))
-	case int:
-		buf.WriteString(fmt.Sprintf("i%de", val))
-	case []any:
-		buf.WriteByte('l')
-		for _, item := range val {
-			encodeBencodeTo(buf, item)
+// EncodeGetResponse creates a get response message with the closest nodes and the item, if any (BEP 44)
+func EncodeGetResponse(txID string, nodeID NodeID, token string, nodes, nodes6 []byte, item *Item, to *net.UDPAddr) []byte {
+	response := Dict{
+		"id":    NewString(string(nodeID[:])),
+		"token": NewString(token),
+	}
+	addNodes(response, nodes, nodes6)
+	if item != nil {
+		response["v"] = item.Value
+		if item.Key != nil {
+			response["k"] = NewString(string(item.Key))
+			response["seq"] = NewInt(item.Seq)
+			response["sig"] = NewString(string(item.Sig))
 		}
-		buf.WriteByte('e')
-	case map[string]any:
-		buf.WriteByte('d')
-		// Keys must be sorted
-		keys := make([]string, 0, len(val))
-		for k := range val {
-			keys = append(keys, k)
+	}
+	return encodeResponse(txID, response, to)
+}
+
+// EncodePut creates a put query message (BEP 44)
+// if cas is not nil, the receiver only replaces a mutable item whose sequence number is *cas
+func EncodePut(txID string, nodeID NodeID, token string, item *Item, cas *int, readOnly bool) []byte {
+	args := Dict{
+		"id":    NewString(string(nodeID[:])),
+		"token": NewString(token),
+		"v":     item.Value,
+	}
+	if item.Key != nil {
+		args["k"] = NewString(string(item.Key))
+		args["seq"] = NewInt(item.Seq)
+		args["sig"] = NewString(string(item.Sig))
+		if item.Salt != "" {
+			args["salt"] = NewString(item.Salt)
 		}
-		sortStringSlice(keys)
-		for _, k := range keys {
-			buf.WriteString(fmt.Sprintf("%d:%s", len(k), k))
-			encodeBencodeTo(buf, val[k])
+		if cas != nil {
+			args["cas"] = NewInt(*cas)
 		}
-		buf.WriteByte('e')
 	}
+	return encodeQuery(txID, MethodPut, args, readOnly)
 }
 
-func sortStringSlice(s []string) {
-	for i := 1; i < len(s); i++ {
-		j := i
-		for j > 0 && s[j] < s[j-1] {
-			s[j], s[j-1] = s[j-1], s[j]
-			j--
-		}
+// EncodePutResponse creates a put response message
+func EncodePutResponse(txID string, nodeID NodeID, to *net.UDPAddr) []byte {
+	return EncodePingResponse(txID, nodeID, to)
+}
+
+// EncodeSampleInfohashes creates a sample_infohashes query message (BEP 51)
+func EncodeSampleInfohashes(txID string, nodeID, target NodeID, readOnly bool) []byte {
+	return encodeQuery(txID, MethodSampleInfohashes, Dict{
+		"id":     NewString(string(nodeID[:])),
+		"target": NewString(string(target[:])),
+	}, readOnly)
+}
+
+// EncodeSampleInfohashesResponse creates a sample_infohashes response message (BEP 51)
+// with the sampled info hashes, the number of info hashes we store,
+// the interval in seconds before the sender may query us again and the closest nodes to the target
+func EncodeSampleInfohashesResponse(txID string, nodeID NodeID, interval, num int, samples [][20]byte, nodes, nodes6 []byte, to *net.UDPAddr) []byte {
+	compact := make([]byte, 0, 20*len(samples))
+	for _, s := range samples {
+		compact = append(compact, s[:]...)
+	}
+	response := Dict{
+		"id":       NewString(string(nodeID[:])),
+		"interval": NewInt(interval),
+		"num":      NewInt(num),
+		"samples":  NewString(string(compact)),
 	}
+	addNodes(response, nodes, nodes6)
+	return encodeResponse(txID, response, to)
+}
+
+// EncodeError creates an error response message
+func EncodeError(txID string, code int, message string) []byte {
+	msg := &Message{
+		TransactionID: txID,
+		Type:          ErrorType,
+		Error:         &Error{Code: code, Message: message},
+	}
+	return msg.Encode()
+}
+
+// encodeQuery creates a query message with the given arguments
+// readOnly marks the query as coming from a read-only node (BEP 43)
+func encodeQuery(txID, method string, args Dict, readOnly bool) []byte {
+	msg := &Message{TransactionID: txID, Type: QueryType, Query: method, Args: args, ReadOnly: readOnly}
+	return msg.Encode()
+}
+
+// encodeResponse creates a response message with the given values
+// to is the address of the requester, sent back so that it learns its external IP (BEP 42), nil to leave it out
+func encodeResponse(txID string, response Dict, to *net.UDPAddr) []byte {
+	msg := &Message{TransactionID: txID, Type: ResponseType, Response: response}
+	if to != nil {
+		msg.IP, _ = compactPeer(to.IP, to.Port)
+	}
+	return msg.Encode()
+}
+
+// Encode returns the bencoded form of the message
+func (m *Message) Encode() []byte {
+	dict := Dict{
+		"t": NewString(m.TransactionID),
+		"y": NewString(m.Type),
+	}
+	if m.Query != "" {
+		dict["q"] = NewString(m.Query)
+	}
+	if m.Args != nil {
+		dict["a"] = NewDict(m.Args)
+	}
+	if m.Response != nil {
+		dict["r"] = NewDict(m.Response)
+	}
+	if m.Error != nil {
+		dict["e"] = NewList(NewInt(m.Error.Code), NewString(m.Error.Message))
+	}
+	if m.IP != "" {
+		dict["ip"] = NewString(m.IP)
+	}
+	if m.ReadOnly {
+		dict["ro"] = NewInt(1)
+	}
+	var buf bytes.Buffer
+	dict.encodeTo(&buf)
+	return buf.Bytes()
 }
 
 // DecodeMessage parses a bencoded KRPC message
+// the arguments and response values keep their types: strings, integers, lists and dictionaries
 func DecodeMessage(data []byte) (*Message, error) {
-	ben, err := decodeBencode(data)
+	ben, err := DecodeValue(data)
 	if err != nil {
 		return nil, err
 	}
-	dict, ok := ben.(map[string]any)
-	if !ok {
+	if ben.Kind != KindDict {
 		return nil, errors.New("KRPC message must be a dictionary")
 	}
+	dict := ben.Dict
 
 	msg := &Message{}
 
 	// Transaction ID
-	if t, ok := dict["t"].(string); ok {
-		msg.TransactionID = t
+	if t, ok := dict["t"]; ok && t.Kind == KindString {
+		msg.TransactionID = t.Str
 	} else {
 		return nil, errors.New("missing transaction ID")
 	}
 
 	// Message type
-	if y, ok := dict["y"].(string); ok {
-		msg.Type = y
+	if y, ok := dict["y"]; ok && y.Kind == KindString {
+		msg.Type = y.Str
 	} else {
 		return nil, errors.New("missing message type")
 	}
 
+	msg.IP = dict.Str("ip")
+	if ro, _ := dict.Int("ro"); ro == 1 {
+		msg.ReadOnly = true
+	}
+
 	switch msg.Type {
 	case QueryType:
-		if q, ok := dict["q"].(string); ok {
-			msg.Query = q
-		}
-		if a, ok := dict["a"].(map[string]any); ok {
-			msg.Args = make(map[string]string)
-			for k, v := range a {
-				if s, ok := v.(string); ok {
-					msg.Args[k] = s
-				}
-			}
-		}
+		msg.Query = dict.Str("q")
+		msg.Args = dict.Dict("a")
 	case ResponseType:
-		if r, ok := dict["r"].(map[string]any); ok {
-			msg.Response = make(map[string]string)
-			for k, v := range r {
-				if s, ok := v.(string); ok {
-					msg.Response[k] = s
-				}
-			}
-		}
+		msg.Response = dict.Dict("r")
 	case ErrorType:
-		if e, ok := dict["e"].([]any); ok {
-			msg.Error = e
+		msg.Error = &Error{}
+		e := dict.List("e")
+		if len(e) > 0 && e[0].Kind == KindInt {
+			msg.Error.Code = e[0].Int
+		}
+		if len(e) > 1 && e[1].Kind == KindString {
+			msg.Error.Message = e[1].Str
 		}
 	}
 
 	return msg, nil
 }
 
-// decodeBencode parses bencoded data into Go values
-func decodeBencode(data []byte) (any, error) {
-	reader := bufio.NewReader(bytes.NewReader(data))
-	return decodeBencodeValue(reader)
-}
-
-func decodeBencodeValue(reader *bufio.Reader) (any, error) {
-	b, err := reader.ReadByte()
-	if err != nil {
-		return nil, err
-	}
-
-	switch b {
-	case 'd':
-		dict := make(map[string]any)
-		for {
-			peek, err := reader.Peek(1)
-			if err != nil {
-				return nil, err
-			}
-			if peek[0] == 'e' {
-				reader.ReadByte()
-				return dict, nil
-			}
-			key, err := decodeBencodeValue(reader)
-			if err != nil {
-				return nil, err
-			}
-			keyStr, ok := key.(string)
-			if !ok {
-				return nil, errors.New("dict key must be string")
-			}
-			val, err := decodeBencodeValue(reader)
-			if err != nil {
-				return nil, err
-			}
-			dict[keyStr] = val
-		}
-	case 'l':
-		var list []any
-		for {
-			peek, err := reader.Peek(1)
-			if err != nil {
-				return nil, err
-			}
-			if peek[0] == 'e' {
-				reader.ReadByte()
-				return list, nil
-			}
-			val, err := decodeBencodeValue(reader)
-			if err != nil {
-				return nil, err
-			}
-			list = append(list, val)
-		}
-	case 'i':
-		numStr, err := reader.ReadString('e')
-		if err != nil {
-			return nil, err
-		}
-		var num int
-		fmt.Sscanf(numStr[:len(numStr)-1], "%d", &num)
-		return num, nil
-	default:
-		reader.UnreadByte()
-		lenStr, err := reader.ReadString(':')
-		if err != nil {
-			return nil, err
-		}
-		var length int
-		fmt.Sscanf(lenStr[:len(lenStr)-1], "%d", &length)
-		buf := make([]byte, length)
-		_, err = reader.Read(buf)
-		if err != nil {
-			return nil, err
-		}
-		return string(buf), nil
-	}
-}
-
 // GenerateToken creates a random token for announce validation (8 hex chars)
 func GenerateToken() (string, error) {
 	return rand.Text()[:8], nil
@@ -431,10 +461,10 @@ func (m *Message) ExtractNodeID() (NodeID, error) {
 	var id NodeID
 	var idStr string
 
-	if m.Type == QueryType && m.Args != nil {
-		idStr = m.Args["id"]
-	} else if m.Type == ResponseType && m.Response != nil {
-		idStr = m.Response["id"]
+	if m.Type == QueryType {
+		idStr = m.Args.Str("id")
+	} else if m.Type == ResponseType {
+		idStr = m.Response.Str("id")
 	}
 
 	if len(idStr) != 20 {
@@ -455,8 +485,8 @@ func (m *Message) ExtractNodes(ipv6 bool) ([]*NodeInfo, error) {
 		key = "nodes6"
 	}
 
-	nodesStr, ok := m.Response[key]
-	if !ok {
+	nodesStr := m.Response.Str(key)
+	if nodesStr == "" {
 		return nil, nil // No nodes in response
 	}
 
@@ -2,14 +2,18 @@ package dht
 
 import (
 	"bytes"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodePing(t *testing.T) {
 	var nodeID NodeID
 	copy(nodeID[:], "abcdefghij0123456789")
 
-	encoded := EncodePing("aa", nodeID)
+	encoded := EncodePing("aa", nodeID, false)
 
 	// Should be a valid bencoded dict
 	if encoded[0] != 'd' || encoded[len(encoded)-1] != 'e' {
@@ -31,20 +35,36 @@ func TestEncodePing(t *testing.T) {
 	if msg.Query != MethodPing {
 		t.Errorf("Expected query 'ping', got '%s'", msg.Query)
 	}
-	if msg.Args["id"] != string(nodeID[:]) {
+	if msg.Args.Str("id") != string(nodeID[:]) {
 		t.Error("Node ID mismatch")
 	}
+	if msg.ReadOnly {
+		t.Error("Query should not be read-only")
+	}
+
+	// A read-only node flags its queries (BEP 43)
+	msg, err = DecodeMessage(EncodePing("aa", nodeID, true))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !msg.ReadOnly {
+		t.Error("Expected a read-only query")
+	}
 }
 
 func TestEncodePingResponse(t *testing.T) {
 	var nodeID NodeID
 	copy(nodeID[:], "abcdefghij0123456789")
 
-	encoded := EncodePingResponse("aa", nodeID)
+	// the requester learns where we see it (BEP 42)
+	encoded := EncodePingResponse("aa", nodeID, &net.UDPAddr{IP: net.IPv4(124, 31, 75, 21), Port: 6881})
 	msg, err := DecodeMessage(encoded)
 	if err != nil {
 		t.Fatalf("Failed to decode: %v", err)
 	}
+	if msg.IP != "\x7c\x1f\x4b\x15\x1a\xe1" {
+		t.Errorf("Unexpected ip %x", msg.IP)
+	}
 
 	if msg.TransactionID != "aa" {
 		t.Errorf("Expected txID 'aa', got '%s'", msg.TransactionID)
@@ -52,7 +72,7 @@ func TestEncodePingResponse(t *testing.T) {
 	if msg.Type != ResponseType {
 		t.Errorf("Expected type 'r', got '%s'", msg.Type)
 	}
-	if msg.Response["id"] != string(nodeID[:]) {
+	if msg.Response.Str("id") != string(nodeID[:]) {
 		t.Error("Node ID mismatch")
 	}
 }
@@ -62,7 +82,7 @@ func TestEncodeFindNode(t *testing.T) {
 	copy(nodeID[:], "abcdefghij0123456789")
 	copy(target[:], "01234567890123456789")
 
-	encoded := EncodeFindNode("bb", nodeID, target)
+	encoded := EncodeFindNode("bb", nodeID, target, false)
 	msg, err := DecodeMessage(encoded)
 	if err != nil {
 		t.Fatalf("Failed to decode: %v", err)
@@ -71,10 +91,10 @@ func TestEncodeFindNode(t *testing.T) {
 	if msg.Query != MethodFindNode {
 		t.Errorf("Expected query 'find_node', got '%s'", msg.Query)
 	}
-	if msg.Args["id"] != string(nodeID[:]) {
+	if msg.Args.Str("id") != string(nodeID[:]) {
 		t.Error("Node ID mismatch")
 	}
-	if msg.Args["target"] != string(target[:]) {
+	if msg.Args.Str("target") != string(target[:]) {
 		t.Error("Target mismatch")
 	}
 }
@@ -85,7 +105,7 @@ func TestEncodeGetPeers(t *testing.T) {
 	copy(nodeID[:], "abcdefghij0123456789")
 	copy(infoHash[:], "01onal34567890123456")
 
-	encoded := EncodeGetPeers("cc", nodeID, infoHash)
+	encoded := EncodeGetPeers("cc", nodeID, infoHash, false)
 	msg, err := DecodeMessage(encoded)
 	if err != nil {
 		t.Fatalf("Failed to decode: %v", err)
@@ -94,7 +114,7 @@ func TestEncodeGetPeers(t *testing.T) {
 	if msg.Query != MethodGetPeers {
 		t.Errorf("Expected query 'get_peers', got '%s'", msg.Query)
 	}
-	if msg.Args["info_hash"] != string(infoHash[:]) {
+	if msg.Args.Str("info_hash") != string(infoHash[:]) {
 		t.Error("Info hash mismatch")
 	}
 }
@@ -109,14 +129,14 @@ func TestEncodeError(t *testing.T) {
 	if msg.Type != ErrorType {
 		t.Errorf("Expected type 'e', got '%s'", msg.Type)
 	}
-	if len(msg.Error) != 2 {
-		t.Fatalf("Expected 2 error elements, got %d", len(msg.Error))
+	if msg.Error == nil {
+		t.Fatal("Expected an error")
 	}
-	if msg.Error[0].(int) != ErrorGeneric {
-		t.Errorf("Expected error code %d, got %v", ErrorGeneric, msg.Error[0])
+	if msg.Error.Code != ErrorGeneric {
+		t.Errorf("Expected error code %d, got %v", ErrorGeneric, msg.Error.Code)
 	}
-	if msg.Error[1].(string) != "test error" {
-		t.Errorf("Expected error message 'test error', got '%v'", msg.Error[1])
+	if msg.Error.Message != "test error" {
+		t.Errorf("Expected error message 'test error', got '%v'", msg.Error.Message)
 	}
 }
 
@@ -131,9 +151,9 @@ func TestTransactionManager(t *testing.T) {
 	}
 
 	// Add pending
-	pq := tm.AddPending(txID1, MethodPing, nil)
-	if pq == nil {
-		t.Fatal("AddPending returned nil")
+	pq, err := tm.AddPending(txID1, MethodPing, nil)
+	if err != nil || pq == nil {
+		t.Fatalf("AddPending failed: %v", err)
 	}
 	if tm.PendingCount() != 1 {
 		t.Errorf("Expected 1 pending, got %d", tm.PendingCount())
@@ -157,6 +177,33 @@ func TestTransactionManager(t *testing.T) {
 	}
 }
 
+func TestTransactionManagerLimits(t *testing.T) {
+	tm := newTransactionManager(2)
+	first, _ := tm.AddPending(tm.NewTransactionID(), MethodPing, nil)
+	tm.AddPending(tm.NewTransactionID(), MethodPing, nil)
+	if _, err := tm.AddPending(tm.NewTransactionID(), MethodPing, nil); err != ErrTooManyPending {
+		t.Fatalf("Expected ErrTooManyPending, got %v", err)
+	}
+	if tm.rejected.Load() != 1 {
+		t.Errorf("Expected 1 rejected query, got %d", tm.rejected.Load())
+	}
+
+	// Expired queries make room, and their waiters get nil
+	first.SentAt = time.Now().Add(-time.Minute)
+	if expired := tm.CleanupExpired(time.Second); len(expired) != 1 || expired[0] != first {
+		t.Fatalf("Expected the first query to expire, got %v", expired)
+	}
+	if resp := <-first.ResponseChan; resp != nil {
+		t.Error("Expected a nil response for an expired query")
+	}
+	if _, err := tm.AddPending(tm.NewTransactionID(), MethodPing, nil); err != nil {
+		t.Errorf("AddPending failed after cleanup: %v", err)
+	}
+	if tm.expired.Load() != 1 {
+		t.Errorf("Expected 1 expired query, got %d", tm.expired.Load())
+	}
+}
+
 func TestDecodeMessage(t *testing.T) {
 	// Real ping query from BEP 5 spec
 	data := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
@@ -180,7 +227,7 @@ func TestExtractNodeID(t *testing.T) {
 	var nodeID NodeID
 	copy(nodeID[:], "abcdefghij0123456789")
 
-	encoded := EncodePing("aa", nodeID)
+	encoded := EncodePing("aa", nodeID, false)
 	msg, _ := DecodeMessage(encoded)
 
 	extracted, err := msg.ExtractNodeID()
@@ -219,9 +266,9 @@ func TestEncodeDecodeRoundTrip(t *testing.T) {
 		name    string
 		encoded []byte
 	}{
-		{"ping", EncodePing("aa", nodeID)},
-		{"ping_response", EncodePingResponse("bb", nodeID)},
-		{"find_node", EncodeFindNode("cc", nodeID, nodeID)},
+		{"ping", EncodePing("aa", nodeID, false)},
+		{"ping_response", EncodePingResponse("bb", nodeID, nil)},
+		{"find_node", EncodeFindNode("cc", nodeID, nodeID, false)},
 		{"error", EncodeError("dd", 201, "error")},
 	}
 
@@ -260,7 +307,7 @@ func TestExtractNodes(t *testing.T) {
 	nodesData[50] = 0x1A
 	nodesData[51] = 0xE2 // port 6882
 
-	encoded := EncodeFindNodeResponse("aa", nodeID, nodesData)
+	encoded := EncodeFindNodeResponse("aa", nodeID, nodesData, nil, nil)
 	msg, err := DecodeMessage(encoded)
 	if err != nil {
 		t.Fatalf("Failed to decode: %v", err)
@@ -285,3 +332,79 @@ func TestExtractNodes(t *testing.T) {
 		t.Errorf("Expected port 6882, got %d", nodes[1].Addr.Port)
 	}
 }
+
+func TestDecodeMessageTypedValues(t *testing.T) {
+	// get_peers response with a list of peers, and a query with an integer and a nested dict
+	var nodeID NodeID
+	peers := []string{"\x0a\x00\x00\x01\x1a\xe1", "\x0a\x00\x00\x02\x1a\xe1"}
+	msg, err := DecodeMessage(EncodeGetPeersResponsePeers("aa", nodeID, "tok", peers, nil))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	values := Strings(msg.Response.List("values"))
+	if len(values) != 2 || values[0] != peers[0] || values[1] != peers[1] {
+		t.Errorf("Expected the peers to be kept, got %q", values)
+	}
+	if msg.Response.Str("token") != "tok" {
+		t.Errorf("Expected token 'tok', got %q", msg.Response.Str("token"))
+	}
+
+	msg, err = DecodeMessage([]byte("d1:ad2:id20:abcdefghij012345678912:implied_porti1e1:vd3:seqi-5eee1:q13:announce_peer1:t2:aa1:y1:qe"))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if implied, ok := msg.Args.Int("implied_port"); !ok || implied != 1 {
+		t.Errorf("Expected implied_port 1, got %d", implied)
+	}
+	if seq, ok := msg.Args.Dict("v").Int("seq"); !ok || seq != -5 {
+		t.Errorf("Expected nested seq -5, got %d", seq)
+	}
+	if msg.Args.Str("implied_port") != "" {
+		t.Error("An integer should not be returned as a string")
+	}
+}
+
+func TestDecodeMessageMalformed(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"le",
+		"d1:t2:aae",                 // missing type
+		"d1:y1:qe",                  // missing transaction ID
+		"d1:t2:aa1:y1:q",            // unterminated dictionary
+		"d1:t99:aa1:y1:qe",          // string past the end
+		"d1:t2:aa1:y1:q1:ai12xee",   // invalid integer
+		"di1ei2ee",                  // non-string key
+		"d1:t-1:1:y1:qe",            // negative length
+		"d1:ad1:ad1:ad1:ad1:ad1:ad", // unterminated nesting
+		strings.Repeat("l", 100) + strings.Repeat("e", 100),
+	} {
+		if _, err := DecodeMessage([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	var nodeID NodeID
+	copy(nodeID[:], "abcdefghij0123456789")
+	f.Add(EncodePing("aa", nodeID, false))
+	f.Add(EncodeFindNodeResponse("bb", nodeID, make([]byte, 26), nil, nil))
+	f.Add(EncodeGetPeersResponsePeers("cc", nodeID, "token", []string{"abcdef"}, nil))
+	f.Add(EncodeAnnouncePeer("dd", nodeID, nodeID, 6881, "token", true, false))
+	f.Add(EncodeError("ee", ErrorProtocol, "bad token"))
+	f.Add([]byte("d1:t2:aa1:y1:q1:ai12xee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			return
+		}
+		// a decoded message survives a round trip
+		again, err := DecodeMessage(msg.Encode())
+		if err != nil {
+			t.Fatalf("Failed to decode the re-encoded message: %v", err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("Round trip changed the message: %+v != %+v", msg, again)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lookup parameters
+const (
+	Alpha            = 3   // queries in flight during a lookup
+	maxLookupQueries = 100 // queries sent by a lookup at most, against nodes feeding us endless closer nodes
+)
+
+// lookupReply is the answer of a node to a query of a lookup
+type lookupReply struct {
+	nodes []*NodeInfo // closer nodes
+	peers []string    // peers of the info hash, get_peers only
+	token string      // token to announce to the node, get_peers only
+}
+
+// lookupQuery sends the query of a lookup to a node
+type lookupQuery func(node *NodeInfo) (*lookupReply, error)
+
+// lookupNode is a node of the shortlist of a lookup
+type lookupNode struct {
+	node      *NodeInfo
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+}
+
+// lookupResult is the outcome of a lookup
+type lookupResult struct {
+	closest []*lookupNode // closest nodes that responded, at most K
+	peers   []string      // peers returned by the nodes, without duplicates
+}
+
+// lookupResponse is the outcome of one query of a lookup
+type lookupResponse struct {
+	entry *lookupNode
+	reply *lookupReply
+	err   error
+}
+
+// lookupAll runs a lookup of target over the routing table of each address family in parallel
+// and merges their results
+func (d *DHT) lookupAll(target NodeID, query lookupQuery) *lookupResult {
+	tables := d.tables()
+	results := make([]*lookupResult, len(tables))
+	var wg sync.WaitGroup
+	for i, rt := range tables {
+		wg.Go(func() { results[i] = d.lookup(rt, target, query) })
+	}
+	wg.Wait()
+
+	merged := &lookupResult{}
+	for _, r := range results {
+		merged.closest = append(merged.closest, r.closest...)
+		merged.peers = append(merged.peers, r.peers...)
+	}
+	return merged
+}
+
+// lookup runs an iterative Kademlia lookup of target over the nodes of rt:
+// the Alpha closest nodes of the shortlist that were not queried yet are queried in parallel,
+// the closer nodes they return are added to the shortlist, and the lookup ends
+// when the K closest nodes of the shortlist have all responded or no node is left to query
+// the returned nodes only reach the routing table once they respond to a query
+func (d *DHT) lookup(rt *RoutingTable, target NodeID, query lookupQuery) *lookupResult {
+	var shortlist []*lookupNode
+	seen := make(map[NodeID]bool)
+	self := d.NodeID()
+	add := func(nodes []*NodeInfo) {
+		for _, n := range nodes {
+			if n.ID == self || seen[n.ID] {
+				continue
+			}
+			seen[n.ID] = true
+			shortlist = append(shortlist, &lookupNode{node: n})
+		}
+		slices.SortFunc(shortlist, func(a, b *lookupNode) int {
+			return compareDistance(a.node.ID, b.node.ID, target)
+		})
+	}
+	add(rt.ClosestNodes(target, K))
+
+	result := &lookupResult{}
+	seenPeers := make(map[string]bool)
+	responses := make(chan lookupResponse)
+	inFlight, sent := 0, 0
+	for {
+		// Query the closest unqueried nodes among the K closest live ones
+		live := 0
+		done := true
+		for _, e := range shortlist {
+			if e.failed {
+				continue
+			}
+			if live++; live > K {
+				break
+			}
+			if !e.responded {
+				done = false
+			}
+			if !e.queried && inFlight < Alpha && sent < maxLookupQueries {
+				e.queried = true
+				inFlight++
+				sent++
+				go func() {
+					reply, err := query(e.node)
+					responses <- lookupResponse{entry: e, reply: reply, err: err}
+				}()
+			}
+		}
+		if done || inFlight == 0 {
+			break
+		}
+
+		resp := <-responses
+		inFlight--
+		if resp.err != nil {
+			resp.entry.failed = true
+			continue
+		}
+		resp.entry.responded = true
+		resp.entry.token = resp.reply.token
+		add(resp.reply.nodes)
+		for _, p := range resp.reply.peers {
+			if !seenPeers[p] {
+				seenPeers[p] = true
+				result.peers = append(result.peers, p)
+			}
+		}
+	}
+
+	// Let the queries still in flight finish in the background
+	if inFlight > 0 {
+		go func() {
+			for range inFlight {
+				<-responses
+			}
+		}()
+	}
+
+	for _, e := range shortlist {
+		if e.responded {
+			result.closest = append(result.closest, e)
+			if len(result.closest) == K {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// announceTarget is a node close to an info hash and the token it gave us to announce to it
+type announceTarget struct {
+	node  *NodeInfo
+	token string
+}
+
+// announceTargets holds the nodes to announce an info hash to, as found by the last get_peers lookup
+type announceTargets struct {
+	mu      sync.Mutex
+	targets map[[20]byte][]announceTarget
+	found   map[[20]byte]time.Time
+}
+
+// set records the nodes to announce infoHash to
+func (at *announceTargets) set(infoHash [20]byte, targets []announceTarget) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.targets == nil {
+		at.targets = make(map[[20]byte][]announceTarget)
+		at.found = make(map[[20]byte]time.Time)
+	}
+	at.targets[infoHash] = targets
+	at.found[infoHash] = time.Now()
+}
+
+// get returns the nodes to announce infoHash to, nil if their tokens may have expired
+// the nodes rotate their secret every 5 minutes or so, and accept the previous one
+func (at *announceTargets) get(infoHash [20]byte) []announceTarget {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if time.Since(at.found[infoHash]) >= TokenRotateInterval {
+		delete(at.targets, infoHash)
+		delete(at.found, infoHash)
+		return nil
+	}
+	return at.targets[infoHash]
+}
+
+// cleanup drops the nodes whose tokens may have expired
+func (at *announceTargets) cleanup() {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	for infoHash, found := range at.found {
+		if time.Since(found) >= TokenRotateInterval {
+			delete(at.targets, infoHash)
+			delete(at.found, infoHash)
+		}
+	}
+}
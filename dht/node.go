@@ -14,9 +14,12 @@ type NodeID [20]byte
 
 // NodeInfo represents a DHT node with its ID and network address
 type NodeInfo struct {
-	ID       NodeID
-	Addr     *net.UDPAddr
-	LastSeen time.Time
+	ID           NodeID
+	Addr         *net.UDPAddr
+	LastSeen     time.Time // last time we heard from the node, zero if we only learned of it from another node
+	LastResponse time.Time // last time the node responded to one of our queries
+	Failures     int       // queries the node failed to respond to since its last response
+	pinging      bool      // the node is being pinged before it gets evicted
 }
 
 // GenerateNodeID creates a random 160-bit node ID
@@ -105,9 +108,8 @@ func ParseCompactIPv4(data []byte) (*NodeInfo, error) {
 	ip := net.IP(data[20:24])
 	port := binary.BigEndian.Uint16(data[24:26])
 	return &NodeInfo{
-		ID:       id,
-		Addr:     &net.UDPAddr{IP: ip, Port: int(port)},
-		LastSeen: time.Now(),
+		ID:   id,
+		Addr: &net.UDPAddr{IP: ip, Port: int(port)},
 	}, nil
 }
 
@@ -121,9 +123,8 @@ func ParseCompactIPv6(data []byte) (*NodeInfo, error) {
 	ip := net.IP(data[20:36])
 	port := binary.BigEndian.Uint16(data[36:38])
 	return &NodeInfo{
-		ID:       id,
-		Addr:     &net.UDPAddr{IP: ip, Port: int(port)},
-		LastSeen: time.Now(),
+		ID:   id,
+		Addr: &net.UDPAddr{IP: ip, Port: int(port)},
 	}, nil
 }
 
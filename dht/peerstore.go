@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Peer store limits
+const (
+	PeerExpiry      = 30 * time.Minute // peers that do not announce again for this long are dropped
+	maxStoredPeers  = 1000             // peers stored per info hash
+	maxReturnPeers  = 50               // peers returned in a get_peers response, to fit in a packet
+	maxStoredHashes = 10000            // info hashes stored
+	maxSamples      = 20               // info hashes returned in a sample_infohashes response (BEP 51)
+	sampleRefresh   = time.Minute      // shortest time we give out the same sample for once the stored info hashes changed
+)
+
+// SampleInterval is how long we give out the same sample of info hashes (BEP 51),
+// the nodes that sampled them must not query us again before
+const SampleInterval = 6 * time.Hour
+
+// peerStore holds the peers announced to us with announce_peer, in compact form
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]time.Time // info hash -> compact peer -> time of the last announce
+
+	samples [][20]byte // info hashes given out in sample_infohashes responses
+	num     int        // info hashes stored when the samples were taken
+	sampled time.Time  // when the samples were taken
+	changed bool       // info hashes were added or dropped since the samples were taken
+}
+
+// newPeerStore creates an empty peer store
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[string]time.Time)}
+}
+
+// add records that the peer announced it has the torrent with the given info hash
+// returns false if the store is full
+func (ps *peerStore) add(infoHash [20]byte, compactPeer string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	peers := ps.peers[infoHash]
+	if peers == nil {
+		if len(ps.peers) >= maxStoredHashes {
+			return false
+		}
+		peers = make(map[string]time.Time)
+		ps.peers[infoHash] = peers
+		ps.changed = true
+	}
+	if _, ok := peers[compactPeer]; !ok && len(peers) >= maxStoredPeers {
+		return false
+	}
+	peers[compactPeer] = time.Now()
+	return true
+}
+
+// get returns at most count random unexpired peers of the torrent with the given info hash,
+// the IPv6 ones if ipv6 is set and the IPv4 ones otherwise
+func (ps *peerStore) get(infoHash [20]byte, ipv6 bool, count int) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var peers []string
+	for peer, announced := range ps.peers[infoHash] {
+		if (len(peer) == 18) == ipv6 && time.Since(announced) < PeerExpiry {
+			peers = append(peers, peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	return peers[:min(len(peers), count)]
+}
+
+// sample returns at most count random info hashes with unexpired peers and the number of info hashes stored
+// the same sample is returned until SampleInterval has passed, unless it is empty,
+// or for sampleRefresh only once the stored info hashes changed
+func (ps *peerStore) sample(count int) ([][20]byte, int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	age := time.Since(ps.sampled)
+	if len(ps.samples) > 0 && age < SampleInterval && (!ps.changed || age < sampleRefresh) {
+		return ps.samples, ps.num
+	}
+	var hashes [][20]byte
+	for infoHash, peers := range ps.peers {
+		for _, announced := range peers {
+			if time.Since(announced) < PeerExpiry {
+				hashes = append(hashes, infoHash)
+				break
+			}
+		}
+	}
+	rand.Shuffle(len(hashes), func(i, j int) {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	})
+	ps.num = len(hashes)
+	ps.samples = hashes[:min(len(hashes), count)]
+	ps.sampled = time.Now()
+	ps.changed = false
+	return ps.samples, ps.num
+}
+
+// cleanup drops the expired peers and the info hashes left without peers
+func (ps *peerStore) cleanup() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for infoHash, peers := range ps.peers {
+		for peer, announced := range peers {
+			if time.Since(announced) >= PeerExpiry {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(ps.peers, infoHash)
+			ps.changed = true
+		}
+	}
+}
@@ -9,9 +9,6 @@ import (
 	"time"
 )
 
-// DefaultNodesFile is the default filename for persisted nodes
-const DefaultNodesFile = ".dht_nodes.json"
-
 // nodeJSON is the JSON representation of a DHT node
 type nodeJSON struct {
 	ID   string `json:"id"`   // hex-encoded node ID
@@ -24,9 +21,13 @@ type nodesFile struct {
 	Nodes   []nodeJSON `json:"nodes"`
 }
 
-// SaveNodes persists the routing table nodes to a JSON file
-func (rt *RoutingTable) SaveNodes(path string) error {
+// SaveNodes persists the nodes of the IPv4 and IPv6 routing tables to a JSON file
+// rt6 may be nil
+func SaveNodes(path string, rt, rt6 *RoutingTable) error {
 	nodes := rt.AllNodes()
+	if rt6 != nil {
+		nodes = append(nodes, rt6.AllNodes()...)
+	}
 	if len(nodes) == 0 {
 		return nil // Nothing to save
 	}
@@ -62,9 +63,10 @@ func (rt *RoutingTable) SaveNodes(path string) error {
 	return nil
 }
 
-// LoadNodes loads nodes from a JSON file and adds them to the routing table
+// LoadNodes loads nodes from a JSON file and adds them to the routing table of their address family
+// the IPv6 nodes are skipped if rt6 is nil
 // Returns the number of nodes loaded
-func (rt *RoutingTable) LoadNodes(path string) (int, error) {
+func LoadNodes(path string, rt, rt6 *RoutingTable) (int, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -85,7 +87,11 @@ func (rt *RoutingTable) LoadNodes(path string) (int, error) {
 		if err != nil {
 			continue // Skip invalid entries
 		}
-		if rt.AddNode(node) {
+		table := rt
+		if node.Addr.IP.To4() == nil {
+			table = rt6
+		}
+		if table != nil && table.AddNode(node) {
 			loaded++
 		}
 	}
@@ -93,6 +99,17 @@ func (rt *RoutingTable) LoadNodes(path string) (int, error) {
 	return loaded, nil
 }
 
+// SaveNodes persists the routing table nodes to a JSON file
+func (rt *RoutingTable) SaveNodes(path string) error {
+	return SaveNodes(path, rt, nil)
+}
+
+// LoadNodes loads the IPv4 nodes of a JSON file and adds them to the routing table
+// Returns the number of nodes loaded
+func (rt *RoutingTable) LoadNodes(path string) (int, error) {
+	return LoadNodes(path, rt, nil)
+}
+
 func parseNodeJSON(n nodeJSON) (*NodeInfo, error) {
 	// Parse node ID from hex
 	var id NodeID
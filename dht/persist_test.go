@@ -21,7 +21,7 @@ func TestSaveLoadNodes(t *testing.T) {
 	nodes := []*NodeInfo{
 		{ID: NodeID{1, 2, 3}, Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6881}},
 		{ID: NodeID{4, 5, 6}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6882}},
-		{ID: NodeID{7, 8, 9}, Addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6883}},
+		{ID: NodeID{7, 8, 9}, Addr: &net.UDPAddr{IP: net.IPv4(172, 16, 0, 1), Port: 6883}},
 	}
 	for _, n := range nodes {
 		rt.AddNode(n)
@@ -62,7 +62,7 @@ func TestLoadNodesNonExistent(t *testing.T) {
 	var selfID NodeID
 	rt := NewRoutingTable(selfID)
 
-	loaded, err := rt.LoadNodes("/nonexistent/path/nodes.json")
+	loaded, err := LoadNodes("/nonexistent/path/nodes.json", rt, nil)
 	if err != nil {
 		t.Errorf("LoadNodes should not error on missing file: %v", err)
 	}
@@ -79,7 +79,7 @@ func TestSaveNodesEmpty(t *testing.T) {
 	rt := NewRoutingTable(selfID)
 
 	// Save empty routing table - should not create file
-	err := rt.SaveNodes(path)
+	err := SaveNodes(path, rt, nil)
 	if err != nil {
 		t.Fatalf("SaveNodes failed: %v", err)
 	}
@@ -103,7 +103,7 @@ func TestLoadNodesInvalidJSON(t *testing.T) {
 	var selfID NodeID
 	rt := NewRoutingTable(selfID)
 
-	_, err = rt.LoadNodes(path)
+	_, err = LoadNodes(path, rt, nil)
 	if err == nil {
 		t.Error("Expected error for invalid JSON")
 	}
@@ -115,30 +115,40 @@ func TestSaveLoadIPv6(t *testing.T) {
 
 	var selfID NodeID
 	rt := NewRoutingTable(selfID)
+	rt6 := NewRoutingTable(selfID)
 
-	// Add IPv6 node
+	// Add an IPv4 and an IPv6 node
 	rt.AddNode(&NodeInfo{
+		ID:   NodeID{0x12, 0x34},
+		Addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6881},
+	})
+	rt6.AddNode(&NodeInfo{
 		ID:   NodeID{0xAB, 0xCD},
 		Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
 	})
 
-	err := rt.SaveNodes(path)
+	err := SaveNodes(path, rt, rt6)
 	if err != nil {
 		t.Fatalf("SaveNodes failed: %v", err)
 	}
 
 	rt2 := NewRoutingTable(selfID)
-	loaded, err := rt2.LoadNodes(path)
+	rt62 := NewRoutingTable(selfID)
+	loaded, err := LoadNodes(path, rt2, rt62)
 	if err != nil {
 		t.Fatalf("LoadNodes failed: %v", err)
 	}
-	if loaded != 1 {
-		t.Fatalf("Expected 1 node, got %d", loaded)
+	if loaded != 2 {
+		t.Fatalf("Expected 2 nodes, got %d", loaded)
 	}
 
-	nodes := rt2.AllNodes()
+	// Each node is back in the table of its address family
+	if rt2.Size() != 1 || rt2.FindNode(NodeID{0x12, 0x34}) == nil {
+		t.Error("Expected the IPv4 node in the IPv4 table")
+	}
+	nodes := rt62.AllNodes()
 	if len(nodes) != 1 {
-		t.Fatal("Expected 1 node in table")
+		t.Fatal("Expected 1 node in the IPv6 table")
 	}
 
 	// Check IPv6 address preserved
@@ -148,4 +158,9 @@ func TestSaveLoadIPv6(t *testing.T) {
 	if nodes[0].Addr.Port != 6881 {
 		t.Errorf("Expected port 6881, got %d", nodes[0].Addr.Port)
 	}
+
+	// Without an IPv6 table, the IPv6 nodes are skipped
+	if loaded, _ := LoadNodes(path, NewRoutingTable(selfID), nil); loaded != 1 {
+		t.Errorf("Expected only the IPv4 node, got %d", loaded)
+	}
 }
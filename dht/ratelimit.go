@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// maxLimitedIPs is how many IPs an ipLimiter tracks at most
+const maxLimitedIPs = 10000
+
+// tokenBucket allows rate events per second on average, in bursts of at most burst events
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full token bucket
+func newTokenBucket(rate, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket and returns true if there was one
+// a nil bucket allows everything
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full returns true if the bucket has filled up again since it was last used
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// ipLimiter rate limits each IP with a token bucket of its own
+type ipLimiter struct {
+	mu      sync.Mutex
+	rate    int
+	burst   int
+	buckets map[string]*tokenBucket // IP -> its bucket
+}
+
+// newIPLimiter creates a limiter that allows each IP rate events per second, in bursts of at most burst events
+func newIPLimiter(rate, burst int) *ipLimiter {
+	return &ipLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of ip and returns true if there was one
+// once maxLimitedIPs are tracked, new IPs are refused until cleanup drops the buckets that filled up again
+// a nil limiter allows everything
+func (l *ipLimiter) allow(ip net.IP, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := string(ip.To16())
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxLimitedIPs {
+			return false
+		}
+		b = newTokenBucket(l.rate, l.burst)
+		b.last = now
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// cleanup drops the buckets that filled up again: their IPs are back to a fresh bucket
+func (l *ipLimiter) cleanup(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	now := b.last
+	if !b.allow(now) || !b.allow(now) {
+		t.Fatal("Expected a burst of 2")
+	}
+	if b.allow(now) {
+		t.Error("Expected the bucket to be empty")
+	}
+	// 10 per second: a token every 100ms, at most 2 saved
+	if !b.allow(now.Add(100*time.Millisecond)) || b.allow(now.Add(100*time.Millisecond)) {
+		t.Error("Expected one token after 100ms")
+	}
+	later := now.Add(time.Hour)
+	if !b.allow(later) || !b.allow(later) || b.allow(later) {
+		t.Error("Expected the bucket to hold at most 2 tokens")
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.allow(now) {
+		t.Error("Expected a nil bucket to allow everything")
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(1, 1)
+	now := time.Now()
+	a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	if !l.allow(a, now) || l.allow(a, now) {
+		t.Error("Expected a single query from a")
+	}
+	if !l.allow(b, now) {
+		t.Error("Expected b to have a bucket of its own")
+	}
+
+	// Buckets that filled up again are dropped
+	l.cleanup(now.Add(500 * time.Millisecond))
+	if len(l.buckets) != 2 {
+		t.Errorf("Expected 2 buckets, got %d", len(l.buckets))
+	}
+	l.cleanup(now.Add(time.Second))
+	if len(l.buckets) != 0 {
+		t.Errorf("Expected no bucket left, got %d", len(l.buckets))
+	}
+
+	var unlimited *ipLimiter
+	if !unlimited.allow(a, now) {
+		t.Error("Expected a nil limiter to allow everything")
+	}
+}
+
+func TestIPLimiterFull(t *testing.T) {
+	l := newIPLimiter(1, 1)
+	now := time.Now()
+	for i := range maxLimitedIPs {
+		l.allow(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), now)
+	}
+	ip := net.IPv4(192, 0, 2, 1)
+	if l.allow(ip, now) {
+		t.Error("Expected a new IP to be refused while the limiter is full")
+	}
+	l.cleanup(now.Add(time.Second))
+	if !l.allow(ip, now.Add(time.Second)) {
+		t.Error("Expected a new IP to be allowed after the cleanup")
+	}
+}
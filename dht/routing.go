@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"net"
 	"sync"
 	"time"
 )
@@ -8,72 +9,338 @@ import (
 // K is the maximum number of nodes per bucket (Kademlia constant)
 const K = 8
 
-// BucketCount is the number of buckets in the routing table (160 bits)
+// BucketCount is the maximum number of buckets in the routing table (160 bits)
 const BucketCount = 160
 
 // BucketRefreshInterval is how often to refresh stale buckets
 const BucketRefreshInterval = 15 * time.Minute
 
+// Node states (BEP 5)
+const (
+	GoodNodeTimeout = 15 * time.Minute // a node we have not heard from for this long is questionable
+	MaxNodeFailures = 2                // a node that failed to respond to this many queries in a row is bad
+)
+
+// NodeState is the state of a node of the routing table (BEP 5)
+type NodeState int
+
+// Node states
+const (
+	NodeGood         NodeState = iota // responded to us and was heard from in the last 15 minutes
+	NodeQuestionable                  // not heard from recently, or never responded to us
+	NodeBad                           // failed to respond to several queries in a row
+)
+
 // Bucket is a k-bucket containing up to K nodes
+// nodes that do not fit wait in the replacement cache until a node of the bucket goes bad
 type Bucket struct {
-	Nodes       []*NodeInfo
-	LastChanged time.Time
+	Nodes        []*NodeInfo // least recently seen first
+	Replacements []*NodeInfo // most recently seen last, at most K
+	LastChanged  time.Time
+	probing      bool // its questionable nodes are being pinged
 }
 
-// RoutingTable is the DHT routing table with 160 k-buckets
+// RoutingTable is the DHT routing table
+// it starts with one bucket covering the whole ID space; the last bucket, the one
+// holding our own ID, is split in two when it is full, up to BucketCount buckets
+// bucket i holds the nodes whose distance to us has i leading zeros, the last one the closer nodes too
 type RoutingTable struct {
 	Self    NodeID
-	Buckets [BucketCount]*Bucket
+	Buckets []*Bucket
 	mu      sync.RWMutex
 }
 
 // NewRoutingTable creates a new routing table for the given node ID
 func NewRoutingTable(self NodeID) *RoutingTable {
-	rt := &RoutingTable{Self: self}
-	for i := range rt.Buckets {
-		rt.Buckets[i] = &Bucket{
-			Nodes:       make([]*NodeInfo, 0, K),
-			LastChanged: time.Now(),
-		}
+	return &RoutingTable{
+		Self:    self,
+		Buckets: []*Bucket{newBucket()},
+	}
+}
+
+// newBucket creates an empty bucket
+func newBucket() *Bucket {
+	return &Bucket{
+		Nodes:       make([]*NodeInfo, 0, K),
+		LastChanged: time.Now(),
 	}
-	return rt
+}
+
+// State returns the state of the node (BEP 5)
+func (n *NodeInfo) State() NodeState {
+	if n.Failures >= MaxNodeFailures {
+		return NodeBad
+	}
+	if !n.LastResponse.IsZero() && time.Since(n.LastSeen) < GoodNodeTimeout {
+		return NodeGood
+	}
+	return NodeQuestionable
+}
+
+// bucketIndex returns the index of the bucket for the given ID
+// must be called with the lock held
+func (rt *RoutingTable) bucketIndex(id NodeID) int {
+	return min(BucketIndex(rt.Self, id), len(rt.Buckets)-1)
 }
 
 // AddNode adds or updates a node in the routing table
-// Returns true if the node was added, false if the bucket was full
+// an existing node is updated with the times we last heard from it
+// a new node replaces a bad node of a full bucket, or splits the bucket holding our own ID;
+// a node with a secure ID (BEP 42) that responded to us replaces a node without one that is not good;
+// otherwise it goes to the replacement cache of the bucket
+// Returns true if the node is in the table, false if the bucket was full
 func (rt *RoutingTable) AddNode(node *NodeInfo) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.add(node)
+}
+
+// SetSelf changes our own ID and sorts the nodes into the buckets of the new ID
+func (rt *RoutingTable) SetSelf(self NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes, replacements []*NodeInfo
+	for _, bucket := range rt.Buckets {
+		nodes = append(nodes, bucket.Nodes...)
+		replacements = append(replacements, bucket.Replacements...)
+	}
+	rt.Self = self
+	rt.Buckets = []*Bucket{newBucket()}
+	for _, n := range append(nodes, replacements...) {
+		rt.add(n)
+	}
+}
+
+// add adds or updates a node in the routing table
+// must be called with the lock held
+func (rt *RoutingTable) add(node *NodeInfo) bool {
 	if node.ID == rt.Self {
 		return false // Don't add ourselves
 	}
 
-	rt.mu.Lock()
-	defer rt.mu.Unlock()
+	for {
+		idx := rt.bucketIndex(node.ID)
+		bucket := rt.Buckets[idx]
 
-	idx := BucketIndex(rt.Self, node.ID)
-	bucket := rt.Buckets[idx]
+		// Check if node already exists - move to end (most recently seen)
+		for i, n := range bucket.Nodes {
+			if n.ID == node.ID {
+				n.update(node)
+				bucket.Nodes = append(bucket.Nodes[:i], bucket.Nodes[i+1:]...)
+				bucket.Nodes = append(bucket.Nodes, n)
+				bucket.LastChanged = time.Now()
+				return true
+			}
+		}
 
-	// Check if node already exists - move to end (most recently seen)
-	for i, n := range bucket.Nodes {
-		if n.ID == node.ID {
-			bucket.Nodes = append(bucket.Nodes[:i], bucket.Nodes[i+1:]...)
-			node.LastSeen = time.Now()
+		// Add new node if bucket not full
+		if len(bucket.Nodes) < K {
 			bucket.Nodes = append(bucket.Nodes, node)
 			bucket.LastChanged = time.Now()
+			bucket.removeReplacement(node.ID)
 			return true
 		}
+
+		// Replace a bad node
+		for i, n := range bucket.Nodes {
+			if n.State() == NodeBad {
+				bucket.Nodes = append(bucket.Nodes[:i], bucket.Nodes[i+1:]...)
+				bucket.Nodes = append(bucket.Nodes, node)
+				bucket.LastChanged = time.Now()
+				bucket.removeReplacement(node.ID)
+				return true
+			}
+		}
+
+		// Split the bucket holding our own ID and try again
+		if idx == len(rt.Buckets)-1 && len(rt.Buckets) < BucketCount {
+			rt.split()
+			continue
+		}
+
+		// Replace the least recently seen node without a secure ID that is not good,
+		// if the new node proved it is reachable by responding to us
+		if node.Secure() && !node.LastResponse.IsZero() {
+			for i, n := range bucket.Nodes {
+				if !n.Secure() && n.State() != NodeGood {
+					bucket.Nodes = append(bucket.Nodes[:i], bucket.Nodes[i+1:]...)
+					bucket.Nodes = append(bucket.Nodes, node)
+					bucket.LastChanged = time.Now()
+					bucket.removeReplacement(node.ID)
+					return true
+				}
+			}
+		}
+
+		bucket.addReplacement(node)
+		return false
+	}
+}
+
+// split splits the last bucket in two: the nodes at its distance stay, the closer ones move to a new bucket
+// must be called with the lock held
+func (rt *RoutingTable) split() {
+	last := rt.Buckets[len(rt.Buckets)-1]
+	next := newBucket()
+	rt.Buckets = append(rt.Buckets, next)
+	idx := len(rt.Buckets) - 2
+
+	var stay []*NodeInfo
+	for _, n := range last.Nodes {
+		if rt.bucketIndex(n.ID) == idx {
+			stay = append(stay, n)
+		} else {
+			next.Nodes = append(next.Nodes, n)
+		}
+	}
+	last.Nodes = stay
+	var stayReplacements []*NodeInfo
+	for _, n := range last.Replacements {
+		if rt.bucketIndex(n.ID) == idx {
+			stayReplacements = append(stayReplacements, n)
+		} else {
+			next.Replacements = append(next.Replacements, n)
+		}
+	}
+	last.Replacements = stayReplacements
+	next.LastChanged = last.LastChanged
+}
+
+// update merges what we learned about a node into n
+func (n *NodeInfo) update(other *NodeInfo) {
+	if other.LastSeen.After(n.LastSeen) {
+		n.LastSeen = other.LastSeen
+	}
+	if other.LastResponse.After(n.LastResponse) {
+		n.LastResponse = other.LastResponse
+		n.Failures = 0
+	}
+}
+
+// addReplacement adds a node to the replacement cache, dropping the oldest one if it is full
+func (b *Bucket) addReplacement(node *NodeInfo) {
+	b.removeReplacement(node.ID)
+	if len(b.Replacements) >= K {
+		b.Replacements = b.Replacements[1:]
+	}
+	b.Replacements = append(b.Replacements, node)
+}
+
+// removeReplacement removes a node from the replacement cache
+func (b *Bucket) removeReplacement(id NodeID) {
+	for i, n := range b.Replacements {
+		if n.ID == id {
+			b.Replacements = append(b.Replacements[:i], b.Replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+// replace removes the node at index i of the bucket and promotes a replacement, if any:
+// the most recent one with a secure ID (BEP 42), or else the most recent one
+func (b *Bucket) replace(i int) {
+	b.Nodes = append(b.Nodes[:i], b.Nodes[i+1:]...)
+	if n := len(b.Replacements); n > 0 {
+		promoted := n - 1
+		for j := n - 1; j >= 0; j-- {
+			if b.Replacements[j].Secure() {
+				promoted = j
+				break
+			}
+		}
+		b.Nodes = append(b.Nodes, b.Replacements[promoted])
+		b.Replacements = append(b.Replacements[:promoted], b.Replacements[promoted+1:]...)
 	}
+	b.LastChanged = time.Now()
+}
 
-	// Add new node if bucket not full
-	if len(bucket.Nodes) < K {
-		node.LastSeen = time.Now()
-		bucket.Nodes = append(bucket.Nodes, node)
-		bucket.LastChanged = time.Now()
-		return true
+// Failed records that the node at addr did not respond to a query
+// a node that becomes bad is replaced by a node of the replacement cache, if there is one
+func (rt *RoutingTable) Failed(addr *net.UDPAddr) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, bucket := range rt.Buckets {
+		for i, n := range bucket.Nodes {
+			if !n.Addr.IP.Equal(addr.IP) || n.Addr.Port != addr.Port {
+				continue
+			}
+			n.Failures++
+			if n.State() == NodeBad && len(bucket.Replacements) > 0 {
+				bucket.replace(i)
+			}
+			return
+		}
 	}
+}
 
-	// Bucket is full - in a full implementation we would ping the oldest node
-	// and replace it if it doesn't respond. For now, just reject.
-	return false
+// Evict removes a node that failed to respond to a ping and promotes a replacement in its place
+func (rt *RoutingTable) Evict(id NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.Buckets[rt.bucketIndex(id)]
+	for i, n := range bucket.Nodes {
+		if n.ID == id {
+			bucket.replace(i)
+			return
+		}
+	}
+}
+
+// Questionable returns the least recently seen questionable node of the bucket of id, nil if none
+// the node is flagged as being pinged until Pinged is called, so it is only returned once
+func (rt *RoutingTable) Questionable(id NodeID) *NodeInfo {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.Buckets[rt.bucketIndex(id)]
+	if len(bucket.Replacements) == 0 {
+		return nil // nothing to replace it with
+	}
+	for _, n := range bucket.Nodes {
+		if !n.pinging && n.State() == NodeQuestionable {
+			n.pinging = true
+			copied := *n
+			return &copied
+		}
+	}
+	return nil
+}
+
+// startProbe flags the bucket of id as having its questionable nodes pinged
+// returns the bucket, or nil if it is already flagged
+func (rt *RoutingTable) startProbe(id NodeID) *Bucket {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.Buckets[rt.bucketIndex(id)]
+	if bucket.probing {
+		return nil
+	}
+	bucket.probing = true
+	return bucket
+}
+
+// endProbe clears the flag set by startProbe
+func (rt *RoutingTable) endProbe(bucket *Bucket) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bucket.probing = false
+}
+
+// Pinged clears the pinging flag set by Questionable
+func (rt *RoutingTable) Pinged(id NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, n := range rt.Buckets[rt.bucketIndex(id)].Nodes {
+		if n.ID == id {
+			n.pinging = false
+			return
+		}
+	}
 }
 
 // RemoveNode removes a node from the routing table
@@ -81,8 +348,7 @@ func (rt *RoutingTable) RemoveNode(id NodeID) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
-	idx := BucketIndex(rt.Self, id)
-	bucket := rt.Buckets[idx]
+	bucket := rt.Buckets[rt.bucketIndex(id)]
 
 	for i, n := range bucket.Nodes {
 		if n.ID == id {
@@ -93,23 +359,23 @@ func (rt *RoutingTable) RemoveNode(id NodeID) {
 	}
 }
 
-// FindNode returns the node with the given ID if it exists
+// FindNode returns a copy of the node with the given ID if it exists
 func (rt *RoutingTable) FindNode(id NodeID) *NodeInfo {
 	rt.mu.RLock()
 	defer rt.mu.RUnlock()
 
-	idx := BucketIndex(rt.Self, id)
-	bucket := rt.Buckets[idx]
+	bucket := rt.Buckets[rt.bucketIndex(id)]
 
 	for _, n := range bucket.Nodes {
 		if n.ID == id {
-			return n
+			copied := *n
+			return &copied
 		}
 	}
 	return nil
 }
 
-// ClosestNodes returns up to count nodes closest to the target ID
+// ClosestNodes returns up to count nodes closest to the target ID, skipping the bad ones
 func (rt *RoutingTable) ClosestNodes(target NodeID, count int) []*NodeInfo {
 	rt.mu.RLock()
 	defer rt.mu.RUnlock()
@@ -117,7 +383,12 @@ func (rt *RoutingTable) ClosestNodes(target NodeID, count int) []*NodeInfo {
 	// Collect all nodes
 	var all []*NodeInfo
 	for _, bucket := range rt.Buckets {
-		all = append(all, bucket.Nodes...)
+		for _, n := range bucket.Nodes {
+			if n.State() != NodeBad {
+				copied := *n
+				all = append(all, &copied)
+			}
+		}
 	}
 
 	// Sort by XOR distance to target
@@ -168,14 +439,17 @@ func (rt *RoutingTable) Size() int {
 	return count
 }
 
-// AllNodes returns all nodes in the routing table
+// AllNodes returns a copy of all nodes in the routing table
 func (rt *RoutingTable) AllNodes() []*NodeInfo {
 	rt.mu.RLock()
 	defer rt.mu.RUnlock()
 
 	var all []*NodeInfo
 	for _, bucket := range rt.Buckets {
-		all = append(all, bucket.Nodes...)
+		for _, n := range bucket.Nodes {
+			copied := *n
+			all = append(all, &copied)
+		}
 	}
 	return all
 }
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"net"
+	"slices"
+	"sync"
+)
+
+// minIPVotes is how many nodes must report the same external IP before we trust it
+const minIPVotes = 3
+
+// maxIPVotes is how many of the latest external IPs reported to us are tallied
+const maxIPVotes = 32
+
+// BEP 42 masks of the bits of the IP that make up the node ID
+var (
+	ipv4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+	ipv6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// GenerateSecureNodeID creates a node ID derived from our external IP (BEP 42),
+// so that other nodes can check we did not choose where we sit in the ID space
+func GenerateSecureNodeID(ip net.IP) (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	crc := ipCRC(ip, id[19]&0x7)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	return id, nil
+}
+
+// ValidNodeID returns true if id was derived from ip (BEP 42)
+// nodes on local networks are exempt, as they have no external IP to derive their ID from
+func ValidNodeID(id NodeID, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if isLocalIP(ip) {
+		return true
+	}
+	crc := ipCRC(ip, id[19]&0x7)
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// ipCRC returns the CRC32-C of the masked IP with the 3 random bits r, the ID prefix of BEP 42
+func ipCRC(ip net.IP, r byte) uint32 {
+	mask := ipv4Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		mask = ipv6Mask
+	}
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= r << 5
+	return crc32.Checksum(masked, crc32c)
+}
+
+// isLocalIP returns true for the loopback, private and link-local addresses exempt from BEP 42
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// compactIP returns the IP of a compact address, nil if it is not 6 or 18 bytes long
+func compactIP(compact string) net.IP {
+	if len(compact) != 6 && len(compact) != 18 {
+		return nil
+	}
+	return net.IP(compact[:len(compact)-2])
+}
+
+// Secure returns true if the ID of the node was derived from its IP (BEP 42)
+func (n *NodeInfo) Secure() bool {
+	return n.Addr != nil && ValidNodeID(n.ID, n.Addr.IP)
+}
+
+// externalIP learns our external IPv4 address from the ip field of the responses to our queries (BEP 42)
+type externalIP struct {
+	mu    sync.Mutex
+	votes []ipVote // most recent last, at most maxIPVotes and one per voter
+	ip    net.IP
+}
+
+// ipVote is the external IP reported by a node
+type ipVote struct {
+	ip    string
+	voter string
+}
+
+// vote records that the node at voter sees us at ip; only the last maxIPVotes votes are tallied
+// returns our external IP and true when enough nodes agree on a new one:
+// more nodes than for any other IP for the first one, a majority of the votes to change it
+func (e *externalIP) vote(ip, voter net.IP) (net.IP, bool) {
+	if ip.To4() == nil || isLocalIP(ip) || !ip.IsGlobalUnicast() {
+		return nil, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key, from := ip.String(), voter.String()
+	// a node only counts once, for the IP it reported last
+	e.votes = slices.DeleteFunc(e.votes, func(v ipVote) bool { return v.voter == from })
+	if len(e.votes) >= maxIPVotes {
+		e.votes = slices.Delete(e.votes, 0, 1)
+	}
+	e.votes = append(e.votes, ipVote{ip: key, voter: from})
+	if ip.Equal(e.ip) {
+		return nil, false
+	}
+
+	tally := make(map[string]int)
+	for _, v := range e.votes {
+		tally[v.ip]++
+	}
+	if tally[key] < minIPVotes {
+		return nil, false
+	}
+	if e.ip == nil {
+		for other, n := range tally {
+			if other != key && n >= tally[key] {
+				return nil, false
+			}
+		}
+	} else if 2*tally[key] <= len(e.votes) {
+		return nil, false
+	}
+	e.ip = ip
+	return ip, true
+}
+
+// get returns our external IP, nil if we have not learned it yet
+func (e *externalIP) get() net.IP {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ip
+}
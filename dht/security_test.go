@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// BEP 42 test vectors
+var secureIDVectors = []struct {
+	ip string
+	id string
+}{
+	{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func TestValidNodeID(t *testing.T) {
+	for _, v := range secureIDVectors {
+		var id NodeID
+		hex.Decode(id[:], []byte(v.id))
+		if !ValidNodeID(id, net.ParseIP(v.ip)) {
+			t.Errorf("%s: expected %s to be valid", v.ip, v.id)
+		}
+		id[1] ^= 0x01
+		if ValidNodeID(id, net.ParseIP(v.ip)) {
+			t.Errorf("%s: expected a modified ID to be invalid", v.ip)
+		}
+	}
+
+	// Local addresses are exempt
+	var id NodeID
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "172.16.0.1", "169.254.1.1", "::1"} {
+		if !ValidNodeID(id, net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be exempt", ip)
+		}
+	}
+	if ValidNodeID(id, nil) {
+		t.Error("Expected an ID without IP to be invalid")
+	}
+}
+
+func TestGenerateSecureNodeID(t *testing.T) {
+	for _, ip := range []string{"124.31.75.21", "2001:db8::1"} {
+		id, err := GenerateSecureNodeID(net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("GenerateSecureNodeID failed: %v", err)
+		}
+		if !ValidNodeID(id, net.ParseIP(ip)) {
+			t.Errorf("%s: generated ID %x is not valid", ip, id)
+		}
+		if ValidNodeID(id, net.ParseIP("21.75.31.124")) {
+			t.Errorf("%s: generated ID %x valid for another IP", ip, id)
+		}
+	}
+}
+
+func TestExternalIPVote(t *testing.T) {
+	var e externalIP
+	ip := net.ParseIP("124.31.75.21")
+
+	// Local addresses are not our external IP
+	for i := range minIPVotes {
+		if _, ok := e.vote(net.ParseIP("192.168.1.1"), net.IPv4(1, 1, 1, byte(i))); ok {
+			t.Fatal("Local IP adopted")
+		}
+	}
+
+	// The same node voting twice counts once
+	e.vote(ip, net.IPv4(1, 1, 1, 1))
+	e.vote(ip, net.IPv4(1, 1, 1, 1))
+	e.vote(ip, net.IPv4(1, 1, 1, 2))
+	if e.get() != nil {
+		t.Fatal("IP adopted before enough votes")
+	}
+	got, ok := e.vote(ip, net.IPv4(1, 1, 1, 3))
+	if !ok || !got.Equal(ip) || !e.get().Equal(ip) {
+		t.Fatalf("Expected %s to be adopted, got %s", ip, got)
+	}
+	if _, ok := e.vote(ip, net.IPv4(1, 1, 1, 4)); ok {
+		t.Error("Same IP adopted twice")
+	}
+
+	// Another IP needs a majority of the votes to replace it
+	other := net.ParseIP("124.31.75.22")
+	for i := range 4 {
+		if _, ok := e.vote(other, net.IPv4(2, 2, 2, byte(i))); ok {
+			t.Fatalf("IP changed with %d votes against 4", i+1)
+		}
+	}
+	if got, ok := e.vote(other, net.IPv4(2, 2, 2, 4)); !ok || !got.Equal(other) {
+		t.Fatalf("Expected %s to be adopted, got %s", other, got)
+	}
+
+	// Only the latest votes are tallied
+	for i := range 2 * maxIPVotes {
+		e.vote(ip, net.IPv4(3, 3, 3, byte(i)))
+	}
+	if len(e.votes) != maxIPVotes || !e.get().Equal(ip) {
+		t.Errorf("Expected %d votes for %s, got %d for %s", maxIPVotes, ip, len(e.votes), e.get())
+	}
+}
+
+func TestRoutingTablePrefersSecureNodes(t *testing.T) {
+	rt, nodes := fullBucket(t)
+	insecureIP := net.ParseIP("21.75.31.124")
+	var insecureID NodeID
+	insecureID[0] = rt.Self[0] ^ 0x80
+	insecureID[19] = 0xFE
+
+	// Make the first node insecure: its ID was not derived from its IP
+	rt.RemoveNode(nodes[0].ID)
+	rt.AddNode(&NodeInfo{ID: insecureID, Addr: &net.UDPAddr{IP: insecureIP, Port: 6881}})
+
+	// An insecure node waits in the replacement cache
+	insecure2 := insecureID
+	insecure2[19] = 0xFD
+	if rt.AddNode(&NodeInfo{ID: insecure2, Addr: &net.UDPAddr{IP: insecureIP, Port: 6882}}) {
+		t.Fatal("Insecure node should not replace another node")
+	}
+
+	// A secure node takes the place of the insecure one
+	ip := net.ParseIP("124.31.75.21")
+	secureID, _ := GenerateSecureNodeID(ip)
+	for BucketIndex(rt.Self, secureID) != 0 {
+		secureID, _ = GenerateSecureNodeID(ip)
+	}
+	secure := &NodeInfo{ID: secureID, Addr: &net.UDPAddr{IP: ip, Port: 6881}}
+	// only once it responded to us
+	if rt.AddNode(secure) {
+		t.Fatal("Secure node that never responded should not replace another node")
+	}
+	secure.LastSeen, secure.LastResponse = time.Now(), time.Now()
+	if !rt.AddNode(secure) {
+		t.Fatal("Secure node should replace the insecure one")
+	}
+	if rt.FindNode(insecureID) != nil || rt.FindNode(secureID) == nil {
+		t.Error("Expected the secure node in place of the insecure one")
+	}
+
+	// A good node is never replaced
+	rt.RemoveNode(secureID)
+	rt.AddNode(&NodeInfo{ID: insecureID, Addr: &net.UDPAddr{IP: insecureIP, Port: 6881}, LastSeen: time.Now(), LastResponse: time.Now()})
+	if rt.AddNode(secure) || rt.FindNode(insecureID) == nil {
+		t.Error("Secure node should not replace a good node")
+	}
+}
+
+func TestRoutingTableSetSelf(t *testing.T) {
+	rt, nodes := fullBucket(t)
+	rt.SetSelf(nodes[0].ID)
+
+	// Every node but our new self is kept
+	if rt.Self != nodes[0].ID || rt.Size() != K-1 {
+		t.Errorf("Expected %d nodes, got %d", K-1, rt.Size())
+	}
+	if rt.FindNode(nodes[0].ID) != nil {
+		t.Error("Our own ID should not be in the routing table")
+	}
+	for _, n := range nodes[1:] {
+		if rt.FindNode(n.ID) == nil {
+			t.Errorf("Node %x lost", n.ID)
+		}
+	}
+}
+
+func TestDHTExternalIP(t *testing.T) {
+	a := newTestDHT(t)
+	b := newTestDHT(t)
+	a.routingTable.AddNode(&NodeInfo{ID: b.ID, Addr: b.conn.LocalAddr().(*net.UDPAddr)})
+
+	// b reports where it sees us in its responses
+	resp, err := a.Ping(b.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	expected, _ := compactPeer(net.IPv4(127, 0, 0, 1), a.port)
+	if resp.IP != expected {
+		t.Errorf("Expected ip %x, got %x", expected, resp.IP)
+	}
+
+	// Learning our external IP gives us a secure ID and keeps our nodes
+	ip := net.ParseIP("124.31.75.21")
+	a.setExternalIP(ip)
+	if !ValidNodeID(a.NodeID(), ip) {
+		t.Errorf("Expected a secure node ID, got %x", a.NodeID())
+	}
+	if a.routingTable.Self != a.NodeID() || a.routingTable.FindNode(b.ID) == nil {
+		t.Error("Expected the routing table to follow the new ID")
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenRotateInterval is how often the token secret changes
+// tokens of the previous secret are still accepted, so a token is valid for 5 to 10 minutes
+const TokenRotateInterval = 5 * time.Minute
+
+// tokenSize is the length in bytes of the tokens we give out
+const tokenSize = 8
+
+// tokenManager gives out the tokens of get_peers responses and checks them in announce_peer queries (BEP 5):
+// a token is derived from the IP of the requester and a secret that rotates every TokenRotateInterval
+type tokenManager struct {
+	mu       sync.Mutex
+	secret   [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+// newTokenManager creates a token manager with a random secret
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{rotated: time.Now()}
+	rand.Read(tm.secret[:])
+	rand.Read(tm.previous[:])
+	return tm
+}
+
+// generate returns the token of the node at ip
+func (tm *tokenManager) generate(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate(time.Now())
+	return tokenFor(tm.secret, ip)
+}
+
+// validate returns true if token was given to the node at ip by one of the last two secrets
+func (tm *tokenManager) validate(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotate(time.Now())
+	return hmac.Equal([]byte(token), []byte(tokenFor(tm.secret, ip))) ||
+		hmac.Equal([]byte(token), []byte(tokenFor(tm.previous, ip)))
+}
+
+// rotate replaces the secret if it is older than TokenRotateInterval
+// must be called with the lock held
+func (tm *tokenManager) rotate(now time.Time) {
+	if now.Sub(tm.rotated) < TokenRotateInterval {
+		return
+	}
+	tm.previous = tm.secret
+	rand.Read(tm.secret[:])
+	tm.rotated = now
+}
+
+// tokenFor returns the token of ip under secret
+func tokenFor(secret [20]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip)
+	return string(mac.Sum(nil)[:tokenSize])
+}
@@ -0,0 +1,206 @@
+package torrent
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Announce timings
+const (
+	defaultAnnounceInterval = 30 * time.Minute // used when a tracker does not give an interval
+	minAnnounceInterval     = time.Minute      // never announce more often than this
+	announceRetryInterval   = time.Minute      // first wait after a failed announce, doubles on each failure
+	announceRetries         = 3                // UDP attempts of a regular announce
+	dhtAnnounceInterval     = 15 * time.Minute // how often a torrent is announced on the DHT
+	scrapeInterval          = 30 * time.Minute // how often the trackers are scraped for the state of the swarm
+	stopTimeout             = 5 * time.Second  // longest wait for the trackers to be told we stopped
+)
+
+// announceStats returns the counters reported to the trackers
+type announceStats func() (uploaded, downloaded, left int64)
+
+// announcer announces a torrent to its trackers for as long as it is active:
+// a started event first, regular announces at the interval asked by the tracker,
+// a completed event when the download completes and a stopped event when it stops
+// the trackers are tried in the order of their tiers (BEP 12)
+type announcer struct {
+	tiers    *trackerTiers
+	hash     [20]byte
+	clientID [20]byte
+	port     int
+	stats    announceStats
+	onPeers  func(peers []string) // receives the peers returned by the trackers
+	onScrape func(r ScrapeResult) // receives the state of the swarm every scrapeInterval, nil to not scrape
+
+	completeOnce sync.Once
+	completed    chan struct{} // closed when the download completes
+	closeOnce    sync.Once
+	quit         chan struct{} // closed to stop announcing
+	stopped      chan struct{} // closed once the trackers were sent the stopped event
+}
+
+// newAnnouncer creates an announcer for the torrent with the given info hash
+func newAnnouncer(tiers *trackerTiers, hash, clientID [20]byte, port int, stats announceStats, onPeers func([]string)) *announcer {
+	return &announcer{
+		tiers:     tiers,
+		hash:      hash,
+		clientID:  clientID,
+		port:      port,
+		stats:     stats,
+		onPeers:   onPeers,
+		completed: make(chan struct{}),
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// run announces to the trackers until close is called
+// the trackers are scraped on their own meanwhile if onScrape is set
+func (a *announcer) run() {
+	go a.loop()
+	if a.onScrape != nil {
+		go a.scrapeLoop()
+	}
+}
+
+// close stops announcing and sends a stopped event to the trackers,
+// waiting at most stopTimeout for it to be sent
+func (a *announcer) close() {
+	a.closeOnce.Do(func() { close(a.quit) })
+	select {
+	case <-a.stopped:
+	case <-time.After(stopTimeout):
+		log.Printf("Trackers not told of the stop after %s", stopTimeout)
+	}
+}
+
+// complete sends a completed event to the trackers
+func (a *announcer) complete() {
+	a.completeOnce.Do(func() { close(a.completed) })
+}
+
+// request returns a function building the announce of event sent to a tracker
+// with the current counters; a tracker that does not know we are active gets a started event
+func (a *announcer) request(event AnnounceEvent) func(e *trackerEntry) *AnnounceRequest {
+	return func(e *trackerEntry) *AnnounceRequest {
+		ev := event
+		if ev != EventStopped && !a.tiers.isStarted(e) {
+			ev = EventStarted
+		}
+		req := &AnnounceRequest{
+			InfoHash:  a.hash,
+			PeerID:    a.clientID,
+			Port:      a.port,
+			Event:     ev,
+			TrackerID: a.tiers.trackerID(e),
+		}
+		if a.stats != nil {
+			req.Uploaded, req.Downloaded, req.Left = a.stats()
+		}
+		return req
+	}
+}
+
+// loop announces to the trackers until quit is closed
+func (a *announcer) loop() {
+	defer close(a.stopped)
+	event := EventNone
+	completed := a.completed
+	retry := announceRetryInterval
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.quit:
+			a.stop(event, completed)
+			return
+		case <-completed:
+			completed = nil
+			event = EventCompleted
+		case <-timer.C:
+		}
+
+		resp, err := a.tiers.announce(a.request(event), announceRetries)
+		if err != nil {
+			log.Printf("Announce failed: %s", err)
+			timer.Reset(retry)
+			retry = min(2*retry, defaultAnnounceInterval)
+			continue
+		}
+		retry = announceRetryInterval
+		event = EventNone
+		if resp.Warning != "" {
+			log.Printf("Tracker warning: %s", resp.Warning)
+		}
+		if a.onPeers != nil && len(resp.PeersAddresses) > 0 {
+			a.onPeers(resp.PeersAddresses)
+		}
+		timer.Reset(announceInterval(resp))
+	}
+}
+
+// scrapeLoop scrapes the trackers right away and then every scrapeInterval until quit is closed
+func (a *announcer) scrapeLoop() {
+	ticker := time.NewTicker(scrapeInterval)
+	defer ticker.Stop()
+	for {
+		if r, err := a.tiers.scrape(a.hash, 1); err == nil {
+			a.onScrape(r)
+		}
+		select {
+		case <-a.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop sends a stopped event to the trackers that know we are active
+// a completion they were not told about yet is reported first
+func (a *announcer) stop(event AnnounceEvent, completed <-chan struct{}) {
+	select {
+	case <-completed:
+		event = EventCompleted
+	default:
+	}
+	if event == EventCompleted {
+		a.tiers.announce(a.request(EventCompleted), 1)
+	}
+	a.tiers.stop(a.request(EventStopped))
+}
+
+// announceDHT announces the torrent with the given info hash on the DHT node of the session,
+// once it is bootstrapped and then every dhtAnnounceInterval until done is closed,
+// so that other peers find us through the DHT
+func (s *Session) announceDHT(hash [20]byte, done <-chan struct{}) {
+	select {
+	case <-s.dhtReady:
+	case <-done:
+		return
+	}
+	if s.dht == nil {
+		return
+	}
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.dht.AnnouncePeer(hash, s.Port()); err != nil {
+			log.Printf("DHT: announce failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// announceInterval returns how long to wait before the next regular announce to a tracker
+func announceInterval(resp *TrackerResponse) time.Duration {
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	return max(interval, time.Duration(resp.MinInterval)*time.Second, minAnnounceInterval)
+}
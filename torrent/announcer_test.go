@@ -0,0 +1,152 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// announceRecord is an announce received by a test tracker
+type announceRecord struct {
+	event, uploaded, downloaded, left string
+}
+
+// newTestTracker starts an HTTP tracker recording the announces it receives
+// and returning the peer 10.0.0.1:6881 to every announce
+func newTestTracker(t *testing.T) (*url.URL, chan announceRecord) {
+	announces := make(chan announceRecord, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		announces <- announceRecord{q.Get("event"), q.Get("uploaded"), q.Get("downloaded"), q.Get("left")}
+		w.Write([]byte("d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e"))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, announces
+}
+
+// nextAnnounce returns the next announce received by the test tracker
+func nextAnnounce(t *testing.T, announces chan announceRecord) announceRecord {
+	t.Helper()
+	select {
+	case a := <-announces:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an announce")
+		return announceRecord{}
+	}
+}
+
+func TestAnnouncerEvents(t *testing.T) {
+	u, announces := newTestTracker(t)
+	left := int64(100)
+	stats := func() (int64, int64, int64) { return 7, 100 - left, left }
+	peers := make(chan []string, 1)
+	a := newAnnouncer(newTrackerTiers([][]*url.URL{{u}}), [20]byte{1}, [20]byte{2}, 6881, stats, func(p []string) { peers <- p })
+	a.run()
+
+	if got := nextAnnounce(t, announces); got != (announceRecord{"started", "7", "0", "100"}) {
+		t.Errorf("unexpected started announce %+v", got)
+	}
+	select {
+	case p := <-peers:
+		if len(p) != 1 || p[0] != "10.0.0.1:6881" {
+			t.Errorf("unexpected peers %v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peers of the tracker were not handed over")
+	}
+
+	left = 0
+	a.complete()
+	if got := nextAnnounce(t, announces); got != (announceRecord{"completed", "7", "100", "0"}) {
+		t.Errorf("unexpected completed announce %+v", got)
+	}
+	// the stopped event is sent before close returns
+	a.close()
+	select {
+	case got := <-announces:
+		if got.event != "stopped" {
+			t.Errorf("expected a stopped announce, got %+v", got)
+		}
+	default:
+		t.Error("expected the stopped announce to be sent by close")
+	}
+}
+
+func TestAnnounceURLEvent(t *testing.T) {
+	u, _ := url.Parse("http://tracker.example/announce")
+	req := &AnnounceRequest{Port: 6881, Uploaded: 1, Downloaded: 2, Left: 3, Event: EventStarted}
+	q, err := url.Parse(announceURL(u, req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := q.Query()
+	for key, expected := range map[string]string{"event": "started", "uploaded": "1", "downloaded": "2", "left": "3", "port": "6881"} {
+		if values.Get(key) != expected {
+			t.Errorf("expected %s=%s, got %q", key, expected, values.Get(key))
+		}
+	}
+	req.Event = EventNone
+	if q, _ := url.Parse(announceURL(u, req)); q.Query().Has("event") {
+		t.Error("expected no event for a regular announce")
+	}
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	tests := []struct {
+		resp     TrackerResponse
+		expected time.Duration
+	}{
+		{TrackerResponse{Interval: 1800}, 30 * time.Minute},
+		{TrackerResponse{}, defaultAnnounceInterval},
+		{TrackerResponse{Interval: 5}, minAnnounceInterval},
+		{TrackerResponse{Interval: 120, MinInterval: 300}, 5 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := announceInterval(&test.resp); got != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.resp, test.expected, got)
+		}
+	}
+}
+
+func TestAnnouncerScrapesOnItsOwn(t *testing.T) {
+	tracker := newUDPTestTracker(t)
+	a := newAnnouncer(newTrackerTiers([][]*url.URL{{tracker.url}}), [20]byte{1}, [20]byte{2}, 6881, nil, nil)
+	scrapes := make(chan ScrapeResult, 10)
+	a.onScrape = func(r ScrapeResult) { scrapes <- r }
+	a.run()
+	defer a.close()
+
+	// the swarm is scraped once when the announcer starts
+	select {
+	case r := <-scrapes:
+		if r != (ScrapeResult{Seeders: 1, Completed: 2, Leechers: 3}) {
+			t.Errorf("unexpected scrape %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a scrape")
+	}
+
+	// and not after every announce
+	for _, complete := range []bool{false, true} {
+		if complete {
+			a.complete()
+		}
+		select {
+		case <-tracker.urlData:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an announce")
+		}
+	}
+	select {
+	case <-scrapes:
+		t.Error("expected no scrape before scrapeInterval")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
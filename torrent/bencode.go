@@ -19,6 +19,7 @@ type bencode struct {
 	Str  string
 	Int  int
 	Hash [20]byte
+	Info []byte // raw 'info' table, used to serve the metadata (BEP 9)
 }
 
 // decode decodes a bencode file to a bencode object
@@ -70,6 +71,7 @@ func decode(reader *bufio.Reader, buff *bytes.Buffer, infoMap bool) (*bencode, e
 			if key == "info" {
 				infoMap = false
 				ben.Hash = sha1.Sum(buff.Bytes())
+				ben.Info = bytes.Clone(buff.Bytes())
 				buff.Reset()
 			}
 
@@ -144,45 +146,88 @@ func decode(reader *bufio.Reader, buff *bytes.Buffer, infoMap bool) (*bencode, e
 // Encode encodes a bencode object to a byte slice
 func Encode(ben *bencode) []byte {
 	var buf bytes.Buffer
-	encodeTo(&buf, ben)
+	marshalTo(&buf, *ben) // never fails on a bencode object
 	return buf.Bytes()
 }
 
-// encodeTo writes the bencoded representation to a buffer
-func encodeTo(buf *bytes.Buffer, ben *bencode) {
-	switch {
-	case ben.Dict != nil:
+// Marshal bencodes a value made of strings, byte slices, integers,
+// lists ([]any), dictionaries (map[string]any) and bencode objects
+// unlike in a bencode object, empty strings are kept as strings
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshalTo(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// marshalTo writes the bencoded representation of v to a buffer
+func marshalTo(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case map[string]any:
 		buf.WriteByte('d')
 		// Keys must be sorted in lexicographical order
-		keys := slices.Sorted(maps.Keys(ben.Dict))
-		for _, k := range keys {
-			v := ben.Dict[k]
-			// Write key as string
-			buf.WriteString(strconv.Itoa(len(k)))
-			buf.WriteByte(':')
-			buf.WriteString(k)
-			// Write value
-			encodeTo(buf, &v)
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			marshalString(buf, k)
+			if err := marshalTo(buf, v[k]); err != nil {
+				return err
+			}
 		}
 		buf.WriteByte('e')
-	case ben.List != nil:
+	case []any:
 		buf.WriteByte('l')
-		for i := range ben.List {
-			encodeTo(buf, &ben.List[i])
+		for _, e := range v {
+			if err := marshalTo(buf, e); err != nil {
+				return err
+			}
 		}
 		buf.WriteByte('e')
-	case ben.Str != "":
-		buf.WriteString(strconv.Itoa(len(ben.Str)))
-		buf.WriteByte(':')
-		buf.WriteString(ben.Str)
-	case ben.Int != 0:
-		buf.WriteByte('i')
-		buf.WriteString(strconv.Itoa(ben.Int))
-		buf.WriteByte('e')
+	case string:
+		marshalString(buf, v)
+	case []byte:
+		marshalString(buf, string(v))
+	case int:
+		marshalInt(buf, int64(v))
+	case int64:
+		marshalInt(buf, v)
+	case bencode:
+		switch {
+		case v.Dict != nil:
+			dict := make(map[string]any, len(v.Dict))
+			for k, e := range v.Dict {
+				dict[k] = e
+			}
+			return marshalTo(buf, dict)
+		case v.List != nil:
+			list := make([]any, len(v.List))
+			for i, e := range v.List {
+				list[i] = e
+			}
+			return marshalTo(buf, list)
+		case v.Str != "":
+			marshalString(buf, v.Str)
+		default:
+			// Zero int or empty - encode as int 0
+			marshalInt(buf, int64(v.Int))
+		}
 	default:
-		// Zero int or empty - encode as int 0
-		buf.WriteString("i0e")
+		return fmt.Errorf("cannot bencode %T", v)
 	}
+	return nil
+}
+
+// marshalString writes a bencoded string to a buffer
+func marshalString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+// marshalInt writes a bencoded integer to a buffer
+func marshalInt(buf *bytes.Buffer, i int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte('e')
 }
 
 func (ben bencode) String() string {
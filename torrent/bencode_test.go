@@ -149,3 +149,34 @@ func TestEncodeKRPCPing(t *testing.T) {
 		t.Error("Should contain transaction ID")
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	result, err := Marshal(map[string]any{
+		"peers":    "",
+		"interval": 1800,
+		"files":    []any{[]byte("a"), int64(-3), map[string]any{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("d5:filesl1:ai-3edee8:intervali1800e5:peers0:e")
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+	if _, err := Marshal(map[string]any{"x": 1.5}); err == nil {
+		t.Error("Expected an error for a float")
+	}
+
+	// bencode objects are encoded as by Encode
+	ben := bencode{Dict: map[string]bencode{"a": {Str: "b"}, "l": {List: []bencode{{Int: 2}, {}}}}}
+	result, err = Marshal(map[string]any{"x": ben})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "d1:x" + string(Encode(&ben)) + "e"; string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+	if expected := "d1:a1:b1:lli2ei0eee"; string(Encode(&ben)) != expected {
+		t.Errorf("Expected %s, got %s", expected, Encode(&ben))
+	}
+}
@@ -3,6 +3,15 @@ package torrent
 // bitfield represents a bitfield
 type bitfield []byte
 
+// fullBitfield returns a bitfield with the first n values set to true
+func fullBitfield(n int) bitfield {
+	bf := make(bitfield, (n+7)/8)
+	for i := range n {
+		bf.set(i)
+	}
+	return bf
+}
+
 // get returns the value of the bitfield at a certain index
 func (bf bitfield) get(index int) bool {
 	bucket := index / 8
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+// chokeInterval is how often the choker ranks the peers again (BEP 3)
+const chokeInterval = 10 * time.Second
+
+// optimisticInterval is how often the optimistic unchoke slot rotates
+const optimisticInterval = 30 * time.Second
+
+// uploadSlots is the number of peers unchoked because of their rate
+const uploadSlots = 4
+
+// choker decides which peers of a swarm we upload to, following the
+// tit-for-tat algorithm of BEP 3: the interested peers with the best rates
+// are unchoked, plus one random optimistic unchoke rotated every 30 seconds
+type choker struct {
+	swarm      *swarm
+	optimistic *peer
+	rounds     int
+	// bytes transferred with each peer at the previous round, to compute rates
+	lastDownloaded map[*peer]int64
+	lastUploaded   map[*peer]int64
+}
+
+// newChoker creates a choker for the peers of sw
+func newChoker(sw *swarm) *choker {
+	return &choker{
+		swarm:          sw,
+		lastDownloaded: make(map[*peer]int64),
+		lastUploaded:   make(map[*peer]int64),
+	}
+}
+
+// run rechokes the peers every chokeInterval until done is closed
+func (c *choker) run(done <-chan struct{}) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.rechoke()
+		}
+	}
+}
+
+// chokeCandidate is a peer considered by the choker, with its rate over the last round
+type chokeCandidate struct {
+	peer       *peer
+	rate       int64
+	interested bool
+}
+
+// rankPeers returns the interested candidates with the best rates, at most slots of them
+func rankPeers(candidates []chokeCandidate, slots int) []*peer {
+	interested := make([]chokeCandidate, 0, len(candidates))
+	for _, c := range candidates {
+		if c.interested {
+			interested = append(interested, c)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+	best := make([]*peer, 0, slots)
+	for i := 0; i < len(interested) && i < slots; i++ {
+		best = append(best, interested[i].peer)
+	}
+	return best
+}
+
+// rechoke ranks the connected peers and updates which ones are unchoked.
+// While downloading, peers are ranked by how fast they send us pieces;
+// once we seed, by how fast they take pieces from us.
+func (c *choker) rechoke() {
+	peers := c.swarm.connectedPeers()
+	seeding := c.swarm.state != nil && c.swarm.state.IsComplete()
+
+	candidates := make([]chokeCandidate, len(peers))
+	downloaded := make(map[*peer]int64, len(peers))
+	uploaded := make(map[*peer]int64, len(peers))
+	for i, p := range peers {
+		downloaded[p] = p.downloaded.Load()
+		uploaded[p] = p.uploaded.Load()
+		rate := downloaded[p] - c.lastDownloaded[p]
+		if seeding {
+			rate = uploaded[p] - c.lastUploaded[p]
+		}
+		candidates[i] = chokeCandidate{peer: p, rate: rate, interested: p.interested.Load()}
+	}
+	// forget the peers that disconnected
+	c.lastDownloaded, c.lastUploaded = downloaded, uploaded
+
+	unchoked := make(map[*peer]bool, uploadSlots+1)
+	for _, p := range rankPeers(candidates, uploadSlots) {
+		unchoked[p] = true
+	}
+
+	// rotate the optimistic unchoke every optimisticInterval,
+	// or sooner if the peer is gone or earned a regular slot
+	_, connected := downloaded[c.optimistic]
+	if c.rounds%int(optimisticInterval/chokeInterval) == 0 || !connected || unchoked[c.optimistic] {
+		c.optimistic = pickOptimistic(candidates, unchoked)
+	}
+	if c.optimistic != nil {
+		unchoked[c.optimistic] = true
+	}
+	c.rounds++
+
+	for _, p := range peers {
+		if unchoked[p] {
+			p.unchoke()
+		} else {
+			p.choke()
+		}
+	}
+}
+
+// pickOptimistic returns a random interested candidate that is not already unchoked
+func pickOptimistic(candidates []chokeCandidate, unchoked map[*peer]bool) *peer {
+	var choked []*peer
+	for _, c := range candidates {
+		if c.interested && !unchoked[c.peer] {
+			choked = append(choked, c.peer)
+		}
+	}
+	if len(choked) == 0 {
+		return nil
+	}
+	return choked[rand.IntN(len(choked))]
+}
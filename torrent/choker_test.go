@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"io"
+	"testing"
+)
+
+// newChokerPeers connects n interested peers to sw, discarding what is sent to them
+func newChokerPeers(t *testing.T, sw *swarm, n int) []*peer {
+	peers := make([]*peer, n)
+	for i := range peers {
+		p, remote := newTestPeer(sw)
+		t.Cleanup(p.close)
+		go io.Copy(io.Discard, remote)
+		p.interested.Store(true)
+		sw.addPeer(p)
+		peers[i] = p
+	}
+	return peers
+}
+
+func TestRankPeers(t *testing.T) {
+	peers := make([]*peer, 5)
+	for i := range peers {
+		peers[i] = &peer{}
+	}
+	candidates := []chokeCandidate{
+		{peer: peers[0], rate: 10, interested: true},
+		{peer: peers[1], rate: 50, interested: false},
+		{peer: peers[2], rate: 30, interested: true},
+		{peer: peers[3], rate: 20, interested: true},
+		{peer: peers[4], rate: 0, interested: true},
+	}
+	best := rankPeers(candidates, 2)
+	if len(best) != 2 || best[0] != peers[2] || best[1] != peers[3] {
+		t.Errorf("expected peers 2 and 3 to be ranked first, got %v", best)
+	}
+	if all := rankPeers(candidates, 10); len(all) != 4 {
+		t.Errorf("expected only the 4 interested peers, got %d", len(all))
+	}
+}
+
+func TestChokerUnchokesFastestDownloaders(t *testing.T) {
+	sw := newTestSwarm(t)
+	sw.state.ClearPiece(0) // still downloading
+	peers := newChokerPeers(t, sw, uploadSlots+2)
+	for i, p := range peers {
+		p.downloaded.Store(int64(i * 100))
+		p.uploaded.Store(int64((len(peers) - i) * 100))
+	}
+
+	c := newChoker(sw)
+	c.rechoke()
+
+	for _, p := range peers[2:] {
+		if p.amChoking.Load() {
+			t.Errorf("expected the peer with rate %d to be unchoked", p.downloaded.Load())
+		}
+	}
+	if c.optimistic != peers[0] && c.optimistic != peers[1] {
+		t.Fatal("expected one of the slowest peers to be optimistically unchoked")
+	}
+	for _, p := range peers[:2] {
+		if p.amChoking.Load() == (p == c.optimistic) {
+			t.Errorf("unexpected choke state for peer with rate %d", p.downloaded.Load())
+		}
+	}
+}
+
+func TestChokerRanksByUploadWhenSeeding(t *testing.T) {
+	sw := newTestSwarm(t)
+	peers := newChokerPeers(t, sw, uploadSlots+2)
+	for i, p := range peers {
+		p.downloaded.Store(int64(i * 100))
+		p.uploaded.Store(int64((len(peers) - i) * 100))
+	}
+
+	c := newChoker(sw)
+	c.rechoke()
+
+	for _, p := range peers[:uploadSlots] {
+		if p.amChoking.Load() {
+			t.Errorf("expected the peer with upload rate %d to be unchoked", p.uploaded.Load())
+		}
+	}
+	if c.optimistic != peers[uploadSlots] && c.optimistic != peers[uploadSlots+1] {
+		t.Error("expected one of the slowest peers to be optimistically unchoked")
+	}
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	sw := newTestSwarm(t)
+	peers := newChokerPeers(t, sw, uploadSlots+1)
+	for i, p := range peers {
+		p.uploaded.Store(int64((len(peers) - i) * 100))
+	}
+
+	c := newChoker(sw)
+	c.rechoke()
+	if c.optimistic != peers[uploadSlots] {
+		t.Fatal("expected the only choked peer to be optimistically unchoked")
+	}
+	// the optimistic peer becomes the fastest one: it takes a regular slot
+	// and the slowest regular peer gets the optimistic slot
+	for i, p := range peers {
+		p.uploaded.Add(int64((len(peers) - i) * 100))
+	}
+	peers[uploadSlots].uploaded.Add(10000)
+	c.rechoke()
+	if c.optimistic != peers[uploadSlots-1] {
+		t.Errorf("expected the optimistic unchoke to move to the slowest peer")
+	}
+	for _, p := range peers {
+		if p.amChoking.Load() {
+			t.Errorf("expected every peer to be unchoked")
+		}
+	}
+}
@@ -3,7 +3,6 @@ package torrent
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"fmt"
 	"log"
 	"net"
@@ -23,13 +22,9 @@ type ProgressCallback func(completedPieces, totalPieces int, downloadedBytes, to
 // DownloadOptions configures download behavior
 type DownloadOptions struct {
 	RarestFirst bool              // Use rarest-first piece selection (better for swarm health)
+	Seed        bool              // Keep serving pieces to peers once the download is complete
 	OnProgress  ProgressCallback  // Progress callback
-}
-
-// fileDescriptor is a file writer plus the remaining bytes to be written
-type fileDescriptor struct {
-	FileWriter *os.File
-	Remaining  int
+	ListenPort  int               // Port to listen on for incoming peers (0 for 6881-6889), ignored within a Session
 }
 
 // clientID returns '-', the id 'GT' followed by the version number, '-' and 12 random bytes
@@ -39,16 +34,26 @@ func clientID() ([20]byte, error) {
 	return id, err
 }
 
-// downloadPiecesWithContext retrieves the file as a byte array
-// from torrent file, a list of peers and a client ID
+// listenPort returns the port to advertise to trackers for the listener l
+func listenPort(l *Listener) int {
+	if l == nil {
+		return portRangeStart
+	}
+	return l.Port()
+}
+
+// downloadPieces retrieves the pieces of the torrent from a list of peers
 // and writes them to the file system. Supports cancellation via context.
 // If state is provided, it will be used to skip already downloaded pieces and track progress.
-func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr []string, clientID [20]byte, outDir string, state *DownloadState, opts *DownloadOptions) error {
+// Pieces we have are served to the peers while downloading, and after completion if t.opts.Seed is set.
+// Peers connecting to the session for this torrent are handed to the same workers as the ones we connect to.
+func (t *Torrent) downloadPieces(ctx context.Context, inf *TorrentInfo, peersAddr []string, outDir string, state *DownloadState) error {
+	s := t.session
 	fileLen := inf.Length
 	pieceLen := inf.PieceLength
 	numPieces := len(inf.Pieces)
 	files := inf.Files
-	numFiles := len(files)
+	seed := t.opts.Seed
 	
 	// Create or use provided state
 	if state == nil {
@@ -56,16 +61,14 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 		state.AddPeers(peersAddr)
 	}
 	
-	// pieceToFile maps a piece index to the indices of the files it corresponds to
-	pieceToFile := make(map[int][]int, numPieces)
-	// fWriters maps a file index to its file descriptor
-	fWriters := make(map[int]*fileDescriptor, numFiles)
+	st, err := openStorage(inf, outDir)
+	if err != nil {
+		return err
+	}
 	
 	// Cleanup function to close all open file handles and save state
 	cleanup := func() {
-		for _, val := range fWriters {
-			val.FileWriter.Close()
-		}
+		st.close()
 		// Save state on cleanup
 		if err := state.Save(); err != nil {
 			log.Printf("Failed to save download state: %v", err)
@@ -73,92 +76,20 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 	}
 	defer cleanup()
 	
-	// Check if we're resuming (some pieces already downloaded)
-	resuming := state.CompletedPieces() > 0
-	
-	for i, f := range inf.Files {
-		path := filepath.Join(outDir, f.Path)
-		os.MkdirAll(filepath.Dir(path), os.ModePerm)
-		
-		var fd *os.File
-		var err error
-		
-		if resuming {
-			// Open existing file for writing
-			fd, err = os.OpenFile(path, os.O_RDWR, 0644)
-			if err != nil {
-				// File doesn't exist, create it
-				fd, err = os.Create(path)
-				if err != nil {
-					return err
-				}
-				_, err = fd.Seek(int64(f.Length-1), 0)
-				if err != nil {
-					return err
-				}
-				_, err = fd.Write([]byte{0})
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			fd, err = os.Create(path)
-			if err != nil {
-				return err
-			}
-			_, err = fd.Seek(int64(f.Length-1), 0)
-			if err != nil {
-				return err
-			}
-			_, err = fd.Write([]byte{0})
-			if err != nil {
-				return err
-			}
-		}
-		fWriters[i] = &fileDescriptor{fd, f.Length}
-	}
-
 	// If resuming, verify completed pieces against file data
-	if resuming {
+	if state.CompletedPieces() > 0 {
 		log.Printf("Verifying %d completed pieces...", state.CompletedPieces())
 		invalidated := 0
-		for i, expectedHash := range inf.Pieces {
+		for i := range numPieces {
 			if !state.IsPieceComplete(i) {
 				continue
 			}
-			length := pieceLen
-			if i == numPieces-1 && fileLen%pieceLen != 0 {
-				length = fileLen % pieceLen
-			}
-			pieceData := make([]byte, length)
-			pieceStart := i * pieceLen
-			// Read piece data from file(s)
-			for fi, f := range files {
-				fileEnd := f.CumStart + f.Length
-				if pieceStart+length <= f.CumStart || pieceStart >= fileEnd {
-					continue
-				}
-				fd, ok := fWriters[fi]
-				if !ok {
-					continue
-				}
-				resOffset := 0
-				fileOffset := pieceStart - f.CumStart
-				if fileOffset < 0 {
-					resOffset = -fileOffset
-					fileOffset = 0
-				}
-				end := length
-				if end+pieceStart > fileEnd {
-					end = fileEnd - pieceStart
-				}
-				fd.FileWriter.ReadAt(pieceData[resOffset:end], int64(fileOffset))
-			}
-			h := sha1.Sum(pieceData)
-			if h != expectedHash {
+			if !st.verifyPiece(i) {
 				state.ClearPiece(i)
 				invalidated++
+				continue
 			}
+			st.markWritten(i)
 		}
 		if invalidated > 0 {
 			log.Printf("Invalidated %d corrupted pieces", invalidated)
@@ -173,8 +104,13 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 		}
 	}
 	
-	// If already complete, we're done
-	if piecesToDownload == 0 {
+	downloadedBytes := func() int64 {
+		return min(int64(state.CompletedPieces())*int64(pieceLen), int64(fileLen))
+	}
+	t.progress(state.CompletedPieces(), numPieces, downloadedBytes(), int64(fileLen))
+
+	// If already complete, we're done unless we want to seed
+	if piecesToDownload == 0 && !seed {
 		log.Printf("Download already complete")
 		return nil
 	}
@@ -183,28 +119,22 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 	
 	// Build list of pieces to download
 	allPieces := make([]*Piece, numPieces)
-	pos := 0
-	fileIndex := 0
 	for i, hash := range inf.Pieces {
-		length := pieceLen
-		// The last piece might be shorter
-		if i == numPieces-1 && fileLen%pieceLen != 0 {
-			length = fileLen % pieceLen
-		}
-		
 		allPieces[i] = &Piece{
 			Index:  i,
 			Hash:   hash,
-			Length: length,
+			Length: st.pieceLength(i),
 		}
-		
-		pos += length
-		var f []int
-		for ; fileIndex < numFiles && files[fileIndex].CumStart+files[fileIndex].Length < pos; fileIndex++ {
-			f = append(f, fileIndex)
-		}
-		f = append(f, fileIndex)
-		pieceToFile[i] = f
+	}
+
+	sw := newSwarm(inf, s.id, state, st, seed)
+	sw.conns = s.conns
+	sw.peerSlots = newConnLimiter(s.maxTorrentConns, defaultMaxTorrentConnections)
+	sw.port = s.Port()
+	sw.metadata = t.metadata
+	t.setSwarm(sw, inf)
+	if piecesToDownload > 0 {
+		t.setStatus(StatusDownloading)
 	}
 
 	// Create chan of results to collect
@@ -214,22 +144,23 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 	done := make(chan struct{})
 	defer close(done)
 
+	// Decide which peers we upload to
+	go newChoker(sw).run(done)
+
 	// Choose piece selection strategy
-	useRarestFirst := opts != nil && opts.RarestFirst
+	useRarestFirst := t.opts.RarestFirst
 	
 	if useRarestFirst {
 		// Rarest-first: use PieceQueue
 		queue := NewPieceQueue(allPieces, state.Downloaded)
-		for _, peerAddress := range peersAddr {
-			go DownloadPiecesWithQueue(inf.Hash, clientID, peerAddress, queue, results, done)
-		}
+		sw.worker = func(p *peer) { runQueueWorker(p, queue, results, done) }
+		sw.connect = func(address string) { downloadPiecesWithQueue(sw, address, queue, results, done) }
 	} else {
 		// Sequential/random: use channel
 		pieces := make(chan *Piece)
-		info := make(chan *TorrentInfo) // unused but required by DownloadPieces
-		for _, peerAddress := range peersAddr {
-			go DownloadPieces(inf.Hash, clientID, peerAddress, pieces, info, results)
-		}
+		info := make(chan *TorrentInfo) // unused but required by downloadPieces
+		sw.worker = func(p *peer) { runPieceWorker(p, pieces, info, results, done) }
+		sw.connect = func(address string) { downloadPieces(sw, address, pieces, info, results, done) }
 		// Send pieces that need downloading
 		go func() {
 			for _, p := range allPieces {
@@ -241,10 +172,47 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 					}
 				}
 			}
-			close(pieces)
 		}()
 	}
 
+	// Connect to the known peers, and to the ones learned through PEX later on
+	sw.addPeers(peersAddr)
+	go sw.runPex(done)
+
+	// Keep the trackers informed of our progress, and connect to the peers they return
+	bytesLeft := func() int64 {
+		var left int64
+		for i := range numPieces {
+			if !state.IsPieceComplete(i) {
+				left += int64(st.pieceLength(i))
+			}
+		}
+		return left
+	}
+	stats := func() (int64, int64, int64) {
+		return sw.uploaded.Load(), sw.downloaded.Load(), bytesLeft()
+	}
+	ann := newAnnouncer(t.tiers, inf.Hash, s.id, s.Port(), stats, func(peers []string) {
+		state.AddPeers(peers)
+		if n := sw.addPeers(peers); n > 0 {
+			log.Printf("Received %d new peers from trackers", n)
+		}
+	})
+	ann.onScrape = t.setScrape
+	ann.run()
+	defer ann.close()
+
+	// Let the peers of the DHT find us too
+	if s.listener != nil {
+		go s.announceDHT(inf.Hash, done)
+	}
+
+	// Accept incoming peers for this torrent
+	if s.listener != nil {
+		s.listener.register(sw)
+		defer s.listener.unregister(sw)
+	}
+
 	// Parse the results as they come and copy them to file
 	nextNotification := notificationStep
 	completedInSession := 0
@@ -255,46 +223,27 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 			log.Printf("Download cancelled/paused, saving state...")
 			return ctx.Err()
 		case result := <-results:
-			// Mark piece as complete in state
-			state.MarkPieceComplete(result.Index)
-			completedInSession++
-			
+			if state.IsPieceComplete(result.Index) {
+				continue // already downloaded from another peer
+			}
 			// write to the associated files
-			for _, i := range pieceToFile[result.Index] {
-				f := files[i]
-				pieceStart := result.Index * pieceLen
-				// start writing in the file at fileOffset
-				// start reading the result at resOffset
-				resOffset, fileOffset := 0, pieceStart-f.CumStart
-				if fileOffset < 0 {
-					resOffset, fileOffset = -fileOffset, 0
-				}
-				// write the result till end
-				end := len(result.Value)
-				if end+pieceStart > f.CumStart+f.Length {
-					end = f.CumStart + f.Length - pieceStart
-				}
-				fd := fWriters[i]
-				n, err := fd.FileWriter.WriteAt(result.Value[resOffset:end], int64(fileOffset))
-				if err != nil {
-					return err
-				}
-				fd.Remaining -= n
-				if fd.Remaining == 0 {
-					fd.FileWriter.Close()
-					delete(fWriters, i)
-					log.Printf("Finished downloading %s", filepath.Base(f.Path))
-				}
+			finished, err := st.writePiece(result.Index, result.Value)
+			if err != nil {
+				return err
+			}
+			for _, i := range finished {
+				log.Printf("Finished downloading %s", filepath.Base(files[i].Path))
 			}
+			// Mark piece as complete in state once it is on disk, then advertise it
+			state.MarkPieceComplete(result.Index)
+			completedInSession++
+			sw.broadcastHave(result.Index)
 
 			// Progress based on total pieces (including already downloaded)
 			totalCompleted := state.CompletedPieces()
 			
-			// Call progress callback if provided
-			if opts != nil && opts.OnProgress != nil {
-				downloadedBytes := min(int64(totalCompleted)*int64(pieceLen), int64(fileLen))
-				opts.OnProgress(totalCompleted, numPieces, downloadedBytes, int64(fileLen))
-			}
+			// Record the progress and call the progress callback if provided
+			t.progress(totalCompleted, numPieces, downloadedBytes(), int64(fileLen))
 			
 			for p := float64(totalCompleted) / float64(numPieces) * 100; p > float64(nextNotification); nextNotification += notificationStep {
 				log.Printf("Progress (%.2f%%)", p)
@@ -309,212 +258,59 @@ func downloadPiecesWithContext(ctx context.Context, inf *TorrentInfo, peersAddr
 		}
 	}
 	
+	if piecesToDownload > 0 {
+		ann.complete()
+	}
+
 	// Download complete - delete state file
 	if err := state.Delete(); err != nil {
 		log.Printf("Warning: failed to delete state file: %v", err)
 	}
+
+	if seed {
+		t.setStatus(StatusSeeding)
+		log.Printf("Download complete, seeding until stopped")
+		<-ctx.Done()
+		log.Printf("Stopped seeding, uploaded %d bytes", sw.uploaded.Load())
+	}
 	
 	return nil
 }
 
-// DownloadWithContext retrieves the file and saves it to the specified path
-// if the path is empty, saves it to the folder of the torrent file
-// with the default name coming from the torrent file
-// Supports cancellation via context.
-func DownloadWithContext(ctx context.Context, torrentPath, outputPath string) error {
-	id, err := clientID()
-	if err != nil {
-		return err
-	}
-	t, err := OpenTorrent(torrentPath)
-	if err != nil {
-		return err
-	}
-	outDir := outputPath
-	if outDir == "" {
-		outDir = filepath.Dir(torrentPath)
-	}
+// downloadFile downloads the .torrent file from the peers its trackers return
+func (t *Torrent) downloadFile(ctx context.Context) error {
+	tf := t.file
+	outDir := t.outputPath
 	// If there are multiple files, create a containing folder
-	if t.Info.Multi() {
-		outDir = filepath.Join(outDir, t.Info.Name)
+	if tf.Info.Multi() {
+		outDir = filepath.Join(outDir, tf.Info.Name)
 		os.MkdirAll(outDir, os.ModePerm)
 	}
-	
+
 	// Try to load existing state for resuming
-	state, err := LoadState(t.Info.Hash)
+	state, err := LoadState(tf.Info.Hash)
 	if err != nil {
 		// No existing state, will create new one
 		state = nil
 	} else {
 		log.Printf("Found existing state, resuming download...")
 	}
-	
-	peers, err := t.GetPeers(id)
-	if err != nil {
-		return err
-	}
-	log.Printf("Received %d peers from tracker", len(peers.PeersAddresses))
-	
-	// Create state if not resuming
-	if state == nil {
-		state = NewDownloadState(t.Info.Hash, t.Info.Name, outDir, len(t.Info.Pieces), t.Info.PieceLength, t.Info.Length)
-	}
-	state.SetTorrentPath(torrentPath)
-	state.AddPeers(peers.PeersAddresses)
-	
-	return downloadPiecesWithContext(ctx, t.Info, peers.PeersAddresses, id, outDir, state, nil)
-}
 
-// Download retrieves the file and saves it to the specified path
-// if the path is empty, saves it to the folder of the torrent file
-// with the default name coming from the torrent file
-func Download(torrentPath, outputPath string) error {
-	return DownloadWithContext(context.Background(), torrentPath, outputPath)
-}
-
-// DownloadWithProgress downloads a torrent file with progress callback
-func DownloadWithProgress(ctx context.Context, torrentPath, outputPath string, opts *DownloadOptions) error {
-	id, err := clientID()
-	if err != nil {
-		return err
-	}
-	t, err := OpenTorrent(torrentPath)
-	if err != nil {
-		return err
-	}
-	outDir := outputPath
-	if outDir == "" {
-		outDir = filepath.Dir(torrentPath)
-	}
-	if t.Info.Multi() {
-		outDir = filepath.Join(outDir, t.Info.Name)
-		os.MkdirAll(outDir, os.ModePerm)
-	}
-	
-	state, err := LoadState(t.Info.Hash)
-	if err != nil {
-		state = nil
-	} else {
-		log.Printf("Found existing state, resuming download...")
-	}
-	
-	peers, err := t.GetPeers(id)
-	if err != nil {
-		return err
-	}
-	log.Printf("Received %d peers from tracker", len(peers.PeersAddresses))
-	
+	// Create state if not resuming
 	if state == nil {
-		state = NewDownloadState(t.Info.Hash, t.Info.Name, outDir, len(t.Info.Pieces), t.Info.PieceLength, t.Info.Length)
-	}
-	state.SetTorrentPath(torrentPath)
-	state.AddPeers(peers.PeersAddresses)
-	
-	return downloadPiecesWithContext(ctx, t.Info, peers.PeersAddresses, id, outDir, state, opts)
-}
-
-// DownloadMagnetWithProgress downloads a magnet link with progress callback and shared DHT
-func DownloadMagnetWithProgress(ctx context.Context, magnetLink, outputPath string, sharedDHT *dht.DHT, opts *DownloadOptions) error {
-	magnet, err := ParseMagnet(magnetLink)
-	if err != nil {
-		return fmt.Errorf("failed to parse magnet link: %w", err)
-	}
-
-	id, err := clientID()
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Downloading: %s", magnet.DisplayName())
-	log.Printf("Info hash: %s", magnet.InfoHashHex())
-
-	collector := NewPeerCollector()
-
-	if magnet.HasPeers() {
-		added := collector.Add(magnet.PeerAddresses, "magnet link")
-		if added > 0 {
-			log.Printf("Added %d peers from magnet link", added)
-		}
-	}
-
-	var d *dht.DHT
-	dhtCtx, dhtCancel := context.WithCancel(ctx)
-	defer dhtCancel()
-
-	if sharedDHT != nil {
-		d = sharedDHT
-		log.Printf("DHT: using shared node on port %d", d.Port())
-	} else {
-		d, err = dht.New()
-		if err != nil {
-			log.Printf("DHT: failed to create: %v", err)
-		} else {
-			defer d.Stop()
-			if err := d.Start(dhtCtx); err != nil {
-				log.Printf("DHT: failed to start: %v", err)
-				d = nil
-			} else {
-				log.Printf("DHT: started, bootstrapping...")
-				d.Bootstrap()
-			}
-		}
-	}
-
-	if d != nil {
-		for _, addr := range magnet.PeerAddresses {
-			if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
-				go d.Ping(udpAddr)
-			}
-		}
-
-		log.Printf("DHT: searching for peers...")
-		dhtPeers, err := d.GetPeers(magnet.Hash)
-		if err != nil {
-			log.Printf("DHT: get_peers failed: %v", err)
-		} else {
-			added := collector.Add(dhtPeers, "DHT")
-			if added > 0 {
-				log.Printf("Added %d peers from DHT", added)
-			}
-		}
-	}
-
-	if magnet.HasTrackers() {
-		log.Printf("Querying %d trackers...", len(magnet.TrackersURL))
-		trackerPeers := QueryTrackers(magnet.TrackersURL, magnet.Hash, id)
-		added := collector.Add(trackerPeers, "trackers")
-		if added > 0 {
-			log.Printf("Added %d peers from trackers", added)
-		}
+		state = NewDownloadState(tf.Info.Hash, tf.Info.Name, outDir, len(tf.Info.Pieces), tf.Info.PieceLength, tf.Info.Length)
 	}
+	state.SetTorrentPath(t.torrentPath)
 
-	if collector.Count() == 0 {
-		return fmt.Errorf("no peers found from any source")
-	}
-
-	log.Printf("Total peers: %d", collector.Count())
-
-	return downloadFromPeersWithContext(ctx, magnet.Hash, id, collector.Peers(), outputPath, magnetLink, opts)
+	// the peers come from the trackers, announced to while downloading
+	return t.downloadPieces(ctx, tf.Info, nil, outDir, state)
 }
 
-// DownloadMagnetWithContext downloads a torrent from a magnet link using DHT and trackers
-// Supports cancellation via context.
-func DownloadMagnetWithContext(ctx context.Context, magnetLink, outputPath string) error {
-	return DownloadMagnetWithDHT(ctx, magnetLink, outputPath, nil)
-}
-
-// DownloadMagnetWithDHT downloads a torrent from a magnet link using an optional shared DHT node.
-// If sharedDHT is nil, an ephemeral DHT node is created for this download.
-func DownloadMagnetWithDHT(ctx context.Context, magnetLink, outputPath string, sharedDHT *dht.DHT) error {
-	magnet, err := ParseMagnet(magnetLink)
-	if err != nil {
-		return fmt.Errorf("failed to parse magnet link: %w", err)
-	}
-
-	id, err := clientID()
-	if err != nil {
-		return err
-	}
+// downloadMagnet finds peers through the magnet link, the DHT and the trackers,
+// then fetches the metadata and downloads the torrent
+func (t *Torrent) downloadMagnet(ctx context.Context) error {
+	s := t.session
+	magnet := t.magnet
 
 	log.Printf("Downloading: %s", magnet.DisplayName())
 	log.Printf("Info hash: %s", magnet.InfoHashHex())
@@ -530,34 +326,14 @@ func DownloadMagnetWithDHT(ctx context.Context, magnetLink, outputPath string, s
 		}
 	}
 
-	// Start DHT for peer discovery
-	var d *dht.DHT
-	// Use the passed context for DHT and download
-	dhtCtx, dhtCancel := context.WithCancel(ctx)
-	defer dhtCancel()
-
-	if sharedDHT != nil {
-		// Reuse shared DHT node
-		d = sharedDHT
-		log.Printf("DHT: using shared node on port %d", d.Port())
-	} else {
-		d, err = dht.New()
-		if err != nil {
-			log.Printf("DHT: failed to create: %v", err)
-		} else {
-			defer d.Stop()
-
-			if err := d.Start(dhtCtx); err != nil {
-				log.Printf("DHT: failed to start: %v", err)
-				d = nil
-			} else {
-				log.Printf("DHT: started, bootstrapping...")
-				d.Bootstrap()
-			}
-		}
+	// Wait for the DHT node of the session to be bootstrapped
+	select {
+	case <-s.dhtReady:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	if d != nil {
+	if d := s.dht; d != nil {
 		// Add magnet peer addresses to DHT routing table
 		for _, addr := range magnet.PeerAddresses {
 			if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
@@ -580,7 +356,7 @@ func DownloadMagnetWithDHT(ctx context.Context, magnetLink, outputPath string, s
 	// Query trackers from magnet link in parallel
 	if magnet.HasTrackers() {
 		log.Printf("Querying %d trackers...", len(magnet.TrackersURL))
-		trackerPeers := QueryTrackers(magnet.TrackersURL, magnet.Hash, id)
+		trackerPeers := QueryTrackersOnPort(magnet.TrackersURL, magnet.Hash, s.id, s.Port())
 		added := collector.Add(trackerPeers, "trackers")
 		if added > 0 {
 			log.Printf("Added %d peers from trackers", added)
@@ -594,45 +370,48 @@ func DownloadMagnetWithDHT(ctx context.Context, magnetLink, outputPath string, s
 	log.Printf("Total peers: %d", collector.Count())
 
 	// Fetch metadata and download file
-	return downloadFromPeersWithContext(ctx, magnet.Hash, id, collector.Peers(), outputPath, magnetLink, nil)
+	return t.downloadFromPeers(ctx, collector.Peers())
 }
 
-// DownloadMagnet downloads a torrent from a magnet link using DHT and trackers
-func DownloadMagnet(magnetLink, outputPath string) error {
-	return DownloadMagnetWithContext(context.Background(), magnetLink, outputPath)
-}
-
-// downloadFromPeersWithContext fetches metadata from peers and downloads the torrent
+// downloadFromPeers fetches metadata from peers and downloads the torrent
 // Supports cancellation via context.
-func downloadFromPeersWithContext(ctx context.Context, infoHash, clientID [20]byte, peers []string, outputPath string, magnetLink string, opts *DownloadOptions) error {
+func (t *Torrent) downloadFromPeers(ctx context.Context, peers []string) error {
+	s := t.session
 	// Try to load existing state for resuming
-	state, err := LoadState(infoHash)
+	state, err := LoadState(t.hash)
 	if err != nil {
 		state = nil
 	} else {
 		log.Printf("Found existing state, resuming download...")
 	}
-	
-	// Create channels for metadata exchange
-	pieces := make(chan *Piece)
+
+	// Create channel for metadata exchange
 	info := make(chan *TorrentInfo)
-	results := make(chan *Result)
+
+	// done channel stops the metadata workers, and frees their connection slots,
+	// as soon as one of them sent the info or the download is cancelled
+	done := make(chan struct{})
 
 	// Start workers to get metadata
+	sw := &swarm{hash: t.hash, clientID: s.id, conns: s.conns, port: s.Port()}
+	sw.peerSlots = newConnLimiter(s.maxTorrentConns, defaultMaxTorrentConnections)
 	for _, peerAddress := range peers {
-		go DownloadPieces(infoHash, clientID, peerAddress, pieces, info, results)
+		go downloadPieces(sw, peerAddress, nil, info, nil, done)
 	}
 
 	// Wait for metadata from any peer
 	log.Printf("Fetching torrent metadata from peers...")
 	select {
 	case <-ctx.Done():
+		close(done)
 		return ctx.Err()
 	case torrentInfo := <-info:
+		close(done)
 		log.Printf("Received metadata: %s (%d pieces)", torrentInfo.Name, len(torrentInfo.Pieces))
+		t.metadata = sw.rawMetadata()
 
 		// Set up output directory
-		outDir := outputPath
+		outDir := t.outputPath
 		if torrentInfo.Multi() {
 			outDir = filepath.Join(outDir, torrentInfo.Name)
 			os.MkdirAll(outDir, os.ModePerm)
@@ -642,10 +421,74 @@ func downloadFromPeersWithContext(ctx context.Context, infoHash, clientID [20]by
 		if state == nil {
 			state = NewDownloadState(torrentInfo.Hash, torrentInfo.Name, outDir, len(torrentInfo.Pieces), torrentInfo.PieceLength, torrentInfo.Length)
 		}
-		state.SetMagnetLink(magnetLink)
+		state.SetMagnetLink(t.magnetLink)
 		state.AddPeers(peers)
 
-		// Download the actual file
-		return downloadPiecesWithContext(ctx, torrentInfo, peers, clientID, outDir, state, opts)
+		// Download the actual file; the trackers are announced to again with its real size
+		return t.downloadPieces(ctx, torrentInfo, peers, outDir, state)
 	}
 }
+
+// download runs a single download in a session of its own
+// until it is complete (and seeded, if asked) or ctx is done
+func download(ctx context.Context, source, outputPath string, cfg *SessionConfig, opts *DownloadOptions) error {
+	if opts != nil {
+		cfg.ListenPort = opts.ListenPort
+	}
+	s, err := NewSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	t, err := s.add(ctx, source, outputPath, opts)
+	if err != nil {
+		return err
+	}
+	return t.Wait()
+}
+
+// DownloadWithContext retrieves the file and saves it to the specified path
+// if the path is empty, saves it to the folder of the torrent file
+// with the default name coming from the torrent file
+// Supports cancellation via context.
+func DownloadWithContext(ctx context.Context, torrentPath, outputPath string) error {
+	return DownloadWithProgress(ctx, torrentPath, outputPath, nil)
+}
+
+// Download retrieves the file and saves it to the specified path
+// if the path is empty, saves it to the folder of the torrent file
+// with the default name coming from the torrent file
+func Download(torrentPath, outputPath string) error {
+	return DownloadWithContext(context.Background(), torrentPath, outputPath)
+}
+
+// DownloadWithProgress downloads a torrent file with progress callback
+func DownloadWithProgress(ctx context.Context, torrentPath, outputPath string, opts *DownloadOptions) error {
+	return download(ctx, torrentPath, outputPath, &SessionConfig{DisableDHT: true}, opts)
+}
+
+// DownloadMagnetWithProgress downloads a magnet link with progress callback and shared DHT
+// If sharedDHT is nil, an ephemeral DHT node is created for this download.
+func DownloadMagnetWithProgress(ctx context.Context, magnetLink, outputPath string, sharedDHT *dht.DHT, opts *DownloadOptions) error {
+	if _, err := ParseMagnet(magnetLink); err != nil {
+		return fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+	return download(ctx, magnetLink, outputPath, &SessionConfig{DHT: sharedDHT}, opts)
+}
+
+// DownloadMagnetWithContext downloads a torrent from a magnet link using DHT and trackers
+// Supports cancellation via context.
+func DownloadMagnetWithContext(ctx context.Context, magnetLink, outputPath string) error {
+	return DownloadMagnetWithDHT(ctx, magnetLink, outputPath, nil)
+}
+
+// DownloadMagnetWithDHT downloads a torrent from a magnet link using an optional shared DHT node.
+// If sharedDHT is nil, an ephemeral DHT node is created for this download.
+func DownloadMagnetWithDHT(ctx context.Context, magnetLink, outputPath string, sharedDHT *dht.DHT) error {
+	return DownloadMagnetWithProgress(ctx, magnetLink, outputPath, sharedDHT, nil)
+}
+
+// DownloadMagnet downloads a torrent from a magnet link using DHT and trackers
+func DownloadMagnet(magnetLink, outputPath string) error {
+	return DownloadMagnetWithContext(context.Background(), magnetLink, outputPath)
+}
@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// limits of the metadata fetched during a crawl
+const (
+	maxMetadataFetches = 16               // torrents whose metadata is fetched at once
+	metadataTimeout    = 30 * time.Second // time given to the peers of a torrent to send its metadata
+)
+
+// FetchMetadata finds the peers of the torrent with the given info hash through the DHT
+// and returns its info, downloaded with ut_metadata (BEP 9) from the first peer that sends it
+func (s *Session) FetchMetadata(ctx context.Context, infoHash [20]byte) (*TorrentInfo, error) {
+	select {
+	case <-s.dhtReady:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.dht == nil {
+		return nil, errors.New("session has no DHT node")
+	}
+	peers, err := s.dht.GetPeers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return s.fetchMetadata(ctx, infoHash, peers)
+}
+
+// fetchMetadata connects to the peers and returns the info of the torrent from the first one that sends it
+func (s *Session) fetchMetadata(ctx context.Context, infoHash [20]byte, peers []string) (*TorrentInfo, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers found")
+	}
+	info := make(chan *TorrentInfo)
+	done := make(chan struct{})
+	defer close(done)
+
+	// without pieces to download, the workers only fetch the metadata
+	sw := &swarm{hash: infoHash, clientID: s.id, conns: s.conns, port: s.Port()}
+	sw.peerSlots = newConnLimiter(s.maxTorrentConns, defaultMaxTorrentConnections)
+	var wg sync.WaitGroup
+	for _, address := range peers {
+		wg.Go(func() { downloadPieces(sw, address, nil, info, nil, done) })
+	}
+	failed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(failed)
+	}()
+
+	select {
+	case inf := <-info:
+		return inf, nil
+	case <-failed:
+		return nil, fmt.Errorf("none of the %d peers sent the metadata", len(peers))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Crawl walks the DHT for info hashes (BEP 51) until ctx is done and calls found for each of them
+// with withMetadata, the info of the torrent is fetched from its peers first, and is nil if none sent it;
+// found is never called by two goroutines at once
+func (s *Session) Crawl(ctx context.Context, withMetadata bool, found func(infoHash [20]byte, info *TorrentInfo)) error {
+	select {
+	case <-s.dhtReady:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.dht == nil {
+		return errors.New("session has no DHT node")
+	}
+	if !withMetadata {
+		return s.dht.Crawl(ctx, func(infoHash [20]byte) { found(infoHash, nil) })
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	fetches := make(chan struct{}, maxMetadataFetches)
+	err := s.dht.Crawl(ctx, func(infoHash [20]byte) {
+		// the crawl waits for a free fetch slot
+		select {
+		case fetches <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Go(func() {
+			defer func() { <-fetches }()
+			fetchCtx, cancel := context.WithTimeout(ctx, metadataTimeout)
+			defer cancel()
+			info, err := s.FetchMetadata(fetchCtx, infoHash)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Crawl: no metadata for %x: %v", infoHash, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			found(infoHash, info)
+		})
+	})
+	wg.Wait()
+	return err
+}
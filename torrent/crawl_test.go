@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionFetchMetadata(t *testing.T) {
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	// a seeder that serves the metadata of the test torrent
+	inf, _ := newTestInfo()
+	pieces := make([]byte, 0, 20*len(inf.Pieces))
+	for _, p := range inf.Pieces {
+		pieces = append(pieces, p[:]...)
+	}
+	metadata, err := Marshal(map[string]any{
+		"name":         inf.Name,
+		"length":       inf.Length,
+		"piece length": inf.PieceLength,
+		"pieces":       pieces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := newTestSwarm(t)
+	sw.hash = sha1.Sum(metadata)
+	sw.metadata = metadata
+	done := make(chan struct{})
+	defer close(done)
+	sw.worker = func(p *peer) {
+		defer p.close()
+		p.unchoke()
+		p.serve(done)
+	}
+	l.register(sw)
+	defer l.unregister(sw)
+
+	s := newTestSession(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seeder := net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Port()))
+	got, err := s.fetchMetadata(ctx, sw.hash, []string{"127.0.0.1:1", seeder})
+	if err != nil {
+		t.Fatalf("fetchMetadata failed: %v", err)
+	}
+	if got.Hash != sw.hash || got.Name != inf.Name || len(got.Pieces) != len(inf.Pieces) {
+		t.Errorf("unexpected info %+v", got)
+	}
+
+	if _, err := s.fetchMetadata(ctx, [20]byte{1}, []string{"127.0.0.1:1"}); err == nil {
+		t.Error("expected an error without any peer sending the metadata")
+	}
+}
+
+func TestSessionCrawlWithoutDHT(t *testing.T) {
+	s := newTestSession(t)
+	if err := s.Crawl(context.Background(), true, func([20]byte, *TorrentInfo) {}); err == nil {
+		t.Error("expected an error for a session without DHT node")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 )
 
 // Extension messages
@@ -14,56 +16,186 @@ const (
 	eReject
 )
 
-// ParseExtensionsHandshake parses an extension handshake, returning its m map and metadata size
-func ParseExtensionsHandshake(payload []byte) (map[string]uint8, int, error) {
+// IDs we assign to the extension messages we support, advertised in our extension handshake
+const (
+	pexID      uint8 = 1 // ut_pex (BEP 11)
+	metadataID uint8 = 2 // ut_metadata (BEP 9)
+)
+
+// clientVersion is the client name and version we advertise in our extension handshake
+const clientVersion = "go-torrent 0.1.4"
+
+// maxPeerRequests is the number of outstanding requests we accept from a peer
+const maxPeerRequests = 250
+
+// ExtensionHandshake holds the fields of an extension handshake (BEP 10)
+type ExtensionHandshake struct {
+	M            map[string]uint8 // extension names to the IDs the sender wants to receive them with
+	Version      string           // v: client name and version
+	Port         int              // p: TCP port the sender listens on
+	ReqQ         int              // reqq: number of outstanding requests the sender accepts
+	YourIP       net.IP           // yourip: the IP of the receiver, as seen by the sender
+	MetadataSize int              // metadata_size: size of the info dictionary (BEP 9)
+}
+
+// ExtensionsHandshake returns a serialised extension handshake
+// the zero fields of h are left out
+func ExtensionsHandshake(h *ExtensionHandshake) []byte {
+	m := make(map[string]bencode, len(h.M))
+	for name, id := range h.M {
+		m[name] = bencode{Int: int(id)}
+	}
+	dict := map[string]bencode{"m": {Dict: m}}
+	if h.Version != "" {
+		dict["v"] = bencode{Str: h.Version}
+	}
+	if h.Port != 0 {
+		dict["p"] = bencode{Int: h.Port}
+	}
+	if h.ReqQ != 0 {
+		dict["reqq"] = bencode{Int: h.ReqQ}
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = bencode{Str: string(ip4)}
+	} else if len(h.YourIP) == net.IPv6len {
+		dict["yourip"] = bencode{Str: string(h.YourIP)}
+	}
+	if h.MetadataSize != 0 {
+		dict["metadata_size"] = bencode{Int: h.MetadataSize}
+	}
+	payload := append([]byte{0}, Encode(&bencode{Dict: dict})...)
+	return (&Message{MExtended, payload}).serialise()
+}
+
+// ParseExtensionHandshake parses the payload of an extension handshake
+// only the m dictionary is required, the other fields are left to zero if missing
+func ParseExtensionHandshake(payload []byte) (*ExtensionHandshake, error) {
 	ben, err := decode(bufio.NewReader(bytes.NewReader(payload)), new(bytes.Buffer), false)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	if ben.Dict == nil {
-		return nil, 0, errors.New("extension message has no dictionary")
+		return nil, errors.New("extension message has no dictionary")
 	}
 	dict := ben.Dict
 	m, ok := dict["m"]
 	if !ok || m.Dict == nil {
-		return nil, 0, errors.New("extension message has no \"m\" key")
+		return nil, errors.New("extension message has no \"m\" key")
 	}
 
-	metaSize, ok := dict["metadata_size"]
-	if !ok || metaSize.Int == 0 {
-		return nil, 0, errors.New("extension message has no \"metadata_size\" key")
+	h := &ExtensionHandshake{
+		M:            make(map[string]uint8),
+		Version:      dict["v"].Str,
+		Port:         dict["p"].Int,
+		ReqQ:         dict["reqq"].Int,
+		MetadataSize: dict["metadata_size"].Int,
 	}
-
-	ext := make(map[string]uint8)
 	for key, val := range m.Dict {
-		ext[key] = uint8(val.Int)
+		h.M[key] = uint8(val.Int)
+	}
+	if ip := dict["yourip"].Str; len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		h.YourIP = net.IP(ip)
 	}
-	return ext, metaSize.Int, nil
+	return h, nil
 }
 
-// ParseExtensionsMetadata parses an extension metadata message
-// returns its payload and the piece index
-// a nil payload means it was a reject message
-func ParseExtensionsMetadata(payload []byte) ([]byte, int, error) {
+// ParseExtensionsHandshake parses an extension handshake, returning its m map and metadata size
+func ParseExtensionsHandshake(payload []byte) (map[string]uint8, int, error) {
+	h, err := ParseExtensionHandshake(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.MetadataSize == 0 {
+		return nil, 0, errors.New("extension message has no \"metadata_size\" key")
+	}
+	return h.M, h.MetadataSize, nil
+}
+
+// metadataMessage is a ut_metadata message (BEP 9)
+type metadataMessage struct {
+	msgType   uint8
+	piece     int
+	totalSize int
+	data      []byte // the metadata piece of a data message
+}
+
+// parseMetadataMessage parses the payload of a ut_metadata message
+func parseMetadataMessage(payload []byte) (*metadataMessage, error) {
 	br := bufio.NewReader(bytes.NewReader(payload))
 	ben, err := decode(br, new(bytes.Buffer), false)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	if ben.Dict == nil {
-		return nil, 0, errors.New("nil dictionary in payload")
+		return nil, errors.New("nil dictionary in payload")
 	}
 	msgType, ok := ben.Dict["msg_type"]
 	if !ok {
-		return nil, 0, errors.New("payload missing \"msg_type\" entry")
-	}
-	if uint8(msgType.Int) == eReject {
-		return nil, 0, nil
+		return nil, errors.New("payload missing \"msg_type\" entry")
 	}
 	index, ok := ben.Dict["piece"]
 	if !ok {
-		return nil, 0, errors.New("payload missing \"piece\" entry")
+		return nil, errors.New("payload missing \"piece\" entry")
+	}
+	msg := &metadataMessage{
+		msgType:   uint8(msgType.Int),
+		piece:     index.Int,
+		totalSize: ben.Dict["total_size"].Int,
+	}
+	if msg.msgType == eData {
+		if msg.data, err = io.ReadAll(br); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// ParseExtensionsMetadata parses an extension metadata message
+// returns its payload and the piece index
+// a nil payload means it was a reject message
+func ParseExtensionsMetadata(payload []byte) ([]byte, int, error) {
+	msg, err := parseMetadataMessage(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch msg.msgType {
+	case eData:
+		if msg.data == nil {
+			msg.data = []byte{}
+		}
+		return msg.data, msg.piece, nil
+	case eReject:
+		return nil, 0, nil
 	}
-	p, err := io.ReadAll(br)
-	return p, index.Int, err
+	return nil, 0, fmt.Errorf("unexpected metadata message type %d", msg.msgType)
+}
+
+// MetadataData returns a serialised ut_metadata data message
+// carrying the piece at index of metadata, given the extension id of the receiver
+// an index past the end of the metadata gets a piece without data
+func MetadataData(extID uint8, index int, metadata []byte) []byte {
+	start, end := len(metadata), len(metadata)
+	if index >= 0 && index < metadataPieces(len(metadata)) {
+		start = index * chunkSize
+		end = min(start+chunkSize, len(metadata))
+	}
+	dict := map[string]bencode{
+		"msg_type":   {Int: int(eData)},
+		"piece":      {Int: index},
+		"total_size": {Int: len(metadata)},
+	}
+	payload := append([]byte{extID}, Encode(&bencode{Dict: dict})...)
+	payload = append(payload, metadata[start:end]...)
+	return (&Message{MExtended, payload}).serialise()
+}
+
+// metadataPieces returns the number of ut_metadata pieces of metadata of the given size
+func metadataPieces(size int) int {
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// MetadataReject returns a serialised ut_metadata reject message for the piece at index
+func MetadataReject(extID uint8, index int) []byte {
+	msg := []byte(fmt.Sprintf("d8:msg_typei%de5:piecei%dee", eReject, index))
+	return (&Message{MExtended, append([]byte{extID}, msg...)}).serialise()
 }
@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	sent := &ExtensionHandshake{
+		M:            map[string]uint8{"ut_metadata": metadataID, "ut_pex": pexID},
+		Version:      clientVersion,
+		Port:         6881,
+		ReqQ:         maxPeerRequests,
+		YourIP:       net.ParseIP("10.0.0.1"),
+		MetadataSize: 1234,
+	}
+	msg := ExtensionsHandshake(sent)
+	// skip the length, type and extended message ID
+	got, err := ParseExtensionHandshake(msg[6:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.M["ut_metadata"] != metadataID || got.M["ut_pex"] != pexID {
+		t.Errorf("unexpected m dictionary %v", got.M)
+	}
+	if got.Version != sent.Version || got.Port != sent.Port || got.ReqQ != sent.ReqQ || got.MetadataSize != sent.MetadataSize {
+		t.Errorf("expected %+v, got %+v", sent, got)
+	}
+	if !got.YourIP.Equal(sent.YourIP) || len(got.YourIP) != net.IPv4len {
+		t.Errorf("expected compact IP %s, got %v", sent.YourIP, []byte(got.YourIP))
+	}
+}
+
+func TestExtensionHandshakeOptionalFields(t *testing.T) {
+	msg := ExtensionsHandshake(&ExtensionHandshake{M: map[string]uint8{"ut_pex": pexID}})
+	got, err := ParseExtensionHandshake(msg[6:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != "" || got.Port != 0 || got.ReqQ != 0 || got.YourIP != nil || got.MetadataSize != 0 {
+		t.Errorf("expected only the m dictionary, got %+v", got)
+	}
+	if _, _, err := ParseExtensionsHandshake(msg[6:]); err == nil {
+		t.Error("expected an error for a handshake without metadata size")
+	}
+}
+
+func TestSetupPeerExchangesExtensionHandshakes(t *testing.T) {
+	sw := newTestSwarm(t)
+	sw.port = 6882
+	sw.metadata = []byte("d4:name4:teste")
+	handshake := plainHandshake([20]byte{}, [20]byte{})
+	handshake[1+len(Protocol)+5] = ExtensionExtended
+	p := setupTestPeer(t, sw, handshake, func(conn net.Conn) {
+		if msg, err := ReadMessage(conn); err != nil || msg.Type != MBitfield {
+			t.Errorf("expected our bitfield, got %v (%v)", msg, err)
+		}
+		msg, err := ReadMessage(conn)
+		if err != nil || msg.Type != MExtended || msg.Payload[0] != 0 {
+			t.Errorf("expected our extension handshake, got %v (%v)", msg, err)
+			return
+		}
+		ours, err := ParseExtensionHandshake(msg.Payload[1:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if ours.Port != sw.port || ours.MetadataSize != len(sw.metadata) || ours.Version != clientVersion || ours.ReqQ != maxPeerRequests {
+			t.Errorf("unexpected extension handshake %+v", ours)
+		}
+		conn.Write(ExtensionsHandshake(&ExtensionHandshake{
+			M:       map[string]uint8{"ut_pex": 3},
+			Version: "other 1.0",
+			Port:    51413,
+			ReqQ:    2,
+			YourIP:  net.ParseIP("192.0.2.1"),
+		}))
+		conn.Write(BitfieldMessage(fullBitfield(len(sw.info.Pieces))))
+	})
+	if p.clientName != "other 1.0" || p.reqq != 2 || p.listenPort != 51413 || p.extensions["ut_pex"] != 3 {
+		t.Errorf("remote extension handshake not recorded: %+v", p)
+	}
+	if !p.yourIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected our IP to be 192.0.2.1, got %s", p.yourIP)
+	}
+	if p.requestLimit() != 2 {
+		t.Errorf("expected the request limit to follow reqq, got %d", p.requestLimit())
+	}
+}
+
+func TestMetadataDataRoundTrip(t *testing.T) {
+	metadata := bytes.Repeat([]byte("x"), chunkSize+10)
+	for index, expected := range [][]byte{metadata[:chunkSize], metadata[chunkSize:]} {
+		msg := MetadataData(metadataID, index, metadata)
+		data, piece, err := ParseExtensionsMetadata(msg[6:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if piece != index || !bytes.Equal(data, expected) {
+			t.Errorf("piece %d: got piece %d with %d bytes", index, piece, len(data))
+		}
+	}
+	msg := MetadataData(metadataID, 1<<49+1<<48, metadata)
+	if data, _, err := ParseExtensionsMetadata(msg[6:]); err != nil || len(data) != 0 {
+		t.Errorf("expected no data for a huge index, got %d bytes (%v)", len(data), err)
+	}
+	data, _, err := ParseExtensionsMetadata(MetadataReject(metadataID, 1)[6:])
+	if err != nil || data != nil {
+		t.Errorf("expected a reject, got %d bytes (%v)", len(data), err)
+	}
+}
+
+// requestMetadata sends a ut_metadata request for index to p and returns the answer
+func requestMetadata(t *testing.T, p *peer, remote net.Conn, index int) *metadataMessage {
+	t.Helper()
+	go p.read(time.Second)
+	if _, err := remote.Write(RequestMetaData(metadataID, index)); err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MExtended || msg.Payload[0] != 5 {
+		t.Fatalf("expected a ut_metadata message, got type %d", msg.Type)
+	}
+	answer, err := parseMetadataMessage(msg.Payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func TestPeerServesMetadata(t *testing.T) {
+	sw := newTestSwarm(t)
+	sw.metadata = []byte("d4:name4:teste")
+	p, remote := newTestPeer(sw)
+	defer p.close()
+	p.extensions = map[string]uint8{"ut_metadata": 5}
+
+	answer := requestMetadata(t, p, remote, 0)
+	if answer.msgType != eData || answer.piece != 0 || answer.totalSize != len(sw.metadata) || !bytes.Equal(answer.data, sw.metadata) {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	answer = requestMetadata(t, p, remote, 1)
+	if answer.msgType != eReject || answer.piece != 1 {
+		t.Errorf("expected a reject for a piece past the end, got %+v", answer)
+	}
+	// index*chunkSize overflows
+	huge := 1<<49 + 1<<48
+	answer = requestMetadata(t, p, remote, huge)
+	if answer.msgType != eReject || answer.piece != huge {
+		t.Errorf("expected a reject for a huge piece, got %+v", answer)
+	}
+}
+
+func TestPeerRejectsMetadataWithoutInfo(t *testing.T) {
+	p, remote := newTestPeer(&swarm{})
+	defer p.close()
+	p.extensions = map[string]uint8{"ut_metadata": 5}
+
+	if answer := requestMetadata(t, p, remote, 0); answer.msgType != eReject {
+		t.Errorf("expected a reject, got %+v", answer)
+	}
+}
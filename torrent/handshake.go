@@ -10,6 +10,7 @@ const HandshakeSize int = 1 + len(Protocol) + 8 + 20 + 20
 // Extension bits
 const (
 	ExtensionDHT      = 0x01 // reserved[7] bit 0 - BEP 5
+	ExtensionFast     = 0x04 // reserved[7] bit 2 - BEP 6
 	ExtensionExtended = 0x10 // reserved[5] bit 4 - BEP 10
 )
 
@@ -27,8 +28,8 @@ func Handshake(metadataHash, id [20]byte) []byte {
 	extensions := make([]byte, 8)
 	// support extensions (BEP 10)
 	extensions[5] = 0x10
-	// support DHT (BEP 5)
-	extensions[7] = 0x01
+	// support DHT (BEP 5) and the Fast Extension (BEP 6)
+	extensions[7] = ExtensionDHT | ExtensionFast
 	copy(res[1+protocolLen:], extensions)
 
 	// 20 bytes for the the hash of the metadata of the torrent
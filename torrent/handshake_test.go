@@ -9,12 +9,12 @@ func TestHandshake(t *testing.T) {
 	metadata := [20]byte{'m', 'e', 't', 'a', 'd', 'a', 't', 'a', ' ', 'f', 'o', 'r', ' ', 't', 'o', 'r', 'r', 'e', 'n', 't'}
 	id := [20]byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9'}
 	handshake := Handshake(metadata, id)
-	// Reserved bytes: [5]=0x10 (extensions), [7]=0x01 (DHT)
+	// Reserved bytes: [5]=0x10 (extensions), [7]=0x05 (DHT and fast)
 	expected := append(
 		append(
 			[]byte{'\x13',
 				'B', 'i', 't', 'T', 'o', 'r', 'r', 'e', 'n', 't', ' ', 'p', 'r', 'o', 't', 'o', 'c', 'o', 'l',
-				'\x00', '\x00', '\x00', '\x00', '\x00', '\x10', '\x00', '\x01'},
+				'\x00', '\x00', '\x00', '\x00', '\x00', '\x10', '\x00', '\x05'},
 			metadata[:]...),
 		id[:]...)
 	if !bytes.Equal(handshake, expected) {
@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"net/url"
 	"path/filepath"
 )
 
@@ -141,11 +140,6 @@ func (inf *TorrentInfo) Multi() bool {
 	return len(inf.Files) > 1
 }
 
-// getPeersHTTP returns the list of peers using HTTP from an info dictionary and client ID
-func (inf *TorrentInfo) getPeersHTTP(clientID [20]byte, trackerURL *url.URL) (*TrackerResponse, error) {
-	return QueryHTTPTracker(trackerURL, inf.Hash, clientID, inf.Length)
-}
-
 // ParseInfo parses a bencoded dictionary as an TorrentInfo struct
 func ParseInfo(info []byte, hash [20]byte) (*TorrentInfo, error) {
 	ben, err := decode(bufio.NewReader(bytes.NewReader(info)), new(bytes.Buffer), false)
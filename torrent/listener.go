@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BEP 3 recommended port range for incoming peer connections
+const (
+	portRangeStart = 6881
+	portRangeEnd   = 6889
+)
+
+// Listener accepts incoming peer connections and hands them
+// to the active torrent matching the info hash of their handshake
+type Listener struct {
+	ln   net.Listener
+	port int
+
+	mu     sync.RWMutex
+	swarms map[[20]byte]*swarm
+}
+
+// Listen starts listening for incoming peer connections on the given TCP port
+// If port is 0, the first free port in the range 6881-6889 is used
+func Listen(port int) (*Listener, error) {
+	var ln net.Listener
+	var err error
+	if port != 0 {
+		ln, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+	} else {
+		for port = portRangeStart; port <= portRangeEnd; port++ {
+			ln, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	l := &Listener{
+		ln:     ln,
+		port:   ln.Addr().(*net.TCPAddr).Port,
+		swarms: make(map[[20]byte]*swarm),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Port returns the port the listener is bound to
+func (l *Listener) Port() int {
+	return l.port
+}
+
+// Close stops accepting incoming connections
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// register makes the listener hand the connections for the torrent of sw to it
+func (l *Listener) register(sw *swarm) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.swarms[sw.hash] = sw
+}
+
+// unregister stops handing connections to sw
+func (l *Listener) unregister(sw *swarm) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.swarms[sw.hash] == sw {
+		delete(l.swarms, sw.hash)
+	}
+}
+
+// lookup returns the swarm of the torrent with the given info hash, if active
+func (l *Listener) lookup(hash [20]byte) *swarm {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.swarms[hash]
+}
+
+// acceptLoop accepts incoming connections until the listener is closed
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept peer connection: %s", err)
+			continue
+		}
+		go l.handleConn(conn)
+	}
+}
+
+// handleConn performs the handshake with an incoming connection
+// and hands it to the worker of the torrent it asks for
+func (l *Listener) handleConn(conn net.Conn) {
+	address := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(peerConnectTimeout))
+	received := make([]byte, HandshakeSize)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		conn.Close()
+		return
+	}
+	startLen := 1 + len(Protocol)
+	if received[0] != byte(len(Protocol)) || !bytes.Equal(received[1:startLen], []byte(Protocol)) {
+		conn.Close()
+		return
+	}
+	var hash [20]byte
+	copy(hash[:], received[startLen+8:startLen+28])
+	sw := l.lookup(hash)
+	if sw == nil || !sw.tryAcquireConn() {
+		conn.Close()
+		return
+	}
+	defer sw.releaseConn()
+	if _, err := conn.Write(Handshake(sw.hash, sw.clientID)); err != nil {
+		conn.Close()
+		return
+	}
+	p, err := setupPeer(conn, address, received, sw)
+	if err != nil {
+		log.Printf("Could not accept peer from %s: %s", address, err)
+		return
+	}
+	p.incoming = true
+	log.Printf("Accepted peer from %s", address)
+	sw.handlePeer(p)
+}
@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// plainHandshake returns a handshake without any extension bit set
+func plainHandshake(hash, id [20]byte) []byte {
+	handshake := Handshake(hash, id)
+	clear(handshake[1+len(Protocol) : 1+len(Protocol)+8])
+	return handshake
+}
+
+func TestListenerAcceptsRegisteredTorrent(t *testing.T) {
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	sw := newTestSwarm(t)
+	sw.hash = [20]byte{'h', 'a', 's', 'h'}
+	sw.clientID = [20]byte{'u', 's'}
+	accepted := make(chan *peer, 1)
+	sw.worker = func(p *peer) { accepted <- p }
+	l.register(sw)
+	defer l.unregister(sw)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	remoteID := [20]byte{'t', 'h', 'e', 'm'}
+	conn.Write(plainHandshake(sw.hash, remoteID))
+	conn.Write(BitfieldMessage([]byte{0b10100000}))
+
+	received := make([]byte, HandshakeSize)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if !bytes.Equal(received[HandshakeSize-20:], sw.clientID[:]) {
+		t.Errorf("expected our client ID in the handshake, got %v", received[HandshakeSize-20:])
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("failed to read bitfield: %v", err)
+	}
+	if msg.Type != MBitfield {
+		t.Errorf("expected our bitfield, got message of type %d", msg.Type)
+	}
+
+	select {
+	case p := <-accepted:
+		defer p.close()
+		if !p.bitfield.get(0) || p.bitfield.get(1) || !p.bitfield.get(2) {
+			t.Errorf("unexpected peer bitfield %08b", p.bitfield)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was not handed to the worker")
+	}
+}
+
+func TestListenerRejectsUnknownTorrent(t *testing.T) {
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(plainHandshake([20]byte{'u', 'n', 'k'}, [20]byte{}))
+	if _, err := io.ReadFull(conn, make([]byte, HandshakeSize)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
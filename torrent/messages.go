@@ -20,8 +20,13 @@ const (
 	MRequest
 	MPiece
 	MCancel
-	MPort     MessageType = 9 // DHT port (BEP 5)
-	MExtended MessageType = 20
+	MPort        MessageType = 9  // DHT port (BEP 5)
+	MSuggest     MessageType = 13 // Fast Extension (BEP 6)
+	MHaveAll     MessageType = 14
+	MHaveNone    MessageType = 15
+	MReject      MessageType = 16
+	MAllowedFast MessageType = 17
+	MExtended    MessageType = 20
 )
 
 // Message represents a Message: its type and payload
@@ -99,6 +104,15 @@ func (msg *Message) serialise() []byte {
 	return serialised
 }
 
+// Choke returns a serialised choke Message
+func Choke() []byte {
+	msg := &Message{
+		Type:    MChoke,
+		Payload: []byte{},
+	}
+	return msg.serialise()
+}
+
 // Unchoke returns a serialised unchoke Message
 func Unchoke() []byte {
 	msg := &Message{
@@ -117,6 +131,77 @@ func Interested() []byte {
 	return msg.serialise()
 }
 
+// NotInterested returns a serialised not interested Message
+func NotInterested() []byte {
+	msg := &Message{
+		Type:    MNotInterested,
+		Payload: []byte{},
+	}
+	return msg.serialise()
+}
+
+// HaveAll returns a serialised have all Message (BEP 6)
+func HaveAll() []byte {
+	msg := &Message{
+		Type:    MHaveAll,
+		Payload: []byte{},
+	}
+	return msg.serialise()
+}
+
+// HaveNone returns a serialised have none Message (BEP 6)
+func HaveNone() []byte {
+	msg := &Message{
+		Type:    MHaveNone,
+		Payload: []byte{},
+	}
+	return msg.serialise()
+}
+
+// RejectRequest returns a serialised reject request Message for a block (BEP 6)
+func RejectRequest(index, begin, length int) []byte {
+	payload := make([]byte, 3*4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	binary.BigEndian.PutUint32(payload[4:], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:], uint32(length))
+	msg := &Message{
+		Type:    MReject,
+		Payload: payload,
+	}
+	return msg.serialise()
+}
+
+// AllowedFast returns a serialised allowed fast Message for a piece (BEP 6)
+func AllowedFast(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	msg := &Message{
+		Type:    MAllowedFast,
+		Payload: payload,
+	}
+	return msg.serialise()
+}
+
+// SuggestPiece returns a serialised suggest piece Message (BEP 6)
+func SuggestPiece(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	msg := &Message{
+		Type:    MSuggest,
+		Payload: payload,
+	}
+	return msg.serialise()
+}
+
+// BitfieldMessage returns a bitfield message advertising the pieces we have
+func BitfieldMessage(bf []byte) []byte {
+	msg := &Message{
+		Type:    MBitfield,
+		Payload: bf,
+	}
+	return msg.serialise()
+}
+
 // Have returns a have message for a chunk
 func Have(index int) []byte {
 	payload := make([]byte, 4)
@@ -141,6 +226,30 @@ func RequestPiece(index, begin, length int) []byte {
 	return msg.serialise()
 }
 
+// ParseRequest extracts the piece index, beginning and length of a request message payload
+func ParseRequest(payload []byte) (index, begin, length int, err error) {
+	if len(payload) != 3*4 {
+		return 0, 0, 0, fmt.Errorf("invalid request message length: %d", len(payload))
+	}
+	index = int(binary.BigEndian.Uint32(payload))
+	begin = int(binary.BigEndian.Uint32(payload[4:]))
+	length = int(binary.BigEndian.Uint32(payload[8:]))
+	return index, begin, length, nil
+}
+
+// PieceBlock returns a piece message carrying a block of a piece
+func PieceBlock(index, begin int, block []byte) []byte {
+	payload := make([]byte, 2*4+len(block))
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	binary.BigEndian.PutUint32(payload[4:], uint32(begin))
+	copy(payload[8:], block)
+	msg := &Message{
+		Type:    MPiece,
+		Payload: payload,
+	}
+	return msg.serialise()
+}
+
 // RequestMetaData requests a metadata piece for a certain index given the extension id
 func RequestMetaData(extID uint8, index int) []byte {
 	msg := []byte(fmt.Sprintf("d8:msg_typei0e5:piecei%dee", index))
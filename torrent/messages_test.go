@@ -110,3 +110,33 @@ func TestParsePortMessageInvalid(t *testing.T) {
 		t.Error("Expected error for invalid payload length")
 	}
 }
+
+func TestParseRequest(t *testing.T) {
+	msg := RequestPiece(3, 1<<14, 1<<14)
+	index, begin, length, err := ParseRequest(msg[5:])
+	if err != nil {
+		t.Fatalf("ParseRequest failed: %v", err)
+	}
+	if index != 3 || begin != 1<<14 || length != 1<<14 {
+		t.Errorf("Expected (3, %d, %d), got (%d, %d, %d)", 1<<14, 1<<14, index, begin, length)
+	}
+
+	if _, _, _, err := ParseRequest([]byte{0, 0, 0, 1}); err == nil {
+		t.Error("Expected error for invalid payload length")
+	}
+}
+
+func TestPieceBlock(t *testing.T) {
+	block := []byte("block of data")
+	msg := PieceBlock(7, 32, block)
+	if msg[4] != byte(MPiece) {
+		t.Errorf("Expected message type %d, got %d", MPiece, msg[4])
+	}
+	c, err := parsePiece(msg[5:])
+	if err != nil {
+		t.Fatalf("parsePiece failed: %v", err)
+	}
+	if c.index != 7 || c.begin != 32 || !bytes.Equal(c.value, block) {
+		t.Errorf("Unexpected chunk: index %d begin %d value %q", c.index, c.begin, c.value)
+	}
+}
@@ -1,13 +1,19 @@
 package torrent
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,11 +30,18 @@ const peerConnectTimeout = 5 * time.Second
 // peerReadTimeout is the deadline for reading a piece from a peer
 const peerReadTimeout = 20 * time.Second
 
+// peerIdleTimeout is how long an idle worker waits for a message before checking for work again
+const peerIdleTimeout = 100 * time.Millisecond
+
+// maxBlockRequest is the largest block a peer may request from us (128 KiB)
+const maxBlockRequest int = 1 << 17
+
 type chunkType int
 
 const (
-	cFile chunkType = iota // a piece of the file
-	cInfo                  // a piece of the info dictionary
+	cFile   chunkType = iota // a piece of the file
+	cInfo                    // a piece of the info dictionary
+	cReject                  // a request the peer refused (BEP 6)
 )
 
 // chunk of a piece
@@ -57,14 +70,43 @@ type Result struct {
 // peer represents a connection to a peer
 type peer struct {
 	conn         net.Conn
+	reader       *bufio.Reader // buffered reader of conn
+	address      string
 	bitfield     bitfield
-	choked       bool
+	haveAll      bool        // the peer sent have all, even before we knew the number of pieces
+	queue        *PieceQueue // the queue tracking the pieces of the peer once registered
+	choked       bool        // the peer is choking us
+	interested   atomic.Bool // the peer is interested in our pieces
+	amChoking    atomic.Bool // we are choking the peer
+	fast         bool        // the peer supports the Fast Extension (BEP 6)
+	incoming     bool        // the peer connected to us: its address is not the one it listens on
 	extensions   map[string]uint8
 	metadataSize int
+	clientName   string // v of the extension handshake of the peer
+	reqq         int    // number of outstanding requests the peer accepts, 0 if unknown
+	yourIP       net.IP // our IP as seen by the peer
+	listenPort   int    // port the peer listens on, 0 if unknown
+	swarm        *swarm // the torrent we serve pieces of
+
+	allowedFast map[int]bool    // pieces we may download while choked
+	suggested   map[int]bool    // pieces the peer suggests we download
+	rejected    map[int]bool    // pieces the peer refused to send us while unchoked
+	pexSent     map[string]bool // peers we told the peer about through PEX
+
+	downloaded atomic.Int64 // bytes of pieces received from the peer
+	uploaded   atomic.Int64 // bytes of pieces sent to the peer
+
+	pending   []*Message    // messages received during the setup, handed first by readLoop
+	messages  chan *Message // messages received by readLoop
+	readErr   error         // error that stopped readLoop
+	closed    chan struct{}
+	closeOnce sync.Once
+	writeMu   sync.Mutex
 }
 
-// newPeer creates a new peer from a handshake and a peer address
-func newPeer(handshake []byte, address string) (*peer, error) {
+// newPeer connects to the peer at address and performs the handshake
+// sw holds the pieces we can serve to this peer
+func newPeer(handshake []byte, address string, sw *swarm) (*peer, error) {
 	conn, err := net.DialTimeout("tcp", address, peerConnectTimeout)
 	if err != nil {
 		return nil, err
@@ -72,6 +114,7 @@ func newPeer(handshake []byte, address string) (*peer, error) {
 	// Performing the handshake
 	_, err = conn.Write(handshake)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	// We should get a handshake back
@@ -94,58 +137,180 @@ func newPeer(handshake []byte, address string) (*peer, error) {
 		return nil, fmt.Errorf("expected handshake with metadata\n%v got\n%v instead", handshake[startLen+8:startLen+28], received[startLen+8:startLen+28])
 	}
 
-	// check for extensions
-	var ext map[string]uint8
-	size := 0
-	extensions := received[startLen : startLen+8]
-	if extensions[5]&0x10 != 0 {
-		payload, err := ReadExtensions(conn)
+	return setupPeer(conn, address, received, sw)
+}
+
+// setupPeer exchanges the messages following the handshake with a connected peer
+// received is the handshake the peer sent us; the connection is closed on failure
+func setupPeer(conn net.Conn, address string, received []byte, sw *swarm) (*peer, error) {
+	startLen := 1 + len(Protocol)
+	reserved := received[startLen : startLen+8]
+	p := &peer{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		address:     address,
+		choked:      true,
+		fast:        reserved[7]&ExtensionFast != 0,
+		swarm:       sw,
+		allowedFast: make(map[int]bool),
+		suggested:   make(map[int]bool),
+		rejected:    make(map[int]bool),
+		messages:    make(chan *Message),
+		closed:      make(chan struct{}),
+	}
+	p.amChoking.Store(true)
+	if sw.info != nil {
+		p.bitfield = make(bitfield, (len(sw.info.Pieces)+7)/8)
+	}
+
+	// Advertise the pieces we have
+	var msg []byte
+	switch bf := sw.bitfield(); {
+	case p.fast && bf == nil:
+		msg = HaveNone()
+	case p.fast && sw.complete():
+		msg = HaveAll()
+	case bf != nil:
+		msg = BitfieldMessage(bf)
+	}
+	if msg != nil {
+		if _, err := conn.Write(msg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	needExtensions := reserved[5]&ExtensionExtended != 0
+	if needExtensions {
+		hs := &ExtensionHandshake{
+			M:            map[string]uint8{"ut_metadata": metadataID, "ut_pex": pexID},
+			Version:      clientVersion,
+			Port:         sw.port,
+			ReqQ:         maxPeerRequests,
+			MetadataSize: len(sw.rawMetadata()),
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			hs.YourIP = addr.IP
+		}
+		if _, err := conn.Write(ExtensionsHandshake(hs)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// The peer should send its extension handshake if it supports extensions,
+	// and advertise its pieces with a bitfield, have all or have none message.
+	// A peer with no pieces might advertise nothing at all.
+	needBitfield := true
+	deadline := time.Now().Add(peerConnectTimeout)
+	for needExtensions || needBitfield {
+		// wait for the next message without consuming it, so that it can be read whole
+		conn.SetReadDeadline(deadline)
+		if _, err := p.reader.Peek(1); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			conn.Close()
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+		msg, err := ReadMessage(p.reader)
 		if err != nil {
 			conn.Close()
 			return nil, err
 		}
-		msgType := payload[0]
-		if msgType == 0 { // handshake
-			ext, size, err = ParseExtensionsHandshake(payload[1:])
-			if err != nil {
+		switch {
+		case msg.Type == MExtended && len(msg.Payload) > 0 && msg.Payload[0] == 0:
+			// extension handshake; peers without metadata may not advertise its size
+			if hs, err := ParseExtensionHandshake(msg.Payload[1:]); err == nil {
+				p.extensions = hs.M
+				p.metadataSize = hs.MetadataSize
+				p.clientName = hs.Version
+				p.reqq = hs.ReqQ
+				p.yourIP = hs.YourIP
+				p.listenPort = hs.Port
+			}
+			needExtensions = false
+		case needBitfield && (msg.Type == MBitfield || msg.Type == MHaveAll || msg.Type == MHaveNone):
+			if _, err := p.handle(msg); err != nil {
 				conn.Close()
 				return nil, err
 			}
+			needBitfield = false
+		default:
+			// the peer skipped its bitfield: handle the message with the following ones
+			p.pending = append(p.pending, msg)
+			needBitfield = false
 		}
 	}
 
-	// next we should receive a bitfield message
-	bitfield, err := ReadBitfield(conn)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	// the handshake is over: clear any deadline before handing the connection to readLoop
+	conn.SetDeadline(time.Time{})
+	go p.readLoop()
+	return p, nil
+}
+
+// readLoop reads messages from the connection and hands them to the worker
+// until the connection fails or the peer is closed
+// the messages received during the setup of the connection are handed first
+func (p *peer) readLoop() {
+	defer close(p.messages)
+	for {
+		var msg *Message
+		if len(p.pending) > 0 {
+			msg, p.pending = p.pending[0], p.pending[1:]
+		} else {
+			var err error
+			msg, err = ReadMessage(p.reader)
+			if err != nil {
+				p.readErr = err
+				return
+			}
+		}
+		select {
+		case p.messages <- msg:
+		case <-p.closed:
+			return
+		}
 	}
+}
 
-	return &peer{
-		conn:         conn,
-		bitfield:     bitfield,
-		choked:       true,
-		extensions:   ext,
-		metadataSize: size,
-	}, nil
+// close closes the connection to the peer
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.conn.Close()
+	})
 }
 
-// unchoke sends a unchoke message
-func (p *peer) unchoke() error {
-	unchokeMsg := Unchoke()
-	_, err := p.conn.Write(unchokeMsg)
+// send writes a serialised message to the peer
+// it is safe to call from multiple goroutines
+func (p *peer) send(msg []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err := p.conn.Write(msg)
 	return err
 }
 
-// startConn sends an unchoke message followed by an interested
-func (p *peer) startConn() error {
-	err := p.unchoke()
-	if err != nil {
-		return err
+// unchoke sends an unchoke message if we are choking the peer
+func (p *peer) unchoke() error {
+	if !p.amChoking.CompareAndSwap(true, false) {
+		return nil
 	}
-	interestedMsg := Interested()
-	_, err = p.conn.Write(interestedMsg)
-	return err
+	return p.send(Unchoke())
+}
+
+// choke sends a choke message if we are not choking the peer
+func (p *peer) choke() error {
+	if !p.amChoking.CompareAndSwap(false, true) {
+		return nil
+	}
+	return p.send(Choke())
+}
+
+// startConn tells the peer we are interested in its pieces
+// whether we upload to it is up to the choker
+func (p *peer) startConn() error {
+	return p.send(Interested())
 }
 
 // parsePiece parse a parse message as a chunk
@@ -176,44 +341,293 @@ func (p *peer) parseExtended(payload []byte) (*chunk, error) {
 	if len(payload) < 1 {
 		return nil, fmt.Errorf("expected message of length at least 1 got %d instead", len(payload))
 	}
-	parsed, index, err := ParseExtensionsMetadata(payload[1:])
-	if err != nil || parsed == nil {
-		return nil, err
+	switch payload[0] {
+	case 0:
+		// extension handshake, already handled during the setup
+		return nil, nil
+	case pexID:
+		pex, err := ParsePex(payload[1:])
+		if err != nil {
+			return nil, err
+		}
+		if p.swarm != nil {
+			// BEP 11 allows at most 50 added peers per message: the others are ignored
+			addresses := make([]string, min(len(pex.Added), maxPexPeers))
+			for i := range addresses {
+				addresses[i] = pex.Added[i].Address
+			}
+			if n := p.swarm.addPeers(addresses); n > 0 {
+				log.Printf("Learned %d peers from %s through PEX", n, p.address)
+			}
+		}
+		return nil, nil
+	case metadataID:
+		msg, err := parseMetadataMessage(payload[1:])
+		if err != nil {
+			return nil, err
+		}
+		switch msg.msgType {
+		case eRequest:
+			return nil, p.serveMetadata(msg.piece)
+		case eData:
+			return &chunk{
+				chunkType: cInfo,
+				index:     msg.piece,
+				begin:     msg.piece * chunkSize,
+				value:     msg.data,
+			}, nil
+		}
+		// a reject: the metadata download asks another peer
+		return nil, nil
 	}
-	return &chunk{
-		chunkType: cInfo,
-		index:     index,
-		begin:     index * chunkSize,
-		value:     parsed,
-	}, nil
+	// an extension we did not advertise
+	return nil, nil
 }
 
-// read reads and parses the first non keepalive message from the connection
-// fills the argument and the length of the piece in case of a piece message
-func (p *peer) read() (*chunk, error) {
-	msg, err := ReadMessage(p.conn)
+// serveMetadata answers a ut_metadata request with the piece at index of the info dictionary
+// or rejects it if we do not have the metadata yet
+func (p *peer) serveMetadata(index int) error {
+	extID := p.extensions["ut_metadata"]
+	if extID == 0 {
+		// the peer cannot receive our answer
+		return nil
+	}
+	var metadata []byte
+	if p.swarm != nil {
+		metadata = p.swarm.rawMetadata()
+	}
+	if index < 0 || index >= metadataPieces(len(metadata)) {
+		return p.send(MetadataReject(extID, index))
+	}
+	return p.send(MetadataData(extID, index, metadata))
+}
+
+// serveRequest answers a request message with the requested block
+// requests for pieces we do not have or sent while we choke the peer
+// are rejected if the peer supports the Fast Extension, ignored otherwise
+func (p *peer) serveRequest(payload []byte) error {
+	index, begin, length, err := ParseRequest(payload)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if length > maxBlockRequest {
+		return fmt.Errorf("requested a block too long: %d bytes", length)
 	}
+	if p.amChoking.Load() || p.swarm == nil || !p.swarm.hasPiece(index) {
+		if p.fast {
+			return p.send(RejectRequest(index, begin, length))
+		}
+		return nil
+	}
+	block, err := p.swarm.storage.readBlock(index, begin, length)
+	if err != nil {
+		return err
+	}
+	if err := p.send(PieceBlock(index, begin, block)); err != nil {
+		return err
+	}
+	p.uploaded.Add(int64(length))
+	p.swarm.uploaded.Add(int64(length))
+	return nil
+}
+
+// read waits at most timeout for the next message from the peer and handles it
+// returns the chunk in case of a piece message, and nil if nothing was received in time
+func (p *peer) read(timeout time.Duration) (*chunk, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-p.messages:
+		if !ok {
+			return nil, p.readErr
+		}
+		return p.handle(msg)
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+// serve answers the messages of the peer until done is closed or the connection fails
+// used once we have nothing left to download from the peer
+func (p *peer) serve(done <-chan struct{}) error {
+	p.send(NotInterested()) // best-effort, ignore error
+	for {
+		select {
+		case <-done:
+			return nil
+		case msg, ok := <-p.messages:
+			if !ok {
+				return p.readErr
+			}
+			if _, err := p.handle(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle parses a message received from the peer
+// returns the chunk in case of a piece message
+func (p *peer) handle(msg *Message) (*chunk, error) {
 	switch msg.Type {
 	case MChoke:
 		p.choked = true
-		p.unchoke()
 	case MUnchoke:
 		p.choked = false
+		clear(p.rejected)
+	case MInterested:
+		p.interested.Store(true)
+	case MNotInterested:
+		p.interested.Store(false)
+	case MRequest:
+		return nil, p.serveRequest(msg.Payload)
 	case MHave:
 		if len(msg.Payload) != 4 {
 			return nil, fmt.Errorf("expected payload length 4 got %d instead", len(msg.Payload))
 		}
-		p.bitfield.set(int(binary.BigEndian.Uint32(msg.Payload)))
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if !p.bitfield.get(index) {
+			bf := slices.Clone(p.bitfield)
+			bf.set(index)
+			p.setBitfield(bf)
+		}
+	case MBitfield:
+		p.setBitfield(msg.Payload)
 	case MPiece:
-		return parsePiece(msg.Payload)
+		c, err := parsePiece(msg.Payload)
+		if err == nil {
+			p.downloaded.Add(int64(len(c.value)))
+			if p.swarm != nil {
+				p.swarm.downloaded.Add(int64(len(c.value)))
+			}
+		}
+		return c, err
 	case MExtended:
 		return p.parseExtended(msg.Payload)
+	case MHaveAll, MHaveNone, MReject, MAllowedFast, MSuggest:
+		return p.handleFast(msg)
 	}
 	return nil, nil
 }
 
+// setBitfield replaces the bitfield of the peer, and its availability in the queue it is registered to
+func (p *peer) setBitfield(bf bitfield) {
+	if p.queue != nil {
+		p.queue.UnregisterPeer(p.bitfield)
+		p.queue.RegisterPeer(bf)
+	}
+	p.bitfield = bf
+}
+
+// sizeBitfield gives the bitfield of the peer the size of a torrent of n pieces once we know its info
+func (p *peer) sizeBitfield(n int) {
+	if p.haveAll {
+		p.setBitfield(fullBitfield(n))
+		return
+	}
+	bf := make(bitfield, (n+7)/8)
+	copy(bf, p.bitfield)
+	p.setBitfield(bf)
+}
+
+// register adds the pieces of the peer to the availability tracked by queue until unregister is called
+func (p *peer) register(queue *PieceQueue) {
+	p.queue = queue
+	queue.RegisterPeer(p.bitfield)
+}
+
+// unregister removes the pieces of the peer from the availability tracked by its queue
+func (p *peer) unregister() {
+	if p.queue != nil {
+		p.queue.UnregisterPeer(p.bitfield)
+		p.queue = nil
+	}
+}
+
+// handleFast parses a message of the Fast Extension (BEP 6)
+// returns a chunk of type cReject in case of a reject message
+func (p *peer) handleFast(msg *Message) (*chunk, error) {
+	if !p.fast {
+		return nil, fmt.Errorf("received a fast extension message of type %d without support for it", msg.Type)
+	}
+	switch msg.Type {
+	case MHaveAll:
+		p.haveAll = true
+		if p.swarm != nil && p.swarm.info != nil {
+			p.setBitfield(fullBitfield(len(p.swarm.info.Pieces)))
+		}
+	case MHaveNone:
+		p.haveAll = false
+		p.setBitfield(make(bitfield, len(p.bitfield)))
+	case MReject:
+		index, begin, _, err := ParseRequest(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &chunk{chunkType: cReject, index: index, begin: begin}, nil
+	case MAllowedFast, MSuggest:
+		if len(msg.Payload) != 4 {
+			return nil, fmt.Errorf("expected payload length 4 got %d instead", len(msg.Payload))
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if msg.Type == MAllowedFast {
+			p.allowedFast[index] = true
+		} else {
+			p.suggested[index] = true
+		}
+	}
+	return nil, nil
+}
+
+// requestLimit returns the max number of requests to queue up with the peer
+func (p *peer) requestLimit() int {
+	if p.reqq > 0 && p.reqq < maxRequests {
+		return p.reqq
+	}
+	return maxRequests
+}
+
+// has returns true if the peer has the piece at index and did not refuse to send it
+func (p *peer) has(index int) bool {
+	return p.bitfield.get(index) && !p.rejected[index]
+}
+
+// availablePieces returns the pieces of the peer it did not refuse to send us
+func (p *peer) availablePieces() bitfield {
+	if len(p.rejected) == 0 {
+		return p.bitfield
+	}
+	bf := make(bitfield, len(p.bitfield))
+	copy(bf, p.bitfield)
+	for index := range p.rejected {
+		bf.Unset(index)
+	}
+	return bf
+}
+
+// preferredPieces restricts the pieces of the peer to the ones we should download first:
+// the allowed fast ones while we are choked, the suggested ones otherwise
+// returns nil if there are none
+func (p *peer) preferredPieces() bitfield {
+	preferred := p.suggested
+	if p.choked {
+		preferred = p.allowedFast
+	}
+	var bf bitfield
+	for index := range preferred {
+		if p.has(index) {
+			if bf == nil {
+				bf = make(bitfield, len(p.bitfield))
+			}
+			bf.set(index)
+		}
+	}
+	return bf
+}
+
+// errRejected is returned when a peer refuses to send us a piece (BEP 6)
+var errRejected = errors.New("peer rejected the request")
+
 // downloadPiece attempts to download a piece from the peer
 // info is true if we want to download the metadata instead of the file
 func (p *peer) downloadPiece(piece *Piece, info bool) ([]byte, error) {
@@ -221,13 +635,23 @@ func (p *peer) downloadPiece(piece *Piece, info bool) ([]byte, error) {
 	start := 0
 	inQueue := 0
 	res := make([]byte, piece.Length)
-	i := 0
+	received := make([]bool, (piece.Length+chunkSize-1)/chunkSize)
 	// Add a deadline so that we do not wait for stuck peers
-	p.conn.SetDeadline(time.Now().Add(peerReadTimeout))
-	defer p.conn.SetDeadline(time.Time{})
+	deadline := time.Now().Add(peerReadTimeout)
+	// while choked, only allowed fast pieces can be requested
+	canRequest := func() bool {
+		return !p.choked || (!info && p.allowedFast[piece.Index])
+	}
 
 	for downloaded < piece.Length {
-		for ; !p.choked && inQueue < maxRequests && start < piece.Length; inQueue++ {
+		for ; canRequest() && inQueue < p.requestLimit() && start < piece.Length; inQueue++ {
+			// skip the blocks received before being choked
+			i := start / chunkSize
+			if received[i] {
+				start += chunkSize
+				inQueue--
+				continue
+			}
 			// request the next piece
 			// last piece might be shorter
 			length := chunkSize
@@ -243,36 +667,59 @@ func (p *peer) downloadPiece(piece *Piece, info bool) ([]byte, error) {
 			} else {
 				req = RequestPiece(piece.Index, start, length)
 			}
-			_, err := p.conn.Write(req)
-			if err != nil {
+			if err := p.send(req); err != nil {
 				return nil, err
 			}
 			start += length
-			i++
 		}
 		// we want to read all the buffered messages
 		// and at least one in case we are waiting for unchoking
 		for ok := true; ok; ok = inQueue > 0 {
-			chunk, err := p.read()
+			chunk, err := p.read(time.Until(deadline))
 			if err != nil {
 				return nil, err
 			}
+			if chunk == nil && time.Now().After(deadline) {
+				return nil, fmt.Errorf("timed out after %s", peerReadTimeout)
+			}
+			// a choking peer discards our pending requests:
+			// request the missing blocks again once unchoked
+			if !canRequest() && chunk == nil {
+				inQueue, start = 0, 0
+			}
 			// if it is not a chunk or if the chunk has the wrong index, continue
 			if chunk == nil {
 				continue
 			}
+			if chunk.chunkType == cReject {
+				// rejections of the requests a choke discarded are expected
+				if !info && chunk.index == piece.Index && canRequest() {
+					return nil, fmt.Errorf("%w: piece %d", errRejected, piece.Index)
+				}
+				continue
+			}
 			if (info && chunk.chunkType != cInfo) ||
 				(!info && (chunk.chunkType != cFile || chunk.index != piece.Index)) {
 				continue
 			}
-			// if the chunk is too long, return an error
-			if chunk.begin+len(chunk.value) > piece.Length {
+			// only a whole block we could have requested is accepted
+			i := chunk.begin / chunkSize
+			if info {
+				i = chunk.index // the begin of a metadata chunk is only valid for a valid index
+			}
+			if i < 0 || i >= len(received) || chunk.begin%chunkSize != 0 || len(chunk.value) == 0 ||
+				chunk.begin+len(chunk.value) > piece.Length {
 				return nil,
-					fmt.Errorf("received a chunk too long: bound %d for piece of size %d",
-						chunk.begin+len(chunk.value), piece.Length)
+					fmt.Errorf("received an invalid chunk: %d bytes at %d for piece of size %d",
+						len(chunk.value), chunk.begin, piece.Length)
+			}
+			if !received[i] {
+				received[i] = true
+				downloaded += copy(res[chunk.begin:], chunk.value)
+			}
+			if inQueue > 0 {
+				inQueue--
 			}
-			downloaded += copy(res[chunk.begin:], chunk.value)
-			inQueue--
 		}
 	}
 	return res, nil
@@ -280,34 +727,99 @@ func (p *peer) downloadPiece(piece *Piece, info bool) ([]byte, error) {
 
 // DownloadPieces creates a new peer that downloads pieces from a file
 func DownloadPieces(hash, clientID [20]byte, address string, pieces chan *Piece, info chan<- *TorrentInfo, results chan<- *Result) {
-	handshake := Handshake(hash, clientID)
-	peer, err := newPeer(handshake, address)
+	downloadPieces(&swarm{hash: hash, clientID: clientID}, address, pieces, info, results, nil)
+}
+
+// downloadPieces connects to the peer at address and downloads pieces from it
+func downloadPieces(sw *swarm, address string, pieces chan *Piece, info chan<- *TorrentInfo, results chan<- *Result, done <-chan struct{}) {
+	if !sw.acquireConn(done) {
+		return
+	}
+	defer sw.releaseConn()
+	handshake := Handshake(sw.hash, sw.clientID)
+	peer, err := newPeer(handshake, address, sw)
 	if err != nil {
 		log.Printf("Could not connect to peer at %s: %s", address, err)
 		return
 	}
-	defer peer.conn.Close()
-	err = peer.startConn()
+	log.Printf("Connected to peer at %s", address)
+	runPieceWorker(peer, pieces, info, results, done)
+}
+
+// runPieceWorker downloads the pieces sent on pieces from a connected peer,
+// after the metadata of the torrent if the swarm does not have it yet.
+// While there is nothing to download, it serves the requests of the peer, until done is closed.
+func runPieceWorker(peer *peer, pieces chan *Piece, info chan<- *TorrentInfo, results chan<- *Result, done <-chan struct{}) {
+	sw, address := peer.swarm, peer.address
+	defer peer.close()
+	err := peer.startConn()
 	if err != nil {
 		log.Printf("Could not connect to peer at %s: %s", address, err)
 		return
 	}
-	log.Printf("Connected to peer at %s", address)
+	sw.addPeer(peer)
+	defer sw.removePeer(peer)
 
-	// if there are pieces, download them
-	// if not, we should download the info file
-	needsInfo := true
+	// without the info of the torrent, we must download the metadata first
+	needsInfo := sw.info == nil
 	for {
+		if needsInfo {
+			// a peer that cannot send the metadata is of no use until we have it
+			if peer.metadataSize <= 0 || peer.extensions["ut_metadata"] == 0 {
+				log.Printf("Disconnecting from peer at %s: it does not send the metadata", address)
+				return
+			}
+			res, err := peer.downloadPiece(&Piece{Length: peer.metadataSize}, true)
+			if err != nil {
+				log.Printf("Disconnecting from peer at %s: %s", address, err)
+				return
+			}
+			h := sha1.Sum(res)
+			if !bytes.Equal(sw.hash[:], h[:]) {
+				log.Printf("Disconnecting from peer at %s: metadata has the wrong sum", address)
+				return
+			}
+			inf, err := ParseInfo(res, sw.hash)
+			if err != nil {
+				log.Printf("Disconnecting from peer at %s: %s", address, err)
+				return
+			}
+			needsInfo = false
+			sw.setMetadata(res)
+			peer.sizeBitfield(len(inf.Pieces))
+			select {
+			case info <- inf:
+			case <-done:
+				return
+			}
+			continue
+		}
+
 		select {
+		case <-done:
+			return
+		case msg, ok := <-peer.messages:
+			// nothing to download for now: answer the peer
+			if !ok {
+				return
+			}
+			if _, err := peer.handle(msg); err != nil {
+				log.Printf("Disconnecting from peer at %s: %s", address, err)
+				return
+			}
 		case piece := <-pieces:
-			needsInfo = false // there must already been an info file provided
 			// check if this peer has that piece; put it back if not
-			if !peer.bitfield.get(piece.Index) {
+			if !peer.has(piece.Index) {
 				pieces <- piece
 				continue
 			}
 
 			res, err := peer.downloadPiece(piece, false)
+			if errors.Is(err, errRejected) {
+				peer.rejected[piece.Index] = true
+				pieces <- piece
+				continue
+			}
 			if err != nil {
 				log.Printf("Disconnecting from peer at %s: %s", address, err)
 				pieces <- piece
@@ -322,29 +834,7 @@ func DownloadPieces(hash, clientID [20]byte, address string, pieces chan *Piece,
 				continue
 			}
 
-			peer.conn.Write(Have(piece.Index)) // best-effort, ignore error
 			results <- &Result{Index: piece.Index, Value: res}
-		default:
-			if !needsInfo {
-				return
-			}
-			// we must download the metadata
-			res, err := peer.downloadPiece(&Piece{Length: peer.metadataSize}, true)
-			if err != nil {
-				log.Printf("Disconnecting from peer at %s: %s", address, err)
-				return
-			}
-			h := sha1.Sum(res)
-			if !bytes.Equal(hash[:], h[:]) {
-				continue
-			}
-			inf, err := ParseInfo(res, hash)
-			if err != nil {
-				log.Printf("Disconnecting from peer at %s: %s", address, err)
-				return
-			}
-			needsInfo = false
-			info <- inf
 		}
 	}
 }
@@ -352,26 +842,44 @@ func DownloadPieces(hash, clientID [20]byte, address string, pieces chan *Piece,
 // DownloadPiecesWithQueue downloads pieces using a PieceQueue for rarest-first selection.
 // The done channel signals when the download is complete.
 func DownloadPiecesWithQueue(hash, clientID [20]byte, address string, queue *PieceQueue, results chan<- *Result, done <-chan struct{}) {
-	handshake := Handshake(hash, clientID)
-	peer, err := newPeer(handshake, address)
+	downloadPiecesWithQueue(&swarm{hash: hash, clientID: clientID}, address, queue, results, done)
+}
+
+// downloadPiecesWithQueue connects to the peer at address and downloads the pieces picked by queue.
+func downloadPiecesWithQueue(sw *swarm, address string, queue *PieceQueue, results chan<- *Result, done <-chan struct{}) {
+	if !sw.acquireConn(done) {
+		return
+	}
+	defer sw.releaseConn()
+	handshake := Handshake(sw.hash, sw.clientID)
+	peer, err := newPeer(handshake, address, sw)
 	if err != nil {
 		log.Printf("Could not connect to peer at %s: %s", address, err)
 		return
 	}
+	log.Printf("Connected to peer at %s", address)
+	runQueueWorker(peer, queue, results, done)
+}
+
+// runQueueWorker downloads the pieces picked by queue from a connected peer.
+// Once every piece is downloaded, it keeps serving the peer until done is closed if the swarm seeds.
+func runQueueWorker(peer *peer, queue *PieceQueue, results chan<- *Result, done <-chan struct{}) {
+	sw, address := peer.swarm, peer.address
 	defer func() {
-		queue.UnregisterPeer(peer.bitfield)
-		peer.conn.Close()
+		peer.unregister()
+		peer.close()
 	}()
-	
-	err = peer.startConn()
+
+	err := peer.startConn()
 	if err != nil {
 		log.Printf("Could not connect to peer at %s: %s", address, err)
 		return
 	}
-	log.Printf("Connected to peer at %s", address)
-	
+	sw.addPeer(peer)
+	defer sw.removePeer(peer)
+
 	// Register this peer's bitfield for availability tracking
-	queue.RegisterPeer(peer.bitfield)
+	peer.register(queue)
 
 	for {
 		select {
@@ -379,23 +887,39 @@ func DownloadPiecesWithQueue(hash, clientID [20]byte, address string, queue *Pie
 			return
 		default:
 		}
-		
+
+		if queue.AllComplete() {
+			if sw.seed {
+				peer.serve(done)
+			}
+			return
+		}
+
 		// Get the rarest piece this peer can download
-		piece := queue.GetPiece(peer.bitfield)
+		// Prefer the allowed fast pieces while choked, the suggested ones otherwise
+		var piece *Piece
+		if preferred := peer.preferredPieces(); preferred != nil {
+			piece = queue.GetPiece(preferred)
+		}
 		if piece == nil {
-			// No pieces available for this peer right now
-			// Check if download is done or wait a bit
-			select {
-			case <-done:
+			piece = queue.GetPiece(peer.availablePieces())
+		}
+		if piece == nil {
+			// No pieces available for this peer right now:
+			// handle its messages while waiting instead of busy-waiting
+			if _, err := peer.read(peerIdleTimeout); err != nil {
+				log.Printf("Disconnecting from peer at %s: %s", address, err)
 				return
-			default:
-				// Small sleep to avoid busy-waiting
-				time.Sleep(100 * time.Millisecond)
-				continue
 			}
+			continue
 		}
 
 		res, err := peer.downloadPiece(piece, false)
+		if errors.Is(err, errRejected) {
+			peer.rejected[piece.Index] = true
+			queue.Return(piece.Index)
+			continue
+		}
 		if err != nil {
 			log.Printf("Disconnecting from peer at %s: %s", address, err)
 			queue.Return(piece.Index)
@@ -411,7 +935,10 @@ func DownloadPiecesWithQueue(hash, clientID [20]byte, address string, queue *Pie
 		}
 
 		queue.Complete(piece.Index)
-		peer.conn.Write(Have(piece.Index)) // best-effort, ignore error
-		results <- &Result{Index: piece.Index, Value: res}
+		select {
+		case results <- &Result{Index: piece.Index, Value: res}:
+		case <-done:
+			return
+		}
 	}
 }
@@ -0,0 +1,430 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestPeer returns a peer connected through a pipe and the remote end of the pipe
+func newTestPeer(sw *swarm) (*peer, net.Conn) {
+	local, remote := net.Pipe()
+	p := &peer{
+		conn:        local,
+		reader:      bufio.NewReader(local),
+		choked:      true,
+		swarm:       sw,
+		allowedFast: make(map[int]bool),
+		suggested:   make(map[int]bool),
+		rejected:    make(map[int]bool),
+		messages:    make(chan *Message),
+		closed:      make(chan struct{}),
+	}
+	p.amChoking.Store(true)
+	go p.readLoop()
+	return p, remote
+}
+
+// newTestSwarm returns a swarm serving the test torrent with every piece downloaded
+func newTestSwarm(t *testing.T) *swarm {
+	inf, data := newTestInfo()
+	st, err := openStorage(inf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.close)
+	state := NewDownloadState(inf.Hash, inf.Name, "", len(inf.Pieces), inf.PieceLength, inf.Length)
+	for i := range inf.Pieces {
+		start := i * inf.PieceLength
+		if _, err := st.writePiece(i, data[start:start+st.pieceLength(i)]); err != nil {
+			t.Fatal(err)
+		}
+		state.MarkPieceComplete(i)
+	}
+	return newSwarm(inf, [20]byte{}, state, st, true)
+}
+
+func TestPeerServeRequest(t *testing.T) {
+	sw := newTestSwarm(t)
+	p, remote := newTestPeer(sw)
+	defer p.close()
+	p.amChoking.Store(false)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.read(time.Second)
+		errs <- err
+	}()
+	if _, err := remote.Write(RequestPiece(1, 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MPiece {
+		t.Fatalf("expected a piece message, got type %d", msg.Type)
+	}
+	c, err := parsePiece(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.index != 1 || c.begin != 1 || !bytes.Equal(c.value, []byte("fgh")) {
+		t.Errorf("unexpected block: index %d begin %d value %q", c.index, c.begin, c.value)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if sw.uploaded.Load() != 3 || p.uploaded.Load() != 3 {
+		t.Errorf("expected 3 bytes uploaded, got %d (%d to the peer)", sw.uploaded.Load(), p.uploaded.Load())
+	}
+}
+
+func TestPeerIgnoresRequestWhileChoked(t *testing.T) {
+	sw := newTestSwarm(t)
+	p, remote := newTestPeer(sw)
+	defer p.close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.read(time.Second)
+		errs <- err
+	}()
+	if _, err := remote.Write(RequestPiece(1, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected the request to be ignored, got %v", err)
+	}
+	if sw.uploaded.Load() != 0 {
+		t.Errorf("expected nothing uploaded, got %d bytes", sw.uploaded.Load())
+	}
+}
+
+func TestPeerDoesNotUnchokeWhenChoked(t *testing.T) {
+	p, remote := newTestPeer(nil)
+	defer p.close()
+	p.choked = false
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.read(time.Second)
+		errs <- err
+	}()
+	if _, err := remote.Write(Choke()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !p.choked {
+		t.Error("expected the peer to be choking us")
+	}
+	if !p.amChoking.Load() {
+		t.Error("expected us to keep choking the peer")
+	}
+}
+
+func TestPeerIgnoresRequestForMissingPiece(t *testing.T) {
+	sw := newTestSwarm(t)
+	sw.state.ClearPiece(2)
+	p, remote := newTestPeer(sw)
+	defer p.close()
+	p.amChoking.Store(false)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.read(time.Second)
+		errs <- err
+	}()
+	if _, err := remote.Write(RequestPiece(2, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected the request to be ignored, got %v", err)
+	}
+	if sw.uploaded.Load() != 0 {
+		t.Errorf("expected nothing uploaded, got %d bytes", sw.uploaded.Load())
+	}
+}
+
+// fastHandshake returns the handshake of a peer supporting only the Fast Extension
+func fastHandshake() []byte {
+	handshake := plainHandshake([20]byte{}, [20]byte{})
+	handshake[1+len(Protocol)+7] = ExtensionFast
+	return handshake
+}
+
+// setupTestPeer runs setupPeer on one end of a pipe and returns the peer and the remote end
+// remote is run against the remote end while the setup is in progress
+func setupTestPeer(t *testing.T, sw *swarm, handshake []byte, remote func(conn net.Conn)) *peer {
+	local, conn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	go remote(conn)
+	p, err := setupPeer(local, "pipe", handshake, sw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+func TestSetupPeerHaveAll(t *testing.T) {
+	sw := newTestSwarm(t)
+	p := setupTestPeer(t, sw, fastHandshake(), func(conn net.Conn) {
+		if msg, err := ReadMessage(conn); err != nil || msg.Type != MHaveAll {
+			t.Errorf("expected our have all message, got %v (%v)", msg, err)
+		}
+		conn.Write(HaveAll())
+	})
+	for i := range sw.info.Pieces {
+		if !p.has(i) {
+			t.Errorf("expected the peer to have piece %d", i)
+		}
+	}
+}
+
+func TestSetupPeerWithoutBitfield(t *testing.T) {
+	sw := newTestSwarm(t)
+	sw.state.ClearPiece(0)
+	p := setupTestPeer(t, sw, plainHandshake([20]byte{}, [20]byte{}), func(conn net.Conn) {
+		if msg, err := ReadMessage(conn); err != nil || msg.Type != MBitfield {
+			t.Errorf("expected our bitfield, got %v (%v)", msg, err)
+		}
+		// no bitfield: the peer goes straight to a have message
+		conn.Write(Have(2))
+	})
+	if _, err := p.read(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if p.has(0) || !p.has(2) {
+		t.Errorf("expected the peer to only have piece 2, got %08b", p.bitfield)
+	}
+}
+
+func TestPeerRejectsRequestWhileChoked(t *testing.T) {
+	sw := newTestSwarm(t)
+	p, remote := newTestPeer(sw)
+	defer p.close()
+	p.fast = true
+
+	go p.read(time.Second)
+	if _, err := remote.Write(RequestPiece(1, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MReject {
+		t.Fatalf("expected a reject message, got type %d", msg.Type)
+	}
+	if index, begin, length, _ := ParseRequest(msg.Payload); index != 1 || begin != 0 || length != 4 {
+		t.Errorf("unexpected rejected block: index %d begin %d length %d", index, begin, length)
+	}
+}
+
+func TestPeerDownloadsAllowedFastWhileChoked(t *testing.T) {
+	p, remote := newTestPeer(nil)
+	defer p.close()
+	p.fast = true
+
+	go func() {
+		remote.Write(AllowedFast(3))
+		msg, err := ReadMessage(remote)
+		if err != nil || msg.Type != MRequest {
+			t.Errorf("expected a request, got %v (%v)", msg, err)
+			return
+		}
+		index, begin, length, _ := ParseRequest(msg.Payload)
+		remote.Write(PieceBlock(index, begin, bytes.Repeat([]byte{'x'}, length)))
+	}()
+	// wait for the allowed fast message to be handled
+	if _, err := p.read(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.downloadPiece(&Piece{Index: 3, Length: 4}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, []byte("xxxx")) {
+		t.Errorf("unexpected piece %q", res)
+	}
+}
+
+func TestPeerRejectedPiece(t *testing.T) {
+	p, remote := newTestPeer(nil)
+	defer p.close()
+	p.fast = true
+	p.choked = false
+
+	go func() {
+		msg, err := ReadMessage(remote)
+		if err != nil {
+			return
+		}
+		index, begin, length, _ := ParseRequest(msg.Payload)
+		remote.Write(RejectRequest(index, begin, length))
+	}()
+	if _, err := p.downloadPiece(&Piece{Index: 1, Length: 4}, false); !errors.Is(err, errRejected) {
+		t.Errorf("expected the piece to be rejected, got %v", err)
+	}
+}
+
+func TestPeerInvalidChunk(t *testing.T) {
+	tests := []struct {
+		name  string
+		begin int
+		block []byte
+	}{
+		{"empty block past the end", chunkSize, nil},
+		{"empty block", 0, nil},
+		{"unaligned begin", 1, []byte("x")},
+		{"past the end", chunkSize, []byte("x")},
+	}
+	for _, tt := range tests {
+		p, remote := newTestPeer(nil)
+		p.choked = false
+		go func() {
+			if _, err := ReadMessage(remote); err != nil {
+				return
+			}
+			remote.Write(PieceBlock(0, tt.begin, tt.block))
+		}()
+		if _, err := p.downloadPiece(&Piece{Index: 0, Length: chunkSize}, false); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		p.close()
+	}
+}
+
+func TestFastMessageWithoutSupport(t *testing.T) {
+	p, remote := newTestPeer(nil)
+	defer p.close()
+
+	go remote.Write(HaveAll())
+	if _, err := p.read(time.Second); err == nil {
+		t.Error("expected an error for a fast message from a peer without support for it")
+	}
+}
+
+func TestPeerBitfieldRegistered(t *testing.T) {
+	pieces := make([]*Piece, 6)
+	for i := range pieces {
+		pieces[i] = &Piece{Index: i, Length: 4}
+	}
+	queue := NewPieceQueue(pieces, make(bitfield, 1))
+	p := &peer{fast: true, bitfield: make(bitfield, 1), swarm: &swarm{info: &TorrentInfo{Pieces: make([][20]byte, len(pieces))}}}
+	p.register(queue)
+
+	// every change of the bitfield after the registration is tracked by the queue
+	bf := make(bitfield, 1)
+	bf.set(0)
+	msgs := []*Message{
+		{Type: MBitfield, Payload: bf},
+		{Type: MHave, Payload: []byte{0, 0, 0, 3}},
+		{Type: MHaveNone},
+		{Type: MHaveAll},
+	}
+	for _, msg := range msgs {
+		if _, err := p.handle(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.unregister()
+	for i, avail := range queue.availability {
+		if avail != 0 {
+			t.Errorf("expected no availability for piece %d after unregistering, got %d", i, avail)
+		}
+	}
+}
+
+func TestPeerHaveAllBeforeInfo(t *testing.T) {
+	p := &peer{fast: true, swarm: &swarm{}}
+	if _, err := p.handle(&Message{Type: MHaveAll}); err != nil {
+		t.Fatal(err)
+	}
+	p.sizeBitfield(6)
+	for i := range 6 {
+		if !p.has(i) {
+			t.Errorf("expected the peer to have piece %d", i)
+		}
+	}
+}
+
+func TestPieceWorkerDownloadsFromSeed(t *testing.T) {
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	// a seed with every piece: its worker has nothing to download and serves the downloader
+	seed := newTestSwarm(t)
+	seed.worker = func(p *peer) {
+		p.unchoke()
+		runPieceWorker(p, nil, nil, nil, done)
+	}
+	l.register(seed)
+	defer l.unregister(seed)
+
+	inf := seed.info
+	sw := newSwarm(inf, [20]byte{1}, NewDownloadState(inf.Hash, inf.Name, "", len(inf.Pieces), inf.PieceLength, inf.Length), nil, false)
+	pieces := make(chan *Piece, 1)
+	results := make(chan *Result, 1)
+	pieces <- &Piece{Index: 1, Hash: inf.Pieces[1], Length: inf.PieceLength}
+	go downloadPieces(sw, net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Port())), pieces, nil, results, done)
+
+	select {
+	case res := <-results:
+		if res.Index != 1 || !bytes.Equal(res.Value, []byte("efgh")) {
+			t.Errorf("unexpected piece %d: %q", res.Index, res.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the piece from the seed")
+	}
+	if seed.uploaded.Load() != 4 {
+		t.Errorf("expected the seed to upload 4 bytes, got %d", seed.uploaded.Load())
+	}
+}
+
+func TestPieceWorkerSkipsPeerWithoutMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		extensions   map[string]uint8
+		metadataSize int
+	}{
+		{"no extensions", nil, 0},
+		{"no metadata size", map[string]uint8{"ut_metadata": 3}, 0},
+		{"no ut_metadata", map[string]uint8{"ut_pex": 1}, 100},
+	}
+	for _, tt := range tests {
+		p, remote := newTestPeer(&swarm{hash: [20]byte{1}})
+		p.choked = false
+		p.extensions = tt.extensions
+		p.metadataSize = tt.metadataSize
+		finished := make(chan struct{})
+		go func() {
+			runPieceWorker(p, nil, make(chan *TorrentInfo), nil, nil)
+			close(finished)
+		}()
+		go io.Copy(io.Discard, remote)
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected the worker to disconnect from the peer", tt.name)
+			p.close()
+		}
+		remote.Close()
+	}
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// pexInterval is how often we send peer exchange messages (at most once a minute per BEP 11)
+const pexInterval = time.Minute
+
+// maxPexPeers is the max number of peers added or dropped in a single PEX message
+const maxPexPeers = 50
+
+// PEX flags describing an added peer (BEP 11)
+const (
+	PexEncryption = 0x01 // prefers encryption
+	PexSeed       = 0x02 // is a seed
+	PexUTP        = 0x04 // supports uTP
+	PexHolepunch  = 0x08 // supports ut_holepunch
+	PexReachable  = 0x10 // accepts incoming connections
+)
+
+// PexPeer is a peer learned through peer exchange: its address and flags
+type PexPeer struct {
+	Address string
+	Flags   byte
+}
+
+// Pex is the content of a PEX message: the peers the sender connected to and disconnected from
+type Pex struct {
+	Added   []PexPeer
+	Dropped []string
+}
+
+// ParsePex parses the bencoded payload of a ut_pex message
+func ParsePex(payload []byte) (*Pex, error) {
+	ben, err := decode(bufio.NewReader(bytes.NewReader(payload)), new(bytes.Buffer), false)
+	if err != nil {
+		return nil, err
+	}
+	if ben.Dict == nil {
+		return nil, errors.New("pex message has no dictionary")
+	}
+	pex := &Pex{}
+	for _, ipv6 := range []bool{false, true} {
+		suffix := ""
+		if ipv6 {
+			suffix = "6"
+		}
+		added, err := parseCompactPeers(ben.Dict["added"+suffix].Str, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid added%s peers: %w", suffix, err)
+		}
+		// flags are optional, and ignored if they do not match the peers
+		flags := ben.Dict["added"+suffix+".f"].Str
+		for i, address := range added {
+			peer := PexPeer{Address: address}
+			if len(flags) == len(added) {
+				peer.Flags = flags[i]
+			}
+			pex.Added = append(pex.Added, peer)
+		}
+		dropped, err := parseCompactPeers(ben.Dict["dropped"+suffix].Str, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dropped%s peers: %w", suffix, err)
+		}
+		pex.Dropped = append(pex.Dropped, dropped...)
+	}
+	return pex, nil
+}
+
+// CompactPeer returns the compact form of an address (BEP 23): 4 or 16 bytes of IP and 2 of port
+func CompactPeer(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid peer IP %q", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer port %q", portStr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return binary.BigEndian.AppendUint16(bytes.Clone(ip), uint16(port)), nil
+}
+
+// listenAddress returns the address the peer accepts connections on, empty if unknown:
+// the port of a peer that connected to us is only known from its extension handshake
+func (p *peer) listenAddress() string {
+	if !p.incoming {
+		return p.address
+	}
+	if p.listenPort == 0 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.listenPort))
+}
+
+// PexMessage returns a serialised ut_pex message adding and dropping peers
+// extID is the ut_pex ID of the receiving peer; addresses that cannot be parsed are skipped
+func PexMessage(extID uint8, added []PexPeer, dropped []string) []byte {
+	dict := make(map[string]bencode)
+	var added4, added6, flags4, flags6 []byte
+	for _, p := range added {
+		compact, err := CompactPeer(p.Address)
+		if err != nil {
+			continue
+		}
+		if len(compact) == net.IPv4len+2 {
+			added4 = append(added4, compact...)
+			flags4 = append(flags4, p.Flags)
+		} else {
+			added6 = append(added6, compact...)
+			flags6 = append(flags6, p.Flags)
+		}
+	}
+	var dropped4, dropped6 []byte
+	for _, address := range dropped {
+		compact, err := CompactPeer(address)
+		if err != nil {
+			continue
+		}
+		if len(compact) == net.IPv4len+2 {
+			dropped4 = append(dropped4, compact...)
+		} else {
+			dropped6 = append(dropped6, compact...)
+		}
+	}
+	// empty entries are left out: they would be encoded as integers
+	for key, value := range map[string][]byte{
+		"added": added4, "added.f": flags4, "added6": added6, "added6.f": flags6,
+		"dropped": dropped4, "dropped6": dropped6,
+	} {
+		if len(value) > 0 {
+			dict[key] = bencode{Str: string(value)}
+		}
+	}
+	payload := append([]byte{extID}, Encode(&bencode{Dict: dict})...)
+	return (&Message{MExtended, payload}).serialise()
+}
+
+// runPex sends PEX messages to the peers of the swarm every pexInterval until done is closed
+func (s *swarm) runPex(done <-chan struct{}) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.sendPex()
+		}
+	}
+}
+
+// sendPex tells each peer supporting ut_pex which peers we connected to
+// and disconnected from since the last message we sent it
+func (s *swarm) sendPex() {
+	peers := s.connectedPeers()
+	// only the peers we connected to or that told us their port are known to accept connections
+	connected := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		if address := p.listenAddress(); address != "" {
+			connected[address] = true
+		}
+	}
+	for _, p := range peers {
+		extID := p.extensions["ut_pex"]
+		if extID == 0 {
+			continue
+		}
+		if p.pexSent == nil {
+			p.pexSent = make(map[string]bool)
+		}
+		var added []PexPeer
+		for address := range connected {
+			if address != p.listenAddress() && address != p.address && !p.pexSent[address] && len(added) < maxPexPeers {
+				added = append(added, PexPeer{Address: address, Flags: PexReachable})
+			}
+		}
+		var dropped []string
+		for address := range p.pexSent {
+			if !connected[address] && len(dropped) < maxPexPeers {
+				dropped = append(dropped, address)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+		if err := p.send(PexMessage(extID, added, dropped)); err != nil {
+			continue
+		}
+		for _, a := range added {
+			p.pexSent[a.Address] = true
+		}
+		for _, address := range dropped {
+			delete(p.pexSent, address)
+		}
+	}
+}
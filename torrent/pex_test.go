@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	added := []PexPeer{
+		{Address: "1.2.3.4:6881", Flags: PexSeed | PexReachable},
+		{Address: "[2001:db8::1]:51413", Flags: PexUTP},
+		{Address: "5.6.7.8:80"},
+	}
+	dropped := []string{"9.9.9.9:1234", "[::1]:1"}
+	msg, err := ReadMessage(bytes.NewReader(PexMessage(3, added, dropped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MExtended || msg.Payload[0] != 3 {
+		t.Fatalf("expected an extended message with ID 3, got type %d", msg.Type)
+	}
+	pex, err := ParsePex(msg.Payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PexPeer{added[0], added[2], {Address: "[2001:db8::1]:51413", Flags: PexUTP}}
+	if !slices.Equal(pex.Added, expected) {
+		t.Errorf("expected added peers %v, got %v", expected, pex.Added)
+	}
+	if !slices.Equal(pex.Dropped, dropped) {
+		t.Errorf("expected dropped peers %v, got %v", dropped, pex.Dropped)
+	}
+}
+
+func TestParsePexWithoutFlags(t *testing.T) {
+	pex, err := ParsePex([]byte("d5:added6:\x01\x02\x03\x04\x1a\xe1e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pex.Added) != 1 || pex.Added[0] != (PexPeer{Address: "1.2.3.4:6881"}) {
+		t.Errorf("unexpected added peers %v", pex.Added)
+	}
+	if _, err := ParsePex([]byte("d5:added5:\x01\x02\x03\x04\x1ae")); err == nil {
+		t.Error("expected an error for a truncated peer list")
+	}
+}
+
+func TestSwarmAddPeers(t *testing.T) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var connected []string
+	sw := &swarm{connect: func(address string) {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		connected = append(connected, address)
+	}}
+	wg.Add(3)
+	if n := sw.addPeers([]string{"1.1.1.1:1", "2.2.2.2:2"}); n != 2 {
+		t.Errorf("expected 2 new peers, got %d", n)
+	}
+	if n := sw.addPeers([]string{"2.2.2.2:2", "3.3.3.3:3"}); n != 1 {
+		t.Errorf("expected 1 new peer, got %d", n)
+	}
+	wg.Wait()
+	slices.Sort(connected)
+	if !slices.Equal(connected, []string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3"}) {
+		t.Errorf("unexpected connections %v", connected)
+	}
+}
+
+func TestSwarmAddPeersLimitsDials(t *testing.T) {
+	release := make(chan struct{})
+	sw := &swarm{connect: func(string) { <-release }}
+	addresses := make([]string, maxPendingDials+10)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("10.0.%d.%d:1", i/256, i%256)
+	}
+	if n := sw.addPeers(addresses); n != maxPendingDials {
+		t.Errorf("expected %d connections, got %d", maxPendingDials, n)
+	}
+	if n := sw.addPeers([]string{"1.1.1.1:1"}); n != 0 {
+		t.Errorf("expected no connection while %d are pending, got %d", maxPendingDials, n)
+	}
+
+	// the addresses left over are dialed once the connections end
+	close(release)
+	for deadline := time.Now().Add(time.Second); ; {
+		sw.mu.Lock()
+		dials := sw.dials
+		sw.mu.Unlock()
+		if dials == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connections to end, %d left", dials)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := sw.addPeers(addresses); n != 10 {
+		t.Errorf("expected the 10 addresses left over, got %d", n)
+	}
+}
+
+func TestPeerLearnsPexPeers(t *testing.T) {
+	learned := make(chan string, maxPexPeers+10)
+	sw := &swarm{connect: func(address string) { learned <- address }}
+	p, remote := newTestPeer(sw)
+	defer p.close()
+
+	go remote.Write(PexMessage(pexID, []PexPeer{{Address: "1.2.3.4:6881"}}, nil))
+	if _, err := p.read(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case address := <-learned:
+		if address != "1.2.3.4:6881" {
+			t.Errorf("unexpected peer %s", address)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the peer from the PEX message to be connected to")
+	}
+
+	// only the first 50 peers of a message are learned
+	added := make([]PexPeer, maxPexPeers+10)
+	for i := range added {
+		added[i].Address = fmt.Sprintf("10.0.0.%d:6881", i)
+	}
+	go remote.Write(PexMessage(pexID, added, nil))
+	if _, err := p.read(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for range maxPexPeers {
+		select {
+		case <-learned:
+		case <-time.After(time.Second):
+			t.Fatal("expected the peers from the PEX message to be connected to")
+		}
+	}
+	select {
+	case address := <-learned:
+		t.Errorf("expected at most %d peers, also got %s", maxPexPeers, address)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSwarmSendPex(t *testing.T) {
+	sw := &swarm{}
+	receiver, remote := newTestPeer(sw)
+	defer receiver.close()
+	receiver.address = "10.0.0.1:1"
+	receiver.extensions = map[string]uint8{"ut_pex": 7}
+	other, otherRemote := newTestPeer(sw)
+	defer other.close()
+	other.address = "10.0.0.2:2"
+	go io.Copy(io.Discard, otherRemote)
+	sw.addPeer(receiver)
+	sw.addPeer(other)
+
+	// read the PEX messages sent to receiver
+	messages := make(chan *Pex, 2)
+	go func() {
+		for {
+			msg, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			pex, err := ParsePex(msg.Payload[1:])
+			if err != nil || msg.Payload[0] != 7 {
+				t.Errorf("unexpected PEX message: %v", err)
+				return
+			}
+			messages <- pex
+		}
+	}()
+
+	sw.sendPex()
+	pex := <-messages
+	if len(pex.Added) != 1 || pex.Added[0].Address != other.address || len(pex.Dropped) != 0 {
+		t.Errorf("expected %s to be added, got %+v", other.address, pex)
+	}
+
+	sw.removePeer(other)
+	sw.sendPex()
+	pex = <-messages
+	if len(pex.Added) != 0 || !slices.Equal(pex.Dropped, []string{other.address}) {
+		t.Errorf("expected %s to be dropped, got %+v", other.address, pex)
+	}
+}
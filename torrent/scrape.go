@@ -0,0 +1,174 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxUDPScrape is the max number of info hashes in a UDP scrape (BEP 15)
+const maxUDPScrape = 74
+
+// ScrapeResult is the state of the swarm of a torrent, as reported by a tracker
+type ScrapeResult struct {
+	Seeders   int // peers with the whole torrent
+	Leechers  int // peers still downloading
+	Completed int // number of times the torrent was downloaded
+}
+
+// Scrape asks a tracker for the state of the swarms of the given info hashes,
+// over HTTP(S) or UDP depending on the scheme of its URL
+// the hashes the tracker does not know are missing from the result
+func Scrape(trackerURL *url.URL, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	return scrape(trackerURL, infoHashes, TrackerMaxRetries)
+}
+
+// scrape scrapes a tracker, retrying at most retries times for UDP trackers
+func scrape(trackerURL *url.URL, infoHashes [][20]byte, retries int) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, errors.New("no info hash to scrape")
+	}
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return scrapeHTTP(trackerURL, infoHashes)
+	case "udp", "udp4", "udp6":
+		return scrapeUDPTracker(trackerURL, infoHashes, retries)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", trackerURL.Scheme)
+}
+
+// scrapeURL returns the scrape URL of an HTTP tracker for the given info hashes
+// by convention, it is the announce URL with "announce" replaced by "scrape"
+// in its last path component; trackers without such an URL do not support scraping
+func scrapeURL(u *url.URL, infoHashes [][20]byte) (string, error) {
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scraping", u.Host)
+	}
+	result := *u
+	result.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	params := u.Query()
+	for _, hash := range infoHashes {
+		params.Add("info_hash", string(hash[:]))
+	}
+	result.RawQuery = params.Encode()
+	return result.String(), nil
+}
+
+// scrapeHTTP scrapes an HTTP tracker
+func scrapeHTTP(trackerURL *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := scrapeURL(trackerURL, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: httpTimeout}
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned status %s", res.Status)
+	}
+
+	ben, err := decode(bufio.NewReader(res.Body), new(bytes.Buffer), false)
+	if err != nil {
+		return nil, err
+	}
+	return parseScrapeResponse(ben)
+}
+
+// parseScrapeResponse parses a bencoded scrape response
+func parseScrapeResponse(ben *bencode) (map[[20]byte]ScrapeResult, error) {
+	dic := ben.Dict
+	if dic == nil {
+		return nil, errors.New("scrape response has no dictionary")
+	}
+	if failure, ok := dic["failure reason"]; ok {
+		return nil, &TrackerError{Message: failure.Str}
+	}
+	files, ok := dic["files"]
+	if !ok {
+		return nil, errors.New("scrape response missing files")
+	}
+	results := make(map[[20]byte]ScrapeResult, len(files.Dict))
+	for key, file := range files.Dict {
+		if len(key) != 20 || file.Dict == nil {
+			continue
+		}
+		results[[20]byte([]byte(key))] = ScrapeResult{
+			Seeders:   file.Dict["complete"].Int,
+			Leechers:  file.Dict["incomplete"].Int,
+			Completed: file.Dict["downloaded"].Int,
+		}
+	}
+	return results, nil
+}
+
+// scrapeUDPTracker scrapes a UDP tracker, at most maxUDPScrape hashes at a time
+func scrapeUDPTracker(trackerURL *url.URL, infoHashes [][20]byte, retries int) (map[[20]byte]ScrapeResult, error) {
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += maxUDPScrape {
+		batch := infoHashes[start:min(start+maxUDPScrape, len(infoHashes))]
+		err := queryUDPTracker(trackerURL, retries, func(conn *net.UDPConn, connID uint64) error {
+			return scrapeUDP(conn, connID, batch, results)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// scrapeUDP sends a scrape request and adds the results of the response to results
+func scrapeUDP(conn *net.UDPConn, connID uint64, infoHashes [][20]byte, results map[[20]byte]ScrapeResult) error {
+	transactionID := rand.Uint32()
+
+	// Build scrape request (16 bytes and 20 per info hash)
+	req := make([]byte, 16, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint64(req, connID)
+	binary.BigEndian.PutUint32(req[8:], aScrape)
+	binary.BigEndian.PutUint32(req[12:], transactionID)
+	for _, hash := range infoHashes {
+		req = append(req, hash[:]...)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Read response: 8 bytes and 12 per info hash, or an error packet
+	res := make([]byte, max(8+12*len(infoHashes), 512))
+	n, err := conn.Read(res)
+	if err != nil {
+		return err
+	}
+	res = res[:n]
+
+	// Validate response
+	if err := checkUDPResponse(res, aScrape, transactionID); err != nil {
+		return err
+	}
+	if n < 8+12*len(infoHashes) {
+		return fmt.Errorf("response too short: %d bytes for %d hashes", n, len(infoHashes))
+	}
+
+	for i, hash := range infoHashes {
+		entry := res[8+12*i:]
+		results[hash] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(entry)),
+			Completed: int(binary.BigEndian.Uint32(entry[4:])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:])),
+		}
+	}
+	return nil
+}
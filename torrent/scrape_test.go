@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/announce":          "http://example.com/scrape",
+		"http://example.com/x/announce?k=v":    "http://example.com/x/scrape?k=v",
+		"http://example.com/announce.php":      "http://example.com/scrape.php",
+		"https://example.com/a/announce?pk=1a": "https://example.com/a/scrape?pk=1a",
+	}
+	for announce, expected := range tests {
+		u, _ := url.Parse(announce)
+		got, err := scrapeURL(u, nil)
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", announce, expected, got, err)
+		}
+	}
+	for _, announce := range []string{"http://example.com/a", "http://example.com/announce/x"} {
+		u, _ := url.Parse(announce)
+		if _, err := scrapeURL(u, nil); err == nil {
+			t.Errorf("%s: expected scraping to be unsupported", announce)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	known := [20]byte{1}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || len(r.URL.Query()["info_hash"]) != 2 {
+			http.Error(w, "bad scrape", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + string(known[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/announce")
+
+	results, err := Scrape(u, known, [20]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[known] != (ScrapeResult{Seeders: 5, Leechers: 10, Completed: 50}) {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+// udpTestTracker is a UDP tracker answering connect, announce and scrape requests
+// announces for unregisteredHash are answered with an error packet
+type udpTestTracker struct {
+	url      *url.URL
+	connects atomic.Int32
+	urlData  chan string // URL data of the announces (BEP 41)
+}
+
+// unregisteredHash is an info hash the test trackers do not know
+var unregisteredHash = [20]byte{0xee}
+
+// newUDPTestTracker starts a UDP tracker answering connect requests,
+// announces with the peer 10.0.0.1:6881 and scrapes with seeders 1, completed 2 and leechers 3
+func newUDPTestTracker(t *testing.T) *udpTestTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	tracker := &udpTestTracker{
+		url:     &url.URL{Scheme: "udp", Host: conn.LocalAddr().String()},
+		urlData: make(chan string, 10),
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			action := binary.BigEndian.Uint32(req[8:])
+			res := binary.BigEndian.AppendUint32(nil, action)
+			res = append(res, req[12:16]...)
+			switch action {
+			case aConnect:
+				tracker.connects.Add(1)
+				res = binary.BigEndian.AppendUint64(res, 42)
+			case aAnnounce:
+				if [20]byte(req[16:36]) == unregisteredHash {
+					res = binary.BigEndian.AppendUint32(nil, aError)
+					res = append(res, req[12:16]...)
+					res = append(res, "unregistered torrent"...)
+					break
+				}
+				var data []byte
+				for options := req[98:]; len(options) > 1 && options[0] == optionURLData; options = options[2+int(options[1]):] {
+					data = append(data, options[2:2+int(options[1])]...)
+				}
+				tracker.urlData <- string(data)
+				res = binary.BigEndian.AppendUint32(res, 1800) // interval
+				res = binary.BigEndian.AppendUint32(res, 4)    // leechers
+				res = binary.BigEndian.AppendUint32(res, 5)    // seeders
+				res = append(res, 10, 0, 0, 1, 0x1a, 0xe1)
+			case aScrape:
+				for range (n - 16) / 20 {
+					res = binary.BigEndian.AppendUint32(res, 1)
+					res = binary.BigEndian.AppendUint32(res, 2)
+					res = binary.BigEndian.AppendUint32(res, 3)
+				}
+			}
+			conn.WriteToUDP(res, addr)
+		}
+	}()
+	return tracker
+}
+
+func TestScrapeUDP(t *testing.T) {
+	u := newUDPTestTracker(t).url
+	hashes := make([][20]byte, maxUDPScrape+1)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+	results, err := Scrape(u, hashes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("expected %d results, got %d", len(hashes), len(results))
+	}
+	if r := results[hashes[maxUDPScrape]]; r != (ScrapeResult{Seeders: 1, Completed: 2, Leechers: 3}) {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
@@ -0,0 +1,534 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matei-oltean/go-torrent/dht"
+)
+
+// default connection limits of a session
+const (
+	defaultMaxConnections        = 200
+	defaultMaxTorrentConnections = 50
+)
+
+// SessionConfig configures a Session
+type SessionConfig struct {
+	ListenPort            int         // TCP port for incoming peers (0 for the first free one in 6881-6889)
+	DHT                   *dht.DHT    // DHT node owned by the caller; the session starts its own if nil
+	DisableDHT            bool        // do not start a DHT node when none is provided
+	DHTConfig             *dht.Config // options of the DHT node the session starts, nil for the defaults
+	MaxConnections        int         // max peer connections across all torrents (0 for the default)
+	MaxTorrentConnections int         // max peer connections per torrent (0 for the default)
+}
+
+// Session manages many torrents over shared resources:
+// one peer ID, one listener for incoming peers, one DHT node and global connection limits
+type Session struct {
+	id       [20]byte
+	listener *Listener
+	dht      *dht.DHT
+	dhtReady chan struct{} // closed once the DHT node is bootstrapped
+	stopDHT  func()
+
+	conns           connLimiter // connections across all torrents
+	maxTorrentConns int
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	added    int // number of torrents ever added, to keep List in order
+}
+
+// NewSession creates a session and starts listening for incoming peers
+// cfg can be nil to use the defaults
+func NewSession(cfg *SessionConfig) (*Session, error) {
+	if cfg == nil {
+		cfg = &SessionConfig{}
+	}
+	id, err := clientID()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		id:              id,
+		dhtReady:        make(chan struct{}),
+		stopDHT:         func() {},
+		conns:           newConnLimiter(cfg.MaxConnections, defaultMaxConnections),
+		maxTorrentConns: cfg.MaxTorrentConnections,
+		torrents:        make(map[[20]byte]*Torrent),
+	}
+	if s.maxTorrentConns <= 0 {
+		s.maxTorrentConns = defaultMaxTorrentConnections
+	}
+
+	l, err := Listen(cfg.ListenPort)
+	if err != nil {
+		log.Printf("Not accepting incoming peers: %v", err)
+	} else {
+		log.Printf("Listening for peers on port %d", l.Port())
+		s.listener = l
+	}
+
+	switch {
+	case cfg.DHT != nil:
+		s.dht = cfg.DHT
+		close(s.dhtReady)
+	case !cfg.DisableDHT:
+		s.startDHT(cfg.DHTConfig)
+	default:
+		close(s.dhtReady)
+	}
+	return s, nil
+}
+
+// startDHT starts a DHT node owned by the session and bootstraps it in the background
+func (s *Session) startDHT(cfg *dht.Config) {
+	d, err := dht.NewWithConfig(cfg)
+	if err != nil {
+		log.Printf("DHT: failed to create: %v", err)
+		close(s.dhtReady)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.Start(ctx); err != nil {
+		log.Printf("DHT: failed to start: %v", err)
+		cancel()
+		close(s.dhtReady)
+		return
+	}
+	log.Printf("DHT: started on port %d, bootstrapping...", d.Port())
+	s.dht = d
+	s.stopDHT = func() {
+		cancel()
+		d.Stop()
+	}
+	go func() {
+		defer close(s.dhtReady)
+		d.Bootstrap()
+		if d.RoutingTable().Size() == 0 {
+			log.Println("DHT: no bootstrap nodes reachable — UDP port 6881 may be blocked by firewall")
+		}
+	}()
+}
+
+// Port returns the port incoming peers connect to
+func (s *Session) Port() int {
+	return listenPort(s.listener)
+}
+
+// DHT returns the DHT node of the session, nil if it has none
+func (s *Session) DHT() *dht.DHT {
+	return s.dht
+}
+
+// Close stops all the torrents, the listener and the DHT node owned by the session
+func (s *Session) Close() {
+	for _, t := range s.list() {
+		t.stop()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.stopDHT()
+}
+
+// Add starts downloading a torrent from a magnet link or the path of a .torrent file
+// The files are saved in outputPath; for a .torrent file, an empty outputPath means its folder.
+func (s *Session) Add(source, outputPath string, opts *DownloadOptions) (*Torrent, error) {
+	return s.add(context.Background(), source, outputPath, opts)
+}
+
+// AddWithContext is Add for a torrent that stops, announcing it to its trackers, once ctx is done
+func (s *Session) AddWithContext(ctx context.Context, source, outputPath string, opts *DownloadOptions) (*Torrent, error) {
+	return s.add(ctx, source, outputPath, opts)
+}
+
+// add registers a torrent and starts downloading it until ctx is done
+func (s *Session) add(ctx context.Context, source, outputPath string, opts *DownloadOptions) (*Torrent, error) {
+	t := &Torrent{
+		session:    s,
+		ctx:        ctx,
+		outputPath: outputPath,
+		status:     StatusStarting,
+	}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if strings.HasPrefix(source, "magnet:") {
+		magnet, err := ParseMagnet(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse magnet link: %w", err)
+		}
+		t.magnet = magnet
+		t.magnetLink = source
+		t.hash = magnet.Hash
+		t.name = magnet.DisplayName()
+		// the trackers of a magnet link are alternatives to one another
+		t.tiers = newTrackerTiers([][]*url.URL{magnet.TrackersURL})
+	} else {
+		file, metadata, err := openTorrent(source)
+		if err != nil {
+			return nil, err
+		}
+		t.file = file
+		t.metadata = metadata
+		t.tiers = newTrackerTiers(file.Tiers())
+		t.torrentPath = source
+		t.hash = file.Info.Hash
+		t.name = file.Info.Name
+		t.size = int64(file.Info.Length)
+		t.total = len(file.Info.Pieces)
+		if t.outputPath == "" {
+			t.outputPath = filepath.Dir(source)
+		}
+	}
+
+	s.mu.Lock()
+	if _, ok := s.torrents[t.hash]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("torrent %x already added", t.hash)
+	}
+	t.order = s.added
+	s.added++
+	s.torrents[t.hash] = t
+	s.mu.Unlock()
+
+	t.start()
+	return t, nil
+}
+
+// Get returns the torrent with the given info hash, nil if it is not in the session
+func (s *Session) Get(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Pause stops downloading and serving a torrent; its progress is kept
+func (s *Session) Pause(infoHash [20]byte) error {
+	t := s.Get(infoHash)
+	if t == nil {
+		return fmt.Errorf("torrent %x not found", infoHash)
+	}
+	t.stop()
+	return nil
+}
+
+// Resume starts again a paused or failed torrent
+func (s *Session) Resume(infoHash [20]byte) error {
+	t := s.Get(infoHash)
+	if t == nil {
+		return fmt.Errorf("torrent %x not found", infoHash)
+	}
+	t.mu.Lock()
+	status := t.status
+	t.mu.Unlock()
+	if status == StatusPaused || status == StatusError {
+		t.start()
+	}
+	return nil
+}
+
+// Remove stops a torrent and removes it from the session along with its resume state
+// The downloaded files are kept
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if ok {
+		t.stop()
+	}
+	if err := os.Remove(StateFile(infoHash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the stats of every torrent of the session, in the order they were added
+func (s *Session) List() []TorrentStats {
+	torrents := s.list()
+	stats := make([]TorrentStats, len(torrents))
+	for i, t := range torrents {
+		stats[i] = t.Stats()
+	}
+	return stats
+}
+
+// list returns the torrents of the session in the order they were added
+func (s *Session) list() []*Torrent {
+	s.mu.Lock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+	sort.Slice(torrents, func(i, j int) bool {
+		return torrents[i].order < torrents[j].order
+	})
+	return torrents
+}
+
+// Status is the state a torrent of a session is in
+type Status string
+
+// states of a torrent
+const (
+	StatusStarting    Status = "starting"    // looking for peers or metadata
+	StatusDownloading Status = "downloading" // downloading pieces
+	StatusSeeding     Status = "seeding"     // complete and serving peers
+	StatusCompleted   Status = "completed"   // complete and stopped
+	StatusPaused      Status = "paused"      // stopped by the user
+	StatusError       Status = "error"       // stopped by an error
+)
+
+// TorrentStats is a snapshot of the state of a torrent
+type TorrentStats struct {
+	InfoHash        [20]byte
+	Name            string
+	Status          Status
+	Err             error // why the torrent stopped, if Status is StatusError
+	CompletedPieces int
+	TotalPieces     int
+	Downloaded      int64 // bytes of the completed pieces
+	Size            int64 // 0 until the metadata of a magnet link is known
+	Uploaded        int64 // bytes served to peers in the current run
+	Peers           int   // connected peers
+	Seeders         int   // seeders in the swarm, as reported by the trackers
+	Leechers        int   // leechers in the swarm, as reported by the trackers
+	TorrentPath     string
+	MagnetLink      string
+	OutputPath      string
+}
+
+// Progress returns the download progress as a percentage (0-100)
+func (ts TorrentStats) Progress() float64 {
+	if ts.TotalPieces == 0 {
+		return 0
+	}
+	return float64(ts.CompletedPieces) / float64(ts.TotalPieces) * 100
+}
+
+// Torrent is a torrent managed by a Session
+type Torrent struct {
+	session     *Session
+	ctx         context.Context // stops the torrent when done
+	hash        [20]byte
+	file        *TorrentFile // set for .torrent files
+	magnet      *Magnet      // set for magnet links
+	metadata    []byte       // bencoded info dictionary, nil until a magnet fetched it
+	tiers       *trackerTiers
+	torrentPath string
+	magnetLink  string
+	outputPath  string
+	opts        DownloadOptions
+	order       int
+
+	mu         sync.Mutex
+	name       string
+	status     Status
+	err        error // error of the last run
+	completed  int
+	total      int
+	downloaded int64
+	size       int64
+	swarm      *swarm       // peers of the current run, nil until the download starts
+	scrape     ScrapeResult // last state of the swarm reported by the trackers
+	cancel     context.CancelFunc
+	done       chan struct{} // closed when the current run stops
+}
+
+// InfoHash returns the info hash of the torrent
+func (t *Torrent) InfoHash() [20]byte {
+	return t.hash
+}
+
+// Stats returns a snapshot of the state of the torrent
+func (t *Torrent) Stats() TorrentStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := TorrentStats{
+		InfoHash:        t.hash,
+		Name:            t.name,
+		Status:          t.status,
+		CompletedPieces: t.completed,
+		TotalPieces:     t.total,
+		Downloaded:      t.downloaded,
+		Size:            t.size,
+		Seeders:         t.scrape.Seeders,
+		Leechers:        t.scrape.Leechers,
+		TorrentPath:     t.torrentPath,
+		MagnetLink:      t.magnetLink,
+		OutputPath:      t.outputPath,
+	}
+	if t.status == StatusError {
+		stats.Err = t.err
+	}
+	if t.swarm != nil {
+		stats.Uploaded = t.swarm.uploaded.Load()
+		stats.Peers = len(t.swarm.connectedPeers())
+	}
+	return stats
+}
+
+// Wait blocks until the torrent stops and returns the error that stopped it
+// It returns nil once a download that does not seed is complete.
+func (t *Torrent) Wait() error {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+	<-done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// start runs the torrent in the background unless it is already running
+func (t *Torrent) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done != nil {
+		select {
+		case <-t.done:
+		default:
+			return // still running
+		}
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.status = StatusStarting
+	t.err = nil
+	go t.run(ctx, cancel, t.done)
+}
+
+// stop stops the torrent and waits for it to be stopped
+func (t *Torrent) stop() {
+	t.mu.Lock()
+	cancel, done := t.cancel, t.done
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// run downloads the torrent until it is complete (and seeded, if asked) or ctx is done
+func (t *Torrent) run(ctx context.Context, cancel context.CancelFunc, done chan struct{}) {
+	defer close(done)
+	defer cancel()
+	var err error
+	if t.magnet != nil {
+		err = t.downloadMagnet(ctx)
+	} else {
+		err = t.downloadFile(ctx)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+	t.swarm = nil
+	switch {
+	case err == nil:
+		t.status = StatusCompleted
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		t.status = StatusPaused
+	default:
+		t.status = StatusError
+	}
+}
+
+// setScrape records the state of the swarm reported by the trackers
+func (t *Torrent) setScrape(r ScrapeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scrape = r
+}
+
+// Trackers returns the state of the trackers of the torrent, in the order they are tried
+func (t *Torrent) Trackers() []TrackerStatus {
+	return t.tiers.status()
+}
+
+// setStatus updates the status of the running torrent
+func (t *Torrent) setStatus(status Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+}
+
+// setSwarm records the swarm of the running download, once the metadata is known
+func (t *Torrent) setSwarm(sw *swarm, inf *TorrentInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.swarm = sw
+	t.name = inf.Name
+	t.size = int64(inf.Length)
+	t.total = len(inf.Pieces)
+}
+
+// progress records the progress of the download and reports it to the caller
+func (t *Torrent) progress(completedPieces, totalPieces int, downloadedBytes, totalBytes int64) {
+	t.mu.Lock()
+	t.completed, t.total = completedPieces, totalPieces
+	t.downloaded, t.size = downloadedBytes, totalBytes
+	t.mu.Unlock()
+	if t.opts.OnProgress != nil {
+		t.opts.OnProgress(completedPieces, totalPieces, downloadedBytes, totalBytes)
+	}
+}
+
+// connLimiter bounds a number of peer connections
+// a nil connLimiter allows any number of them
+type connLimiter chan struct{}
+
+// newConnLimiter returns a limiter allowing n connections, or def if n is not positive
+func newConnLimiter(n, def int) connLimiter {
+	if n <= 0 {
+		n = def
+	}
+	return make(connLimiter, n)
+}
+
+// acquire waits for a free connection slot; returns false if done is closed first
+func (c connLimiter) acquire(done <-chan struct{}) bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// tryAcquire takes a free connection slot if there is one
+func (c connLimiter) tryAcquire() bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a connection slot taken by acquire or tryAcquire
+func (c connLimiter) release() {
+	if c != nil {
+		<-c
+	}
+}
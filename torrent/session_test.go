@@ -0,0 +1,123 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+)
+
+// magnets without any peer source: their download fails as soon as it starts
+const (
+	peerlessMagnet      = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=first"
+	otherPeerlessMagnet = "magnet:?xt=urn:btih:76543210fedcba9876543210fedcba9876543210&dn=second"
+)
+
+// newTestSession returns a session without DHT node, closed at the end of the test
+func newTestSession(t *testing.T) *Session {
+	s, err := NewSession(&SessionConfig{DisableDHT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSessionAddAndList(t *testing.T) {
+	s := newTestSession(t)
+
+	first, err := s.Add(peerlessMagnet, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(otherPeerlessMagnet, t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(peerlessMagnet, t.TempDir(), nil); err == nil {
+		t.Error("expected adding the same torrent twice to fail")
+	}
+
+	if err := first.Wait(); err == nil || !strings.Contains(err.Error(), "no peers") {
+		t.Errorf("expected the download to fail for lack of peers, got %v", err)
+	}
+	stats := first.Stats()
+	if stats.Status != StatusError || stats.Err == nil {
+		t.Errorf("expected the torrent to be in error, got %s (%v)", stats.Status, stats.Err)
+	}
+
+	list := s.List()
+	if len(list) != 2 {
+		t.Fatalf("expected 2 torrents, got %d", len(list))
+	}
+	if list[0].Name != "first" || list[1].Name != "second" {
+		t.Errorf("expected the torrents in the order they were added, got %q then %q", list[0].Name, list[1].Name)
+	}
+	if list[0].MagnetLink != peerlessMagnet {
+		t.Errorf("unexpected magnet link %q", list[0].MagnetLink)
+	}
+}
+
+func TestSessionInvalidSource(t *testing.T) {
+	s := newTestSession(t)
+	if _, err := s.Add("magnet:?dn=nohash", "", nil); err == nil {
+		t.Error("expected an invalid magnet link to be rejected")
+	}
+	if _, err := s.Add("does/not/exist.torrent", "", nil); err == nil {
+		t.Error("expected a missing torrent file to be rejected")
+	}
+	if len(s.List()) != 0 {
+		t.Error("expected no torrent to be registered")
+	}
+}
+
+func TestSessionResumeAndRemove(t *testing.T) {
+	s := newTestSession(t)
+	tor, err := s.Add(peerlessMagnet, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.Wait()
+
+	if err := s.Resume(tor.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Wait(); err == nil {
+		t.Error("expected the resumed download to fail again")
+	}
+	if err := s.Pause(tor.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Remove(tor.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get(tor.InfoHash()) != nil || len(s.List()) != 0 {
+		t.Error("expected the torrent to be removed")
+	}
+	if err := s.Pause(tor.InfoHash()); err == nil {
+		t.Error("expected pausing a removed torrent to fail")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	c := newConnLimiter(0, 2)
+	if !c.tryAcquire() || !c.tryAcquire() {
+		t.Fatal("expected 2 free slots")
+	}
+	if c.tryAcquire() {
+		t.Error("expected no free slot")
+	}
+	done := make(chan struct{})
+	close(done)
+	if c.acquire(done) {
+		t.Error("expected acquire to give up once done is closed")
+	}
+	c.release()
+	if !c.acquire(nil) {
+		t.Error("expected the released slot to be free")
+	}
+
+	var unlimited connLimiter
+	if !unlimited.tryAcquire() {
+		t.Error("expected a nil limiter to allow any connection")
+	}
+	unlimited.release()
+}
@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storage maps the pieces of a torrent onto the files they are written to
+type storage struct {
+	info  *TorrentInfo
+	files []*os.File
+
+	mu        sync.Mutex
+	remaining []int // bytes left to be written per file
+}
+
+// openStorage opens the files of a torrent in outDir, creating them if needed
+// and making sure each file has its final length
+func openStorage(inf *TorrentInfo, outDir string) (*storage, error) {
+	s := &storage{
+		info:      inf,
+		files:     make([]*os.File, len(inf.Files)),
+		remaining: make([]int, len(inf.Files)),
+	}
+	for i, f := range inf.Files {
+		path := filepath.Join(outDir, f.Path)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.files[i] = fd
+		s.remaining[i] = f.Length
+		stat, err := fd.Stat()
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		if stat.Size() != int64(f.Length) {
+			if err := fd.Truncate(int64(f.Length)); err != nil {
+				s.close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// close closes all the files of the storage
+func (s *storage) close() {
+	for _, fd := range s.files {
+		if fd != nil {
+			fd.Close()
+		}
+	}
+}
+
+// pieceLength returns the length of the piece at index; the last piece might be shorter
+func (s *storage) pieceLength(index int) int {
+	pieceLen := s.info.PieceLength
+	if index == len(s.info.Pieces)-1 && s.info.Length%pieceLen != 0 {
+		return s.info.Length % pieceLen
+	}
+	return pieceLen
+}
+
+// access reads or writes buf at offset, offset being relative to the whole torrent
+func (s *storage) access(buf []byte, offset int, write bool) error {
+	for i, f := range s.info.Files {
+		start, end := f.CumStart, f.CumStart+f.Length
+		if offset+len(buf) <= start || offset >= end {
+			continue
+		}
+		// start reading the buffer at bufStart and the file at fileOffset
+		bufStart, fileOffset := 0, offset-start
+		if fileOffset < 0 {
+			bufStart, fileOffset = -fileOffset, 0
+		}
+		bufEnd := min(len(buf), end-offset)
+		var err error
+		if write {
+			_, err = s.files[i].WriteAt(buf[bufStart:bufEnd], int64(fileOffset))
+		} else {
+			_, err = s.files[i].ReadAt(buf[bufStart:bufEnd], int64(fileOffset))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlock reads length bytes of the piece at index, starting at begin
+func (s *storage) readBlock(index, begin, length int) ([]byte, error) {
+	if index < 0 || index >= len(s.info.Pieces) {
+		return nil, fmt.Errorf("piece index %d out of range", index)
+	}
+	if begin < 0 || length < 0 || begin+length > s.pieceLength(index) {
+		return nil, fmt.Errorf("block [%d, %d) out of bounds for piece %d of length %d",
+			begin, begin+length, index, s.pieceLength(index))
+	}
+	block := make([]byte, length)
+	if err := s.access(block, index*s.info.PieceLength+begin, false); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// readPiece reads the whole piece at index
+func (s *storage) readPiece(index int) ([]byte, error) {
+	return s.readBlock(index, 0, s.pieceLength(index))
+}
+
+// writePiece writes the piece at index to the files it spans
+// returns the indices of the files that are now fully written
+func (s *storage) writePiece(index int, data []byte) ([]int, error) {
+	if err := s.access(data, index*s.info.PieceLength, true); err != nil {
+		return nil, err
+	}
+	return s.markWritten(index), nil
+}
+
+// markWritten accounts for the piece at index being on disk
+// returns the indices of the files that are now fully written
+func (s *storage) markWritten(index int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var finished []int
+	pieceStart := index * s.info.PieceLength
+	pieceEnd := pieceStart + s.pieceLength(index)
+	for i, f := range s.info.Files {
+		start, end := max(pieceStart, f.CumStart), min(pieceEnd, f.CumStart+f.Length)
+		if start >= end {
+			continue
+		}
+		s.remaining[i] -= end - start
+		if s.remaining[i] == 0 {
+			finished = append(finished, i)
+		}
+	}
+	return finished
+}
+
+// verifyPiece checks that the data stored for the piece at index matches its hash
+func (s *storage) verifyPiece(index int) bool {
+	data, err := s.readPiece(index)
+	if err != nil {
+		return false
+	}
+	return sha1.Sum(data) == s.info.Pieces[index]
+}
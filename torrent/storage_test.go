@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestInfo returns a torrent of three files spanning pieces of 4 bytes
+// and the content of the whole torrent
+func newTestInfo() (*TorrentInfo, []byte) {
+	data := []byte("abcdefghijklmnopqrstu") // 21 bytes: 5 full pieces and a piece of 1 byte
+	files := []SubFile{
+		{CumStart: 0, Length: 6, Path: "a"},
+		{CumStart: 6, Length: 3, Path: filepath.Join("dir", "b")},
+		{CumStart: 9, Length: 12, Path: "c"},
+	}
+	var pieces [][20]byte
+	for i := 0; i < len(data); i += 4 {
+		pieces = append(pieces, sha1.Sum(data[i:min(i+4, len(data))]))
+	}
+	return &TorrentInfo{
+		Name:        "test",
+		Length:      len(data),
+		Files:       files,
+		PieceLength: 4,
+		Pieces:      pieces,
+	}, data
+}
+
+func TestStorageWriteRead(t *testing.T) {
+	inf, data := newTestInfo()
+	dir := t.TempDir()
+	st, err := openStorage(inf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	finishedFiles := 0
+	for i := range inf.Pieces {
+		start := i * inf.PieceLength
+		finished, err := st.writePiece(i, data[start:start+st.pieceLength(i)])
+		if err != nil {
+			t.Fatalf("writePiece(%d) failed: %v", i, err)
+		}
+		finishedFiles += len(finished)
+	}
+	if finishedFiles != len(inf.Files) {
+		t.Errorf("expected %d finished files, got %d", len(inf.Files), finishedFiles)
+	}
+
+	for i := range inf.Pieces {
+		if !st.verifyPiece(i) {
+			t.Errorf("piece %d failed verification", i)
+		}
+	}
+
+	// a block crossing the boundary between the first two files
+	block, err := st.readBlock(1, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, data[5:8]) {
+		t.Errorf("expected block %q, got %q", data[5:8], block)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "dir", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data[6:9]) {
+		t.Errorf("expected file content %q, got %q", data[6:9], content)
+	}
+}
+
+func TestStorageLastPiece(t *testing.T) {
+	inf, _ := newTestInfo()
+	st, err := openStorage(inf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	if l := st.pieceLength(len(inf.Pieces) - 1); l != 1 {
+		t.Errorf("expected last piece of length 1, got %d", l)
+	}
+	if l := st.pieceLength(0); l != 4 {
+		t.Errorf("expected piece of length 4, got %d", l)
+	}
+}
+
+func TestStorageReadBlockOutOfBounds(t *testing.T) {
+	inf, _ := newTestInfo()
+	st, err := openStorage(inf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	tests := []struct {
+		name                 string
+		index, begin, length int
+	}{
+		{"negative index", -1, 0, 1},
+		{"index too large", len(inf.Pieces), 0, 1},
+		{"block past piece end", 0, 2, 3},
+		{"block past last piece end", len(inf.Pieces) - 1, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := st.readBlock(tt.index, tt.begin, tt.length); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
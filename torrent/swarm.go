@@ -0,0 +1,202 @@
+package torrent
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// limits of the peers a swarm learns about from trackers, the DHT and PEX
+const (
+	maxKnownPeers   = 2000 // addresses remembered; new ones are ignored past it
+	maxPendingDials = 200  // connections started by addPeers at once, waiting for a slot or running
+)
+
+// swarm holds the state shared by all the peer connections of a torrent:
+// the pieces we have, where they are stored and the peers we are connected to
+type swarm struct {
+	hash     [20]byte
+	clientID [20]byte
+	info     *TorrentInfo   // nil while the metadata is being fetched
+	state    *DownloadState // pieces we have
+	storage  *storage       // where the pieces are read from when serving them
+	seed     bool           // keep serving peers once the download is complete
+	worker   func(p *peer)  // runs the download loop of a connected peer
+
+	conns     connLimiter // connection slots shared with the other torrents
+	peerSlots connLimiter // connection slots of this torrent
+
+	connect func(address string) // runs the connection to a newly learned peer until it ends, nil to ignore new peers
+	port    int                  // port we listen on, advertised to the peers
+
+	uploaded   atomic.Int64 // bytes served to peers
+	downloaded atomic.Int64 // bytes of pieces received from peers
+
+	mu       sync.Mutex
+	peers    map[*peer]struct{}
+	known    map[string]bool // addresses of the peers we connected to or tried to, at most maxKnownPeers
+	dials    int             // connections started by addPeers that did not end yet
+	metadata []byte          // bencoded info dictionary, nil until we have it
+}
+
+// newSwarm creates a swarm for a torrent whose pieces are tracked by state and stored in st
+func newSwarm(inf *TorrentInfo, clientID [20]byte, state *DownloadState, st *storage, seed bool) *swarm {
+	return &swarm{
+		hash:     inf.Hash,
+		clientID: clientID,
+		info:     inf,
+		state:    state,
+		storage:  st,
+		seed:     seed,
+		peers:    make(map[*peer]struct{}),
+	}
+}
+
+// hasPiece returns true if we have the piece at index and can serve it
+func (s *swarm) hasPiece(index int) bool {
+	return s.state != nil && s.storage != nil && s.state.IsPieceComplete(index)
+}
+
+// complete returns true if we have every piece of the torrent
+func (s *swarm) complete() bool {
+	return s.state != nil && s.state.IsComplete()
+}
+
+// bitfield returns a copy of the bitfield of the pieces we have
+// returns nil if we have none
+func (s *swarm) bitfield() bitfield {
+	if s.state == nil || s.state.CompletedPieces() == 0 {
+		return nil
+	}
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	bf := make(bitfield, len(s.state.Downloaded))
+	copy(bf, s.state.Downloaded)
+	return bf
+}
+
+// setMetadata stores the bencoded info dictionary of the torrent
+func (s *swarm) setMetadata(metadata []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = metadata
+}
+
+// rawMetadata returns the bencoded info dictionary of the torrent, nil if we do not have it
+func (s *swarm) rawMetadata() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metadata
+}
+
+// addPeer registers a connected peer
+func (s *swarm) addPeer(p *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[*peer]struct{})
+	}
+	s.peers[p] = struct{}{}
+}
+
+// removePeer unregisters a disconnected peer
+func (s *swarm) removePeer(p *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p)
+}
+
+// connectedPeers returns the currently connected peers
+func (s *swarm) connectedPeers() []*peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// acquireConn waits for a connection slot both for the torrent and globally
+// returns false if done is closed first
+func (s *swarm) acquireConn(done <-chan struct{}) bool {
+	if !s.peerSlots.acquire(done) {
+		return false
+	}
+	if !s.conns.acquire(done) {
+		s.peerSlots.release()
+		return false
+	}
+	return true
+}
+
+// tryAcquireConn takes a connection slot if one is free both for the torrent and globally
+func (s *swarm) tryAcquireConn() bool {
+	if !s.peerSlots.tryAcquire() {
+		return false
+	}
+	if !s.conns.tryAcquire() {
+		s.peerSlots.release()
+		return false
+	}
+	return true
+}
+
+// releaseConn frees a connection slot taken by acquireConn or tryAcquireConn
+func (s *swarm) releaseConn() {
+	s.conns.release()
+	s.peerSlots.release()
+}
+
+// addPeers connects to the addresses we did not know about yet
+// at most maxPendingDials connections run at once: the addresses left over are not remembered,
+// so that they can be learned again later
+// returns the number of new addresses
+func (s *swarm) addPeers(addresses []string) int {
+	if s.connect == nil {
+		return 0
+	}
+	s.mu.Lock()
+	if s.known == nil {
+		s.known = make(map[string]bool)
+	}
+	var fresh []string
+	for _, address := range addresses {
+		if s.dials >= maxPendingDials || len(s.known) >= maxKnownPeers {
+			break
+		}
+		if !s.known[address] {
+			s.known[address] = true
+			s.dials++
+			fresh = append(fresh, address)
+		}
+	}
+	s.mu.Unlock()
+	for _, address := range fresh {
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.dials--
+			}()
+			s.connect(address)
+		}()
+	}
+	return len(fresh)
+}
+
+// handlePeer hands a peer that connected to us to the download loop of the torrent
+func (s *swarm) handlePeer(p *peer) {
+	if s.worker == nil {
+		p.close()
+		return
+	}
+	s.worker(p)
+}
+
+// broadcastHave tells every connected peer that we now have the piece at index
+func (s *swarm) broadcastHave(index int) {
+	msg := Have(index)
+	for _, p := range s.connectedPeers() {
+		p.send(msg) // best-effort, ignore error
+	}
+}
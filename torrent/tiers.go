@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TrackerStatus is the state of a tracker of a torrent
+type TrackerStatus struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time // zero if we never announced to the tracker
+	Err          error     // error of the last announce, nil if it succeeded
+	Warning      string    // warning message of the last successful announce, if any
+	Peers        int       // number of peers returned by the last successful announce
+}
+
+// trackerEntry is a tracker of a torrent and the result of the last announce to it
+type trackerEntry struct {
+	url          *url.URL
+	started      bool   // the tracker received our started event and no stopped event since
+	trackerID    string // tracker id to send back to the tracker
+	lastAnnounce time.Time
+	err          error
+	warning      string
+	peers        int
+}
+
+// trackerTiers holds the trackers of a torrent in tiers (BEP 12):
+// the trackers are tried in order, the tiers one after the other, and
+// a tracker that responds is moved to the front of its tier
+type trackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]*trackerEntry
+}
+
+// newTrackerTiers returns the trackers of the given tiers, shuffled within each tier
+func newTrackerTiers(tiers [][]*url.URL) *trackerTiers {
+	t := &trackerTiers{tiers: make([][]*trackerEntry, 0, len(tiers))}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		entries := make([]*trackerEntry, len(tier))
+		for i, u := range tier {
+			entries[i] = &trackerEntry{url: u}
+		}
+		rand.Shuffle(len(entries), func(i, j int) {
+			entries[i], entries[j] = entries[j], entries[i]
+		})
+		t.tiers = append(t.tiers, entries)
+	}
+	return t
+}
+
+// entries returns the trackers in the order they should be tried
+func (t *trackerTiers) entries() []*trackerEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Concat(t.tiers...)
+}
+
+// announce announces to the first tracker that responds, in tier order,
+// and returns its response; request builds the announce sent to a tracker
+func (t *trackerTiers) announce(request func(e *trackerEntry) *AnnounceRequest, retries int) (*TrackerResponse, error) {
+	var errs []error
+	for _, e := range t.entries() {
+		req := request(e)
+		resp, err := announce(e.url, req, retries)
+		t.record(e, req.Event, resp, err)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no tracker to announce to")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// record stores the result of an announce of event to the tracker of e
+// and promotes it to the front of its tier if it responded
+func (t *trackerTiers) record(e *trackerEntry, event AnnounceEvent, resp *TrackerResponse, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.lastAnnounce = time.Now()
+	e.err = err
+	if event == EventStopped {
+		// a tracker that missed our stopped event will forget us after a while anyway
+		e.started = false
+	}
+	if err != nil {
+		return
+	}
+	e.peers = len(resp.PeersAddresses)
+	e.warning = resp.Warning
+	e.started = event != EventStopped
+	if resp.TrackerID != "" {
+		e.trackerID = resp.TrackerID
+	}
+	for _, tier := range t.tiers {
+		if i := slices.Index(tier, e); i > 0 {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = e
+		}
+	}
+}
+
+// scrape asks the trackers in order for the state of the swarm of hash, until one answers
+func (t *trackerTiers) scrape(hash [20]byte, retries int) (ScrapeResult, error) {
+	var errs []error
+	for _, e := range t.entries() {
+		results, err := scrape(e.url, [][20]byte{hash}, retries)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if r, ok := results[hash]; ok {
+			return r, nil
+		}
+		errs = append(errs, fmt.Errorf("tracker %s does not know the torrent", e.url.Host))
+	}
+	if len(errs) == 0 {
+		return ScrapeResult{}, errors.New("no tracker to scrape")
+	}
+	return ScrapeResult{}, errors.Join(errs...)
+}
+
+// isStarted returns true if the tracker of e knows we are active
+func (t *trackerTiers) isStarted(e *trackerEntry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return e.started
+}
+
+// trackerID returns the tracker id the tracker of e gave us, empty if none
+func (t *trackerTiers) trackerID(e *trackerEntry) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return e.trackerID
+}
+
+// stop sends a stopped event to every tracker that knows we are active
+func (t *trackerTiers) stop(request func(e *trackerEntry) *AnnounceRequest) {
+	for _, e := range t.entries() {
+		if !t.isStarted(e) {
+			continue
+		}
+		req := request(e)
+		resp, err := announce(e.url, req, 1)
+		t.record(e, req.Event, resp, err)
+	}
+}
+
+// status returns the state of every tracker, in the order they are tried
+func (t *trackerTiers) status() []TrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var status []TrackerStatus
+	for i, tier := range t.tiers {
+		for _, e := range tier {
+			status = append(status, TrackerStatus{
+				URL:          e.url.String(),
+				Tier:         i,
+				LastAnnounce: e.lastAnnounce,
+				Err:          e.err,
+				Warning:      e.warning,
+				Peers:        e.peers,
+			})
+		}
+	}
+	return status
+}
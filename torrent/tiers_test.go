@@ -0,0 +1,104 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newFailingTracker starts an HTTP tracker answering every announce with an error
+func newFailingTracker(t *testing.T) *url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestParseAnnounceListTiers(t *testing.T) {
+	list := []bencode{
+		{List: []bencode{{Str: "udp://a:1"}, {Str: "udp://b:2"}}},
+		{List: []bencode{}},
+		{List: []bencode{{Str: "http://c:3/announce"}}},
+	}
+	tiers := parseAnnounceList(list)
+	if len(tiers) != 2 || len(tiers[0]) != 2 || len(tiers[1]) != 1 {
+		t.Fatalf("expected tiers of 2 and 1 trackers, got %v", tiers)
+	}
+	if tiers[0][1].Host != "b:2" || tiers[1][0].Host != "c:3" {
+		t.Errorf("trackers out of order: %v", tiers)
+	}
+}
+
+func TestTrackerTiersShuffleWithinTiers(t *testing.T) {
+	var first, second []*url.URL
+	for i := range 10 {
+		first = append(first, &url.URL{Scheme: "udp", Host: "first" + string(rune('a'+i))})
+		second = append(second, &url.URL{Scheme: "udp", Host: "second" + string(rune('a'+i))})
+	}
+	status := newTrackerTiers([][]*url.URL{first, second}).status()
+	if len(status) != 20 {
+		t.Fatalf("expected 20 trackers, got %d", len(status))
+	}
+	for i, s := range status {
+		if s.Tier != i/10 {
+			t.Errorf("tracker %s moved to tier %d", s.URL, s.Tier)
+		}
+	}
+}
+
+func TestTrackerTiersFailover(t *testing.T) {
+	down := newFailingTracker(t)
+	up, announces := newTestTracker(t)
+	backup, _ := newTestTracker(t)
+	tiers := &trackerTiers{tiers: [][]*trackerEntry{
+		{{url: down}, {url: up}},
+		{{url: backup}},
+	}}
+
+	req := func(*trackerEntry) *AnnounceRequest { return &AnnounceRequest{Event: EventStarted} }
+	resp, err := tiers.announce(req, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.PeersAddresses) != 1 {
+		t.Errorf("expected the peer of the responding tracker, got %v", resp.PeersAddresses)
+	}
+	if got := nextAnnounce(t, announces); got.event != "started" {
+		t.Errorf("expected a started event, got %+v", got)
+	}
+
+	status := tiers.status()
+	if status[0].URL != up.String() || status[0].Err != nil || status[0].Peers != 1 || status[0].LastAnnounce.IsZero() {
+		t.Errorf("expected the responding tracker first in its tier, got %+v", status[0])
+	}
+	if status[1].URL != down.String() || status[1].Err == nil {
+		t.Errorf("expected the failing tracker to record its error, got %+v", status[1])
+	}
+	if status[2].URL != backup.String() || !status[2].LastAnnounce.IsZero() {
+		t.Errorf("expected the next tier not to be used, got %+v", status[2])
+	}
+}
+
+func TestTrackerTiersNextTier(t *testing.T) {
+	down := newFailingTracker(t)
+	backup, _ := newTestTracker(t)
+	tiers := newTrackerTiers([][]*url.URL{{down}, {backup}})
+	if _, err := tiers.announce(func(*trackerEntry) *AnnounceRequest { return &AnnounceRequest{} }, 1); err != nil {
+		t.Fatal(err)
+	}
+	status := tiers.status()
+	if status[0].Err == nil || status[1].Err != nil || status[1].Peers != 1 {
+		t.Errorf("expected the second tier to answer, got %+v", status)
+	}
+
+	tiers = newTrackerTiers([][]*url.URL{{down}})
+	if _, err := tiers.announce(func(*trackerEntry) *AnnounceRequest { return &AnnounceRequest{} }, 1); err == nil {
+		t.Error("expected an error when every tracker fails")
+	}
+}
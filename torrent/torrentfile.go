@@ -10,7 +10,7 @@ import (
 	"net"
 	"net/url"
 	"os"
-	"time"
+	"slices"
 )
 
 // the actions for an udp transfer
@@ -21,32 +21,20 @@ const (
 	aError
 )
 
-// UDP tracker constants
-const (
-	udpMaxRetries  = 8                // max retry attempts for UDP tracker
-	udpBaseTimeout = 15 * time.Second // base timeout, doubles each retry
-)
-
-// udpConn is a simple struct with a connection and its scheme
-type udpConn struct {
-	Conn   *net.UDPConn
-	Scheme string
-}
-
 // TorrentFile represents a flattened torrent file
 type TorrentFile struct {
-	Announce []*url.URL
-	Info     *TorrentInfo
+	Announce     []*url.URL
+	AnnounceList [][]*url.URL // tiers of trackers (BEP 12), nil without an announce-list
+	Info         *TorrentInfo
 }
 
-// parseAnnounceList parses and flattens the announce list
-// it should be a list of lists of urls (as strings)
-func parseAnnounceList(l []bencode) []*url.URL {
-	q := []*url.URL{}
+// parseAnnounceList parses the announce list
+// it should be a list of lists of urls (as strings), one list per tier
+// empty tiers are skipped
+func parseAnnounceList(l []bencode) [][]*url.URL {
+	var tiers [][]*url.URL
 	for _, subL := range l {
-		if len(subL.List) == 0 {
-			continue
-		}
+		var tier []*url.URL
 		for _, u := range subL.List {
 			if u.Str == "" {
 				continue
@@ -55,10 +43,22 @@ func parseAnnounceList(l []bencode) []*url.URL {
 			if err != nil {
 				continue
 			}
-			q = append(q, parsedU)
+			tier = append(tier, parsedU)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
 		}
 	}
-	return q
+	return tiers
+}
+
+// Tiers returns the tiers of trackers of the torrent:
+// the announce list if there is one, else a single tier with the announce URL
+func (t *TorrentFile) Tiers() [][]*url.URL {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	return [][]*url.URL{t.Announce}
 }
 
 // prettyTorrentBencode parses the bencode as a TorrentFile
@@ -76,11 +76,12 @@ func prettyTorrentBencode(ben *bencode) (*TorrentFile, error) {
 		return nil, fmt.Errorf("could not parse announce: %s", err.Error())
 	}
 	ann := []*url.URL{u}
+	var tiers [][]*url.URL
 	annList, ok := dic["announce-list"]
 	if ok && annList.List != nil {
-		urls := parseAnnounceList(annList.List)
-		if len(urls) > 0 {
-			ann = urls
+		tiers = parseAnnounceList(annList.List)
+		if len(tiers) > 0 {
+			ann = slices.Concat(tiers...)
 		}
 	}
 
@@ -95,38 +96,49 @@ func prettyTorrentBencode(ben *bencode) (*TorrentFile, error) {
 	}
 
 	return &TorrentFile{
-		Announce: ann,
-		Info:     info,
+		Announce:     ann,
+		AnnounceList: tiers,
+		Info:         info,
 	}, nil
 }
 
 // OpenTorrent returns a TorrentFile by reading a file at a certain path
 func OpenTorrent(path string) (*TorrentFile, error) {
+	tf, _, err := openTorrent(path)
+	return tf, err
+}
+
+// openTorrent reads the torrent file at path
+// and also returns its bencoded info dictionary
+func openTorrent(path string) (*TorrentFile, []byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close()
 	bencode, err := decode(bufio.NewReader(file), new(bytes.Buffer), false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	tf, err := prettyTorrentBencode(bencode)
+	if err != nil {
+		return nil, nil, err
 	}
-	return prettyTorrentBencode(bencode)
+	return tf, bencode.Info, nil
 }
 
 // GetPeers returns the list of peers from a torrent file and client ID
+// announcing the first port of the standard BitTorrent range
 func (t *TorrentFile) GetPeers(clientID [20]byte) (*TrackerResponse, error) {
-	for _, u := range t.Announce {
-		switch u.Scheme {
-		case "http", "https":
-			return t.Info.getPeersHTTP(clientID, u)
-		case "udp", "udp4", "udp6":
-			return t.getPeersUDP(clientID)
-		default:
-			continue
-		}
-	}
-	return nil, errors.New("no supported tracker found")
+	return t.GetPeersOnPort(clientID, portRangeStart)
+}
+
+// GetPeersOnPort returns the list of peers from a torrent file, client ID
+// and the port we listen on for incoming peers
+// the trackers are tried in the order of their tiers until one responds
+func (t *TorrentFile) GetPeersOnPort(clientID [20]byte, port int) (*TrackerResponse, error) {
+	req := &AnnounceRequest{InfoHash: t.Info.Hash, PeerID: clientID, Port: port, Left: int64(t.Info.Length)}
+	return newTrackerTiers(t.Tiers()).announce(func(*trackerEntry) *AnnounceRequest { return req }, TrackerMaxRetries)
 }
 
 // connectToUDP tries to connect to a UDP tracker
@@ -148,73 +160,38 @@ func connectToUDP(conn *net.UDPConn) (uint64, error) {
 	// uint32 action
 	// uint32 transaction_id
 	// uint64 connection_id
-	res := make([]byte, 16)
+	// or an error packet: uint32 action (3), uint32 transaction_id and the message
+	res := make([]byte, 512)
 	resLen, err := conn.Read(res)
 	if err != nil {
 		return 0, err
 	}
+	res = res[:resLen]
+	if err := checkUDPResponse(res, aConnect, transactionID); err != nil {
+		return 0, err
+	}
 	if resLen != 16 {
 		return 0, fmt.Errorf("expected response size 16 got %d instead", resLen)
 	}
-	resAction := binary.BigEndian.Uint32(res[:4])
-	if resAction != uint32(0) {
-		return 0, fmt.Errorf("expected action of 0 got %d instead", resAction)
-	}
-	resTransactionID := binary.BigEndian.Uint32(res[4:8])
-	if resTransactionID != transactionID {
-		return 0, errors.New("received a different transaction_id")
-	}
 	return binary.BigEndian.Uint64(res[8:]), nil
 }
 
-// getPeersUDP returns the list of peers using udp from a torrent file and client ID
-// see http://www.bittorrent.org/beps/bep_0015.html for more detail
-func (t *TorrentFile) getPeersUDP(clientID [20]byte) (*TrackerResponse, error) {
-	i := 0
-	conns := make([]udpConn, len(t.Announce))
-	for _, u := range t.Announce {
-		if u.Scheme != "udp" && u.Scheme != "udp4" && u.Scheme != "udp6" {
-			continue
-		}
-		addr, err := net.ResolveUDPAddr(u.Scheme, u.Host)
-		if err != nil {
-			continue
-		}
-		conn, err := net.DialUDP(u.Scheme, nil, addr)
-		if err != nil {
-			continue
-		}
-		defer conn.Close()
-		conns[i] = udpConn{conn, u.Scheme}
-		i++
-	}
-	conns = conns[:i]
-
-	// shuffle the list of peers
-	for j := range conns {
-		k := rand.Intn(j + 1)
-		conns[j], conns[k] = conns[k], conns[j]
-	}
-	// since we are using udp, retry with an increasing deadline
-	for try := range udpMaxRetries {
-		l := len(conns)
-		for range l {
-			uConn := conns[0]
-			conn := uConn.Conn
-			conns = conns[1:]
-			conn.SetDeadline(time.Now().Add(udpBaseTimeout * (1 << try)))
-			connID, err := connectToUDP(conn)
-			if err != nil {
-				// continue on a timeout
-				var netErr net.Error
-				if errors.As(err, &netErr) && netErr.Timeout() {
-					conns = append(conns, uConn)
-				}
-				continue
-			}
-			ipv6 := uConn.Scheme == "udp6"
-			return announceUDP(conn, connID, t.Info.Hash, clientID, int64(t.Info.Length), ipv6)
-		}
+// checkUDPResponse checks the header of the response of a UDP tracker
+// to a request of the given action and transaction ID
+// an error packet (action 3) is returned as a *TrackerError
+func checkUDPResponse(res []byte, action, transactionID uint32) error {
+	if len(res) < 8 {
+		return fmt.Errorf("response too short: %d bytes", len(res))
+	}
+	if txID := binary.BigEndian.Uint32(res[4:]); txID != transactionID {
+		return errors.New("received a different transaction_id")
+	}
+	switch resAction := binary.BigEndian.Uint32(res); resAction {
+	case action:
+		return nil
+	case aError:
+		return &TrackerError{Message: string(res[8:])}
+	default:
+		return fmt.Errorf("expected action of %d got %d instead", action, resAction)
 	}
-	return nil, fmt.Errorf("timed out after %d retries", udpMaxRetries)
 }
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,57 +20,235 @@ const (
 	TrackerQueryTimeout = 15 * time.Second // Base timeout for UDP tracker queries
 	TrackerMaxRetries   = 8                // Maximum retry attempts for UDP
 	httpTimeout         = 30 * time.Second // Timeout for HTTP tracker requests
-	portRangeStart      = 6881             // BEP 3 recommended port range
-	portRangeEnd        = 6889
 )
 
+// leftUnknown is the number of bytes left reported before we know the size of the torrent:
+// trackers take a peer with nothing left for a seed, and do not send it the other seeds
+const leftUnknown int64 = 1 << 14
+
 // TrackerResponse represents the tracker response to a get message
 type TrackerResponse struct {
-	Interval       int
+	Interval       int    // seconds to wait before the next regular announce
+	MinInterval    int    // seconds the tracker wants between announces, 0 if unset
+	TrackerID      string // to send back in the next announces, empty if unset
+	Warning        string // warning message of the tracker, empty if none
+	Complete       int    // number of seeders in the swarm
+	Incomplete     int    // number of leechers in the swarm
 	PeersAddresses []string
 }
 
-// QueryUDPTracker queries a UDP tracker for peers given an info hash
+// AnnounceEvent is the event reported to a tracker with an announce
+type AnnounceEvent uint32
+
+// Announce events, numbered as in UDP announces (BEP 15)
+const (
+	EventNone AnnounceEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// String returns the name of the event sent to HTTP trackers, empty for EventNone
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// AnnounceRequest holds the parameters of an announce
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int   // port we listen on for incoming peers
+	Uploaded   int64 // bytes sent to peers since the started event
+	Downloaded int64 // bytes received from peers since the started event
+	Left       int64 // bytes we still need to download
+	Event      AnnounceEvent
+	TrackerID  string // tracker id returned by a previous announce to the tracker, if any
+	URLData    string // path and query of the URL of a UDP tracker, set by Announce (BEP 41)
+}
+
+// TrackerError is an error message sent by a tracker:
+// the failure reason of an HTTP tracker or the message of a UDP error packet
+type TrackerError struct {
+	Message string
+}
+
+func (e *TrackerError) Error() string {
+	return "tracker failure: " + e.Message
+}
+
+// Announce sends an announce to a tracker, over HTTP(S) or UDP depending on the scheme of its URL
+func Announce(trackerURL *url.URL, req *AnnounceRequest) (*TrackerResponse, error) {
+	return announce(trackerURL, req, TrackerMaxRetries)
+}
+
+// announce sends an announce to a tracker, retrying at most retries times for UDP trackers
+func announce(trackerURL *url.URL, req *AnnounceRequest, retries int) (*TrackerResponse, error) {
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return getTrackerResponse(announceURL(trackerURL, req))
+	case "udp", "udp4", "udp6":
+		withURL := *req
+		withURL.URLData = trackerURL.RequestURI()
+		if withURL.URLData == "/" {
+			withURL.URLData = ""
+		}
+		return announceUDPTracker(trackerURL, &withURL, retries)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", trackerURL.Scheme)
+}
+
+// QueryUDPTracker queries a UDP tracker for peers given an info hash.
 // This is a standalone function that doesn't require a TorrentFile
 func QueryUDPTracker(trackerURL *url.URL, infoHash, clientID [20]byte) (*TrackerResponse, error) {
+	return QueryUDPTrackerOnPort(trackerURL, infoHash, clientID, portRangeStart)
+}
+
+// QueryUDPTrackerOnPort queries a UDP tracker for peers given an info hash
+// and the port we listen on for incoming peers
+func QueryUDPTrackerOnPort(trackerURL *url.URL, infoHash, clientID [20]byte, port int) (*TrackerResponse, error) {
+	req := &AnnounceRequest{InfoHash: infoHash, PeerID: clientID, Port: port, Left: leftUnknown}
+	return announceUDPTracker(trackerURL, req, TrackerMaxRetries)
+}
+
+// announceUDPTracker sends an announce to a UDP tracker, retrying at most retries times on timeouts
+func announceUDPTracker(trackerURL *url.URL, req *AnnounceRequest, retries int) (*TrackerResponse, error) {
+	var resp *TrackerResponse
+	err := queryUDPTracker(trackerURL, retries, func(conn *net.UDPConn, connID uint64) (err error) {
+		resp, err = announceUDP(conn, connID, req, trackerURL.Scheme == "udp6")
+		return err
+	})
+	return resp, err
+}
+
+// queryUDPTracker connects to a UDP tracker and runs query with the connection ID it gives us
+// both are retried at most retries times on timeouts, with a timeout doubling each time (BEP 15)
+func queryUDPTracker(trackerURL *url.URL, retries int, query func(conn *net.UDPConn, connID uint64) error) error {
 	scheme := trackerURL.Scheme
 	if scheme != "udp" && scheme != "udp4" && scheme != "udp6" {
-		return nil, fmt.Errorf("invalid scheme %s for UDP tracker", scheme)
+		return fmt.Errorf("invalid scheme %s for UDP tracker", scheme)
 	}
 
 	addr, err := net.ResolveUDPAddr(scheme, trackerURL.Host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve tracker address: %w", err)
+		return fmt.Errorf("failed to resolve tracker address: %w", err)
 	}
 
 	conn, err := net.DialUDP(scheme, nil, addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to tracker: %w", err)
+		return fmt.Errorf("failed to connect to tracker: %w", err)
 	}
 	defer conn.Close()
 
 	// Retry with exponential backoff
-	for try := range TrackerMaxRetries {
+	address := addr.String()
+	for try := range retries {
 		conn.SetDeadline(time.Now().Add(TrackerQueryTimeout * (1 << try)))
 
-		connID, err := connectToUDP(conn)
-		if err != nil {
-			var netErr net.Error
-			if errors.As(err, &netErr) && netErr.Timeout() {
-				continue // Retry on timeout
+		// a connection ID can be used for a minute, saving a round trip
+		connID, cached := cachedConnID(address)
+		var err error
+		if !cached {
+			connID, err = connectToUDP(conn)
+			if err == nil {
+				cacheConnID(address, connID)
 			}
-			return nil, err
 		}
+		if err == nil {
+			err = query(conn, connID)
+		}
+		if err == nil {
+			return nil
+		}
+		if cached {
+			// the tracker may have expired the connection ID early: connect again
+			forgetConnID(address)
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue // Retry on timeout
+		}
+		return err
+	}
+
+	return fmt.Errorf("tracker query timed out after %d retries", retries)
+}
 
-		return announceUDP(conn, connID, infoHash, clientID, 0, scheme == "udp6")
+// BEP 41 option types
+const (
+	optionEnd     byte = 0x0
+	optionNOP     byte = 0x1
+	optionURLData byte = 0x2
+)
+
+// urlDataOptions returns the options of a UDP announce carrying urlData (BEP 41):
+// URL data options of at most 255 bytes each, followed by an end of options
+// returns nil if urlData is empty
+func urlDataOptions(urlData string) []byte {
+	if urlData == "" {
+		return nil
+	}
+	var options []byte
+	for len(urlData) > 0 {
+		n := min(len(urlData), 255)
+		options = append(options, optionURLData, byte(n))
+		options = append(options, urlData[:n]...)
+		urlData = urlData[n:]
 	}
+	return append(options, optionEnd)
+}
+
+// udpConnIDLifetime is how long a client may use a connection ID (BEP 15)
+const udpConnIDLifetime = time.Minute
+
+// udpConnIDs caches the connection IDs of the UDP trackers by address
+var udpConnIDs = struct {
+	mu  sync.Mutex
+	ids map[string]udpConnID
+}{ids: make(map[string]udpConnID)}
+
+// udpConnID is a connection ID and when it expires
+type udpConnID struct {
+	id      uint64
+	expires time.Time
+}
+
+// cachedConnID returns the connection ID of the tracker at address if it did not expire
+func cachedConnID(address string) (uint64, bool) {
+	udpConnIDs.mu.Lock()
+	defer udpConnIDs.mu.Unlock()
+	c, ok := udpConnIDs.ids[address]
+	if !ok || time.Now().After(c.expires) {
+		delete(udpConnIDs.ids, address)
+		return 0, false
+	}
+	return c.id, true
+}
+
+// cacheConnID stores a connection ID the tracker at address just gave us
+func cacheConnID(address string, id uint64) {
+	udpConnIDs.mu.Lock()
+	defer udpConnIDs.mu.Unlock()
+	udpConnIDs.ids[address] = udpConnID{id: id, expires: time.Now().Add(udpConnIDLifetime)}
+}
 
-	return nil, fmt.Errorf("tracker query timed out after %d retries", TrackerMaxRetries)
+// forgetConnID removes the connection ID of the tracker at address from the cache
+func forgetConnID(address string) {
+	udpConnIDs.mu.Lock()
+	defer udpConnIDs.mu.Unlock()
+	delete(udpConnIDs.ids, address)
 }
 
 // announceUDP sends an announce request and parses the response
-// bytesLeft is the number of bytes left to download (0 if unknown, e.g., for magnets)
-func announceUDP(conn *net.UDPConn, connID uint64, infoHash, clientID [20]byte, bytesLeft int64, ipv6 bool) (*TrackerResponse, error) {
+func announceUDP(conn *net.UDPConn, connID uint64, announce *AnnounceRequest, ipv6 bool) (*TrackerResponse, error) {
 	transactionID := rand.Uint32()
 
 	// Build announce request (98 bytes)
@@ -77,16 +256,19 @@ func announceUDP(conn *net.UDPConn, connID uint64, infoHash, clientID [20]byte,
 	binary.BigEndian.PutUint64(req, connID)
 	binary.BigEndian.PutUint32(req[8:], aAnnounce)
 	binary.BigEndian.PutUint32(req[12:], transactionID)
-	copy(req[16:], infoHash[:])
-	copy(req[36:], clientID[:])
-	binary.BigEndian.PutUint64(req[56:], 0)                 // downloaded
-	binary.BigEndian.PutUint64(req[64:], uint64(bytesLeft)) // left
-	binary.BigEndian.PutUint64(req[72:], 0)                 // uploaded
-	binary.BigEndian.PutUint32(req[80:], 0)                 // event: none
-	binary.BigEndian.PutUint32(req[84:], 0)                 // IP address
-	binary.BigEndian.PutUint32(req[88:], rand.Uint32())     // key
-	binary.BigEndian.PutUint32(req[92:], 0xFFFFFFFF)        // num_want: -1 (all)
-	binary.BigEndian.PutUint16(req[96:], 6881)              // port
+	copy(req[16:], announce.InfoHash[:])
+	copy(req[36:], announce.PeerID[:])
+	binary.BigEndian.PutUint64(req[56:], uint64(announce.Downloaded))
+	binary.BigEndian.PutUint64(req[64:], uint64(announce.Left))
+	binary.BigEndian.PutUint64(req[72:], uint64(announce.Uploaded))
+	binary.BigEndian.PutUint32(req[80:], uint32(announce.Event))
+	binary.BigEndian.PutUint32(req[84:], 0)                     // IP address
+	binary.BigEndian.PutUint32(req[88:], rand.Uint32())         // key
+	binary.BigEndian.PutUint32(req[92:], 0xFFFFFFFF)            // num_want: -1 (all)
+	binary.BigEndian.PutUint16(req[96:], uint16(announce.Port)) // port
+
+	// URL data of the tracker, such as a passkey (BEP 41)
+	req = append(req, urlDataOptions(announce.URLData)...)
 
 	if _, err := conn.Write(req); err != nil {
 		return nil, err
@@ -98,20 +280,19 @@ func announceUDP(conn *net.UDPConn, connID uint64, infoHash, clientID [20]byte,
 	if err != nil {
 		return nil, err
 	}
-	if n < 20 {
-		return nil, fmt.Errorf("response too short: %d bytes", n)
-	}
 	res = res[:n]
 
 	// Validate response
-	if action := binary.BigEndian.Uint32(res); action != aAnnounce {
-		return nil, fmt.Errorf("unexpected action: %d", action)
+	if err := checkUDPResponse(res, aAnnounce, transactionID); err != nil {
+		return nil, err
 	}
-	if txID := binary.BigEndian.Uint32(res[4:]); txID != transactionID {
-		return nil, errors.New("transaction ID mismatch")
+	if n < 20 {
+		return nil, fmt.Errorf("response too short: %d bytes", n)
 	}
 
 	interval := int(binary.BigEndian.Uint32(res[8:]))
+	leechers := int(binary.BigEndian.Uint32(res[12:]))
+	seeders := int(binary.BigEndian.Uint32(res[16:]))
 
 	// Parse peer list
 	peers := res[20:]
@@ -131,11 +312,22 @@ func announceUDP(conn *net.UDPConn, connID uint64, infoHash, clientID [20]byte,
 		peerList = append(peerList, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
 	}
 
-	return &TrackerResponse{interval, peerList}, nil
+	return &TrackerResponse{
+		Interval:       interval,
+		Complete:       seeders,
+		Incomplete:     leechers,
+		PeersAddresses: peerList,
+	}, nil
 }
 
-// QueryTrackers queries multiple trackers in parallel and collects peers
+// QueryTrackers queries multiple HTTP(S) and UDP trackers in parallel and collects peers
+// for a torrent whose metadata we do not have yet
 func QueryTrackers(trackers []*url.URL, infoHash, clientID [20]byte) []string {
+	return QueryTrackersOnPort(trackers, infoHash, clientID, portRangeStart)
+}
+
+// QueryTrackersOnPort is QueryTrackers announcing port as the port we listen on for incoming peers
+func QueryTrackersOnPort(trackers []*url.URL, infoHash, clientID [20]byte, port int) []string {
 	type result struct {
 		peers  []string
 		source string
@@ -143,20 +335,16 @@ func QueryTrackers(trackers []*url.URL, infoHash, clientID [20]byte) []string {
 
 	results := make(chan result, len(trackers))
 
+	// the size of the torrent is not known before its metadata is fetched
+	req := &AnnounceRequest{InfoHash: infoHash, PeerID: clientID, Port: port, Left: leftUnknown}
 	for _, tracker := range trackers {
 		go func(t *url.URL) {
-			switch t.Scheme {
-			case "udp", "udp4", "udp6":
-				resp, err := QueryUDPTracker(t, infoHash, clientID)
-				if err != nil {
-					results <- result{nil, t.Host}
-					return
-				}
-				results <- result{resp.PeersAddresses, t.Host}
-			default:
-				// HTTP/HTTPS trackers not supported for magnet links
+			resp, err := Announce(t, req)
+			if err != nil {
 				results <- result{nil, t.Host}
+				return
 			}
+			results <- result{resp.PeersAddresses, t.Host}
 		}(tracker)
 	}
 
@@ -218,21 +406,38 @@ func (c *PeerCollector) Count() int {
 // QueryHTTPTracker queries an HTTP/HTTPS tracker for peers
 func QueryHTTPTracker(trackerURL *url.URL, infoHash, clientID [20]byte, bytesLeft int) (*TrackerResponse, error) {
 	// Use a fixed port from the standard BitTorrent range as our announced listen port
-	announceURL := buildAnnounceURL(trackerURL, infoHash, clientID, portRangeStart, bytesLeft)
+	return QueryHTTPTrackerOnPort(trackerURL, infoHash, clientID, portRangeStart, bytesLeft)
+}
+
+// QueryHTTPTrackerOnPort queries an HTTP/HTTPS tracker for peers
+// port is the port we listen on for incoming peers
+func QueryHTTPTrackerOnPort(trackerURL *url.URL, infoHash, clientID [20]byte, port, bytesLeft int) (*TrackerResponse, error) {
+	announceURL := buildAnnounceURL(trackerURL, infoHash, clientID, port, bytesLeft)
 	return getTrackerResponse(announceURL)
 }
 
 // buildAnnounceURL builds the URL to call the tracker
 func buildAnnounceURL(u *url.URL, infoHash, clientID [20]byte, port, bytesLeft int) string {
+	return announceURL(u, &AnnounceRequest{InfoHash: infoHash, PeerID: clientID, Port: port, Left: int64(bytesLeft)})
+}
+
+// announceURL builds the URL of an HTTP announce
+func announceURL(u *url.URL, req *AnnounceRequest) string {
 	params := url.Values{
-		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{string(clientID[:])},
-		"port":       []string{strconv.Itoa(port)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{strconv.Itoa(bytesLeft)},
+		"info_hash":  []string{string(req.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(req.Port)},
+		"uploaded":   []string{strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(req.Downloaded, 10)},
+		"left":       []string{strconv.FormatInt(req.Left, 10)},
 		"compact":    []string{"1"},
 	}
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
 	result := *u
 	result.RawQuery = params.Encode()
 	return result.String()
@@ -267,7 +472,7 @@ func parseTrackerResponse(ben *bencode) (*TrackerResponse, error) {
 	}
 
 	if failure, ok := dic["failure reason"]; ok {
-		return nil, fmt.Errorf("tracker failure: %s", failure.Str)
+		return nil, &TrackerError{Message: failure.Str}
 	}
 
 	interval, ok := dic["interval"]
@@ -276,13 +481,20 @@ func parseTrackerResponse(ben *bencode) (*TrackerResponse, error) {
 	}
 
 	peers, ok := dic["peers"]
-	if !ok || peers.Str == "" {
+	if !ok {
 		return nil, errors.New("tracker response missing peers")
 	}
 
-	peerList, err := parseCompactPeers(peers.Str, false)
-	if err != nil {
-		return nil, err
+	var peerList []string
+	if peers.List != nil {
+		// original model (BEP 3): a list of dictionaries
+		peerList = parseDictPeers(peers.List)
+	} else {
+		// compact model (BEP 23): a string of IPs and ports
+		var err error
+		if peerList, err = parseCompactPeers(peers.Str, false); err != nil {
+			return nil, err
+		}
 	}
 
 	// Also parse IPv6 peers if present
@@ -294,10 +506,29 @@ func parseTrackerResponse(ben *bencode) (*TrackerResponse, error) {
 
 	return &TrackerResponse{
 		Interval:       interval.Int,
+		MinInterval:    dic["min interval"].Int,
+		TrackerID:      dic["tracker id"].Str,
+		Warning:        dic["warning message"].Str,
+		Complete:       dic["complete"].Int,
+		Incomplete:     dic["incomplete"].Int,
 		PeersAddresses: peerList,
 	}, nil
 }
 
+// parseDictPeers parses a list of peer dictionaries with ip and port keys
+// the peers with a missing ip or an invalid port are skipped
+func parseDictPeers(peers []bencode) []string {
+	result := make([]string, 0, len(peers))
+	for _, p := range peers {
+		ip, port := p.Dict["ip"].Str, p.Dict["port"].Int
+		if ip == "" || port <= 0 || port > 0xFFFF {
+			continue
+		}
+		result = append(result, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+	return result
+}
+
 // parseCompactPeers parses a compact peer list (BEP 23)
 func parseCompactPeers(peers string, ipv6 bool) ([]string, error) {
 	data := []byte(peers)
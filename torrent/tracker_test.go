@@ -1,6 +1,13 @@
 package torrent
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -61,3 +68,111 @@ func TestPeerCollectorEmpty(t *testing.T) {
 		t.Errorf("expected 0 added from empty slice, got %d", added)
 	}
 }
+
+func TestQueryTrackersHTTP(t *testing.T) {
+	up, announces := newTestTracker(t)
+	down := newFailingTracker(t)
+	unsupported, _ := url.Parse("wss://tracker.example/announce")
+	peers := QueryTrackersOnPort([]*url.URL{up, down, unsupported}, [20]byte{1}, [20]byte{2}, 6881)
+	if !slices.Equal(peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("expected the peer of the HTTP tracker, got %v", peers)
+	}
+	if got := nextAnnounce(t, announces); got.left != strconv.FormatInt(leftUnknown, 10) {
+		t.Errorf("expected left to be unknown before the metadata, got %s", got.left)
+	}
+}
+
+// parseTestResponse parses a bencoded tracker response
+func parseTestResponse(t *testing.T, raw string) (*TrackerResponse, error) {
+	t.Helper()
+	ben, err := decode(bufio.NewReader(bytes.NewReader([]byte(raw))), new(bytes.Buffer), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseTrackerResponse(ben)
+}
+
+func TestParseTrackerResponseDictPeers(t *testing.T) {
+	resp, err := parseTestResponse(t, "d8:completei3e10:incompletei4e8:intervali900e12:min intervali60e"+
+		"5:peersld2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip3:::14:porti51413eed2:ip0:4:porti1eee"+
+		"10:tracker id3:abc15:warning message4:slowe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp.PeersAddresses, []string{"10.0.0.1:6881", "[::1]:51413"}) {
+		t.Errorf("unexpected peers %v", resp.PeersAddresses)
+	}
+	if resp.Interval != 900 || resp.MinInterval != 60 || resp.TrackerID != "abc" || resp.Warning != "slow" ||
+		resp.Complete != 3 || resp.Incomplete != 4 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestParseTrackerResponseCompactPeers(t *testing.T) {
+	resp, err := parseTestResponse(t, "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp.PeersAddresses, []string{"10.0.0.1:6881"}) {
+		t.Errorf("unexpected peers %v", resp.PeersAddresses)
+	}
+	for _, raw := range []string{"d8:intervali900e5:peers0:e", "d8:intervali900e5:peerslee"} {
+		if resp, err := parseTestResponse(t, raw); err != nil || len(resp.PeersAddresses) != 0 {
+			t.Errorf("%s: expected no peers, got %v (%v)", raw, resp, err)
+		}
+	}
+	if _, err := parseTestResponse(t, "d8:intervali900ee"); err == nil {
+		t.Error("expected an error without peers")
+	}
+}
+
+func TestAnnounceURLTrackerID(t *testing.T) {
+	u, _ := url.Parse("http://tracker.example/announce")
+	q, _ := url.Parse(announceURL(u, &AnnounceRequest{TrackerID: "abc"}))
+	if q.Query().Get("trackerid") != "abc" {
+		t.Errorf("expected the tracker id to be sent back, got %s", q.RawQuery)
+	}
+}
+
+func TestUDPAnnounceURLDataAndConnectionCache(t *testing.T) {
+	tracker := newUDPTestTracker(t)
+	u := *tracker.url
+	u.Path = "/announce"
+	u.RawQuery = "passkey=" + strings.Repeat("x", 300)
+
+	for range 2 {
+		resp, err := Announce(&u, &AnnounceRequest{InfoHash: [20]byte{1}, Port: 6881})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(resp.PeersAddresses, []string{"10.0.0.1:6881"}) || resp.Complete != 5 || resp.Incomplete != 4 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		if data := <-tracker.urlData; data != u.RequestURI() {
+			t.Errorf("expected URL data %s, got %s", u.RequestURI(), data)
+		}
+	}
+	if n := tracker.connects.Load(); n != 1 {
+		t.Errorf("expected the connection ID to be reused, got %d connects", n)
+	}
+}
+
+func TestUDPAnnounceErrorPacket(t *testing.T) {
+	tracker := newUDPTestTracker(t)
+	_, err := Announce(tracker.url, &AnnounceRequest{InfoHash: unregisteredHash})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.Message != "unregistered torrent" {
+		t.Errorf("expected the message of the tracker, got %v", err)
+	}
+}
+
+func TestURLDataOptions(t *testing.T) {
+	if urlDataOptions("") != nil {
+		t.Error("expected no options without URL data")
+	}
+	options := urlDataOptions("/announce")
+	expected := append([]byte{optionURLData, 9}, "/announce"...)
+	if !bytes.Equal(options, append(expected, optionEnd)) {
+		t.Errorf("unexpected options %q", options)
+	}
+}
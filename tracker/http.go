@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"github.com/matei-oltean/go-torrent/torrent"
+)
+
+// handleAnnounce answers an HTTP announce with the peers of the swarm
+// the peers are compact (BEP 23, BEP 7 for IPv6) unless the peer asks for compact=0
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	req, err := parseHTTPAnnounce(params, r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	if !s.isAllowed(req.infoHash) {
+		writeFailure(w, "torrent not allowed")
+		return
+	}
+	peers, stats := s.store.announce(req)
+	resp := map[string]any{
+		"interval":   int(s.interval.Seconds()),
+		"complete":   stats.Seeders,
+		"incomplete": stats.Leechers,
+	}
+	if params.Get("compact") == "0" {
+		resp["peers"] = dictPeers(peers, params.Get("no_peer_id") == "1")
+	} else {
+		var peers4, peers6 []byte
+		for _, p := range peers {
+			compact, err := torrent.CompactPeer(p.addr.String())
+			if err != nil {
+				continue
+			}
+			if p.addr.Addr().Is4() {
+				peers4 = append(peers4, compact...)
+			} else {
+				peers6 = append(peers6, compact...)
+			}
+		}
+		resp["peers"] = peers4
+		if len(peers6) > 0 {
+			resp["peers6"] = peers6
+		}
+	}
+	writeBencode(w, resp)
+}
+
+// handleScrape answers an HTTP scrape with the state of the swarms of the requested torrents,
+// or of every torrent if none is requested
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var hashes [][20]byte
+	for _, hash := range r.URL.Query()["info_hash"] {
+		if len(hash) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		hashes = append(hashes, [20]byte([]byte(hash)))
+	}
+	if len(hashes) == 0 {
+		hashes = s.store.hashes()
+	}
+	files := make(map[string]any, len(hashes))
+	for _, hash := range hashes {
+		if !s.isAllowed(hash) {
+			continue
+		}
+		stats := s.store.scrape(hash)
+		files[string(hash[:])] = map[string]any{
+			"complete":   stats.Seeders,
+			"incomplete": stats.Leechers,
+			"downloaded": stats.Completed,
+		}
+	}
+	writeBencode(w, map[string]any{"files": files})
+}
+
+// parseHTTPAnnounce parses the parameters of an HTTP announce sent from remoteAddr
+// the IP of the peer is the one it connected from: the ip parameter is ignored
+func parseHTTPAnnounce(params url.Values, remoteAddr string) (*announceRequest, error) {
+	infoHash := params.Get("info_hash")
+	if len(infoHash) != 20 {
+		return nil, errors.New("invalid info_hash")
+	}
+	peerID := params.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, errors.New("invalid peer_id")
+	}
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, errors.New("invalid port")
+	}
+	left, err := strconv.ParseInt(params.Get("left"), 10, 64)
+	if err != nil || left < 0 {
+		return nil, errors.New("invalid left")
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address %q", remoteAddr)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address %q", remoteAddr)
+	}
+	want := -1
+	if n := params.Get("numwant"); n != "" {
+		if want, err = strconv.Atoi(n); err != nil {
+			return nil, errors.New("invalid numwant")
+		}
+	}
+	return &announceRequest{
+		infoHash: [20]byte([]byte(infoHash)),
+		peerID:   [20]byte([]byte(peerID)),
+		addr:     netip.AddrPortFrom(ip.Unmap(), uint16(port)),
+		left:     left,
+		event:    parseEvent(params.Get("event")),
+		numWant:  numWant(want),
+	}, nil
+}
+
+// parseEvent returns the announce event with the given HTTP name, EventNone if unknown
+func parseEvent(name string) torrent.AnnounceEvent {
+	for _, event := range []torrent.AnnounceEvent{torrent.EventCompleted, torrent.EventStarted, torrent.EventStopped} {
+		if name == event.String() {
+			return event
+		}
+	}
+	return torrent.EventNone
+}
+
+// dictPeers returns the peers as a list of dictionaries, without their peer ids if noPeerID is set
+func dictPeers(peers []peerInfo, noPeerID bool) []any {
+	list := make([]any, len(peers))
+	for i, p := range peers {
+		dict := map[string]any{
+			"ip":   p.addr.Addr().String(),
+			"port": int(p.addr.Port()),
+		}
+		if !noPeerID {
+			dict["peer id"] = p.id[:]
+		}
+		list[i] = dict
+	}
+	return list
+}
+
+// writeFailure sends a failure reason to the peer
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]any{"failure reason": reason})
+}
+
+// writeBencode sends a bencoded response
+func writeBencode(w http.ResponseWriter, v any) {
+	body, err := torrent.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode tracker response: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
@@ -0,0 +1,73 @@
+// Package tracker implements a BitTorrent tracker serving HTTP announces and scrapes (BEP 3, BEP 48)
+// and UDP announces and scrapes (BEP 15), keeping the swarms in memory
+package tracker
+
+import (
+	"crypto/rand"
+	"net/http"
+	"time"
+)
+
+// Announce defaults and limits
+const (
+	DefaultInterval = 30 * time.Minute // interval given to the peers when none is configured
+	defaultNumWant  = 50               // peers returned when the peer does not say how many it wants
+	maxNumWant      = 200              // peers returned at most
+)
+
+// Config holds the settings of a tracker
+type Config struct {
+	Interval  time.Duration // announce interval given to the peers, DefaultInterval if 0
+	Allowlist [][20]byte    // info hashes the tracker serves, every torrent if empty
+}
+
+// Server is a tracker keeping the peers of its torrents in memory
+// peers that do not announce for two intervals are dropped
+type Server struct {
+	interval time.Duration
+	allowed  map[[20]byte]bool // nil to serve every torrent
+	store    *store
+	secret   [32]byte // key of the UDP connection ids
+	mux      *http.ServeMux
+}
+
+// NewServer creates a tracker with the given config, nil for the defaults
+func NewServer(cfg *Config) *Server {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	s := &Server{interval: cfg.Interval}
+	if s.interval <= 0 {
+		s.interval = DefaultInterval
+	}
+	if len(cfg.Allowlist) > 0 {
+		s.allowed = make(map[[20]byte]bool, len(cfg.Allowlist))
+		for _, hash := range cfg.Allowlist {
+			s.allowed[hash] = true
+		}
+	}
+	s.store = newStore(2 * s.interval)
+	rand.Read(s.secret[:])
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/announce", s.handleAnnounce)
+	s.mux.HandleFunc("/scrape", s.handleScrape)
+	return s
+}
+
+// ServeHTTP serves the HTTP announces on /announce and the scrapes on /scrape
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// isAllowed returns true if the tracker serves the torrent with the given info hash
+func (s *Server) isAllowed(infoHash [20]byte) bool {
+	return s.allowed == nil || s.allowed[infoHash]
+}
+
+// numWant returns the number of peers to return to a peer asking for n, negative if unset
+func numWant(n int) int {
+	if n < 0 {
+		return defaultNumWant
+	}
+	return min(n, maxNumWant)
+}
@@ -0,0 +1,144 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/matei-oltean/go-torrent/torrent"
+)
+
+var testHash = [20]byte{1, 2, 3}
+
+// announceTo announces a peer listening on port to the tracker at u
+func announceTo(t *testing.T, u *url.URL, port int, left int64, event torrent.AnnounceEvent) *torrent.TrackerResponse {
+	t.Helper()
+	resp, err := torrent.Announce(u, &torrent.AnnounceRequest{
+		InfoHash: testHash,
+		PeerID:   [20]byte{byte(port)},
+		Port:     port,
+		Left:     left,
+		Event:    event,
+	})
+	if err != nil {
+		t.Fatalf("Announce failed: %s", err)
+	}
+	return resp
+}
+
+// newHTTPTracker starts an HTTP tracker and returns its announce URL
+func newHTTPTracker(t *testing.T, cfg *Config) *url.URL {
+	srv := httptest.NewServer(NewServer(cfg))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL + "/announce")
+	return u
+}
+
+// newUDPTracker starts a UDP tracker and returns its URL
+func newUDPTracker(t *testing.T, cfg *Config) *url.URL {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go NewServer(cfg).ServeUDP(conn)
+	u, _ := url.Parse("udp://" + conn.LocalAddr().String())
+	return u
+}
+
+func TestTrackerAnnounceAndScrape(t *testing.T) {
+	for name, newTracker := range map[string]func(*testing.T, *Config) *url.URL{
+		"http": newHTTPTracker,
+		"udp":  newUDPTracker,
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := newTracker(t, &Config{Interval: 10 * time.Minute})
+
+			first := announceTo(t, u, 6881, 0, torrent.EventStarted)
+			if len(first.PeersAddresses) != 0 || first.Complete != 1 || first.Interval != 600 {
+				t.Errorf("Unexpected first response %+v", first)
+			}
+			second := announceTo(t, u, 6882, 100, torrent.EventStarted)
+			if !slices.Equal(second.PeersAddresses, []string{"127.0.0.1:6881"}) {
+				t.Errorf("Expected the seeder, got %v", second.PeersAddresses)
+			}
+			if second.Complete != 1 || second.Incomplete != 1 {
+				t.Errorf("Expected 1 seeder and 1 leecher, got %+v", second)
+			}
+			announceTo(t, u, 6882, 0, torrent.EventCompleted)
+
+			results, err := torrent.Scrape(u, testHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := results[testHash]; got != (torrent.ScrapeResult{Seeders: 2, Completed: 1}) {
+				t.Errorf("Unexpected scrape result %+v", got)
+			}
+
+			announceTo(t, u, 6881, 0, torrent.EventStopped)
+			results, err = torrent.Scrape(u, testHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := results[testHash]; got != (torrent.ScrapeResult{Seeders: 1, Completed: 1}) {
+				t.Errorf("Unexpected scrape result after stopped %+v", got)
+			}
+		})
+	}
+}
+
+func TestTrackerAllowlist(t *testing.T) {
+	for name, newTracker := range map[string]func(*testing.T, *Config) *url.URL{
+		"http": newHTTPTracker,
+		"udp":  newUDPTracker,
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := newTracker(t, &Config{Allowlist: [][20]byte{{9}}})
+			_, err := torrent.Announce(u, &torrent.AnnounceRequest{InfoHash: testHash, Port: 6881})
+			var trackerErr *torrent.TrackerError
+			if !errors.As(err, &trackerErr) || trackerErr.Message != "torrent not allowed" {
+				t.Errorf("Expected a not allowed failure, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPAnnounceNonCompact(t *testing.T) {
+	s := NewServer(nil)
+	for _, port := range []string{"6881", "6882"} {
+		r := httptest.NewRequest("GET", "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&left=5&compact=0&port="+port, nil)
+		r.RemoteAddr = "[2001:db8::1]:40000"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if port == "6882" {
+			expected := "d8:completei0e10:incompletei2e8:intervali1800e5:peersld2:ip11:2001:db8::17:peer id20:bbbbbbbbbbbbbbbbbbbb4:porti6881eeee"
+			if got := w.Body.String(); got != expected {
+				t.Errorf("Expected %s, got %s", expected, got)
+			}
+		}
+	}
+}
+
+func TestHTTPAnnounceInvalid(t *testing.T) {
+	r := httptest.NewRequest("GET", "/announce?info_hash=short&port=1", nil)
+	w := httptest.NewRecorder()
+	NewServer(nil).ServeHTTP(w, r)
+	if got := w.Body.String(); got != "d14:failure reason17:invalid info_hashe" {
+		t.Errorf("Unexpected response %s", got)
+	}
+}
+
+func TestUDPInvalidConnectionID(t *testing.T) {
+	s := NewServer(nil)
+	req := make([]byte, 98)
+	req[11] = aAnnounce
+	res := s.handleUDP(req, netip.MustParseAddrPort("127.0.0.1:1234"))
+	if len(res) < 8 || res[3] != aError || string(res[8:]) != "invalid connection id" {
+		t.Errorf("Expected an error packet, got %v", res)
+	}
+}
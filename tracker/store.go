@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/matei-oltean/go-torrent/torrent"
+)
+
+// peerInfo is a peer of a swarm, as last announced
+type peerInfo struct {
+	id   [20]byte
+	addr netip.AddrPort
+	left int64
+	seen time.Time
+}
+
+// swarm holds the peers of a torrent
+type swarm struct {
+	peers     map[netip.AddrPort]*peerInfo
+	completed int       // number of completed events received
+	seen      time.Time // last announce of a peer of the swarm
+}
+
+// announceRequest is an announce received over HTTP or UDP
+type announceRequest struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	addr     netip.AddrPort // address the peer accepts connections on
+	left     int64
+	event    torrent.AnnounceEvent
+	numWant  int
+
+	sameFamily bool // only return peers of the IP family of addr
+}
+
+// store holds the swarms of the tracked torrents in memory
+// peers that did not announce for timeout are dropped, and so are the swarms left without peers
+type store struct {
+	timeout time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	lastSweep time.Time
+}
+
+// newStore creates an empty store dropping the peers silent for timeout
+func newStore(timeout time.Duration) *store {
+	return &store{
+		timeout:   timeout,
+		swarms:    make(map[[20]byte]*swarm),
+		lastSweep: time.Now(),
+	}
+}
+
+// announce records the announce of a peer and returns the state of its swarm
+// and at most req.numWant other peers, picked at random
+// seeders are only given leechers, as they have no use for the other seeders
+func (s *store) announce(req *announceRequest) ([]peerInfo, torrent.ScrapeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	sw := s.swarms[req.infoHash]
+	if sw == nil {
+		if req.event == torrent.EventStopped {
+			return nil, torrent.ScrapeResult{}
+		}
+		sw = &swarm{peers: make(map[netip.AddrPort]*peerInfo)}
+		s.swarms[req.infoHash] = sw
+	}
+
+	sw.seen = now
+	if req.event == torrent.EventStopped {
+		delete(sw.peers, req.addr)
+		if len(sw.peers) == 0 && sw.completed == 0 {
+			delete(s.swarms, req.infoHash)
+		}
+		return nil, sw.stats()
+	}
+	if req.event == torrent.EventCompleted {
+		sw.completed++
+	}
+	sw.peers[req.addr] = &peerInfo{id: req.peerID, addr: req.addr, left: req.left, seen: now}
+
+	var candidates []*peerInfo
+	for _, p := range sw.peers {
+		if p.addr == req.addr || (req.left == 0 && p.left == 0) ||
+			(req.sameFamily && p.addr.Addr().Is4() != req.addr.Addr().Is4()) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	candidates = candidates[:min(len(candidates), req.numWant)]
+	peers := make([]peerInfo, len(candidates))
+	for i, p := range candidates {
+		peers[i] = *p
+	}
+	return peers, sw.stats()
+}
+
+// scrape returns the state of the swarm of a torrent, zero if it has no peers
+func (s *store) scrape(infoHash [20]byte) torrent.ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+	if sw := s.swarms[infoHash]; sw != nil {
+		return sw.stats()
+	}
+	return torrent.ScrapeResult{}
+}
+
+// hashes returns the info hashes of every tracked torrent
+func (s *store) hashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([][20]byte, 0, len(s.swarms))
+	for hash := range s.swarms {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// sweep drops the expired peers, and the swarms without peers for timeout, at most once per timeout
+// must be called with the lock held
+func (s *store) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.timeout {
+		return
+	}
+	s.lastSweep = now
+	for hash, sw := range s.swarms {
+		for addr, p := range sw.peers {
+			if now.Sub(p.seen) >= s.timeout {
+				delete(sw.peers, addr)
+			}
+		}
+		if len(sw.peers) == 0 && (sw.completed == 0 || now.Sub(sw.seen) >= s.timeout) {
+			delete(s.swarms, hash)
+		}
+	}
+}
+
+// stats returns the number of seeders, leechers and completed downloads of the swarm
+func (sw *swarm) stats() torrent.ScrapeResult {
+	r := torrent.ScrapeResult{Completed: sw.completed}
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			r.Seeders++
+		} else {
+			r.Leechers++
+		}
+	}
+	return r
+}
@@ -0,0 +1,61 @@
+package tracker
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/matei-oltean/go-torrent/torrent"
+)
+
+func storeAnnounce(s *store, addr string, left int64) []peerInfo {
+	peers, _ := s.announce(&announceRequest{
+		infoHash: testHash,
+		addr:     netip.MustParseAddrPort(addr),
+		left:     left,
+		event:    torrent.EventStarted,
+		numWant:  defaultNumWant,
+	})
+	return peers
+}
+
+func TestStoreSeedersGetLeechers(t *testing.T) {
+	s := newStore(time.Hour)
+	storeAnnounce(s, "10.0.0.1:1", 0)
+	storeAnnounce(s, "10.0.0.2:1", 10)
+	peers := storeAnnounce(s, "10.0.0.3:1", 0)
+	if len(peers) != 1 || peers[0].addr.String() != "10.0.0.2:1" {
+		t.Errorf("Expected only the leecher, got %v", peers)
+	}
+	if peers := storeAnnounce(s, "10.0.0.4:1", 10); len(peers) != 3 {
+		t.Errorf("Expected every other peer, got %v", peers)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s := newStore(time.Hour)
+	storeAnnounce(s, "10.0.0.1:1", 10)
+	storeAnnounce(s, "10.0.0.2:1", 10)
+	s.swarms[testHash].peers[netip.MustParseAddrPort("10.0.0.1:1")].seen = time.Now().Add(-2 * time.Hour)
+	s.lastSweep = time.Now().Add(-2 * time.Hour)
+	if got := s.scrape(testHash); got.Leechers != 1 {
+		t.Errorf("Expected the silent peer to be dropped, got %+v", got)
+	}
+}
+
+func TestStoreExpiryEmptySwarm(t *testing.T) {
+	s := newStore(time.Hour)
+	s.announce(&announceRequest{
+		infoHash: testHash,
+		addr:     netip.MustParseAddrPort("10.0.0.1:1"),
+		event:    torrent.EventCompleted,
+		numWant:  defaultNumWant,
+	})
+	s.swarms[testHash].peers[netip.MustParseAddrPort("10.0.0.1:1")].seen = time.Now().Add(-2 * time.Hour)
+	s.swarms[testHash].seen = time.Now().Add(-2 * time.Hour)
+	s.lastSweep = time.Now().Add(-2 * time.Hour)
+	s.sweep(time.Now())
+	if len(s.swarms) != 0 {
+		t.Errorf("Expected the swarm without peers to be dropped, got %d swarms", len(s.swarms))
+	}
+}
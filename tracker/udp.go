@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/matei-oltean/go-torrent/torrent"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	protocolID = 0x41727101980 // magic constant of connect requests
+
+	aConnect  = 0
+	aAnnounce = 1
+	aScrape   = 2
+	aError    = 3
+
+	connIDEpoch    = time.Minute // connection ids are valid for one to two epochs
+	maxUDPScrape   = 74          // info hashes in a scrape at most
+	maxUDPResponse = 508         // announce responses are kept under the safe UDP payload size
+)
+
+// ServeUDP answers the UDP announces and scrapes received on conn until it is closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if res := s.handleUDP(buf[:n], udpAddr.AddrPort()); res != nil {
+			conn.WriteTo(res, addr)
+		}
+	}
+}
+
+// handleUDP returns the response to a UDP request from addr, nil to ignore it
+func (s *Server) handleUDP(req []byte, addr netip.AddrPort) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(req)
+	action := binary.BigEndian.Uint32(req[8:])
+	transactionID := binary.BigEndian.Uint32(req[12:])
+	ip := addr.Addr().Unmap()
+
+	if action == aConnect {
+		if connID != protocolID {
+			return nil
+		}
+		res := make([]byte, 16)
+		binary.BigEndian.PutUint32(res, aConnect)
+		binary.BigEndian.PutUint32(res[4:], transactionID)
+		binary.BigEndian.PutUint64(res[8:], s.connectionID(ip, time.Now()))
+		return res
+	}
+	if !s.validConnectionID(connID, ip) {
+		return udpError(transactionID, "invalid connection id")
+	}
+	switch action {
+	case aAnnounce:
+		return s.handleUDPAnnounce(req, ip, transactionID)
+	case aScrape:
+		return s.handleUDPScrape(req, transactionID)
+	}
+	return udpError(transactionID, "unknown action")
+}
+
+// handleUDPAnnounce answers a UDP announce with the peers of the swarm of the same IP family
+func (s *Server) handleUDPAnnounce(req []byte, ip netip.Addr, transactionID uint32) []byte {
+	if len(req) < 98 {
+		return udpError(transactionID, "announce too short")
+	}
+	var infoHash, peerID [20]byte
+	copy(infoHash[:], req[16:36])
+	copy(peerID[:], req[36:56])
+	if !s.isAllowed(infoHash) {
+		return udpError(transactionID, "torrent not allowed")
+	}
+	left := int64(binary.BigEndian.Uint64(req[64:]))
+	port := binary.BigEndian.Uint16(req[96:])
+	if port == 0 || left < 0 {
+		return udpError(transactionID, "invalid announce")
+	}
+	// the IP field is ignored: the peer is reached at the address it sent from
+	entrySize := 6
+	if ip.Is6() {
+		entrySize = 18
+	}
+	want := min(numWant(int(int32(binary.BigEndian.Uint32(req[92:])))), (maxUDPResponse-20)/entrySize)
+	// the response only has room for addresses of the family of the request
+	peers, stats := s.store.announce(&announceRequest{
+		infoHash:   infoHash,
+		peerID:     peerID,
+		addr:       netip.AddrPortFrom(ip, port),
+		left:       left,
+		event:      torrent.AnnounceEvent(binary.BigEndian.Uint32(req[80:])),
+		numWant:    want,
+		sameFamily: true,
+	})
+
+	res := make([]byte, 20, 20+entrySize*len(peers))
+	binary.BigEndian.PutUint32(res, aAnnounce)
+	binary.BigEndian.PutUint32(res[4:], transactionID)
+	binary.BigEndian.PutUint32(res[8:], uint32(s.interval.Seconds()))
+	binary.BigEndian.PutUint32(res[12:], uint32(stats.Leechers))
+	binary.BigEndian.PutUint32(res[16:], uint32(stats.Seeders))
+	for _, p := range peers {
+		res = append(res, p.addr.Addr().AsSlice()...)
+		res = binary.BigEndian.AppendUint16(res, p.addr.Port())
+	}
+	return res
+}
+
+// handleUDPScrape answers a UDP scrape with the state of the swarms of the requested torrents
+func (s *Server) handleUDPScrape(req []byte, transactionID uint32) []byte {
+	count := (len(req) - 16) / 20
+	if count == 0 || count > maxUDPScrape {
+		return udpError(transactionID, "invalid scrape")
+	}
+	res := make([]byte, 8, 8+12*count)
+	binary.BigEndian.PutUint32(res, aScrape)
+	binary.BigEndian.PutUint32(res[4:], transactionID)
+	for i := range count {
+		var stats torrent.ScrapeResult
+		if infoHash := [20]byte(req[16+20*i:]); s.isAllowed(infoHash) {
+			stats = s.store.scrape(infoHash)
+		}
+		res = binary.BigEndian.AppendUint32(res, uint32(stats.Seeders))
+		res = binary.BigEndian.AppendUint32(res, uint32(stats.Completed))
+		res = binary.BigEndian.AppendUint32(res, uint32(stats.Leechers))
+	}
+	return res
+}
+
+// connectionID returns the connection id of ip for the epoch of t:
+// it is derived from the IP with a secret key, so no state is kept per connection
+func (s *Server) connectionID(ip netip.Addr, t time.Time) uint64 {
+	mac := hmac.New(sha256.New, s.secret[:])
+	mac.Write(ip.AsSlice())
+	binary.Write(mac, binary.BigEndian, t.Unix()/int64(connIDEpoch.Seconds()))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionID returns true if connID was given to ip in the current or previous epoch
+func (s *Server) validConnectionID(connID uint64, ip netip.Addr) bool {
+	now := time.Now()
+	return connID == s.connectionID(ip, now) || connID == s.connectionID(ip, now.Add(-connIDEpoch))
+}
+
+// udpError returns an error packet with the given message
+func udpError(transactionID uint32, message string) []byte {
+	res := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(res, aError)
+	binary.BigEndian.PutUint32(res[4:], transactionID)
+	return append(res, message...)
+}